@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// lineEditor reads lines from a terminal in raw mode with history and tab completion. It
+// understands the usual emacs bindings: arrows, Ctrl-A/E to move, Ctrl-U/K to cut, Ctrl-W to
+// cut a word, Ctrl-C to discard the line and Ctrl-D on an empty line to quit.
+type lineEditor struct {
+	in  *bufio.Reader
+	out io.Writer
+	// complete returns the candidates for the word ending the text and where that word starts,
+	// candidates that cannot be extended further end in a space
+	complete func(line string) (int, []string)
+	history  []string
+}
+
+const (
+	keyCtrlA     = 1
+	keyCtrlB     = 2
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlF     = 6
+	keyBackspace = 8
+	keyTab       = 9
+	keyCtrlK     = 11
+	keyCtrlL     = 12
+	keyEnter     = 13
+	keyCtrlN     = 14
+	keyCtrlP     = 16
+	keyCtrlU     = 21
+	keyCtrlW     = 23
+	keyEscape    = 27
+	keyDelete    = 127
+)
+
+// readLine prompts for a line, io.EOF is returned for Ctrl-D on an empty line
+func (ed *lineEditor) readLine(prompt string) (string, error) {
+	var buf []rune
+	pos := 0
+	// hist indexes the history entry shown, len(history) is the line being typed, kept in draft
+	hist := len(ed.history)
+	var draft []rune
+	redraw := func() {
+		fmt.Fprintf(ed.out, "\r%s%s\x1b[K", prompt, string(buf))
+		if back := len(buf) - pos; back > 0 {
+			fmt.Fprintf(ed.out, "\x1b[%dD", back)
+		}
+	}
+	showHistory := func(i int) {
+		if i < 0 || i > len(ed.history) || i == hist {
+			return
+		}
+		if hist == len(ed.history) {
+			draft = buf
+		}
+		hist = i
+		if i == len(ed.history) {
+			buf = draft
+		} else {
+			buf = []rune(ed.history[i])
+		}
+		pos = len(buf)
+		redraw()
+	}
+	redraw()
+
+	for {
+		r, _, err := ed.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case keyEnter, '\n':
+			fmt.Fprint(ed.out, "\r\n")
+			line := string(buf)
+			if strings.TrimSpace(line) != "" && (len(ed.history) == 0 || ed.history[len(ed.history)-1] != line) {
+				ed.history = append(ed.history, line)
+			}
+			return line, nil
+		case keyCtrlC:
+			fmt.Fprint(ed.out, "^C\r\n")
+			buf, pos = nil, 0
+			hist = len(ed.history)
+			redraw()
+		case keyCtrlD:
+			if len(buf) == 0 {
+				fmt.Fprint(ed.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = append(buf[:pos], buf[pos+1:]...)
+				redraw()
+			}
+		case keyBackspace, keyDelete:
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+				redraw()
+			}
+		case keyCtrlA:
+			pos = 0
+			redraw()
+		case keyCtrlE:
+			pos = len(buf)
+			redraw()
+		case keyCtrlB:
+			if pos > 0 {
+				pos--
+				redraw()
+			}
+		case keyCtrlF:
+			if pos < len(buf) {
+				pos++
+				redraw()
+			}
+		case keyCtrlK:
+			buf = buf[:pos]
+			redraw()
+		case keyCtrlU:
+			buf = append([]rune{}, buf[pos:]...)
+			pos = 0
+			redraw()
+		case keyCtrlW:
+			start := pos
+			for start > 0 && buf[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && buf[start-1] != ' ' {
+				start--
+			}
+			buf = append(buf[:start], buf[pos:]...)
+			pos = start
+			redraw()
+		case keyCtrlL:
+			fmt.Fprint(ed.out, "\x1b[H\x1b[2J")
+			redraw()
+		case keyCtrlP:
+			showHistory(hist - 1)
+		case keyCtrlN:
+			showHistory(hist + 1)
+		case keyTab:
+			buf, pos = ed.completeAt(buf, pos)
+			redraw()
+		case keyEscape:
+			seq, err := ed.escape()
+			if err != nil {
+				return "", err
+			}
+			switch seq {
+			case "[A":
+				showHistory(hist - 1)
+			case "[B":
+				showHistory(hist + 1)
+			case "[C":
+				if pos < len(buf) {
+					pos++
+					redraw()
+				}
+			case "[D":
+				if pos > 0 {
+					pos--
+					redraw()
+				}
+			case "[H", "[1~", "OH":
+				pos = 0
+				redraw()
+			case "[F", "[4~", "OF":
+				pos = len(buf)
+				redraw()
+			case "[3~":
+				if pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+					redraw()
+				}
+			}
+		default:
+			if r < ' ' {
+				continue
+			}
+			buf = append(buf[:pos], append([]rune{r}, buf[pos:]...)...)
+			pos++
+			redraw()
+		}
+	}
+}
+
+// escape reads the rest of an escape sequence, only CSI and SS3 sequences are recognized
+func (ed *lineEditor) escape() (string, error) {
+	r, _, err := ed.in.ReadRune()
+	if err != nil {
+		return "", err
+	}
+	if r != '[' && r != 'O' {
+		return "", nil
+	}
+	seq := []rune{r}
+	for {
+		r, _, err := ed.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		seq = append(seq, r)
+		if r >= '@' && r <= '~' {
+			return string(seq), nil
+		}
+	}
+}
+
+// completeAt completes the word before pos. Several candidates are extended to their common
+// prefix and listed when that adds nothing.
+func (ed *lineEditor) completeAt(buf []rune, pos int) ([]rune, int) {
+	before, after := string(buf[:pos]), buf[pos:]
+	start, cands := ed.complete(before)
+	if len(cands) == 0 {
+		fmt.Fprint(ed.out, "\a")
+		return buf, pos
+	}
+	word := before[start:]
+	common := cands[0]
+	for _, c := range cands[1:] {
+		common = commonPrefix(common, c)
+	}
+	if len(common) <= len(word) {
+		if len(cands) > 1 {
+			names := make([]string, len(cands))
+			for i, c := range cands {
+				names[i] = strings.TrimSuffix(c, " ")
+			}
+			fmt.Fprintf(ed.out, "\r\n%s\r\n", strings.Join(names, "  "))
+		}
+		return buf, pos
+	}
+	out := []rune(before[:start] + common)
+	pos = len(out)
+	return append(out, after...), pos
+}
+
+func commonPrefix(a string, b string) string {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return a[:n]
+}
@@ -0,0 +1,125 @@
+// Command memkv inspects and edits a MemKV, either a snapshot file or a store served over HTTP by
+// the memkv/server package.
+//
+// Usage:
+//
+//	memkv -file snapshot.json [command args...]
+//	memkv -url http://host:port [command args...]
+//
+// With a command it runs it and exits, without one it starts an interactive shell with history
+// and tab completion of commands and key paths. Changes to a snapshot file are saved after
+// every command changing the store, a missing file is created on the first change. Run the
+// help command for the list of commands.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/xadaemon/libprisma/memkv"
+	"github.com/xadaemon/libprisma/memkv/client"
+)
+
+func main() {
+	file := flag.String("file", "", "snapshot `path` to open, created on the first change if missing")
+	url := flag.String("url", "", "base `URL` of a memkv server to connect to")
+	sep := flag.String("sep", ".", "key separator of a new snapshot file")
+	insensitive := flag.Bool("i", false, "make a new snapshot file case insensitive")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s (-file path | -url URL) [command args...]\n\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+		fmt.Fprintln(flag.CommandLine.Output())
+		printHelp(flag.CommandLine.Output())
+	}
+	flag.Parse()
+
+	if (*file == "") == (*url == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	sh, err := open(*file, *url, *sep, &memkv.Opts{CaseInsensitive: *insensitive})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "memkv:", err)
+		os.Exit(1)
+	}
+	sh.out, sh.errOut = os.Stdout, os.Stderr
+
+	if flag.NArg() > 0 {
+		if err := sh.run(flag.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, "memkv:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := sh.repl(os.Stdin); err != nil {
+		fmt.Fprintln(os.Stderr, "memkv:", err)
+		os.Exit(1)
+	}
+}
+
+// open returns a shell on the snapshot at file or the server at url
+func open(file string, url string, sep string, opts *memkv.Opts) (*shell, error) {
+	if url != "" {
+		c := client.New(url, nil)
+		sh := &shell{store: c}
+		c.OnError = func(op string, err error) {
+			sh.transportErr = fmt.Errorf("%s: %w", op, err)
+		}
+		if c.Separator() == "" {
+			return nil, sh.takeErr()
+		}
+		return sh, nil
+	}
+	kv := memkv.NewMemKV(sep, opts)
+	data, err := os.ReadFile(file)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		var snapshot map[string]any
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", file, err)
+		}
+		if err := kv.LoadFromSerializableMap(snapshot); err != nil {
+			return nil, fmt.Errorf("loading %s: %w", file, err)
+		}
+	}
+	return &shell{store: kv, file: file}, nil
+}
+
+// save writes a snapshot of kv to path, replacing the file only once it was written completely
+func save(kv memkv.Store, path string) error {
+	data, err := json.MarshalIndent(kv.GetSerializableMap(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// printHelp lists the commands
+func printHelp(w io.Writer) {
+	fmt.Fprintln(w, "commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-28s %s\n", c.name+" "+c.args, c.help)
+	}
+	fmt.Fprintf(w, "  %-28s %s\n", "exit", "leave the interactive shell, as does Ctrl-D")
+}
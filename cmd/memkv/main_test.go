@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xadaemon/libprisma/memkv"
+	"github.com/xadaemon/libprisma/memkv/server"
+)
+
+func runAll(t *testing.T, sh *shell, lines ...string) string {
+	t.Helper()
+	out := &bytes.Buffer{}
+	sh.out = out
+	for _, line := range lines {
+		args, err := splitArgs(line)
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		if err := sh.run(args); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+	return out.String()
+}
+
+func TestShell_File(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "store.json")
+	sh, err := open(file, "", ".", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runAll(t, sh, `set certs.a "hello world"`, `set certs.b '{"n":1}'`, "set misc 3")
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("Snapshot not saved: %v", err)
+	}
+
+	// a new shell sees the saved changes
+	sh, err = open(file, "", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := runAll(t, sh, "get certs.a", "get certs.b.n", "list certs"); got != "hello world\n1\ncerts.a\ncerts.b.n\n" {
+		t.Errorf("Got %q", got)
+	}
+	if err := sh.run([]string{"drop", "certs"}); !errors.Is(err, memkv.ErrIsKeySpace) {
+		t.Errorf("Dropping a key space without -r returned %v", err)
+	}
+	if err := sh.run([]string{"get", "none"}); !errors.Is(err, memkv.ErrNotFound) {
+		t.Errorf("Missing key returned %v", err)
+	}
+	if err := sh.run([]string{"get"}); err == nil || !strings.HasPrefix(err.Error(), "usage: get") {
+		t.Errorf("Missing argument returned %v", err)
+	}
+
+	yml := filepath.Join(dir, "certs.yaml")
+	runAll(t, sh, "export "+yml+" certs", "drop -r certs", "import "+yml+" certs")
+	if got := runAll(t, sh, "export -"); got != "{\n  \"certs\": {\n    \"a\": \"hello world\",\n    \"b\": {\n      \"n\": 1\n    }\n  },\n  \"misc\": 3\n}\n" {
+		t.Errorf("Export after round trip %q", got)
+	}
+}
+
+func TestShell_Remote(t *testing.T) {
+	kv := memkv.NewMemKV("/", nil)
+	ts := httptest.NewServer(server.New(kv))
+	defer ts.Close()
+	sh, err := open("", ts.URL, ".", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runAll(t, sh, "set a/b true")
+	if v, _ := kv.Get("a/b"); v != true {
+		t.Errorf("Server has %v", v)
+	}
+	if got := runAll(t, sh, "get a"); got != "{\n  \"b\": true\n}\n" {
+		t.Errorf("Got %q", got)
+	}
+	if err := sh.run([]string{"drop", "x"}); err == nil {
+		t.Errorf("Dropping a missing key returned %v", err)
+	}
+
+	ts.Close()
+	if err := sh.run([]string{"get", "a/b"}); err == nil || errors.Is(err, memkv.ErrNotFound) {
+		t.Errorf("Unreachable server returned %v", err)
+	}
+}
+
+func TestShell_Complete(t *testing.T) {
+	kv := memkv.NewMemKV(".", &memkv.Opts{CaseInsensitive: true, PreserveCase: true})
+	kv.ImportMap(map[string]any{"Certs": map[string]any{"web": 1, "mail": map[string]any{"key": 2}}, "cache": 3})
+	sh := &shell{store: kv}
+	tests := []struct {
+		line  string
+		start int
+		want  []string
+	}{
+		{"", 0, []string{"get ", "set ", "drop ", "list ", "watch ", "import ", "export ", "help "}},
+		{"ge", 0, []string{"get "}},
+		{"get ", 4, []string{"Certs.", "cache "}},
+		{"get c", 4, []string{"Certs.", "cache "}},
+		{"get certs.", 4, []string{"certs.mail.", "certs.web "}},
+		{"drop -r certs.m", 8, []string{"certs.mail."}},
+		{"get certs.mail.k", 4, []string{"certs.mail.key "}},
+		{"set cache ", 10, nil},
+		{"export out.json C", 16, []string{"Certs.", "cache "}},
+		{"import ", 7, nil},
+		{"import in.yaml certs.w", 15, []string{"certs.web "}},
+		{"nope ", 5, nil},
+	}
+	for _, tt := range tests {
+		start, got := sh.complete(tt.line)
+		if start != tt.start || !reflect.DeepEqual(got, tt.want) && len(got)+len(tt.want) > 0 {
+			t.Errorf("complete(%q) = %d %q, want %d %q", tt.line, start, got, tt.start, tt.want)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"get a.b", []string{"get", "a.b"}},
+		{`  set a "x  y"  `, []string{"set", "a", "x  y"}},
+		{`set a '{"k": "v"}'`, []string{"set", "a", `{"k": "v"}`}},
+		{`set a\ b c\"d ""`, []string{"set", "a b", `c"d`, ""}},
+	}
+	for _, tt := range tests {
+		got, err := splitArgs(tt.line)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitArgs(%q) = %q, %v, want %q", tt.line, got, err, tt.want)
+		}
+	}
+	if _, err := splitArgs(`set a "b`); err == nil {
+		t.Error("Unterminated quote accepted")
+	}
+}
+
+func TestLineEditor(t *testing.T) {
+	sh := &shell{store: memkv.NewMemKV(".", nil)}
+	sh.store.Set("alpha.one", 1)
+	sh.store.Set("alpha.two", 2)
+	out := &bytes.Buffer{}
+	// type "ge", complete, type "al", complete twice, pick "o", complete, enter; then recall it
+	// from history, cut it and quit
+	in := "ge\tal\t\to\t\r\x1b[A\x15\x04"
+	ed := &lineEditor{in: bufio.NewReader(strings.NewReader(in)), out: out, complete: sh.complete}
+	line, err := ed.readLine("> ")
+	if err != nil || line != "get alpha.one " {
+		t.Fatalf("Read %q, %v", line, err)
+	}
+	if !strings.Contains(out.String(), "alpha.one  alpha.two") {
+		t.Errorf("Candidates not listed: %q", out.String())
+	}
+	if _, err := ed.readLine("> "); err == nil {
+		t.Error("Ctrl-D on an empty line did not end input")
+	}
+	if !reflect.DeepEqual(ed.history, []string{"get alpha.one "}) {
+		t.Errorf("History %q", ed.history)
+	}
+}
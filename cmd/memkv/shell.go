@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xadaemon/libprisma/memkv"
+	"github.com/xadaemon/libprisma/memkv/source"
+	"gopkg.in/yaml.v3"
+)
+
+var errUsage = errors.New("usage")
+
+// shell runs commands against a store, a local one is saved to file after every change
+type shell struct {
+	store memkv.Store
+	file  string
+	out   io.Writer
+	// errOut receives the errors of the interactive shell
+	errOut io.Writer
+	// transportErr holds the last error a remote store reported, see takeErr
+	transportErr error
+}
+
+type command struct {
+	name string
+	args string
+	help string
+	// keyArg is the position of the argument completed as a key path, flags not counted, 0 for none
+	keyArg  int
+	mutates bool
+	run     func(sh *shell, args []string) error
+}
+
+var commands []command
+
+func init() {
+	// assigned here since help refers to the table
+	commands = []command{
+		{name: "get", args: "KEY", help: "print the value at KEY", keyArg: 1, run: (*shell).get},
+		{name: "set", args: "KEY VALUE", help: "set KEY to VALUE, parsed as JSON if it is valid JSON", keyArg: 1, mutates: true, run: (*shell).set},
+		{name: "drop", args: "[-r] KEY", help: "drop KEY, -r also drops key spaces", keyArg: 1, mutates: true, run: (*shell).drop},
+		{name: "list", args: "[PREFIX]", help: "list the keys below PREFIX", keyArg: 1, run: (*shell).list},
+		{name: "watch", args: "[PREFIX]", help: "print changes below PREFIX until interrupted", keyArg: 1, run: (*shell).watch},
+		{name: "import", args: "FILE [PREFIX]", help: "merge a JSON, YAML or TOML file into the key space at PREFIX", keyArg: 2, mutates: true, run: (*shell).importFile},
+		{name: "export", args: "FILE [PREFIX]", help: "write the key space at PREFIX to a JSON or YAML file, - for stdout", keyArg: 2, run: (*shell).export},
+		{name: "help", help: "list the commands", run: func(sh *shell, _ []string) error {
+			printHelp(sh.out)
+			return nil
+		}},
+	}
+}
+
+func lookupCommand(name string) (*command, bool) {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i], true
+		}
+	}
+	return nil, false
+}
+
+// run executes one command and saves a local store it changed
+func (sh *shell) run(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	c, ok := lookupCommand(args[0])
+	if !ok {
+		return fmt.Errorf("unknown command %q, try help", args[0])
+	}
+	if err := c.run(sh, args[1:]); err != nil {
+		if errors.Is(err, errUsage) {
+			return fmt.Errorf("usage: %s %s", c.name, c.args)
+		}
+		return err
+	}
+	if c.mutates && sh.file != "" {
+		return save(sh.store, sh.file)
+	}
+	return nil
+}
+
+// takeErr returns and clears the last error reported by a remote store
+func (sh *shell) takeErr() error {
+	err := sh.transportErr
+	sh.transportErr = nil
+	return err
+}
+
+func (sh *shell) get(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	v, ok := sh.store.Get(args[0])
+	if !ok {
+		if err := sh.takeErr(); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s: %w", args[0], memkv.ErrNotFound)
+	}
+	return printValue(sh.out, v)
+}
+
+func (sh *shell) set(args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	key, val := args[0], parseValue(strings.Join(args[1:], " "))
+	if s, ok := sh.store.(interface{ SetE(string, any) error }); ok {
+		return s.SetE(key, val)
+	}
+	if !sh.store.Set(key, val) {
+		if err := sh.takeErr(); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s could not be set", key)
+	}
+	return nil
+}
+
+func (sh *shell) drop(args []string) error {
+	keySpaces := len(args) > 0 && args[0] == "-r"
+	if keySpaces {
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return errUsage
+	}
+	if sh.store.Drop(args[0], keySpaces) {
+		return nil
+	}
+	if err := sh.takeErr(); err != nil {
+		return err
+	}
+	if sh.store.IsKeySpace(args[0]) {
+		return fmt.Errorf("%s: %w, use -r", args[0], memkv.ErrIsKeySpace)
+	}
+	return fmt.Errorf("%s: %w", args[0], memkv.ErrNotFound)
+}
+
+func (sh *shell) list(args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	keys := sh.store.List(prefix)
+	if err := sh.takeErr(); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		fmt.Fprintln(sh.out, k)
+	}
+	return nil
+}
+
+func (sh *shell) watch(args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	var mu sync.Mutex
+	cancel := sh.store.AddPrefixWatcherHook(prefix, func(e memkv.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		printEvent(sh.out, e)
+	}, []memkv.EventType{memkv.E_KEY_CREATED, memkv.E_KEY_UPDATED, memkv.E_KEY_DELETED})
+	defer cancel()
+	if err := sh.takeErr(); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func (sh *shell) importFile(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	src, err := source.File(args[0])
+	if err != nil {
+		return err
+	}
+	data, err := src.Load()
+	if err != nil {
+		return err
+	}
+	if len(args) == 2 && args[1] != "" {
+		segs := strings.Split(args[1], sh.store.Separator())
+		for i := len(segs) - 1; i >= 0; i-- {
+			data = map[string]any{segs[i]: data}
+		}
+	}
+	return sh.store.ImportMap(data)
+}
+
+func (sh *shell) export(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	var v any
+	if len(args) == 2 {
+		var ok bool
+		if v, ok = sh.store.Get(args[1]); !ok {
+			if err := sh.takeErr(); err != nil {
+				return err
+			}
+			return fmt.Errorf("%s: %w", args[1], memkv.ErrNotFound)
+		}
+	} else {
+		snapshot := sh.store.GetSerializableMap()
+		if err := sh.takeErr(); err != nil {
+			return err
+		}
+		v = snapshot["__data"]
+	}
+
+	var data []byte
+	var err error
+	switch strings.ToLower(filepath.Ext(args[0])) {
+	case ".yaml", ".yml":
+		data, err = yaml.Marshal(v)
+	default:
+		data, err = json.MarshalIndent(v, "", "  ")
+		data = append(data, '\n')
+	}
+	if err != nil {
+		return err
+	}
+	if args[0] == "-" {
+		_, err = sh.out.Write(data)
+		return err
+	}
+	return os.WriteFile(args[0], data, 0o644)
+}
+
+// parseValue reads s as JSON, anything that is not valid JSON is taken as a string
+func parseValue(s string) any {
+	var v any
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return s
+	}
+	return v
+}
+
+// printValue prints strings as they are and everything else as JSON
+func printValue(w io.Writer, v any) error {
+	if s, ok := v.(string); ok {
+		_, err := fmt.Fprintln(w, s)
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+func printEvent(w io.Writer, e memkv.Event) {
+	line := fmt.Sprintf("%s %-7s %s", e.When.Format(time.TimeOnly), e.Type, e.Key)
+	if !e.Success {
+		line += " failed: " + e.FailReason
+	} else if e.Type != memkv.E_KEY_DELETED {
+		data, _ := json.Marshal(e.NewVal)
+		line += " = " + string(data)
+	}
+	fmt.Fprintln(w, line)
+}
+
+// splitArgs splits a command line at spaces, single and double quotes group words and a
+// backslash escapes the next character outside single quotes
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				args = append(args, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// repl reads commands from in until EOF or exit, with line editing when in is a terminal
+func (sh *shell) repl(in *os.File) error {
+	var next func() (string, error)
+	if restore, err := makeRaw(in.Fd()); err == nil {
+		restore()
+		ed := &lineEditor{in: bufio.NewReader(in), out: sh.out, complete: sh.complete}
+		next = func() (string, error) {
+			restore, err := makeRaw(in.Fd())
+			if err != nil {
+				return "", err
+			}
+			defer restore()
+			return ed.readLine("memkv> ")
+		}
+	} else {
+		sc := bufio.NewScanner(in)
+		next = func() (string, error) {
+			if !sc.Scan() {
+				if err := sc.Err(); err != nil {
+					return "", err
+				}
+				return "", io.EOF
+			}
+			return sc.Text(), nil
+		}
+	}
+
+	for {
+		line, err := next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args, err := splitArgs(line)
+		if err == nil {
+			if args[0] == "exit" || args[0] == "quit" {
+				return nil
+			}
+			err = sh.run(args)
+		}
+		if err != nil {
+			fmt.Fprintln(sh.errOut, "error:", err)
+		}
+	}
+}
+
+// complete returns the candidates for the word ending line and the offset that word starts at.
+// The first word completes to commands, the key argument of a command to key paths one
+// segment at a time. Complete words end in a space, key spaces in the separator.
+func (sh *shell) complete(line string) (int, []string) {
+	words := strings.Fields(line)
+	start := len(line)
+	cur := ""
+	if len(words) > 0 && !strings.HasSuffix(line, " ") {
+		cur = words[len(words)-1]
+		start -= len(cur)
+		words = words[:len(words)-1]
+	}
+	if len(words) == 0 {
+		var out []string
+		for _, c := range commands {
+			if strings.HasPrefix(c.name, cur) {
+				out = append(out, c.name+" ")
+			}
+		}
+		return start, out
+	}
+	c, ok := lookupCommand(words[0])
+	if !ok || strings.HasPrefix(cur, "-") {
+		return start, nil
+	}
+	pos := 1
+	for _, w := range words[1:] {
+		if !strings.HasPrefix(w, "-") {
+			pos++
+		}
+	}
+	if pos != c.keyArg {
+		return start, nil
+	}
+	return start, sh.completeKey(cur)
+}
+
+// completeKey returns the keys and key spaces one segment below the one partial ends in, keys
+// end in a space and key spaces in the separator so completion can continue below them
+func (sh *shell) completeKey(partial string) []string {
+	sep := sh.store.Separator()
+	parent, typed := "", ""
+	if i := strings.LastIndex(partial, sep); i >= 0 {
+		parent, typed = partial[:i], partial[:i+len(sep)]
+	}
+	seen := map[string]bool{}
+	for _, leaf := range sh.store.List(parent) {
+		rest := leaf
+		if parent != "" {
+			if len(leaf) <= len(typed) || !strings.EqualFold(leaf[:len(typed)], typed) {
+				continue
+			}
+			rest = leaf[len(typed):]
+		}
+		cand := typed + rest + " "
+		if i := strings.Index(rest, sep); i >= 0 {
+			cand = typed + rest[:i] + sep
+		}
+		if len(cand) >= len(partial) && strings.EqualFold(cand[:len(partial)], partial) {
+			seen[cand] = true
+		}
+	}
+	_ = sh.takeErr()
+	out := make([]string, 0, len(seen))
+	for c := range seen {
+		out = append(out, c)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -1,9 +1,18 @@
 package cryptoutil_test
 
 import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+
 	"github.com/google/go-cmp/cmp"
 	"github.com/xadaemon/libprisma/cryptoutil"
-	"testing"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
 )
 
 func TestSeededRandomData(t *testing.T) {
@@ -18,3 +27,131 @@ func TestSeededRandomData(t *testing.T) {
 		t.Errorf("Expected output to be the same for the same seed")
 	}
 }
+
+func TestSeededPRNG(t *testing.T) {
+	seed := []byte("seed")
+	whole := cryptoutil.NewSeededPRNG(seed, 0).GetBytes(1000)
+
+	// the stream is the same however it is read
+	g := cryptoutil.NewSeededPRNG(seed, 0)
+	var chunked []byte
+	for _, n := range []int{1, 63, 64, 65, 7, 800} {
+		chunked = append(chunked, g.GetBytes(n)...)
+	}
+	if !cmp.Equal(whole, chunked) {
+		t.Error("Reading in chunks changed the stream")
+	}
+	if got := cryptoutil.NewSeededPRNG(seed, 3).GetBytes(10); !cmp.Equal(got, whole[24:34]) {
+		t.Error("Discarding words did not skip 8 bytes each")
+	}
+
+	// the key comes from HKDF-SHA256 and the stream is plain ChaCha20
+	key := make([]byte, chacha20.KeySize)
+	io.ReadFull(hkdf.New(sha256.New, seed, nil, []byte("libprisma cryptoutil SeededPRNG v1\x00")), key)
+	c, _ := chacha20.NewUnauthenticatedCipher(key, make([]byte, chacha20.NonceSize))
+	want := make([]byte, len(whole))
+	c.XORKeyStream(want, want)
+	if !cmp.Equal(whole, want) {
+		t.Error("Stream does not follow the documented format")
+	}
+
+	if cmp.Equal(cryptoutil.NewSeededPRNGFor(seed, "fixtures").GetBytes(32), whole[:32]) {
+		t.Error("Contexts do not separate streams")
+	}
+	if cmp.Equal(cryptoutil.SeededRandomData([]byte("seed2"), 32), whole[:32]) {
+		t.Error("Different seeds gave the same stream")
+	}
+
+	// saved states resume where they were
+	g = cryptoutil.NewSeededPRNG(seed, 0)
+	g.GetBytes(100)
+	state, _ := g.MarshalBinary()
+	g.GetBytes(5)
+	var restored cryptoutil.SeededPRNG
+	if err := restored.UnmarshalBinary(state); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.GetBytes(50); !cmp.Equal(got, whole[100:150]) || restored.Position() != 150 {
+		t.Error("Restored state did not resume the stream")
+	}
+	if err := restored.UnmarshalBinary(state[1:]); !errors.Is(err, cryptoutil.ErrInvalidPRNGState) {
+		t.Errorf("Truncated state returned %v", err)
+	}
+
+	// XORing twice with the same stream position gives the input back
+	msg := []byte("fixture payload")
+	a := cryptoutil.NewSeededPRNG(seed, 0)
+	enc := make([]byte, len(msg))
+	a.XORKeyStream(enc, msg)
+	cryptoutil.NewSeededPRNG(seed, 0).XORKeyStream(enc, enc)
+	if !cmp.Equal(enc, msg) {
+		t.Error("XORKeyStream is not its own inverse")
+	}
+
+	// the nonce moves on when the block counter wraps
+	g = cryptoutil.NewSeededPRNG(seed, 0)
+	g.Skip(64<<32 - 32)
+	got := g.GetBytes(64)
+	last := make([]byte, 64)
+	c, _ = chacha20.NewUnauthenticatedCipher(key, make([]byte, chacha20.NonceSize))
+	c.SetCounter(1<<32 - 1)
+	c.XORKeyStream(last, last)
+	first := make([]byte, 32)
+	nonce := make([]byte, chacha20.NonceSize)
+	nonce[len(nonce)-1] = 1
+	c, _ = chacha20.NewUnauthenticatedCipher(key, nonce)
+	c.XORKeyStream(first, first)
+	if !cmp.Equal(got, append(last[32:], first...)) {
+		t.Error("Stream does not continue with the next nonce")
+	}
+}
+
+func TestSecretBytes(t *testing.T) {
+	src := []byte("super secret key material")
+	want := append([]byte{}, src...)
+	s := cryptoutil.NewSecretBytesFrom(src)
+	if !cmp.Equal(s.Bytes(), want) || s.Len() != len(want) {
+		t.Errorf("Secret holds %q", s.Bytes())
+	}
+	if !cmp.Equal(src, make([]byte, len(src))) {
+		t.Error("Source was not zeroed")
+	}
+	for _, format := range []string{"%v", "%s", "%x", "%q", "%#v", "%+v", "%d"} {
+		for _, v := range []any{s, struct{ Key *cryptoutil.SecretBytes }{s}} {
+			if out := fmt.Sprintf(format, v); strings.Contains(out, "secret key") || strings.Contains(out, "7375706572") || !strings.Contains(out, "redacted") {
+				t.Errorf("%s printed %s", format, out)
+			}
+		}
+	}
+	if !s.Equal(cryptoutil.NewSecretBytesFrom(append([]byte{}, want...))) || s.Equal(cryptoutil.NewSecretBytes(len(want))) {
+		t.Error("Equal does not compare the content")
+	}
+
+	held := s.Copy()
+	view := s.Bytes()
+	s.Destroy()
+	s.Destroy()
+	if s.Bytes() != nil || s.Len() != 0 || s.Copy() != nil {
+		t.Error("Destroyed secret still readable")
+	}
+	if !cmp.Equal(held, want) {
+		t.Error("Copy shares memory with the secret")
+	}
+	s.Use(func(b []byte) {
+		if b != nil {
+			t.Error("Use lent a destroyed secret")
+		}
+	})
+	if runtime.GOOS != "linux" && !cmp.Equal(view, make([]byte, len(view))) {
+		t.Error("Destroy did not zero the heap fallback")
+	}
+
+	r := cryptoutil.NewRandomSecret(32)
+	defer r.Destroy()
+	if cmp.Equal(r.Bytes(), make([]byte, 32)) {
+		t.Error("Random secret is all zeros")
+	}
+	if empty := cryptoutil.NewSecretBytes(0); empty.Len() != 0 {
+		t.Error("Empty secret has content")
+	}
+}
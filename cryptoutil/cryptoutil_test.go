@@ -1,6 +1,7 @@
 package cryptoutil
 
 import (
+	"bytes"
 	"errors"
 	"testing"
 )
@@ -18,20 +19,18 @@ func TestPad(t *testing.T) {
 			data:       []byte(""),
 			blockSize:  16,
 			wantLength: 16,
-			expectErr:  true,
 		},
 		{
 			name:       "BlockSize Less Than Data Length",
 			data:       []byte("hello"),
 			blockSize:  3,
 			wantLength: 6,
-			expectErr:  true,
 		},
 		{
 			name:       "BlockSize Equal To Data Length",
 			data:       []byte("hello"),
 			blockSize:  5,
-			wantLength: 5,
+			wantLength: 10,
 		},
 		{
 			name:       "BlockSize Greater Than Data Length",
@@ -86,14 +85,14 @@ func TestUnpad(t *testing.T) {
 			data:    []byte{},
 			bs:      4,
 			want:    nil,
-			wantErr: errors.New("empty data cannot be unpadded"),
+			wantErr: ErrInvalidPadding,
 		},
 		{
 			desc:    "padding length is zero",
 			data:    []byte{1, 2, 3, 0},
 			bs:      4,
 			want:    nil,
-			wantErr: errors.New("padding length is zero"),
+			wantErr: ErrInvalidPadding,
 			prePad:  true,
 		},
 	}
@@ -128,3 +127,83 @@ func TestUnpad(t *testing.T) {
 		})
 	}
 }
+
+func TestPaddings(t *testing.T) {
+	schemes := map[string]Padding{
+		"PKCS7":    PKCS7{},
+		"ISO7816":  ISO7816{},
+		"ANSIX923": ANSIX923{},
+		"Bucket":   Bucket{Sizes: []int{32, 8, 100}},
+	}
+	for name, p := range schemes {
+		for _, bs := range []int{1, 8, 16} {
+			for n := 0; n <= 130; n++ {
+				data := bytes.Repeat([]byte{0x80}, n)
+				padded, err := p.Pad(data, bs)
+				if err != nil {
+					t.Fatalf("%s: Pad(%d bytes, %d) failed: %v", name, n, bs, err)
+				}
+				if len(padded) <= n || len(padded)%bs != 0 {
+					t.Fatalf("%s: Pad(%d bytes, %d) returned %d bytes", name, n, bs, len(padded))
+				}
+				got, err := p.Unpad(padded, bs)
+				if err != nil || !bytes.Equal(got, data) {
+					t.Fatalf("%s: Unpad(Pad(%d bytes, %d)) = %v, %v", name, n, bs, got, err)
+				}
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		p    Padding
+		data []byte
+		bs   int
+		want []byte
+	}{
+		{"PKCS7 partial", PKCS7{}, []byte{1, 2, 3, 4, 5, 3, 3, 3}, 4, []byte{1, 2, 3, 4, 5}},
+		{"PKCS7 whole block", PKCS7{}, []byte{1, 4, 4, 4, 4, 4, 4, 4}, 4, []byte{1, 4, 4, 4}},
+		{"PKCS7 disagreeing bytes", PKCS7{}, []byte{1, 2, 2, 3}, 4, nil},
+		{"PKCS7 longer than a block", PKCS7{}, []byte{5, 5, 5, 5, 5, 5, 5, 5}, 4, nil},
+		{"PKCS7 zero", PKCS7{}, []byte{1, 2, 3, 0}, 4, nil},
+		{"PKCS7 not aligned", PKCS7{}, []byte{1, 2, 1}, 4, nil},
+		{"ANSIX923", ANSIX923{}, []byte{1, 0, 0, 3}, 4, []byte{1}},
+		{"ANSIX923 not zero", ANSIX923{}, []byte{1, 1, 0, 3}, 4, nil},
+		{"ISO7816", ISO7816{}, []byte{1, 0x80, 0, 0}, 4, []byte{1}},
+		{"ISO7816 marker only", ISO7816{}, []byte{1, 2, 3, 0x80}, 4, []byte{1, 2, 3}},
+		{"ISO7816 no marker", ISO7816{}, []byte{1, 2, 0, 0}, 4, nil},
+		{"ISO7816 marker before the block", ISO7816{}, []byte{0x80, 0, 0, 0, 0, 0, 0, 0}, 4, nil},
+		{"Bucket spanning blocks", Bucket{}, []byte{1, 0x80, 0, 0, 0, 0, 0, 0}, 4, []byte{1}},
+		{"Bucket zeros", Bucket{}, []byte{0, 0, 0, 0}, 4, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.p.Unpad(tt.data, tt.bs)
+			if tt.want == nil {
+				if err != ErrInvalidPadding {
+					t.Errorf("Unpad(%v) = %v, %v, want ErrInvalidPadding", tt.data, got, err)
+				}
+			} else if err != nil || !bytes.Equal(got, tt.want) {
+				t.Errorf("Unpad(%v) = %v, %v, want %v", tt.data, got, err, tt.want)
+			}
+		})
+	}
+
+	// buckets hide the length within a size, larger data grows by the largest size
+	b := Bucket{Sizes: []int{64, 16, 256}}
+	for _, c := range []struct{ n, want int }{{0, 16}, {15, 16}, {16, 64}, {200, 256}, {256, 512}, {600, 768}} {
+		if got, _ := b.Pad(make([]byte, c.n), 16); len(got) != c.want {
+			t.Errorf("Bucket padded %d bytes to %d, want %d", c.n, len(got), c.want)
+		}
+	}
+	if _, err := (Bucket{}).Pad([]byte{1}, 16); err == nil {
+		t.Error("Bucket without sizes padded")
+	}
+	if _, err := (PKCS7{}).Pad([]byte{1}, 256); !errors.Is(err, ErrInvalidBlockSize) {
+		t.Errorf("PKCS7 with a 256 byte block returned %v", err)
+	}
+	data := []byte{1, 2, 3}
+	if padded, _ := Pad(data[:1], 4); padded[1] != 3 || data[1] != 2 {
+		t.Error("Pad wrote to the backing array of its input")
+	}
+}
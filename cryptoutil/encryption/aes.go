@@ -5,9 +5,11 @@ import (
 	"crypto/cipher"
 	"crypto/sha256"
 	"crypto/sha512"
+	"fmt"
 	"github.com/xadaemon/libprisma/cryptoutil"
 	"golang.org/x/crypto/pbkdf2"
 	"hash"
+	"math/rand/v2"
 )
 
 type AESSize int
@@ -20,7 +22,7 @@ const (
 
 type SecureAES struct {
 	iv   []byte
-	key  []byte
+	key  *cryptoutil.SecretBytes
 	iAes cipher.Block
 	enc  cipher.BlockMode
 	dec  cipher.BlockMode
@@ -30,13 +32,22 @@ type SecureAES struct {
 // NewSecureAES creates a new SecureAES object with the given key
 // The key will be used to seed a chacha8 CSPRNG to generate a salt for the key derivation function,
 // in this case, PBKDF2 with 4096 iterations and a key length of corresponding to aesSize
-// the original key is not stored in the SecureAES struct only the derived bytes
+// the original key is not stored in the SecureAES struct only the derived bytes, which are kept in a
+// cryptoutil.SecretBytes until Dispose
 func NewSecureAES(key []byte, aesSize AESSize) (SecureCypher, error) {
-	keyDerivedSalt := cryptoutil.SeededRandomData(key, 64)
-	key = pbkdf2.Key(key, keyDerivedSalt, 4096, int(aesSize), sha256.New)
-	iv := cryptoutil.SeededRandomData(pbkdf2.Key(key, keyDerivedSalt, 4096, int(aesSize), sha256.New), aes.BlockSize)
-	bc, err := aes.NewCipher(key)
+	keyDerivedSalt := legacySeededData(key, 64)
+	derived := cryptoutil.NewSecretBytesFrom(pbkdf2.Key(key, keyDerivedSalt, 4096, int(aesSize), sha256.New))
+	var iv []byte
+	var bc cipher.Block
+	var err error
+	derived.Use(func(k []byte) {
+		ivSeed := pbkdf2.Key(k, keyDerivedSalt, 4096, int(aesSize), sha256.New)
+		iv = legacySeededData(ivSeed, aes.BlockSize)
+		clear(ivSeed)
+		bc, err = aes.NewCipher(k)
+	})
 	if err != nil {
+		derived.Destroy()
 		return nil, err
 	}
 	enc := cipher.NewCBCEncrypter(bc, iv)
@@ -44,7 +55,7 @@ func NewSecureAES(key []byte, aesSize AESSize) (SecureCypher, error) {
 	h := sha256.New()
 	s := &SecureAES{
 		iv:   iv,
-		key:  key,
+		key:  derived,
 		iAes: bc,
 		enc:  enc,
 		dec:  dec,
@@ -56,12 +67,28 @@ func NewSecureAES(key []byte, aesSize AESSize) (SecureCypher, error) {
 	return s, nil
 }
 
+// legacySeededData derives the salt and IV of NewSecureAES the way cryptoutil.SeededRandomData
+// did before its stream was redefined, so keys and ciphertexts made earlier stay valid. The
+// ChaCha8 seed is the first 32 bytes of seed followed by its SHA-256 digest.
+func legacySeededData(seed []byte, n int) []byte {
+	h := sha256.New()
+	h.Write(seed)
+	seed = h.Sum(seed)
+	rng := rand.New(rand.NewChaCha8([32]byte(seed)))
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = byte(rng.UintN(256))
+	}
+	return out
+}
+
 func (s *SecureAES) GetBlockSize() int {
 	return aes.BlockSize
 }
 
+// GetKey returns a heap copy of the derived key, nil once disposed. Clear it when done.
 func (s *SecureAES) GetKey() []byte {
-	return s.key
+	return s.key.Copy()
 }
 
 func (s *SecureAES) GetIV() []byte {
@@ -101,7 +128,20 @@ func (s *SecureAES) Encrypt(data []byte) ([]byte, error) {
 	return out, nil
 }
 
+// Decrypt undoes Encrypt, it does not check the tag: use DecryptFromBytes for whole messages
 func (s *SecureAES) Decrypt(data []byte) ([]byte, error) {
+	decrypted, err := s.decryptBlocks(data)
+	if err != nil {
+		return nil, err
+	}
+	return trimLastBlock(decrypted)
+}
+
+// decryptBlocks decrypts data and feeds the result to the tag, leaving any padding in place
+func (s *SecureAES) decryptBlocks(data []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("cannot decrypt data that's not a multiple of %d", aes.BlockSize)
+	}
 	decrypted := make([]byte, len(data))
 	decryptedBlocker := cryptoutil.NewBlocker(aes.BlockSize, decrypted)
 	blocker := cryptoutil.NewBlocker(aes.BlockSize, data)
@@ -114,13 +154,24 @@ func (s *SecureAES) Decrypt(data []byte) ([]byte, error) {
 		s.dec.CryptBlocks(decrypted, block)
 		s.h.Write(decrypted)
 	}
-	decrypted, err := cryptoutil.Unpad(decrypted, aes.BlockSize)
-	if err != nil {
-		return nil, err
-	}
 	return decrypted, nil
 }
 
+// trimLastBlock undoes the padding of Encrypt, which only pads a partial last block and leaves
+// data that fills its blocks as it is. That format cannot tell a padded block from data ending in
+// bytes that look like padding, so it cannot use strict PKCS#7: a last byte above the block size
+// means there was no padding. It is only applied to authenticated data by DecryptFromBytes, where
+// it cannot serve as a padding oracle, and fails with the one cryptoutil.ErrInvalidPadding.
+func trimLastBlock(data []byte) ([]byte, error) {
+	padLen := int(data[len(data)-1])
+	if padLen > aes.BlockSize {
+		return data, nil
+	} else if padLen == 0 {
+		return nil, cryptoutil.ErrInvalidPadding
+	}
+	return data[:len(data)-padLen], nil
+}
+
 // GetTag returns the tag for the all the encryption that was performed up to the call to GetTag
 func (s *SecureAES) GetTag() []byte {
 	var tag []byte
@@ -131,7 +182,7 @@ func (s *SecureAES) GetTag() []byte {
 // GetKeyThumbprint returns the thumbprint of the key currently loaded in the SecureAES object as a SHA-512 hash
 func (s *SecureAES) GetKeyThumbprint() []byte {
 	h := sha512.New()
-	h.Write(s.key)
+	s.key.Use(func(k []byte) { h.Write(k) })
 	return h.Sum(nil)
 }
 
@@ -155,7 +206,7 @@ func (s *SecureAES) TagPlusIVSize() int {
 // Reset resets the encryption state, with a new hash state for the tag
 func (s *SecureAES) Reset() {
 	s.h.Reset()
-	s.h.Write(s.key)
+	s.key.Use(func(k []byte) { s.h.Write(k) })
 	s.h.Write(s.iv)
 }
 
@@ -168,29 +219,53 @@ func (s *SecureAES) FullReset() {
 }
 
 func (s *SecureAES) Dispose() {
-	// overwrite the key and iv with random data
+	// wipe the key where it lives and overwrite the iv with random data
+	s.key.Destroy()
 	s.iv = cryptoutil.NewRandom(aes.BlockSize)
-	s.key = cryptoutil.NewRandom(32)
 	s.iAes = nil
 	s.enc = nil
 	s.dec = nil
 	s.Reset()
 }
 
-// EncryptToBytes encrypts the data and returns the encrypted data with the IV and tag appended
-// it returns [data, IV, tag]
+// secureAESVersion starts the messages of EncryptToBytes. Messages made before it existed have
+// no version and a length that is a multiple of the block size, versioned ones are one byte
+// longer, so both are told apart by length.
+const secureAESVersion = 2
+
+// EncryptToBytes pads data with PKCS#7 and encrypts it, it returns [version, data, IV, tag]
 func (s *SecureAES) EncryptToBytes(data []byte) ([]byte, error) {
-	encrypted, err := s.Encrypt(data)
+	padded, err := cryptoutil.Pad(data, aes.BlockSize)
 	if err != nil {
 		return nil, err
 	}
-	encrypted = append(encrypted, s.GetIV()...)
-	encrypted = append(encrypted, s.GetTag()...)
-	return encrypted, nil
+	encrypted, err := s.Encrypt(padded)
+	clear(padded)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, 1+len(encrypted)+s.TagPlusIVSize())
+	out = append(out, secureAESVersion)
+	out = append(out, encrypted...)
+	out = append(out, s.GetIV()...)
+	out = append(out, s.GetTag()...)
+	return out, nil
 }
 
-// DecryptFromBytes decrypts the data and returns the decrypted data, it expects the data to be in the order [data, IV, tag]
+// DecryptFromBytes decrypts a message of EncryptToBytes, or one in the unversioned [data, IV, tag]
+// layout of earlier releases. The tag is checked before the padding is looked at and every
+// failure returns ErrTagMismatch, so malformed messages cannot be told apart.
 func (s *SecureAES) DecryptFromBytes(data []byte) ([]byte, error) {
+	legacy := len(data)%aes.BlockSize == 0
+	if !legacy {
+		if len(data) == 0 || data[0] != secureAESVersion {
+			return nil, ErrTagMismatch
+		}
+		data = data[1:]
+	}
+	if len(data) < aes.BlockSize+s.TagPlusIVSize() {
+		return nil, ErrTagMismatch
+	}
 	iv := make([]byte, s.GetIvSize())
 	tag := make([]byte, s.GetTagSize())
 	tagIv := data[len(data)-s.TagPlusIVSize():]
@@ -200,14 +275,17 @@ func (s *SecureAES) DecryptFromBytes(data []byte) ([]byte, error) {
 	s.SetIV(iv)
 	s.Reset()
 
-	decrypted, err := s.Decrypt(encrypted)
-	if err != nil {
-		return nil, err
+	decrypted, err := s.decryptBlocks(encrypted)
+	if err != nil || !cryptoutil.SecureCompare(tag, s.GetTag()) {
+		return nil, ErrTagMismatch
 	}
-
-	if !cryptoutil.SecureCompare(tag, s.GetTag()) {
+	if legacy {
+		decrypted, err = trimLastBlock(decrypted)
+	} else {
+		decrypted, err = cryptoutil.Unpad(decrypted, aes.BlockSize)
+	}
+	if err != nil {
 		return nil, ErrTagMismatch
 	}
-
 	return decrypted, nil
 }
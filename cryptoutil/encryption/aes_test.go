@@ -1,6 +1,7 @@
 package encryption_test
 
 import (
+	"errors"
 	"github.com/google/go-cmp/cmp"
 	"github.com/xadaemon/libprisma/cryptoutil/encryption"
 	"testing"
@@ -38,9 +39,60 @@ func TestSecureAES(t *testing.T) {
 	}
 
 	// test detect tampering
-	encrypted[0] = encrypted[0] ^ 0xFF
+	encrypted[1] = encrypted[1] ^ 0xFF
 	_, err = secureAes.DecryptFromBytes(encrypted)
 	if err == nil {
 		t.Errorf("Tampered data was decrypted successfully")
 	}
 }
+
+func TestSecureAES_Format(t *testing.T) {
+	newAES := func() encryption.SecureCypher {
+		s, err := encryption.NewSecureAES([]byte("superSecretKey"), encryption.AES128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	// aligned data ending in what looks like padding survives the round trip
+	aligned := []byte("sixteen bytes\x03\x03\x03")
+	encrypted, err := newAES().EncryptToBytes(aligned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encrypted) != 1+32+16+32 {
+		t.Errorf("Encrypted to %d bytes", len(encrypted))
+	}
+	if got, err := newAES().DecryptFromBytes(encrypted); err != nil || !cmp.Equal(got, aligned) {
+		t.Errorf("Aligned data decrypted to %q, %v", got, err)
+	}
+
+	// messages of earlier releases, [data, IV, tag] with only a partial block padded, still decrypt
+	old := []byte("legacy message")
+	s := newAES()
+	legacy, _ := s.Encrypt(old)
+	legacy = append(append(legacy, s.GetIV()...), s.GetTag()...)
+	if got, err := newAES().DecryptFromBytes(legacy); err != nil || !cmp.Equal(got, old) {
+		t.Errorf("Legacy message decrypted to %q, %v", got, err)
+	}
+
+	// every malformed message fails the same way, without looking at the padding first
+	tamper := func(i int) []byte {
+		out := append([]byte{}, encrypted...)
+		out[i] ^= 1
+		return out
+	}
+	for name, msg := range map[string][]byte{
+		"padding":   tamper(32),
+		"iv":        tamper(34),
+		"tag":       tamper(len(encrypted) - 1),
+		"version":   tamper(0),
+		"truncated": encrypted[:40],
+		"empty":     nil,
+	} {
+		if _, err := newAES().DecryptFromBytes(msg); !errors.Is(err, encryption.ErrTagMismatch) {
+			t.Errorf("Tampered %s: got %v", name, err)
+		}
+	}
+}
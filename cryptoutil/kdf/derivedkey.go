@@ -11,4 +11,6 @@ type Key interface {
 	Equals(other string) bool
 	GetKey() []byte
 	GetSalt() []byte
+	// Destroy wipes the key material, GetKey returns nil afterwards
+	Destroy()
 }
@@ -14,18 +14,17 @@ import (
 	"strings"
 )
 
-type Hash []byte
 type Salt []byte
 
 // Pbkdf2Key represents a key derived using the PBKDF2 algorithm. It contains the following fields:
-// - Hash: The derived key
+// - Hash: The derived key, kept in secret memory until Destroy
 // - Salt: The salt value used for key derivation
 // - Algo: The algorithm used for key derivation
 // - Iter: The number of iterations used for key derivation
 // - KeyLen: The length of the derived key
 // - HashType: The hash function used for key derivation
 type Pbkdf2Key struct {
-	Hash
+	Hash *cryptoutil.SecretBytes
 	Salt
 	Algo     string
 	Iter     uint64
@@ -37,7 +36,12 @@ var PbKdf2 = Pbkdf2Key{}
 
 func (d *Pbkdf2Key) Equals(other string) bool {
 	otherKey := pbkdf2.Key([]byte(other), d.Salt, int(d.Iter), int(d.KeyLen), sha512.New)
-	return subtle.ConstantTimeCompare(d.Hash, otherKey) == 1
+	defer clear(otherKey)
+	eq := false
+	d.Hash.Use(func(b []byte) {
+		eq = subtle.ConstantTimeCompare(b, otherKey) == 1
+	})
+	return eq
 }
 
 func numToStr(i uint64) string {
@@ -56,7 +60,10 @@ func numFromString(s string) (uint64, bool) {
 
 func (d *Pbkdf2Key) String() string {
 	saltEnc := base64.StdEncoding.EncodeToString(d.Salt)
-	hashEnc := base64.StdEncoding.EncodeToString(d.Hash)
+	var hashEnc string
+	d.Hash.Use(func(b []byte) {
+		hashEnc = base64.StdEncoding.EncodeToString(b)
+	})
 	iter := numToStr(d.Iter)
 	keyLen := numToStr(d.KeyLen)
 	return fmt.Sprintf("$%s;%s;%s;%s;%s;%s", d.Algo, d.HashType, iter, keyLen, saltEnc, hashEnc)
@@ -94,7 +101,7 @@ func (*Pbkdf2Key) FromString(s string) (Key, error) {
 	}
 
 	return &Pbkdf2Key{
-		Hash:     key,
+		Hash:     cryptoutil.NewSecretBytesFrom(key),
 		Salt:     salt,
 		Algo:     "pbkdf2",
 		Iter:     iter,
@@ -107,8 +114,14 @@ func (Pbkdf2Key) KeyFromStr(value string, iter int, keyLen int, h func() hash.Ha
 	return PbKdf2.Key([]byte(value), iter, keyLen, h)
 }
 
+// GetKey returns a heap copy of the derived key, nil once destroyed. Clear it when done.
 func (d *Pbkdf2Key) GetKey() []byte {
-	return d.Hash
+	return d.Hash.Copy()
+}
+
+// Destroy wipes the derived key
+func (d *Pbkdf2Key) Destroy() {
+	d.Hash.Destroy()
 }
 
 func (d *Pbkdf2Key) GetSalt() []byte {
@@ -120,7 +133,7 @@ func (Pbkdf2Key) Key(value []byte, iter int, keyLen int, h func() hash.Hash) Key
 	hName := reflect.TypeOf(h())
 	key := pbkdf2.Key(value, salt, iter, keyLen, h)
 	return &Pbkdf2Key{
-		Hash:     key,
+		Hash:     cryptoutil.NewSecretBytesFrom(key),
 		Salt:     salt,
 		Algo:     "pbkdf2",
 		Iter:     uint64(iter),
@@ -2,9 +2,12 @@ package kdf_test
 
 import (
 	"crypto/sha512"
+	"encoding/base64"
 	"fmt"
 	"github.com/google/go-cmp/cmp"
 	"github.com/xadaemon/libprisma/cryptoutil/kdf"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -30,3 +33,28 @@ func TestParsePbkdf2KeyFromString(t *testing.T) {
 		t.Error("Decoded KeyFromStr object from string doesn't match the original")
 	}
 }
+
+func TestPbkdf2Key_GetKey(t *testing.T) {
+	encoded := kdf.PbKdf2.KeyFromStr("SomeKey", 4096, 32, sha512.New).String()
+	want := encoded[strings.LastIndex(encoded, ";")+1:]
+
+	// the key outlives the unreachable Key it came from, whose secret memory is gone after GC
+	v, _ := kdf.PbKdf2.FromString(encoded)
+	key := v.GetKey()
+	v = nil
+	runtime.GC()
+	runtime.GC()
+	if got := base64.StdEncoding.EncodeToString(key); got != want {
+		t.Errorf("GetKey returned %s after GC, want %s", got, want)
+	}
+
+	v, _ = kdf.PbKdf2.FromString(encoded)
+	clear(v.GetKey())
+	if !v.Equals("SomeKey") {
+		t.Error("Clearing the result of GetKey changed the key")
+	}
+	v.Destroy()
+	if v.GetKey() != nil {
+		t.Error("Destroyed key still returned")
+	}
+}
@@ -0,0 +1,203 @@
+package cryptoutil
+
+import (
+	"crypto/subtle"
+	"errors"
+)
+
+var (
+	// ErrInvalidPadding is the only error returned for data that does not unpad, whatever is wrong
+	// with it, so callers cannot leak which check failed
+	ErrInvalidPadding   = errors.New("invalid padding")
+	ErrInvalidBlockSize = errors.New("invalid block size")
+)
+
+// Padding extends data to a multiple of a block size and removes that padding again. Pad always
+// adds at least one byte, a whole block when data is already aligned, so every padded message
+// unpads unambiguously. Unpad validates the padding in constant time with respect to the data
+// and only reports ErrInvalidPadding.
+type Padding interface {
+	Pad(data []byte, blockSize int) ([]byte, error)
+	Unpad(data []byte, blockSize int) ([]byte, error)
+}
+
+var (
+	_ Padding = PKCS7{}
+	_ Padding = ISO7816{}
+	_ Padding = ANSIX923{}
+	_ Padding = Bucket{}
+)
+
+// PKCS7 fills the padding with bytes holding its length (RFC 5652), block sizes go up to 255
+type PKCS7 struct{}
+
+// ISO7816 marks the end of the data with 0x80 followed by zeros (ISO/IEC 7816-4)
+type ISO7816 struct{}
+
+// ANSIX923 fills the padding with zeros ending in a byte holding its length, block sizes go up
+// to 255
+type ANSIX923 struct{}
+
+// Bucket hides the length of the data by padding it to the smallest of Sizes that fits it, sizes
+// are rounded up to the block size and data longer than every size is padded to a multiple of
+// the largest one. The padding is ISO7816, so Unpad does not need to know the sizes.
+type Bucket struct {
+	Sizes []int
+}
+
+// Pad pads data to blockSize with PKCS#7
+func Pad(data []byte, blockSize int) ([]byte, error) {
+	return PKCS7{}.Pad(data, blockSize)
+}
+
+// Unpad removes PKCS#7 padding from data
+func Unpad(data []byte, blockSize int) ([]byte, error) {
+	return PKCS7{}.Unpad(data, blockSize)
+}
+
+func (PKCS7) Pad(data []byte, blockSize int) ([]byte, error) {
+	if blockSize < 1 || blockSize > 255 {
+		return nil, ErrInvalidBlockSize
+	}
+	padLen := blockSize - len(data)%blockSize
+	out := grow(data, padLen)
+	for i := len(data); i < len(out); i++ {
+		out[i] = byte(padLen)
+	}
+	return out, nil
+}
+
+func (PKCS7) Unpad(data []byte, blockSize int) ([]byte, error) {
+	return unpadLength(data, blockSize, false)
+}
+
+func (ANSIX923) Pad(data []byte, blockSize int) ([]byte, error) {
+	if blockSize < 1 || blockSize > 255 {
+		return nil, ErrInvalidBlockSize
+	}
+	padLen := blockSize - len(data)%blockSize
+	out := grow(data, padLen)
+	out[len(out)-1] = byte(padLen)
+	return out, nil
+}
+
+func (ANSIX923) Unpad(data []byte, blockSize int) ([]byte, error) {
+	return unpadLength(data, blockSize, true)
+}
+
+func (ISO7816) Pad(data []byte, blockSize int) ([]byte, error) {
+	if blockSize < 1 {
+		return nil, ErrInvalidBlockSize
+	}
+	out := grow(data, blockSize-len(data)%blockSize)
+	out[len(data)] = 0x80
+	return out, nil
+}
+
+func (ISO7816) Unpad(data []byte, blockSize int) ([]byte, error) {
+	if blockSize < 1 {
+		return nil, ErrInvalidBlockSize
+	}
+	if len(data) == 0 || len(data)%blockSize != 0 {
+		return nil, ErrInvalidPadding
+	}
+	return unpadMarker(data, blockSize)
+}
+
+func (b Bucket) Pad(data []byte, blockSize int) ([]byte, error) {
+	if blockSize < 1 {
+		return nil, ErrInvalidBlockSize
+	}
+	if len(b.Sizes) == 0 {
+		return nil, errors.New("bucket padding needs at least one size")
+	}
+	largest := 0
+	target := -1
+	for _, s := range b.Sizes {
+		if s < 1 {
+			return nil, errors.New("bucket sizes must be positive")
+		}
+		s = roundUp(s, blockSize)
+		largest = max(largest, s)
+		// at least the marker byte has to fit
+		if s > len(data) && (target < 0 || s < target) {
+			target = s
+		}
+	}
+	if target < 0 {
+		target = roundUp(len(data)+1, largest)
+	}
+	out := grow(data, target-len(data))
+	out[len(data)] = 0x80
+	return out, nil
+}
+
+// Unpad removes the padding of any bucket, the whole data is scanned since the padding may span
+// many blocks
+func (Bucket) Unpad(data []byte, blockSize int) ([]byte, error) {
+	if blockSize < 1 {
+		return nil, ErrInvalidBlockSize
+	}
+	if len(data) == 0 || len(data)%blockSize != 0 {
+		return nil, ErrInvalidPadding
+	}
+	return unpadMarker(data, len(data))
+}
+
+// grow returns a copy of data with n zero bytes appended, data itself is never written to
+func grow(data []byte, n int) []byte {
+	out := make([]byte, len(data)+n)
+	copy(out, data)
+	return out
+}
+
+func roundUp(n int, to int) int {
+	return (n + to - 1) / to * to
+}
+
+// unpadLength removes padding ending in its length, the other padding bytes must hold the
+// length too or, when zeros is set, be zero. The last blockSize bytes are always inspected so
+// timing does not depend on the padding length.
+func unpadLength(data []byte, blockSize int, zeros bool) ([]byte, error) {
+	if blockSize < 1 || blockSize > 255 {
+		return nil, ErrInvalidBlockSize
+	}
+	n := len(data)
+	if n == 0 || n%blockSize != 0 {
+		return nil, ErrInvalidPadding
+	}
+	padLen := int(data[n-1])
+	good := subtle.ConstantTimeLessOrEq(1, padLen) & subtle.ConstantTimeLessOrEq(padLen, blockSize)
+	fill := byte(padLen)
+	if zeros {
+		fill = 0
+	}
+	for i := 2; i <= blockSize; i++ {
+		inPad := subtle.ConstantTimeLessOrEq(i, padLen)
+		ok := subtle.ConstantTimeByteEq(data[n-i], fill)
+		good &= subtle.ConstantTimeSelect(inPad, ok, 1)
+	}
+	if good != 1 {
+		return nil, ErrInvalidPadding
+	}
+	return data[:n-padLen], nil
+}
+
+// unpadMarker removes zeros preceded by 0x80 from the end of data, looking at the last window
+// bytes whatever their content
+func unpadMarker(data []byte, window int) ([]byte, error) {
+	n := len(data)
+	padLen, found, good := 0, 0, 0
+	for i := 1; i <= window; i++ {
+		b := data[n-i]
+		// the first byte from the end that is not zero has to be the marker
+		hit := (found ^ 1) & (subtle.ConstantTimeByteEq(b, 0) ^ 1)
+		good |= hit & subtle.ConstantTimeByteEq(b, 0x80)
+		padLen = subtle.ConstantTimeSelect(hit, i, padLen)
+		found |= hit
+	}
+	if good != 1 {
+		return nil, ErrInvalidPadding
+	}
+	return data[:n-padLen], nil
+}
@@ -6,16 +6,61 @@ import (
 	"github.com/xadaemon/libprisma/cryptoutil"
 	"golang.org/x/crypto/ed25519"
 	"hash"
+	"io"
 )
 
 type ed25519Impl struct{}
 
 var Ed25519 ed25519Impl
 
+// Ed25519PrivateKey keeps an Ed25519 private key in a cryptoutil.SecretBytes, it is a crypto.Signer
+// until Destroy wipes it
+type Ed25519PrivateKey struct {
+	secret *cryptoutil.SecretBytes
+	public ed25519.PublicKey
+}
+
+var _ crypto.Signer = (*Ed25519PrivateKey)(nil)
+
+func (k *Ed25519PrivateKey) Public() crypto.PublicKey {
+	return k.public
+}
+
+// Sign signs message like ed25519.PrivateKey.Sign, it fails once the key was destroyed.
+//
+// crypto/ed25519 caches expanded keys by the address of the key and can only do so for heap
+// memory, so each signature works on a heap copy of the key that is wiped right after. The
+// expanded key it cached for that copy stays on the heap until the copy is collected.
+func (k *Ed25519PrivateKey) Sign(rand io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if k.secret.Len() != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("ed25519 private key was destroyed")
+	}
+	key := ed25519.PrivateKey(k.secret.Copy())
+	defer clear(key)
+	return key.Sign(rand, message, opts)
+}
+
+// Destroy wipes the private key
+func (k *Ed25519PrivateKey) Destroy() {
+	k.secret.Destroy()
+}
+
+// NewKey returns a new *Ed25519PrivateKey, neither its seed nor the expanded key are left on the heap
 func (ed25519Impl) NewKey(...any) crypto.PrivateKey {
-	return ed25519.NewKeyFromSeed(cryptoutil.NewRandom(32))
+	seed := cryptoutil.NewRandomSecret(ed25519.SeedSize)
+	defer seed.Destroy()
+	var secret *cryptoutil.SecretBytes
+	seed.Use(func(b []byte) {
+		secret = cryptoutil.NewSecretBytesFrom(ed25519.NewKeyFromSeed(b))
+	})
+	public := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	secret.Use(func(b []byte) {
+		copy(public, b[ed25519.SeedSize:])
+	})
+	return &Ed25519PrivateKey{secret: secret, public: public}
 }
 
+// Sign accepts an *Ed25519PrivateKey or a plain ed25519.PrivateKey
 func (ed25519Impl) Sign(k crypto.PrivateKey, message []byte, h func() hash.Hash) ([]byte, error) {
 	hx := h()
 	hd := make([]byte, 0)
@@ -25,7 +70,13 @@ func (ed25519Impl) Sign(k crypto.PrivateKey, message []byte, h func() hash.Hash)
 		return nil, fmt.Errorf("hasher read %d and not the expected %d", n, len(message))
 	}
 	hd = hx.Sum([]byte{})
-	return ed25519.Sign(k.(ed25519.PrivateKey), hd), nil
+	switch key := k.(type) {
+	case *Ed25519PrivateKey:
+		return key.Sign(nil, hd, crypto.Hash(0))
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, hd), nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", k)
 }
 
 func (ed25519Impl) Verify(k crypto.PublicKey, sig []byte, message []byte, opts ...any) (bool, error) {
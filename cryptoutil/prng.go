@@ -0,0 +1,168 @@
+package cryptoutil
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+)
+
+// seededPRNGInfo is the HKDF info prefix separating SeededPRNG keys from any other use of a seed
+const seededPRNGInfo = "libprisma cryptoutil SeededPRNG v1"
+
+const (
+	chachaBlock = 64
+	// segmentBytes is the output of one nonce, a ChaCha20 block counter has 32 bits
+	segmentBytes = chachaBlock << 32
+	// prngStateSize is the size of a marshaled state: version, key and position
+	prngStateSize = 1 + chacha20.KeySize + 8
+)
+
+var ErrInvalidPRNGState = errors.New("invalid SeededPRNG state")
+
+// SeededPRNG is a deterministic random stream for reproducible data such as test fixtures and
+// derived salts, it is not a source of secrets unless the seed is one.
+//
+// The stream is the ChaCha20 (RFC 8439) key stream under the key
+// HKDF-SHA256(secret = seed, salt = none, info = "libprisma cryptoutil SeededPRNG v1" 0x00 context),
+// starting at block counter 0 with a zero nonce. Every 2^32 blocks the counter wraps and the last
+// 8 bytes of the nonce, a big endian segment number, are incremented. Byte i of the stream is
+// therefore fixed by seed, context and i alone, however it is read.
+type SeededPRNG struct {
+	key [chacha20.KeySize]byte
+	pos uint64
+	// c produces the stream from pos on, it is dropped whenever pos moves otherwise
+	c *chacha20.Cipher
+}
+
+var (
+	_ io.Reader     = (*SeededPRNG)(nil)
+	_ cipher.Stream = (*SeededPRNG)(nil)
+	_ rand.Source   = (*SeededPRNG)(nil)
+)
+
+// NewSeededPRNG returns the stream for seed without a context, skipping the first discard 64 bit
+// words of it
+func NewSeededPRNG(seed []byte, discard uint) *SeededPRNG {
+	g := NewSeededPRNGFor(seed, "")
+	g.Skip(uint64(discard) * 8)
+	return g
+}
+
+// NewSeededPRNGFor returns the stream for seed in context, different contexts give independent
+// streams for the same seed
+func NewSeededPRNGFor(seed []byte, context string) *SeededPRNG {
+	g := &SeededPRNG{}
+	info := append([]byte(seededPRNGInfo), 0)
+	info = append(info, context...)
+	// HKDF-SHA256 can expand far more than a key, this never fails
+	if _, err := io.ReadFull(hkdf.New(sha256.New, seed, nil, info), g.key[:]); err != nil {
+		panic(err)
+	}
+	return g
+}
+
+func (g *SeededPRNG) cipher() *chacha20.Cipher {
+	if g.c != nil {
+		return g.c
+	}
+	block := g.pos / chachaBlock
+	var nonce [chacha20.NonceSize]byte
+	binary.BigEndian.PutUint64(nonce[4:], block>>32)
+	c, err := chacha20.NewUnauthenticatedCipher(g.key[:], nonce[:])
+	if err != nil {
+		panic(err)
+	}
+	c.SetCounter(uint32(block))
+	if off := g.pos % chachaBlock; off > 0 {
+		var skip [chachaBlock]byte
+		c.XORKeyStream(skip[:off], skip[:off])
+	}
+	g.c = c
+	return c
+}
+
+// XORKeyStream XORs src with the next len(src) bytes of the stream into dst, which may overlap
+// src entirely or not at all
+func (g *SeededPRNG) XORKeyStream(dst []byte, src []byte) {
+	if len(dst) < len(src) {
+		panic("cryptoutil: output smaller than input")
+	}
+	for len(src) > 0 {
+		n := uint64(len(src))
+		if left := segmentBytes - g.pos%segmentBytes; n > left {
+			n = left
+		}
+		g.cipher().XORKeyStream(dst[:n], src[:n])
+		g.pos += n
+		if g.pos%segmentBytes == 0 {
+			g.c = nil
+		}
+		dst, src = dst[n:], src[n:]
+	}
+}
+
+// Read fills p with the next bytes of the stream, it never fails
+func (g *SeededPRNG) Read(p []byte) (int, error) {
+	clear(p)
+	g.XORKeyStream(p, p)
+	return len(p), nil
+}
+
+// Uint64 returns the next 8 bytes of the stream little endian, making the stream a rand.Source
+func (g *SeededPRNG) Uint64() uint64 {
+	var b [8]byte
+	g.XORKeyStream(b[:], b[:])
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+// Skip advances the stream by n bytes without producing them
+func (g *SeededPRNG) Skip(n uint64) {
+	g.pos += n
+	g.c = nil
+}
+
+// Position returns how many bytes of the stream were used
+func (g *SeededPRNG) Position() uint64 {
+	return g.pos
+}
+
+func (g *SeededPRNG) GetBytes(n int) []byte {
+	out := make([]byte, n)
+	g.FillBuffer(out)
+	return out
+}
+
+func (g *SeededPRNG) FillBuffer(buff []byte) {
+	_, _ = g.Read(buff)
+}
+
+// MarshalBinary saves the state so the stream can be resumed with UnmarshalBinary. The state
+// holds the derived key, it reveals the whole stream and must be kept as secret as the seed.
+func (g *SeededPRNG) MarshalBinary() ([]byte, error) {
+	out := make([]byte, 0, prngStateSize)
+	out = append(out, 1)
+	out = append(out, g.key[:]...)
+	return binary.BigEndian.AppendUint64(out, g.pos), nil
+}
+
+// UnmarshalBinary restores a state saved by MarshalBinary
+func (g *SeededPRNG) UnmarshalBinary(data []byte) error {
+	if len(data) != prngStateSize || data[0] != 1 {
+		return ErrInvalidPRNGState
+	}
+	copy(g.key[:], data[1:1+chacha20.KeySize])
+	g.pos = binary.BigEndian.Uint64(data[1+chacha20.KeySize:])
+	g.c = nil
+	return nil
+}
+
+// SeededRandomData returns the first n bytes of the stream of NewSeededPRNG for seed
+func SeededRandomData(seed []byte, n int) []byte {
+	return NewSeededPRNG(seed, 0).GetBytes(n)
+}
@@ -0,0 +1,129 @@
+package cryptoutil
+
+import (
+	cryptorand "crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// SecretBytes holds key material outside the Go heap. On Linux the bytes live in their own
+// mapping, locked in memory so they are never swapped, excluded from core dumps and fenced by
+// inaccessible guard pages, with the data ending right at the trailing one so overflows fault.
+// Elsewhere, or when the mapping cannot be made, they fall back to the heap.
+//
+// Destroy zeroes and releases the memory, a finalizer does the same once the handle becomes
+// unreachable, which may happen while a slice into the memory is still in use. Use lends the
+// bytes for the duration of a call and keeps the handle alive meanwhile, Copy returns them on the
+// heap for callers that need them longer. Neither must be handed to code that keys caches or
+// weak pointers on their address, such as crypto/ed25519: give it a Copy and clear it afterwards.
+// Printing a SecretBytes with any fmt verb shows a redacted placeholder.
+type SecretBytes struct {
+	region []byte
+	data   []byte
+	locked bool
+	once   sync.Once
+}
+
+// NewSecretBytes returns n zero bytes of secret memory
+func NewSecretBytes(n int) *SecretBytes {
+	s := &SecretBytes{}
+	s.region, s.data, s.locked = allocSecret(n)
+	runtime.SetFinalizer(s, (*SecretBytes).Destroy)
+	return s
+}
+
+// NewSecretBytesFrom moves src into secret memory, src is zeroed
+func NewSecretBytesFrom(src []byte) *SecretBytes {
+	s := NewSecretBytes(len(src))
+	copy(s.data, src)
+	clear(src)
+	return s
+}
+
+// NewRandomSecret returns n random bytes of secret memory, they never touch the heap. Like
+// NewRandom it panics when the system randomness source fails.
+func NewRandomSecret(n int) *SecretBytes {
+	s := NewSecretBytes(n)
+	if _, err := cryptorand.Read(s.data); err != nil {
+		s.Destroy()
+		panic("Error getting randomness, check your OS true randomness source!")
+	}
+	return s
+}
+
+// Bytes returns the secret memory itself, nil once destroyed. The finalizer unmaps it as soon as
+// s is unreachable, so s has to be kept alive with runtime.KeepAlive until the last use of the
+// slice; Use does that for you.
+func (s *SecretBytes) Bytes() []byte {
+	if s == nil {
+		return nil
+	}
+	return s.data
+}
+
+// Use calls fn with the secret, which is nil once destroyed. The slice must not escape fn.
+func (s *SecretBytes) Use(fn func(b []byte)) {
+	fn(s.Bytes())
+	runtime.KeepAlive(s)
+}
+
+// Copy returns the secret on the heap, the caller should clear it once done
+func (s *SecretBytes) Copy() []byte {
+	var out []byte
+	s.Use(func(b []byte) {
+		if b != nil {
+			out = make([]byte, len(b))
+			copy(out, b)
+		}
+	})
+	return out
+}
+
+func (s *SecretBytes) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.data)
+}
+
+// Locked reports whether the memory is locked, locking fails when RLIMIT_MEMLOCK is exhausted
+// and is not available outside Linux
+func (s *SecretBytes) Locked() bool {
+	return s != nil && s.locked
+}
+
+// Equal compares two secrets in constant time with respect to their content
+func (s *SecretBytes) Equal(other *SecretBytes) bool {
+	eq := subtle.ConstantTimeCompare(s.Bytes(), other.Bytes()) == 1
+	runtime.KeepAlive(s)
+	runtime.KeepAlive(other)
+	return eq
+}
+
+// Destroy zeroes and releases the secret, later calls do nothing
+func (s *SecretBytes) Destroy() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		clear(s.data)
+		freeSecret(s.region, s.locked)
+		s.region, s.data = nil, nil
+		runtime.SetFinalizer(s, nil)
+	})
+}
+
+func (s *SecretBytes) String() string {
+	return "SecretBytes(redacted)"
+}
+
+func (s *SecretBytes) GoString() string {
+	return s.String()
+}
+
+// Format prints the redacted placeholder whatever the verb, so %x or %v never leak the bytes
+func (s *SecretBytes) Format(f fmt.State, _ rune) {
+	_, _ = f.Write([]byte(s.String()))
+}
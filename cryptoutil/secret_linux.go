@@ -0,0 +1,43 @@
+//go:build linux
+
+package cryptoutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// madvDontDump is MADV_DONTDUMP, which the syscall package does not define
+const madvDontDump = 0x10
+
+// allocSecret maps n bytes between two guard pages, locked and excluded from core dumps. The
+// heap is used when the mapping fails, locked tells whether mlock succeeded.
+func allocSecret(n int) (region []byte, data []byte, locked bool) {
+	page := os.Getpagesize()
+	size := roundUp(max(n, 1), page)
+	region, err := syscall.Mmap(-1, 0, size+2*page, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, make([]byte, n), false
+	}
+	if syscall.Mprotect(region[:page], syscall.PROT_NONE) != nil || syscall.Mprotect(region[page+size:], syscall.PROT_NONE) != nil {
+		_ = syscall.Munmap(region)
+		return nil, make([]byte, n), false
+	}
+	inner := region[page : page+size]
+	locked = syscall.Mlock(inner) == nil
+	_ = syscall.Madvise(inner, madvDontDump)
+	// end the data at the trailing guard page so writing past it faults right away
+	return region, inner[size-n : size : size], locked
+}
+
+// freeSecret releases a mapping made by allocSecret, the data must already be zeroed
+func freeSecret(region []byte, locked bool) {
+	if region == nil {
+		return
+	}
+	page := os.Getpagesize()
+	if locked {
+		_ = syscall.Munlock(region[page : len(region)-page])
+	}
+	_ = syscall.Munmap(region)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package cryptoutil
+
+// allocSecret keeps secrets on the heap where memory locking is not implemented, they are still
+// zeroed by Destroy
+func allocSecret(n int) (region []byte, data []byte, locked bool) {
+	return nil, make([]byte, n), false
+}
+
+func freeSecret([]byte, bool) {}
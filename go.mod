@@ -7,4 +7,8 @@ require (
 	golang.org/x/crypto v0.24.0
 )
 
-require google.golang.org/protobuf v1.34.1
+require (
+	github.com/BurntSushi/toml v1.6.0
+	google.golang.org/protobuf v1.34.1
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,619 @@
+package memkv
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Permission is a set of operations a rule grants or denies
+type Permission uint8
+
+const (
+	PERM_READ   Permission = 1 << iota
+	PERM_WRITE  Permission = 1 << iota
+	PERM_WATCH  Permission = 1 << iota
+	PERM_DELETE Permission = 1 << iota
+	PERM_ALL               = PERM_READ | PERM_WRITE | PERM_WATCH | PERM_DELETE
+)
+
+var permNames = []struct {
+	p    Permission
+	name string
+}{
+	{PERM_READ, "read"},
+	{PERM_WRITE, "write"},
+	{PERM_WATCH, "watch"},
+	{PERM_DELETE, "delete"},
+}
+
+func (p Permission) String() string {
+	names := make([]string, 0, len(permNames))
+	for _, n := range permNames {
+		if p&n.p != 0 {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// ParsePermission reads a permission name, "all" grants every permission
+func ParsePermission(s string) (Permission, bool) {
+	if s == "all" {
+		return PERM_ALL, true
+	}
+	for _, n := range permNames {
+		if n.name == s {
+			return n.p, true
+		}
+	}
+	return 0, false
+}
+
+// ACL_KEYSPACE is the reserved key space holding the rules, it is never reachable through a Guard.
+// The rules are stored as a list at ACL_KEYSPACE + separator + "rules", see EncodeACLRules.
+const ACL_KEYSPACE = "__acl"
+
+var ErrPermissionDenied = errors.New("permission denied")
+
+// PermissionError is returned when a Guard refuses an operation
+type PermissionError struct {
+	Principal string
+	Key       string
+	Perm      Permission
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("%s: %q may not %s %q", ErrPermissionDenied, e.Principal, e.Perm, e.Key)
+}
+
+func (e *PermissionError) Unwrap() error {
+	return ErrPermissionDenied
+}
+
+// ACLRule grants and denies permissions to a principal on the keys matching Pattern. Patterns
+// are split at the separator of the store, "*" matches exactly one segment, "**" any number of
+// segments including none and every other segment is matched with path.Match, so
+// "services.ca-*.**" covers every key below services.ca-east and services.ca-west.
+// A Principal of "*" applies to every principal.
+type ACLRule struct {
+	Principal string
+	Pattern   string
+	Allow     Permission
+	Deny      Permission
+}
+
+// ACL decides what principals may do with the keys of a store. Access is denied unless a rule
+// allows it and no rule denies it. The rules are read from ACL_KEYSPACE of the store and
+// reloaded whenever anything changes there, including when a snapshot is loaded. Rules that
+// fail to decode deny everything until they are fixed, Err reports why.
+type ACL struct {
+	kv     *MemKV
+	mu     sync.RWMutex
+	rules  []ACLRule
+	err    error
+	cancel func()
+}
+
+// NewACL loads the rules stored in kv and follows their changes until Close is called
+func NewACL(kv *MemKV) *ACL {
+	a := &ACL{kv: kv}
+	cancelWatch := kv.AddPrefixWatcherHook(ACL_KEYSPACE, func(e Event) {
+		if e.Success {
+			a.reload()
+		}
+	}, []EventType{E_KEY_CREATED, E_KEY_UPDATED, E_KEY_DELETED})
+	cancelLoad := kv.addLoadHook(a.reload)
+	a.cancel = func() {
+		cancelWatch()
+		cancelLoad()
+	}
+
+	kv.rlock()
+	defer kv.l.RUnlock()
+	a.reload()
+	return a
+}
+
+// reload reads the rules from the store. It runs with the store locked, from hooks dispatched
+// by the change itself, so rules and store never disagree once the change returns.
+func (a *ACL) reload() {
+	v, ok := lookup(a.kv.m, a.kv.split(a.key()))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !ok {
+		a.rules, a.err = nil, nil
+		return
+	}
+	rules, err := DecodeACLRules(v)
+	if err != nil {
+		a.rules, a.err = nil, err
+		return
+	}
+	a.rules, a.err = rules, nil
+}
+
+// key is where the rules are stored, loading a snapshot may change the separator
+func (a *ACL) key() string {
+	return ACL_KEYSPACE + a.kv.sep + "rules"
+}
+
+// Close stops following rule changes, the last rules stay in effect
+func (a *ACL) Close() {
+	a.cancel()
+}
+
+// Err returns why the stored rules could not be decoded
+func (a *ACL) Err() error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.err
+}
+
+// Rules returns the rules in effect
+func (a *ACL) Rules() []ACLRule {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return append([]ACLRule{}, a.rules...)
+}
+
+// SetRules stores rules in the reserved key space, they take effect once the store dispatched the update
+func (a *ACL) SetRules(rules []ACLRule) error {
+	return a.kv.SetE(ACL_KEYSPACE+a.kv.Separator()+"rules", EncodeACLRules(rules))
+}
+
+// Allowed reports whether principal holds every permission of perm on key
+func (a *ACL) Allowed(principal string, key string, perm Permission) bool {
+	key = a.kv.normalize(key)
+	if a.reserved(key) {
+		return false
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var allow, deny Permission
+	for _, r := range a.rules {
+		if r.Principal != "*" && r.Principal != principal {
+			continue
+		}
+		if !matchPattern(a.kv.split(a.kv.normalize(r.Pattern)), a.kv.split(key)) {
+			continue
+		}
+		allow |= r.Allow
+		deny |= r.Deny
+	}
+	return allow&^deny&perm == perm
+}
+
+func (a *ACL) reserved(key string) bool {
+	return key == ACL_KEYSPACE || strings.HasPrefix(key, ACL_KEYSPACE+a.kv.sep)
+}
+
+func matchPattern(pattern []string, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(key); i++ {
+			if matchPattern(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(key) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], key[0]); !ok {
+		return false
+	}
+	return matchPattern(pattern[1:], key[1:])
+}
+
+// EncodeACLRules turns rules into the list stored in ACL_KEYSPACE. Every rule becomes a key
+// space with principal, pattern, allow and deny keys, the last two being lists of permission
+// names such as "read" or "all".
+func EncodeACLRules(rules []ACLRule) []any {
+	out := make([]any, len(rules))
+	names := func(p Permission) []any {
+		l := make([]any, 0)
+		for _, n := range permNames {
+			if p&n.p != 0 {
+				l = append(l, n.name)
+			}
+		}
+		return l
+	}
+	for i, r := range rules {
+		out[i] = map[string]any{
+			"principal": r.Principal,
+			"pattern":   r.Pattern,
+			"allow":     names(r.Allow),
+			"deny":      names(r.Deny),
+		}
+	}
+	return out
+}
+
+// DecodeACLRules reads rules encoded by EncodeACLRules
+func DecodeACLRules(v any) ([]ACLRule, error) {
+	list, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("acl rules must be a list, got %s", typeName(v))
+	}
+	perms := func(i int, field string, v any) (Permission, error) {
+		var p Permission
+		if v == nil {
+			return 0, nil
+		}
+		names, ok := v.([]any)
+		if !ok {
+			return 0, fmt.Errorf("acl rule %d: %s must be a list", i, field)
+		}
+		for _, n := range names {
+			s, _ := n.(string)
+			perm, ok := ParsePermission(s)
+			if !ok {
+				return 0, fmt.Errorf("acl rule %d: unknown permission %v", i, n)
+			}
+			p |= perm
+		}
+		return p, nil
+	}
+	rules := make([]ACLRule, len(list))
+	for i, item := range list {
+		m, ok := item.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("acl rule %d must be a key space", i)
+		}
+		r := &rules[i]
+		if r.Principal, ok = m["principal"].(string); !ok || r.Principal == "" {
+			return nil, fmt.Errorf("acl rule %d: principal must be a non empty string", i)
+		}
+		if r.Pattern, ok = m["pattern"].(string); !ok || r.Pattern == "" {
+			return nil, fmt.Errorf("acl rule %d: pattern must be a non empty string", i)
+		}
+		var err error
+		if r.Allow, err = perms(i, "allow", m["allow"]); err != nil {
+			return nil, err
+		}
+		if r.Deny, err = perms(i, "deny", m["deny"]); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// Guard returns the store as seen by principal
+func (a *ACL) Guard(principal string) *Guard {
+	return &Guard{acl: a, kv: a.kv, principal: principal}
+}
+
+// Guard is a Store that checks every operation of one principal against an ACL. Events of the
+// changes it makes carry the principal, so watchers can tell who made them. Denied
+// operations fail with a *PermissionError and dispatch an event with Success set to false and
+// the error as FailReason, of type E_KEY_ACCESSED for reads and watches, E_KEY_UPDATED for
+// writes and E_KEY_DELETED for deletions. Key spaces returned by Get and listings only contain
+// the keys the principal may read.
+type Guard struct {
+	acl       *ACL
+	kv        *MemKV
+	principal string
+}
+
+var _ Store = (*Guard)(nil)
+
+// Principal returns the principal the guard checks
+func (g *Guard) Principal() string {
+	return g.principal
+}
+
+// denied returns the error refusing perm on key to the principal, nil when it is allowed
+func (g *Guard) denied(key string, perm Permission) error {
+	if g.acl.Allowed(g.principal, key, perm) {
+		return nil
+	}
+	return &PermissionError{Principal: g.principal, Key: key, Perm: perm}
+}
+
+// check returns nil if the principal holds perm on key and otherwise reports the refusal
+func (g *Guard) check(key string, perm Permission) error {
+	err := g.denied(key, perm)
+	if err != nil {
+		g.kv.rlock()
+		defer g.kv.l.RUnlock()
+		g.kv.refused(g.principal, err)
+	}
+	return err
+}
+
+// The checks below look at the current content of the store and run under its lock, in the
+// same critical section as the change they allow.
+
+// checkLeaves checks perm on key and every leaf of val below it
+func (g *Guard) checkLeaves(key string, val any, perm Permission) error {
+	if err := g.denied(key, perm); err != nil {
+		return err
+	}
+	var err error
+	walkLeaves(val, key, g.kv.sep, func(k string, _ any) {
+		if err == nil && k != key {
+			err = g.denied(k, perm)
+		}
+	})
+	return err
+}
+
+// checkWrite checks writing val at key: write permission on key and every leaf of val, and on
+// the leaves already under key that val replaces, write permission for those it sets again and
+// delete permission for those it removes
+func (g *Guard) checkWrite(key string, val any) error {
+	if err := g.checkLeaves(key, val, PERM_WRITE); err != nil {
+		return err
+	}
+	kept := map[string]bool{}
+	walkLeaves(val, key, g.kv.sep, func(k string, _ any) {
+		kept[g.kv.normalize(k)] = true
+	})
+	for _, k := range g.kv.list(key) {
+		perm := PERM_DELETE
+		if kept[g.kv.normalize(k)] {
+			perm = PERM_WRITE
+		}
+		if err := g.denied(k, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMerge is checkWrite for an overwriting merge, where key spaces merged into key spaces keep
+// the keys they do not mention
+func (g *Guard) checkMerge(key string, val any) error {
+	ks, ok := val.(map[string]any)
+	cur, _ := lookup(g.kv.m, g.kv.split(key))
+	if _, isKs := cur.(map[string]any); !ok || !isKs {
+		return g.checkWrite(key, val)
+	}
+	if err := g.denied(key, PERM_WRITE); err != nil {
+		return err
+	}
+	for k, v := range ks {
+		if err := g.checkMerge(joinKey(key, g.kv.normalize(k), g.kv.sep), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDrop checks delete permission on key and, when deleteKeySpaces is set, every leaf below it
+func (g *Guard) checkDrop(key string, deleteKeySpaces bool) error {
+	if err := g.denied(key, PERM_DELETE); err != nil {
+		return err
+	}
+	if !deleteKeySpaces {
+		return nil
+	}
+	for _, k := range g.kv.list(key) {
+		if err := g.denied(k, PERM_DELETE); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *Guard) Separator() string {
+	return g.kv.Separator()
+}
+
+func (g *Guard) NormalizeKey(key string) string {
+	return g.kv.NormalizeKey(key)
+}
+
+// GetE is Get returning a *PermissionError when the key may not be read
+func (g *Guard) GetE(key string) (any, error) {
+	if err := g.check(key, PERM_READ); err != nil {
+		return nil, err
+	}
+	v, ok := g.kv.Get(key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if ks, isKs := v.(map[string]any); isKs {
+		return g.filter(ks, g.kv.normalize(key)), nil
+	}
+	return v, nil
+}
+
+// filter removes the keys of ks the principal may not read
+func (g *Guard) filter(ks map[string]any, key string) map[string]any {
+	out := make(map[string]any, len(ks))
+	for k, v := range ks {
+		child := joinKey(key, k, g.kv.sep)
+		if sub, ok := v.(map[string]any); ok {
+			if f := g.filter(sub, child); len(f) > 0 {
+				out[k] = f
+			}
+			continue
+		}
+		if g.acl.Allowed(g.principal, child, PERM_READ) {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func (g *Guard) Get(key string) (any, bool) {
+	v, err := g.GetE(key)
+	return v, err == nil
+}
+
+// SetE is Set returning why the value was refused. Setting a key space requires write
+// permission on every leaf it contains, replacing one requires delete permission on every leaf
+// it loses.
+func (g *Guard) SetE(key string, val any) error {
+	return g.kv.setAs(g.principal, key, val, func() error {
+		return g.checkWrite(g.kv.normalize(key), val)
+	})
+}
+
+func (g *Guard) Set(key string, val any) bool {
+	return g.SetE(key, val) == nil
+}
+
+func (g *Guard) Contains(key string) bool {
+	return g.acl.Allowed(g.principal, key, PERM_READ) && g.kv.Contains(key)
+}
+
+// DropE is Drop returning why the key was not deleted. Deleting a key space requires delete
+// permission on every leaf below it.
+func (g *Guard) DropE(key string, deleteKeySpaces bool) error {
+	return g.kv.dropAs(g.principal, key, deleteKeySpaces, func() error {
+		return g.checkDrop(g.kv.normalize(key), deleteKeySpaces)
+	})
+}
+
+func (g *Guard) Drop(key string, deleteKeySpaces bool) bool {
+	return g.DropE(key, deleteKeySpaces) == nil
+}
+
+func (g *Guard) IsKeySpace(key string) bool {
+	return g.acl.Allowed(g.principal, key, PERM_READ) && g.kv.IsKeySpace(key)
+}
+
+// List returns the keys under prefix the principal may read
+func (g *Guard) List(prefix string) []string {
+	keys := g.kv.List(prefix)
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if g.acl.Allowed(g.principal, k, PERM_READ) {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// Commit checks every operation of txn before applying it, checks need read permission
+func (g *Guard) Commit(txn *Txn) error {
+	return g.kv.commitAs(g.principal, txn, func() error {
+		for i, op := range txn.ops {
+			key := g.kv.normalize(op.Key)
+			var err error
+			switch op.Type {
+			case OP_SET:
+				err = g.checkWrite(key, op.Val)
+			case OP_DROP:
+				err = g.checkDrop(key, op.DeleteKeySpaces)
+			default:
+				err = g.denied(key, PERM_READ)
+			}
+			if err != nil {
+				return fmt.Errorf("op %d on %q: %w", i, op.Key, err)
+			}
+		}
+		return nil
+	})
+}
+
+// AddWatcherHookE is AddWatcherHook returning a *PermissionError when key may not be watched
+func (g *Guard) AddWatcherHookE(key string, hook WatchHook, eFilter []EventType) (func(), error) {
+	if err := g.check(key, PERM_WATCH); err != nil {
+		return func() {}, err
+	}
+	return g.kv.AddWatcherHook(key, g.wrap(hook), eFilter), nil
+}
+
+// AddPrefixWatcherHookE is AddPrefixWatcherHook returning a *PermissionError when prefix may not
+// be watched. Only events on keys the principal may watch are delivered.
+func (g *Guard) AddPrefixWatcherHookE(prefix string, hook WatchHook, eFilter []EventType) (func(), error) {
+	if err := g.check(prefix, PERM_WATCH); err != nil {
+		return func() {}, err
+	}
+	return g.kv.AddPrefixWatcherHook(prefix, g.wrap(hook), eFilter), nil
+}
+
+func (g *Guard) AddWatcherHook(key string, hook WatchHook, eFilter []EventType) func() {
+	cancel, _ := g.AddWatcherHookE(key, hook, eFilter)
+	return cancel
+}
+
+func (g *Guard) AddPrefixWatcherHook(prefix string, hook WatchHook, eFilter []EventType) func() {
+	cancel, _ := g.AddPrefixWatcherHookE(prefix, hook, eFilter)
+	return cancel
+}
+
+func (g *Guard) wrap(hook WatchHook) WatchHook {
+	return func(e Event) {
+		if g.acl.Allowed(g.principal, e.Key, PERM_WATCH) {
+			hook(e)
+		}
+	}
+}
+
+// ImportMap needs write permission on every leaf of data and delete permission on every existing
+// leaf the merge removes
+func (g *Guard) ImportMap(data map[string]any) error {
+	return g.kv.mergeAs(g.principal, data, MERGE_OVERWRITE, func() error {
+		for k, v := range data {
+			if err := g.checkMerge(g.kv.normalize(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetSerializableMap returns a snapshot of the keys the principal may read
+func (g *Guard) GetSerializableMap() map[string]any {
+	snap := g.kv.GetSerializableMap()
+	snap["__data"] = g.filter(snap["__data"].(map[string]any), "")
+	return snap
+}
+
+// LoadFromSerializableMap always fails, replacing the whole store including the rules is
+// reserved to the unguarded store
+func (g *Guard) LoadFromSerializableMap(map[string]any) error {
+	return g.check(ACL_KEYSPACE, PERM_WRITE|PERM_DELETE)
+}
+
+// authorize runs check for a change made by principal, the lock must be held for the change
+func (m *MemKV) authorize(principal string, check func() error) error {
+	if check == nil {
+		return nil
+	}
+	err := check()
+	if err != nil {
+		m.refused(principal, err)
+	}
+	return err
+}
+
+// refused tells the watchers of the key err is about that an operation on it was refused, the
+// lock must be held. Events are of type E_KEY_ACCESSED for reads and watches, E_KEY_UPDATED for
+// writes and E_KEY_DELETED for deletions.
+func (m *MemKV) refused(principal string, err error) {
+	var perr *PermissionError
+	if !errors.As(err, &perr) {
+		return
+	}
+	t := EventType(E_KEY_ACCESSED)
+	switch {
+	case perr.Perm&PERM_DELETE != 0:
+		t = E_KEY_DELETED
+	case perr.Perm&PERM_WRITE != 0:
+		t = E_KEY_UPDATED
+	}
+	m.dispatchWatchers(Event{
+		Key:        m.normalize(perr.Key),
+		Type:       t,
+		When:       time.Now(),
+		Success:    false,
+		FailReason: perr.Error(),
+		Principal:  principal,
+	})
+}
@@ -0,0 +1,281 @@
+package memkv
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"slices"
+	"time"
+)
+
+var (
+	ErrWrongType = errors.New("value has the wrong type for the operation")
+	ErrOverflow  = errors.New("integer overflow")
+	ErrEmptyList = errors.New("list is empty")
+
+	// errUnchanged makes update keep the current value without dispatching an event
+	errUnchanged = errors.New("unchanged")
+)
+
+// update atomically replaces the value at key with the one fn computes from the current value,
+// exists is false when key is missing. The usual created or updated event is dispatched.
+func (m *MemKV) update(key string, fn func(cur any, exists bool) (any, error)) error {
+	m.lock()
+	defer m.l.Unlock()
+	spelled := spellDraft{}
+	key = m.spell(spelled, m.m, key)
+	path := m.split(key)
+	cur, exists := lookup(m.m, path)
+	if _, isKs := cur.(map[string]any); isKs {
+		return ErrIsKeySpace
+	}
+	next, err := fn(cur, exists)
+	if errors.Is(err, errUnchanged) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	root, e, err := m.mutate(key, func(root map[string]any) (Event, error) {
+		return setIn(root, path, next)
+	})
+	if err != nil {
+		return err
+	}
+	m.m = root
+	m.install(spelled)
+	e.Key = key
+	// next usually shares elements with the replaced value, hooks get copies of both
+	e.OldVal = DeepCopy(e.OldVal)
+	e.NewVal = DeepCopy(next)
+	m.dispatchWatchers(e)
+	return nil
+}
+
+// Add atomically adds delta to the integer at key and returns the result. A missing key counts
+// as zero and is created as an int64, otherwise the value keeps its type. Any integer type is
+// accepted, as are floats holding an integer since JSON decodes numbers that way.
+func (m *MemKV) Add(key string, delta int64) (int64, error) {
+	var n int64
+	err := m.update(key, func(cur any, exists bool) (any, error) {
+		if !exists {
+			n = delta
+			return n, nil
+		}
+		next, sum, err := addInt(cur, delta)
+		n = sum
+		return next, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Incr atomically adds one to the integer at key, see Add
+func (m *MemKV) Incr(key string) (int64, error) {
+	return m.Add(key, 1)
+}
+
+// Decr atomically subtracts one from the integer at key, see Add
+func (m *MemKV) Decr(key string) (int64, error) {
+	return m.Add(key, -1)
+}
+
+func addInt(v any, delta int64) (any, int64, error) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return nil, 0, ErrWrongType
+	}
+	var n int64
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if rv.Uint() > math.MaxInt64 {
+			return nil, 0, ErrOverflow
+		}
+		n = int64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if f != math.Trunc(f) || f > math.MaxInt64 || f < math.MinInt64 {
+			return nil, 0, ErrWrongType
+		}
+		n = int64(f)
+	default:
+		return nil, 0, ErrWrongType
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return nil, 0, ErrOverflow
+	}
+	n += delta
+	out := reflect.New(rv.Type()).Elem()
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if out.OverflowInt(n) {
+			return nil, 0, ErrOverflow
+		}
+		out.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		out.SetFloat(float64(n))
+	default:
+		if n < 0 || out.OverflowUint(uint64(n)) {
+			return nil, 0, ErrOverflow
+		}
+		out.SetUint(uint64(n))
+	}
+	return out.Interface(), n, nil
+}
+
+// list returns the []any at a key as a fresh slice that may be modified
+func list(cur any, exists bool) ([]any, error) {
+	if !exists {
+		return []any{}, nil
+	}
+	l, ok := cur.([]any)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return append(make([]any, 0, len(l)+1), l...), nil
+}
+
+// Push atomically appends vals to the list at key and returns its new length. A missing key is
+// created as an empty list, any other value than a []any is refused with ErrWrongType.
+func (m *MemKV) Push(key string, vals ...any) (int, error) {
+	var n int
+	err := m.update(key, func(cur any, exists bool) (any, error) {
+		l, err := list(cur, exists)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vals {
+			l = append(l, DeepCopy(v))
+		}
+		n = len(l)
+		return l, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Pop atomically removes the last element of the list at key and returns it
+func (m *MemKV) Pop(key string) (any, error) {
+	var last any
+	err := m.update(key, func(cur any, exists bool) (any, error) {
+		if !exists {
+			return nil, ErrNotFound
+		}
+		l, err := list(cur, exists)
+		if err != nil {
+			return nil, err
+		}
+		if len(l) == 0 {
+			return nil, ErrEmptyList
+		}
+		last = l[len(l)-1]
+		return slices.Delete(l, len(l)-1, len(l)), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return DeepCopy(last), nil
+}
+
+// Range returns a copy of the elements start up to but excluding end of the list at key.
+// Negative indexes count from the end of the list and both bounds are clamped to it, so
+// Range(key, 0, -1) drops the last element and Range(key, -3, math.MaxInt) returns the last three.
+func (m *MemKV) Range(key string, start int, end int) ([]any, error) {
+	m.rlock()
+	defer m.l.RUnlock()
+	key = m.normalize(key)
+	cur, exists := lookup(m.m, m.split(key))
+	if !exists {
+		return nil, ErrNotFound
+	}
+	l, ok := cur.([]any)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	clamp := func(i int) int {
+		if i < 0 {
+			i += len(l)
+		}
+		return max(0, min(i, len(l)))
+	}
+	start, end = clamp(start), clamp(end)
+	m.dispatchWatchers(Event{Key: key, Type: E_KEY_ACCESSED, When: time.Now(), Success: true})
+	if start >= end {
+		return []any{}, nil
+	}
+	return DeepCopy(l[start:end]).([]any), nil
+}
+
+// SAdd atomically adds the members missing from the set at key and returns how many were added.
+// Sets are stored as []any without duplicates, members are compared with reflect.DeepEqual.
+func (m *MemKV) SAdd(key string, members ...any) (int, error) {
+	added := 0
+	err := m.update(key, func(cur any, exists bool) (any, error) {
+		l, err := list(cur, exists)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range members {
+			if indexOf(l, v) < 0 {
+				l = append(l, DeepCopy(v))
+				added++
+			}
+		}
+		if added == 0 && exists {
+			return nil, errUnchanged
+		}
+		return l, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+// SRem atomically removes members from the set at key and returns how many were removed
+func (m *MemKV) SRem(key string, members ...any) (int, error) {
+	removed := 0
+	err := m.update(key, func(cur any, exists bool) (any, error) {
+		if !exists {
+			return nil, ErrNotFound
+		}
+		l, err := list(cur, exists)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range members {
+			if i := indexOf(l, v); i >= 0 {
+				l = append(l[:i], l[i+1:]...)
+				removed++
+			}
+		}
+		if removed == 0 {
+			return nil, errUnchanged
+		}
+		return l, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// SMembers returns a copy of the members of the set at key in insertion order
+func (m *MemKV) SMembers(key string) ([]any, error) {
+	return m.Range(key, 0, math.MaxInt)
+}
+
+func indexOf(l []any, v any) int {
+	for i, e := range l {
+		if reflect.DeepEqual(e, v) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,272 @@
+// Package audit keeps a tamper evident log of MemKV events.
+//
+// The log is a stream of JSON lines, each holding either an entry or a checkpoint. Every entry
+// records one event and the SHA-256 hash of the entry before it, its own hash covers both, so
+// changing, dropping or reordering entries breaks the chain. Checkpoints sign the hash of the
+// latest entry with Ed25519, tying the chain to the holder of the signing key. Closing a log
+// writes a final checkpoint, a log that does not end with one has been cut short or is still
+// being written.
+package audit
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/xadaemon/libprisma/cryptoutil/pkcrypto"
+	"github.com/xadaemon/libprisma/memkv"
+)
+
+// Entry is one audited event. Values are stored as the JSON they encoded to when recorded.
+type Entry struct {
+	Seq        uint64          `json:"seq"`
+	Time       time.Time       `json:"time"`
+	Key        string          `json:"key"`
+	Type       string          `json:"type"`
+	Success    bool            `json:"success"`
+	FailReason string          `json:"failReason,omitempty"`
+	Principal  string          `json:"principal,omitempty"`
+	OldVal     json.RawMessage `json:"oldVal,omitempty"`
+	NewVal     json.RawMessage `json:"newVal,omitempty"`
+	Prev       []byte          `json:"prev"`
+	Hash       []byte          `json:"hash"`
+}
+
+// digest returns the hash the entry must carry, computed over every other field
+func (e *Entry) digest() ([]byte, error) {
+	body := *e
+	body.Hash = nil
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
+
+// Checkpoint signs the hash of entry Seq, Seq is zero for a checkpoint of an empty log
+type Checkpoint struct {
+	Seq       uint64    `json:"seq"`
+	Hash      []byte    `json:"hash"`
+	Time      time.Time `json:"time"`
+	Final     bool      `json:"final,omitempty"`
+	Signature []byte    `json:"signature"`
+}
+
+// message returns what the signature of the checkpoint covers
+func (c *Checkpoint) message() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("memkv-audit-checkpoint\x00")
+	_ = binary.Write(&buf, binary.BigEndian, c.Seq)
+	_ = binary.Write(&buf, binary.BigEndian, c.Time.UnixNano())
+	if c.Final {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	buf.Write(c.Hash)
+	return buf.Bytes()
+}
+
+// Record is one line of the log
+type Record struct {
+	Entry      *Entry      `json:"entry,omitempty"`
+	Checkpoint *Checkpoint `json:"checkpoint,omitempty"`
+}
+
+type Opts struct {
+	// CheckpointEvery writes a checkpoint after that many entries, 0 means 100 and -1 disables it
+	CheckpointEvery int
+	// Events selects the audited event types, by default every change and every refused operation
+	Events []memkv.EventType
+}
+
+var ErrClosed = errors.New("audit log is closed")
+
+// Log appends events to w. It is safe for concurrent use.
+type Log struct {
+	mu      sync.Mutex
+	w       io.Writer
+	key     crypto.PrivateKey
+	opts    Opts
+	seq     uint64
+	prev    []byte
+	pending int
+	err     error
+	closed  bool
+}
+
+// New starts a log on w signing checkpoints with key, a *pkcrypto.Ed25519PrivateKey as returned by
+// pkcrypto.Ed25519.NewKey or a plain ed25519.PrivateKey.
+// Use Resume to continue an existing log.
+func New(w io.Writer, key crypto.PrivateKey, opts *Opts) *Log {
+	l := &Log{w: w, key: key, prev: make([]byte, sha256.Size)}
+	if opts != nil {
+		l.opts = *opts
+	}
+	if l.opts.CheckpointEvery == 0 {
+		l.opts.CheckpointEvery = 100
+	}
+	if l.opts.Events == nil {
+		l.opts.Events = []memkv.EventType{memkv.E_KEY_CREATED, memkv.E_KEY_UPDATED, memkv.E_KEY_ACCESSED, memkv.E_KEY_DELETED}
+	}
+	return l
+}
+
+// Resume continues the log read from r, which must verify against pub and not be sealed by a
+// final checkpoint. New entries are appended to w, usually the same file opened for appending.
+func Resume(r io.Reader, pub crypto.PublicKey, w io.Writer, key crypto.PrivateKey, opts *Opts) (*Log, error) {
+	rep, err := Verify(r, pub, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rep.Sealed {
+		return nil, ErrClosed
+	}
+	l := New(w, key, opts)
+	l.seq = rep.Entries
+	if rep.Head != nil {
+		l.prev = rep.Head
+	}
+	l.pending = rep.Unsigned
+	return l, nil
+}
+
+// Attach audits the events of store below prefix until the returned function is called.
+// Successful reads are not audited, refused ones are.
+func (l *Log) Attach(store memkv.Store, prefix string) func() {
+	return store.AddPrefixWatcherHook(prefix, func(e memkv.Event) {
+		if e.Type == memkv.E_KEY_ACCESSED && e.Success {
+			return
+		}
+		_ = l.Append(e)
+	}, l.opts.Events)
+}
+
+// Err returns the first error that happened while appending events from Attach
+func (l *Log) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// Append records e, followed by a checkpoint when one is due
+func (l *Log) Append(e memkv.Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	if l.err != nil {
+		return l.err
+	}
+	entry := &Entry{
+		Seq:        l.seq + 1,
+		Time:       e.When.UTC(),
+		Key:        e.Key,
+		Type:       e.Type.String(),
+		Success:    e.Success,
+		FailReason: e.FailReason,
+		Principal:  e.Principal,
+		OldVal:     encodeValue(e.OldVal),
+		NewVal:     encodeValue(e.NewVal),
+		Prev:       l.prev,
+	}
+	hash, err := entry.digest()
+	if err != nil {
+		return l.fail(err)
+	}
+	entry.Hash = hash
+	if err := l.write(Record{Entry: entry}); err != nil {
+		return err
+	}
+	l.seq++
+	l.prev = hash
+	l.pending++
+	if l.opts.CheckpointEvery > 0 && l.pending >= l.opts.CheckpointEvery {
+		return l.checkpoint(false)
+	}
+	return nil
+}
+
+// encodeValue turns v into JSON, values JSON cannot represent are recorded as their %v form
+func encodeValue(v any) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprintf("%v", v))
+	}
+	return data
+}
+
+// Checkpoint signs the current head of the chain
+func (l *Log) Checkpoint() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.checkpoint(false)
+}
+
+// Close seals the log with a final checkpoint, later appends fail with ErrClosed
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	return l.checkpoint(true)
+}
+
+func (l *Log) checkpoint(final bool) error {
+	if l.err != nil {
+		return l.err
+	}
+	switch l.key.(type) {
+	case *pkcrypto.Ed25519PrivateKey, ed25519.PrivateKey:
+	default:
+		return l.fail(fmt.Errorf("audit logs are signed with an Ed25519 private key, got %T", l.key))
+	}
+	c := &Checkpoint{Seq: l.seq, Hash: l.prev, Time: time.Now().UTC(), Final: final}
+	sig, err := pkcrypto.Ed25519.Sign(l.key, c.message(), sha256.New)
+	if err != nil {
+		return l.fail(err)
+	}
+	c.Signature = sig
+	if err := l.write(Record{Checkpoint: c}); err != nil {
+		return err
+	}
+	l.pending = 0
+	return nil
+}
+
+func (l *Log) write(r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return l.fail(err)
+	}
+	if _, err := l.w.Write(append(data, '\n')); err != nil {
+		return l.fail(err)
+	}
+	return nil
+}
+
+// fail remembers err, a log that failed to write stops appending since its chain is in doubt
+func (l *Log) fail(err error) error {
+	if l.err == nil {
+		l.err = err
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package audit_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/xadaemon/libprisma/cryptoutil/pkcrypto"
+	"github.com/xadaemon/libprisma/memkv"
+	"github.com/xadaemon/libprisma/memkv/audit"
+)
+
+func auditedLog(t *testing.T) (string, ed25519.PublicKey) {
+	t.Helper()
+	key := pkcrypto.Ed25519.NewKey().(*pkcrypto.Ed25519PrivateKey)
+	var buf bytes.Buffer
+	log := audit.New(&buf, key, &audit.Opts{CheckpointEvery: 2})
+
+	kv := memkv.NewMemKV(".", nil)
+	acl := memkv.NewACL(kv)
+	defer acl.Close()
+	if err := acl.SetRules([]memkv.ACLRule{{Principal: "admin", Pattern: "ca.**", Allow: memkv.PERM_ALL}}); err != nil {
+		t.Fatal(err)
+	}
+	cancel := log.Attach(kv, "ca")
+	admin := acl.Guard("admin")
+	admin.Set("ca.ttl", 10)
+	admin.Set("ca.ttl", 20)
+	admin.Set("ca.issuer", "root")
+	admin.Drop("ca.issuer", false)
+	acl.Guard("intruder").Set("ca.ttl", 0)
+	cancel()
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String(), key.Public().(ed25519.PublicKey)
+}
+
+func TestVerify(t *testing.T) {
+	data, pub := auditedLog(t)
+	rep, err := audit.Verify(strings.NewReader(data), pub, &audit.VerifyOpts{RequireSealed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Entries != 5 || !rep.Sealed || rep.Unsigned != 0 {
+		t.Errorf("Unexpected report %+v", rep)
+	}
+	if !strings.Contains(data, `"principal":"admin"`) || !strings.Contains(data, `"principal":"intruder"`) {
+		t.Error("Principals were not recorded")
+	}
+
+	lines := strings.Split(strings.TrimSpace(data), "\n")
+	otherPub := pkcrypto.Ed25519.NewKey().(*pkcrypto.Ed25519PrivateKey).Public()
+	tests := []struct {
+		Name string
+		Log  []string
+		Pub  any
+		Err  error
+	}{
+		{"Edited", append([]string{strings.Replace(lines[0], "10", "11", 1)}, lines[1:]...), pub, audit.ErrChain},
+		{"Reordered", append([]string{lines[1], lines[0]}, lines[2:]...), pub, audit.ErrSequence},
+		{"Entry Removed", append(append([]string{}, lines[:3]...), lines[4:]...), pub, audit.ErrSequence},
+		{"Truncated", lines[:len(lines)-2], pub, audit.ErrTruncated},
+		{"Wrong Key", lines, otherPub, audit.ErrSignature},
+		{"Appended", append(append([]string{}, lines...), lines[0]), pub, audit.ErrAfterSealing},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			_, err := audit.Verify(strings.NewReader(strings.Join(test.Log, "\n")), test.Pub, &audit.VerifyOpts{RequireSealed: true})
+			var verr *audit.VerifyError
+			if !errors.Is(err, test.Err) || !errors.As(err, &verr) {
+				t.Errorf("Got %v, want %v", err, test.Err)
+			}
+		})
+	}
+}
+
+func TestResume(t *testing.T) {
+	key := pkcrypto.Ed25519.NewKey().(*pkcrypto.Ed25519PrivateKey)
+	pub := key.Public()
+	var buf bytes.Buffer
+	log := audit.New(&buf, key, nil)
+	log.Append(memkv.Event{Key: "a", Type: memkv.E_KEY_CREATED, Success: true, NewVal: 1})
+	if err := log.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	anchor, err := audit.Verify(bytes.NewReader(buf.Bytes()), pub, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resumed, err := audit.Resume(bytes.NewReader(buf.Bytes()), pub, &buf, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed.Append(memkv.Event{Key: "a", Type: memkv.E_KEY_UPDATED, Success: true, OldVal: 1, NewVal: 2})
+	resumed.Close()
+	rep, err := audit.Verify(bytes.NewReader(buf.Bytes()), pub, &audit.VerifyOpts{RequireSealed: true, Anchor: anchor.LastCheckpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Entries != 2 {
+		t.Errorf("Resumed log has %d entries", rep.Entries)
+	}
+}
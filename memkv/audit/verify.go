@@ -0,0 +1,155 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/xadaemon/libprisma/cryptoutil/pkcrypto"
+)
+
+var (
+	ErrMalformed    = errors.New("malformed audit record")
+	ErrSequence     = errors.New("entry out of sequence")
+	ErrChain        = errors.New("hash chain broken")
+	ErrSignature    = errors.New("invalid checkpoint signature")
+	ErrTruncated    = errors.New("audit log truncated")
+	ErrAfterSealing = errors.New("records after the final checkpoint")
+)
+
+// VerifyError locates the first problem found in a log, Line counts from 1
+type VerifyError struct {
+	Line int
+	Seq  uint64
+	Err  error
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("line %d, entry %d: %v", e.Line, e.Seq, e.Err)
+}
+
+func (e *VerifyError) Unwrap() error {
+	return e.Err
+}
+
+type VerifyOpts struct {
+	// RequireSealed refuses logs that do not end with a final checkpoint
+	RequireSealed bool
+	// Anchor is a checkpoint kept outside the log, the log must contain the entry it signs
+	Anchor *Checkpoint
+}
+
+// Report describes a log that verified
+type Report struct {
+	// Entries is the number of entries
+	Entries uint64
+	// Head is the hash of the last entry
+	Head []byte
+	// LastCheckpoint is the last valid checkpoint
+	LastCheckpoint *Checkpoint
+	// Unsigned counts the entries after the last checkpoint, nothing proves they were not cut off
+	Unsigned int
+	// Sealed is set when the log ends with a final checkpoint
+	Sealed bool
+}
+
+// Verify reads a log from r and checks the chain of every entry and the signature of every
+// checkpoint against pub, an ed25519.PublicKey. Edits and reordering show up as ErrChain or
+// ErrSequence, removed tails as ErrTruncated when opts demands a seal or an anchor.
+func Verify(r io.Reader, pub crypto.PublicKey, opts *VerifyOpts) (*Report, error) {
+	if _, ok := pub.(ed25519.PublicKey); !ok {
+		return nil, fmt.Errorf("audit logs are verified with an ed25519.PublicKey, got %T", pub)
+	}
+	if opts == nil {
+		opts = &VerifyOpts{}
+	}
+	rep := &Report{}
+	prev := make([]byte, sha256.Size)
+	// the hash of the entry the anchor signs, once it was read
+	var anchored []byte
+	if opts.Anchor != nil && opts.Anchor.Seq == 0 {
+		anchored = prev
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	line := 0
+	fail := func(err error) (*Report, error) {
+		return nil, &VerifyError{Line: line, Seq: rep.Entries, Err: err}
+	}
+	for sc.Scan() {
+		line++
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		if rep.Sealed {
+			return fail(ErrAfterSealing)
+		}
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return fail(fmt.Errorf("%w: %w", ErrMalformed, err))
+		}
+		switch {
+		case rec.Entry != nil && rec.Checkpoint == nil:
+			e := rec.Entry
+			if e.Seq != rep.Entries+1 {
+				return fail(fmt.Errorf("%w: expected %d, got %d", ErrSequence, rep.Entries+1, e.Seq))
+			}
+			if !bytes.Equal(e.Prev, prev) {
+				return fail(fmt.Errorf("%w: entry does not follow the previous one", ErrChain))
+			}
+			sum, err := e.digest()
+			if err != nil {
+				return fail(fmt.Errorf("%w: %w", ErrMalformed, err))
+			}
+			if !bytes.Equal(sum, e.Hash) {
+				return fail(fmt.Errorf("%w: entry was modified", ErrChain))
+			}
+			rep.Entries++
+			rep.Unsigned++
+			prev = e.Hash
+			if opts.Anchor != nil && opts.Anchor.Seq == e.Seq {
+				anchored = e.Hash
+			}
+		case rec.Checkpoint != nil && rec.Entry == nil:
+			c := rec.Checkpoint
+			if c.Seq != rep.Entries || !bytes.Equal(c.Hash, prev) {
+				return fail(fmt.Errorf("%w: checkpoint does not sign the preceding entry", ErrChain))
+			}
+			digest := sha256.Sum256(c.message())
+			if ok, err := pkcrypto.Ed25519.Verify(pub, c.Signature, digest[:]); err != nil || !ok {
+				return fail(ErrSignature)
+			}
+			rep.LastCheckpoint = c
+			rep.Unsigned = 0
+			rep.Sealed = c.Final
+		default:
+			return fail(fmt.Errorf("%w: record must hold exactly one entry or checkpoint", ErrMalformed))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fail(err)
+	}
+	if opts.RequireSealed && !rep.Sealed {
+		return fail(fmt.Errorf("%w: no final checkpoint", ErrTruncated))
+	}
+	if a := opts.Anchor; a != nil {
+		digest := sha256.Sum256(a.message())
+		if ok, err := pkcrypto.Ed25519.Verify(pub, a.Signature, digest[:]); err != nil || !ok {
+			return fail(fmt.Errorf("anchor: %w", ErrSignature))
+		}
+		if anchored == nil {
+			return fail(fmt.Errorf("%w: anchor signs entry %d", ErrTruncated, a.Seq))
+		}
+		if !bytes.Equal(anchored, a.Hash) {
+			return fail(fmt.Errorf("%w: anchor does not match entry %d", ErrChain, a.Seq))
+		}
+	}
+	rep.Head = prev
+	return rep, nil
+}
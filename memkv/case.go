@@ -0,0 +1,159 @@
+package memkv
+
+import "strings"
+
+// Case preserving stores look keys up case insensitively like any case insensitive store, the
+// tree only ever holds normalized keys. Next to it they keep how each key was first written,
+// spelling maps the normalized full path of a key to the spelling of its last segment whenever
+// that differs from the normalized one. Listings, copies and snapshots are translated back with
+// it, everything else, events and queries included, works on normalized keys.
+
+// spellDraft collects the spelling changes of a write, an empty spelling removes the entry.
+// Writes fill it while they build their new root and install both together once they
+// succeeded, so failed writes leave spelling untouched.
+type spellDraft map[string]string
+
+// install applies the changes of d to the spellings of m
+func (m *MemKV) install(d spellDraft) {
+	for k, spelled := range d {
+		if spelled == "" {
+			delete(m.spelling, k)
+		} else {
+			m.spelling[k] = spelled
+		}
+	}
+}
+
+// spell normalizes the key of a write and, in case preserving stores, records in d how each of
+// its segments was written. Keys already present in root keep their spelling, so the first
+// spelling wins until the key is deleted.
+func (m *MemKV) spell(d spellDraft, root map[string]any, key string) string {
+	norm := m.normalize(key)
+	if !m.preserveCase {
+		return norm
+	}
+	raw, segs := m.split(key), m.split(norm)
+	if len(raw) != len(segs) {
+		return norm
+	}
+	var node any = root
+	for i, s := range segs {
+		if ks, ok := node.(map[string]any); ok {
+			if child, exists := ks[s]; exists {
+				node = child
+				continue
+			}
+		}
+		node = nil
+		p := strings.Join(segs[:i+1], m.sep)
+		if raw[i] != s {
+			d[p] = raw[i]
+		} else {
+			d[p] = ""
+		}
+	}
+	return norm
+}
+
+// spellTree remembers the spelling of every key below key in v, key is not normalized yet
+func (m *MemKV) spellTree(d spellDraft, root map[string]any, key string, v any) {
+	ks, ok := v.(map[string]any)
+	if !ok || !m.preserveCase {
+		return
+	}
+	for k, child := range ks {
+		full := joinKey(key, k, m.sep)
+		m.spell(d, root, full)
+		m.spellTree(d, root, full, child)
+	}
+}
+
+// forget records in d that the spellings of key and every key below it are dropped
+func (m *MemKV) forget(d spellDraft, key string) {
+	for k := range m.spelling {
+		if m.underPrefix(k, key) {
+			d[k] = ""
+		}
+	}
+	for k := range d {
+		if m.underPrefix(k, key) {
+			d[k] = ""
+		}
+	}
+}
+
+// display returns the normalized key as it was first written
+func (m *MemKV) display(key string) string {
+	if len(m.spelling) == 0 || key == "" {
+		return key
+	}
+	segs := m.split(key)
+	out := make([]string, len(segs))
+	for i, s := range segs {
+		out[i] = s
+		if d, ok := m.spelling[strings.Join(segs[:i+1], m.sep)]; ok {
+			out[i] = d
+		}
+	}
+	return strings.Join(out, m.sep)
+}
+
+// displayTree returns v, stored at the normalized key, with the key spaces below it copied
+// and their keys spelled as first written. Leaf values are shared with v.
+func (m *MemKV) displayTree(v any, key string) any {
+	ks, ok := v.(map[string]any)
+	if !ok || len(m.spelling) == 0 {
+		return v
+	}
+	out := make(map[string]any, len(ks))
+	for k, child := range ks {
+		full := joinKey(key, k, m.sep)
+		name := k
+		if d, ok := m.spelling[full]; ok {
+			name = d
+		}
+		out[name] = m.displayTree(child, full)
+	}
+	return out
+}
+
+// DisplayKey returns key as it was first written in a case preserving store and the
+// normalized key otherwise
+func (m *MemKV) DisplayKey(key string) string {
+	m.rlock()
+	defer m.l.RUnlock()
+	return m.display(m.normalize(key))
+}
+
+// NormalizeKey returns key the way the store compares it and reports it in events, lower cased
+// in case insensitive stores and unchanged otherwise
+func (m *MemKV) NormalizeKey(key string) string {
+	m.rlock()
+	defer m.l.RUnlock()
+	return m.normalize(key)
+}
+
+// collectSpelling lower cases the keys of a snapshot written by a case preserving store and
+// returns the spelling of every key that differs from its normalized form
+func collectSpelling(data map[string]any, sep string) (map[string]any, map[string]string, error) {
+	lowered := map[string]any{}
+	if err := mergeInto(lowered, data, nil, MERGE_ERROR, sep, strings.ToLower, nil); err != nil {
+		return nil, nil, err
+	}
+	spelling := map[string]string{}
+	var walk func(ks map[string]any, path string)
+	walk = func(ks map[string]any, path string) {
+		for k, v := range ks {
+			norm := strings.ToLower(k)
+			full := joinKey(path, norm, sep)
+			if _, seen := spelling[full]; !seen && norm != k {
+				spelling[full] = k
+			}
+			if child, ok := v.(map[string]any); ok {
+				walk(child, full)
+			}
+		}
+	}
+	walk(data, "")
+	return lowered, spelling, nil
+}
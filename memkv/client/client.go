@@ -0,0 +1,301 @@
+// Package client talks to a MemKV exposed by the server package and implements memkv.Store on top of it.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/xadaemon/libprisma/memkv"
+	"github.com/xadaemon/libprisma/memkv/server"
+)
+
+// Client is a memkv.Store backed by a remote server. Methods of the memkv.Store interface that
+// cannot return an error report transport failures to OnError and behave as if the key was missing.
+type Client struct {
+	base string
+	hc   *http.Client
+	sep  string
+	once sync.Once
+	// OnError is called with the failing operation and its error, it may be nil
+	OnError func(op string, err error)
+}
+
+var _ memkv.Store = (*Client)(nil)
+
+// New returns a client for the server at baseURL, if hc is nil http.DefaultClient is used
+func New(baseURL string, hc *http.Client) *Client {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return &Client{
+		base: strings.TrimSuffix(baseURL, "/"),
+		hc:   hc,
+	}
+}
+
+// StatusError is returned when the server answers with an unexpected status
+type StatusError struct {
+	Status  int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("memkv server returned %d: %s", e.Status, e.Message)
+}
+
+func (c *Client) report(op string, err error) {
+	if c.OnError != nil {
+		c.OnError(op, err)
+	}
+}
+
+func keyPath(key string) string {
+	return "/v1/keys/" + url.PathEscape(key)
+}
+
+// do sends body as JSON and decodes the answer into out when out is not nil
+func (c *Client) do(ctx context.Context, method string, path string, body any, out any) error {
+	var rd io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, rd)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		var eb server.ErrorBody
+		_ = json.NewDecoder(res.Body).Decode(&eb)
+		return &StatusError{Status: res.StatusCode, Message: eb.Error}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func isStatus(err error, status int) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.Status == status
+}
+
+// Separator returns the separator of the remote store, it is fetched once and cached
+func (c *Client) Separator() string {
+	c.once.Do(func() {
+		var info server.InfoBody
+		if err := c.do(context.Background(), http.MethodGet, "/v1/info", nil, &info); err != nil {
+			c.report("info", err)
+			return
+		}
+		c.sep = info.Separator
+	})
+	return c.sep
+}
+
+// GetE is Get returning transport errors, a missing key yields memkv.ErrNotFound
+func (c *Client) GetE(ctx context.Context, key string) (any, error) {
+	var body server.ValueBody
+	if err := c.do(ctx, http.MethodGet, keyPath(key), nil, &body); err != nil {
+		if isStatus(err, http.StatusNotFound) {
+			return nil, memkv.ErrNotFound
+		}
+		return nil, err
+	}
+	return body.Value, nil
+}
+
+func (c *Client) Get(key string) (any, bool) {
+	v, err := c.GetE(context.Background(), key)
+	if err != nil {
+		if !errors.Is(err, memkv.ErrNotFound) {
+			c.report("get", err)
+		}
+		return nil, false
+	}
+	return v, true
+}
+
+// SetE is Set returning the reason of a failure
+func (c *Client) SetE(ctx context.Context, key string, val any) error {
+	return c.do(ctx, http.MethodPut, keyPath(key), server.ValueBody{Value: val}, nil)
+}
+
+func (c *Client) Set(key string, val any) bool {
+	if err := c.SetE(context.Background(), key, val); err != nil {
+		c.report("set", err)
+		return false
+	}
+	return true
+}
+
+func (c *Client) Contains(key string) bool {
+	_, ok := c.Get(key)
+	return ok
+}
+
+// DropE is Drop returning the reason of a failure
+func (c *Client) DropE(ctx context.Context, key string, deleteKeySpaces bool) error {
+	path := keyPath(key)
+	if deleteKeySpaces {
+		path += "?keyspaces=true"
+	}
+	return c.do(ctx, http.MethodDelete, path, nil, nil)
+}
+
+func (c *Client) Drop(key string, deleteKeySpaces bool) bool {
+	if err := c.DropE(context.Background(), key, deleteKeySpaces); err != nil {
+		c.report("drop", err)
+		return false
+	}
+	return true
+}
+
+func (c *Client) IsKeySpace(key string) bool {
+	v, ok := c.Get(key)
+	if !ok {
+		return false
+	}
+	_, ok = v.(map[string]any)
+	return ok
+}
+
+func (c *Client) List(prefix string) []string {
+	var body server.ListBody
+	if err := c.do(context.Background(), http.MethodGet, "/v1/list?prefix="+url.QueryEscape(prefix), nil, &body); err != nil {
+		c.report("list", err)
+		return []string{}
+	}
+	return body.Keys
+}
+
+func (c *Client) Commit(txn *memkv.Txn) error {
+	return c.do(context.Background(), http.MethodPost, "/v1/txn", server.EncodeTxn(txn), nil)
+}
+
+func (c *Client) ImportMap(data map[string]any) error {
+	return c.do(context.Background(), http.MethodPost, "/v1/import", data, nil)
+}
+
+func (c *Client) GetSerializableMap() map[string]any {
+	var out map[string]any
+	if err := c.do(context.Background(), http.MethodGet, "/v1/snapshot", nil, &out); err != nil {
+		c.report("snapshot", err)
+		return nil
+	}
+	return out
+}
+
+func (c *Client) LoadFromSerializableMap(data map[string]any) error {
+	return c.do(context.Background(), http.MethodPut, "/v1/snapshot", data, nil)
+}
+
+func (c *Client) AddWatcherHook(key string, hook memkv.WatchHook, eFilter []memkv.EventType) func() {
+	return c.watch(url.Values{"key": {key}}, hook, eFilter)
+}
+
+func (c *Client) AddPrefixWatcherHook(prefix string, hook memkv.WatchHook, eFilter []memkv.EventType) func() {
+	return c.watch(url.Values{"prefix": {prefix}}, hook, eFilter)
+}
+
+// watch opens an event stream and feeds it to hook until the returned function is called.
+// It only returns once the server acknowledged the subscription so no event after it is missed.
+// The filter is always sent, an empty one selects no events on the server as it does in MemKV.
+func (c *Client) watch(q url.Values, hook memkv.WatchHook, eFilter []memkv.EventType) func() {
+	names := make([]string, len(eFilter))
+	for i, t := range eFilter {
+		names[i] = t.String()
+	}
+	q.Set("events", strings.Join(names, ","))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+"/v1/watch?"+q.Encode(), nil)
+	if err != nil {
+		cancel()
+		c.report("watch", err)
+		return func() {}
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := c.hc.Do(req)
+	if err != nil {
+		cancel()
+		c.report("watch", err)
+		return func() {}
+	}
+	if res.StatusCode != http.StatusOK {
+		var eb server.ErrorBody
+		_ = json.NewDecoder(res.Body).Decode(&eb)
+		res.Body.Close()
+		cancel()
+		c.report("watch", &StatusError{Status: res.StatusCode, Message: eb.Error})
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer res.Body.Close()
+		err := readEvents(res.Body, hook)
+		if err != nil && ctx.Err() == nil {
+			c.report("watch", err)
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// readEvents parses a Server-Sent Events stream and calls hook for every memkv event in it
+func readEvents(r io.Reader, hook memkv.WatchHook) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var name string
+	var data []byte
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			if name == "overflow" {
+				return errors.New("watch stream closed by the server, consumer too slow")
+			}
+			if len(data) > 0 {
+				var e memkv.Event
+				if err := json.Unmarshal(data, &e); err != nil {
+					return err
+				}
+				hook(e)
+			}
+			name, data = "", nil
+		case strings.HasPrefix(line, "event:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimSpace(strings.TrimPrefix(line, "data:"))...)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
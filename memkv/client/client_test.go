@@ -0,0 +1,116 @@
+package client_test
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xadaemon/libprisma/memkv"
+	"github.com/xadaemon/libprisma/memkv/client"
+	"github.com/xadaemon/libprisma/memkv/server"
+)
+
+func newPair(t *testing.T) (*memkv.MemKV, *client.Client) {
+	kvs := memkv.NewMemKV(".", nil)
+	ts := httptest.NewServer(server.New(kvs))
+	t.Cleanup(ts.Close)
+	c := client.New(ts.URL, ts.Client())
+	c.OnError = func(op string, err error) {
+		t.Errorf("%s failed: %v", op, err)
+	}
+	return kvs, c
+}
+
+func TestClient_GetSetDrop(t *testing.T) {
+	kvs, c := newPair(t)
+
+	if !c.Set("Some.test.path", "value") {
+		t.Fatal("Failed to set key")
+	}
+	if v, ok := kvs.Get("Some.test.path"); !ok || v != "value" {
+		t.Errorf("Server store has %v, want value", v)
+	}
+	if v, ok := c.Get("Some.test.path"); !ok || v != "value" {
+		t.Errorf("Got %v, want value", v)
+	}
+	if !c.IsKeySpace("Some.test") {
+		t.Error("Some.test should be a key space")
+	}
+	if c.Separator() != "." {
+		t.Errorf("Got separator %q", c.Separator())
+	}
+
+	c.OnError = nil
+	if c.Drop("Some", false) {
+		t.Error("Dropped key space without deleteKeySpaces")
+	}
+	if !c.Drop("Some.test.path", false) {
+		t.Error("Failed to drop leaf")
+	}
+	if _, ok := c.Get("Some.test.path"); ok {
+		t.Error("Key still present after drop")
+	}
+}
+
+func TestClient_ListAndCommit(t *testing.T) {
+	_, c := newPair(t)
+	c.Set("a.x", 1)
+	c.Set("a.y", 2)
+	c.Set("b", 3)
+
+	if got := c.List("a"); !reflect.DeepEqual(got, []string{"a.x", "a.y"}) {
+		t.Errorf("List(a) = %v", got)
+	}
+
+	failing := memkv.NewTxn().Set("a.z", 4).Check("b", 100)
+	if err := c.Commit(failing); err == nil {
+		t.Error("Commit with failing check succeeded")
+	}
+	if c.Contains("a.z") {
+		t.Error("Failed transaction left a.z behind")
+	}
+
+	ok := memkv.NewTxn().Check("b", float64(3)).Set("a.z", 4).Drop("a.x", false)
+	if err := c.Commit(ok); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if got := c.List(""); !reflect.DeepEqual(got, []string{"a.y", "a.z", "b"}) {
+		t.Errorf("List() = %v", got)
+	}
+}
+
+func TestClient_Watch(t *testing.T) {
+	kvs, c := newPair(t)
+	events := make(chan memkv.Event, 10)
+	cancel := c.AddPrefixWatcherHook("svc", func(e memkv.Event) {
+		events <- e
+	}, []memkv.EventType{memkv.E_KEY_CREATED, memkv.E_KEY_DELETED})
+	defer cancel()
+	// an empty filter selects no events, as it does in MemKV
+	unfiltered := make(chan memkv.Event, 10)
+	defer c.AddPrefixWatcherHook("svc", func(e memkv.Event) {
+		unfiltered <- e
+	}, nil)()
+
+	kvs.Set("svc.port", 80)
+	kvs.Set("other", 1)
+	kvs.Drop("svc.port", false)
+
+	want := []memkv.EventType{memkv.E_KEY_CREATED, memkv.E_KEY_DELETED}
+	for _, w := range want {
+		select {
+		case e := <-events:
+			if e.Type != w || e.Key != "svc.port" {
+				t.Errorf("Got %v on %s, want %v on svc.port", e.Type, e.Key, w)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for %v", w)
+		}
+	}
+	select {
+	case e := <-unfiltered:
+		t.Errorf("Watch with an empty filter got %v on %s", e.Type, e.Key)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
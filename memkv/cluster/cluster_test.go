@@ -0,0 +1,333 @@
+package cluster_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xadaemon/libprisma/memkv"
+	"github.com/xadaemon/libprisma/memkv/cluster"
+)
+
+type testCluster struct {
+	t     *testing.T
+	net   *cluster.InMemNetwork
+	nodes map[string]*cluster.Node
+}
+
+func newNode(t *testing.T, net *cluster.InMemNetwork, id string, members []string) *cluster.Node {
+	return newStoredNode(t, net, id, members, nil)
+}
+
+func newStoredNode(t *testing.T, net *cluster.InMemNetwork, id string, members []string, storage cluster.Storage) *cluster.Node {
+	n, err := cluster.NewNode(cluster.Config{
+		ID:                id,
+		Members:           members,
+		Transport:         net.Transport(id),
+		ElectionTimeout:   60 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+		SnapshotThreshold: 8,
+		Storage:           storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Stop)
+	return n
+}
+
+func newTestCluster(t *testing.T, size int) *testCluster {
+	c := &testCluster{t: t, net: cluster.NewInMemNetwork(), nodes: map[string]*cluster.Node{}}
+	var ids []string
+	for i := range size {
+		ids = append(ids, fmt.Sprintf("n%d", i))
+	}
+	for _, id := range ids {
+		c.nodes[id] = newNode(t, c.net, id, ids)
+	}
+	return c
+}
+
+// leader waits until exactly one of the connected nodes in ids leads
+func (c *testCluster) leader(skip ...string) *cluster.Node {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []*cluster.Node
+	nodes:
+		for id, n := range c.nodes {
+			for _, s := range skip {
+				if s == id {
+					continue nodes
+				}
+			}
+			if n.Role() == cluster.LEADER {
+				leaders = append(leaders, n)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("no leader elected")
+	return nil
+}
+
+func eventually(t *testing.T, what string, f func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if f() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func ctx(t *testing.T) context.Context {
+	c, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	t.Cleanup(cancel)
+	return c
+}
+
+func TestCluster_Replication(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader()
+
+	if err := leader.Set(ctx(t), "ca.serial", 1); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	for id, n := range c.nodes {
+		eventually(t, id+" to apply", func() bool {
+			v, ok := n.Store().Get("ca.serial")
+			return ok && v == float64(1)
+		})
+	}
+
+	for _, n := range c.nodes {
+		if n == leader {
+			continue
+		}
+		err := n.Set(ctx(t), "ca.serial", 2)
+		var nle *cluster.NotLeaderError
+		if !errors.As(err, &nle) || nle.Leader != leader.ID() {
+			t.Errorf("Expected NotLeaderError pointing at %s, got %v", leader.ID(), err)
+		}
+	}
+
+	err := leader.Propose(ctx(t), memkv.NewTxn().Check("ca.serial", float64(5)).Set("ca.serial", 6))
+	if !errors.Is(err, memkv.ErrCheckFailed) {
+		t.Errorf("Expected the failed check to be reported, got %v", err)
+	}
+
+	v, ok, err := leader.Get(ctx(t), "ca.serial", cluster.READ_LINEARIZABLE)
+	if err != nil || !ok || v != float64(1) {
+		t.Errorf("Linearizable read returned %v %v %v", v, ok, err)
+	}
+}
+
+func TestCluster_Failover(t *testing.T) {
+	c := newTestCluster(t, 3)
+	old := c.leader()
+	if err := old.Set(ctx(t), "k", "before"); err != nil {
+		t.Fatal(err)
+	}
+
+	c.net.Disconnect(old.ID())
+	leader := c.leader(old.ID())
+	if err := leader.Set(ctx(t), "k", "after"); err != nil {
+		t.Fatalf("Set on new leader failed: %v", err)
+	}
+	eventually(t, "old leader to step down", func() bool {
+		return old.Role() != cluster.LEADER
+	})
+	if _, _, err := old.Get(ctx(t), "k", cluster.READ_LINEARIZABLE); err == nil {
+		t.Error("Partitioned node served a linearizable read")
+	}
+
+	c.net.Reconnect(old.ID())
+	eventually(t, "old leader to catch up", func() bool {
+		v, _ := old.Store().Get("k")
+		return v == "after"
+	})
+}
+
+func TestCluster_LeaseRead(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader()
+	if err := leader.Set(ctx(t), "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range c.nodes {
+		eventually(t, n.ID()+" to serve a lease read", func() bool {
+			v, ok, err := n.Get(ctx(t), "k", cluster.READ_LEASE)
+			return err == nil && ok && v == "v"
+		})
+	}
+	for _, n := range c.nodes {
+		if n != leader {
+			c.net.Disconnect(n.ID())
+			time.Sleep(100 * time.Millisecond)
+			if _, _, err := n.Get(ctx(t), "k", cluster.READ_LEASE); !errors.Is(err, cluster.ErrNoLease) {
+				t.Errorf("Expected ErrNoLease on isolated follower, got %v", err)
+			}
+			break
+		}
+	}
+}
+
+func TestCluster_SnapshotAndMembership(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader()
+	for i := range 20 {
+		if err := leader.Set(ctx(t), fmt.Sprintf("keys.k%d", i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the log was compacted, so the new member can only catch up through a snapshot
+	joiner := newNode(t, c.net, "n3", nil)
+	c.nodes["n3"] = joiner
+	if err := leader.AddMember(ctx(t), "n3"); err != nil {
+		t.Fatalf("AddMember failed: %v", err)
+	}
+	eventually(t, "joiner to catch up", func() bool {
+		return len(joiner.Store().List("keys")) == 20
+	})
+	if got := len(joiner.Members()); got != 4 {
+		t.Errorf("Joiner knows %d members, want 4", got)
+	}
+
+	if err := leader.RemoveMember(ctx(t), leader.ID()); err != nil {
+		t.Fatalf("RemoveMember failed: %v", err)
+	}
+	old := leader.ID()
+	delete(c.nodes, old)
+	leader = c.leader()
+	if leader.ID() == old {
+		t.Fatal("Removed node still leads")
+	}
+	if err := leader.Set(ctx(t), "after", true); err != nil {
+		t.Fatalf("Set after membership change failed: %v", err)
+	}
+	eventually(t, "joiner to apply", func() bool {
+		return joiner.Store().Contains("after")
+	})
+}
+
+func TestCluster_Restart(t *testing.T) {
+	net := cluster.NewInMemNetwork()
+	ids := []string{"n0", "n1", "n2"}
+	dir := t.TempDir()
+	start := func() *testCluster {
+		c := &testCluster{t: t, net: net, nodes: map[string]*cluster.Node{}}
+		for _, id := range ids {
+			s, err := cluster.OpenFileStorage(filepath.Join(dir, id))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			c.nodes[id] = newStoredNode(t, net, id, ids, s)
+		}
+		return c
+	}
+
+	c := start()
+	leader := c.leader()
+	// enough writes for every node to take a snapshot, followed by entries in the log
+	for i := range 12 {
+		if err := leader.Set(ctx(t), "k", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, n := range c.nodes {
+		eventually(t, n.ID()+" to apply", func() bool {
+			v, _ := n.Store().Get("k")
+			return v == float64(11)
+		})
+		n.Stop()
+	}
+
+	// the restarted nodes start from empty stores and rebuild them from storage
+	c = start()
+	for _, n := range c.nodes {
+		eventually(t, n.ID()+" to serve a lease read", func() bool {
+			_, _, err := n.Get(ctx(t), "k", cluster.READ_LEASE)
+			return err == nil
+		})
+		if v, _, _ := n.Get(ctx(t), "k", cluster.READ_LEASE); v != float64(11) {
+			t.Errorf("%s served %v after a restart", n.ID(), v)
+		}
+	}
+	if err := c.leader().Set(ctx(t), "after", true); err != nil {
+		t.Fatalf("Set after restart failed: %v", err)
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	s, err := cluster.OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := func(index uint64, term uint64) cluster.Entry {
+		return cluster.Entry{Index: index, Term: term, Type: cluster.ENTRY_COMMAND, Data: []byte(fmt.Sprint(index))}
+	}
+	steps := []error{
+		s.SaveState(cluster.HardState{Term: 2, Vote: "n1"}),
+		s.Append([]cluster.Entry{entry(1, 1), entry(2, 1), entry(3, 1)}),
+		// a new leader replaces the conflicting end of the log
+		s.Append([]cluster.Entry{entry(3, 2), entry(4, 2)}),
+		s.SaveSnapshot(cluster.Snapshot{Index: 2, Term: 1, Members: []string{"n1"}, Data: []byte("{}")}, []cluster.Entry{entry(3, 2), entry(4, 2)}),
+		s.Append([]cluster.Entry{entry(5, 2)}),
+	}
+	for i, err := range steps {
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+	}
+	s.Close()
+
+	// a write cut short by a crash is dropped
+	f, _ := os.OpenFile(filepath.Join(dir, "log-1.jsonl"), os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString(`{"Index":6,"Te`)
+	f.Close()
+
+	s, err = cluster.OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Append([]cluster.Entry{entry(6, 3)}); err != nil {
+		t.Fatal(err)
+	}
+	st, snap, entries, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []cluster.Entry{entry(3, 2), entry(4, 2), entry(5, 2), entry(6, 3)}
+	if st != (cluster.HardState{Term: 2, Vote: "n1"}) || snap.Index != 2 || string(snap.Data) != "{}" || !reflect.DeepEqual(entries, want) {
+		t.Errorf("Loaded %+v %+v %+v", st, snap, entries)
+	}
+	if logs, _ := filepath.Glob(filepath.Join(dir, "log-*")); len(logs) != 1 {
+		t.Errorf("Stale log files left: %v", logs)
+	}
+}
+
+func TestCluster_BadSnapshot(t *testing.T) {
+	s := cluster.NewMemoryStorage()
+	s.SaveSnapshot(cluster.Snapshot{Index: 5, Term: 1, Members: []string{"n0"}, Data: []byte("{broken")}, nil)
+	n := newStoredNode(t, cluster.NewInMemNetwork(), "n0", []string{"n0"}, s)
+	eventually(t, "the restore to fail", func() bool {
+		return n.Err() != nil
+	})
+	if err := n.ReadBarrier(ctx(t), cluster.READ_LEASE); err == nil {
+		t.Error("Node without its snapshot served a read")
+	}
+}
@@ -0,0 +1,1136 @@
+// Package cluster replicates a MemKV across a group of nodes with the Raft consensus algorithm.
+//
+// Writes are proposed to the leader as memkv transactions and only applied once a majority of the
+// members stored them, so a successful Propose is linearizable. Reads can either go through the
+// leader with a quorum round (READ_LINEARIZABLE) or be answered from a lease (READ_LEASE): the
+// leader serves them while a majority acknowledged it recently and followers serve them while they
+// heard from a leader recently and applied what it had committed, trading a bounded amount of
+// staleness for latency.
+//
+// The log is compacted into snapshots built from MemKV.GetSerializableMap, lagging or new members
+// are brought up to date with them. Membership changes are done one node at a time with AddMember
+// and RemoveMember. The term, vote, log and snapshot are kept by a Storage and written to it before
+// the node answers anything depending on them, so a node restarted on a FileStorage rejoins with
+// its state; the store is rebuilt from the snapshot and the committed entries.
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/xadaemon/libprisma/memkv"
+)
+
+var (
+	ErrNotLeader         = errors.New("node is not the leader")
+	ErrStopped           = errors.New("node is stopped")
+	ErrLeadershipLost    = errors.New("leadership changed before the entry was committed")
+	ErrConfigInProgress  = errors.New("a membership change is already in progress")
+	ErrNoLease           = errors.New("node holds no read lease")
+	ErrMemberExists      = errors.New("node is already a member")
+	ErrMemberNotFound    = errors.New("node is not a member")
+	ErrInvalidMemberList = errors.New("node must be part of its initial member list")
+)
+
+// NotLeaderError is returned by leader only operations called on another node, Leader is
+// the node currently believed to lead the cluster and may be empty
+type NotLeaderError struct {
+	Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return "node is not the leader, leader unknown"
+	}
+	return fmt.Sprintf("node is not the leader, try %s", e.Leader)
+}
+
+func (e *NotLeaderError) Unwrap() error {
+	return ErrNotLeader
+}
+
+type ReadMode int
+
+const (
+	READ_LINEARIZABLE ReadMode = iota
+	READ_LEASE        ReadMode = iota
+)
+
+type Role int
+
+const (
+	FOLLOWER  Role = iota
+	CANDIDATE Role = iota
+	LEADER    Role = iota
+)
+
+type Config struct {
+	// ID names this node on the transport
+	ID string
+	// Members is the initial member list including ID, it is left empty for nodes
+	// that join a running cluster through AddMember
+	Members   []string
+	Transport Transport
+	// Store is the replicated state machine, if nil a store with "." as separator is created.
+	// It must only be written through the node.
+	Store *memkv.MemKV
+	// ElectionTimeout is the minimum time without a leader before an election starts,
+	// the actual timeout is randomized between it and twice its value
+	ElectionTimeout time.Duration
+	// HeartbeatInterval is how often the leader contacts its followers
+	HeartbeatInterval time.Duration
+	// LeaseDuration bounds the staleness of lease reads, it must be below ElectionTimeout
+	LeaseDuration time.Duration
+	// SnapshotThreshold is the number of applied entries after which the log is compacted
+	SnapshotThreshold uint64
+	// Storage keeps the Raft state across restarts, if nil a MemoryStorage is used. The state
+	// it holds replaces Members once the node ran, and Store should then start empty.
+	Storage Storage
+}
+
+type waiter struct {
+	term uint64
+	ch   chan error
+}
+
+type Node struct {
+	mu  sync.Mutex
+	cfg Config
+	kv  *memkv.MemKV
+	tr  Transport
+
+	storage Storage
+	// saved is the hard state last written to storage
+	saved HardState
+
+	role        Role
+	term        uint64
+	votedFor    string
+	leader      string
+	members     []string
+	log         []Entry
+	snapshot    []byte
+	snapMembers []string
+	commitIndex uint64
+	lastApplied uint64
+
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	lastAck     map[string]time.Time
+	inflight    map[string]bool
+	leaderSince time.Time
+
+	lastContact time.Time
+	// leaseStart is the last contact with a leader that had committed an entry of its term,
+	// leaderCommit its commit index then, which lease reads wait for
+	leaseStart       time.Time
+	leaderCommit     uint64
+	electionDeadline time.Time
+	lastHeartbeat    time.Time
+
+	waiters   map[uint64]waiter
+	applyCond *sync.Cond
+	// applyErr stops the applier when a snapshot cannot be restored
+	applyErr error
+	stop     chan struct{}
+	stopped  bool
+	wg       sync.WaitGroup
+}
+
+// NewNode creates a node, binds it to its transport and starts its timers
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.Transport == nil {
+		return nil, errors.New("a transport is required")
+	}
+	if len(cfg.Members) > 0 && !slices.Contains(cfg.Members, cfg.ID) {
+		return nil, ErrInvalidMemberList
+	}
+	if cfg.Store == nil {
+		cfg.Store = memkv.NewMemKV(".", nil)
+	}
+	if cfg.ElectionTimeout == 0 {
+		cfg.ElectionTimeout = 300 * time.Millisecond
+	}
+	if cfg.HeartbeatInterval == 0 {
+		cfg.HeartbeatInterval = cfg.ElectionTimeout / 6
+	}
+	if cfg.LeaseDuration == 0 {
+		cfg.LeaseDuration = cfg.ElectionTimeout * 2 / 3
+	}
+	if cfg.LeaseDuration >= cfg.ElectionTimeout {
+		return nil, errors.New("lease duration must be below the election timeout")
+	}
+	if cfg.SnapshotThreshold == 0 {
+		cfg.SnapshotThreshold = 1024
+	}
+	if cfg.Storage == nil {
+		cfg.Storage = NewMemoryStorage()
+	}
+	st, snap, entries, err := cfg.Storage.Load()
+	if err != nil {
+		return nil, fmt.Errorf("loading the node state: %w", err)
+	}
+
+	n := &Node{
+		cfg:         cfg,
+		kv:          cfg.Store,
+		tr:          cfg.Transport,
+		storage:     cfg.Storage,
+		saved:       st,
+		role:        FOLLOWER,
+		term:        st.Term,
+		votedFor:    st.Vote,
+		members:     slices.Clone(cfg.Members),
+		snapMembers: slices.Clone(cfg.Members),
+		log:         []Entry{{Index: 0, Term: 0}},
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		lastAck:     make(map[string]time.Time),
+		inflight:    make(map[string]bool),
+		waiters:     make(map[uint64]waiter),
+		stop:        make(chan struct{}),
+	}
+	if snap.Index > 0 {
+		// the applier restores the store from the snapshot since it is committed
+		n.log[0] = Entry{Index: snap.Index, Term: snap.Term}
+		n.snapshot = snap.Data
+		n.snapMembers = slices.Clone(snap.Members)
+		n.commitIndex = snap.Index
+	}
+	n.log = append(n.log, entries...)
+	n.recomputeMembers()
+	n.applyCond = sync.NewCond(&n.mu)
+	n.resetElectionDeadline()
+	n.tr.Bind(n)
+
+	n.wg.Add(2)
+	go n.ticker()
+	go n.applier()
+	return n, nil
+}
+
+// Stop halts the node, pending proposals fail with ErrStopped
+func (n *Node) Stop() {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.stopped = true
+	close(n.stop)
+	for idx, w := range n.waiters {
+		w.ch <- ErrStopped
+		delete(n.waiters, idx)
+	}
+	n.applyCond.Broadcast()
+	n.mu.Unlock()
+	n.wg.Wait()
+}
+
+func (n *Node) ID() string {
+	return n.cfg.ID
+}
+
+// Store returns the local replica, it may be read and watched but must not be written
+func (n *Node) Store() *memkv.MemKV {
+	return n.kv
+}
+
+func (n *Node) Role() Role {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role
+}
+
+// Leader returns the node currently believed to be the leader, it may be empty
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+// Members returns the latest member list known to this node
+func (n *Node) Members() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return slices.Clone(n.members)
+}
+
+// Err returns why the node stopped applying the log, the local replica no longer follows the
+// cluster once a snapshot cannot be restored
+func (n *Node) Err() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.applyErr
+}
+
+// Propose replicates txn and applies it on every node, it returns once the transaction was
+// applied locally, with the error memkv.MemKV.Commit returned for it
+func (n *Node) Propose(ctx context.Context, txn *memkv.Txn) error {
+	data, err := json.Marshal(txn.Ops())
+	if err != nil {
+		return err
+	}
+	return n.propose(ctx, ENTRY_COMMAND, data, nil)
+}
+
+// Set is a shorthand for proposing a transaction with a single set
+func (n *Node) Set(ctx context.Context, key string, val any) error {
+	return n.Propose(ctx, memkv.NewTxn().Set(key, val))
+}
+
+// Drop is a shorthand for proposing a transaction with a single drop
+func (n *Node) Drop(ctx context.Context, key string, deleteKeySpaces bool) error {
+	return n.Propose(ctx, memkv.NewTxn().Drop(key, deleteKeySpaces))
+}
+
+// AddMember adds id to the cluster, the node must already be reachable on the transport
+func (n *Node) AddMember(ctx context.Context, id string) error {
+	return n.changeMembers(ctx, func(members []string) ([]string, error) {
+		if slices.Contains(members, id) {
+			return nil, ErrMemberExists
+		}
+		return append(members, id), nil
+	})
+}
+
+// RemoveMember removes id from the cluster, removing the leader makes it step down once committed
+func (n *Node) RemoveMember(ctx context.Context, id string) error {
+	return n.changeMembers(ctx, func(members []string) ([]string, error) {
+		if !slices.Contains(members, id) {
+			return nil, ErrMemberNotFound
+		}
+		return slices.DeleteFunc(members, func(m string) bool { return m == id }), nil
+	})
+}
+
+func (n *Node) changeMembers(ctx context.Context, change func([]string) ([]string, error)) error {
+	return n.propose(ctx, ENTRY_CONFIG, nil, change)
+}
+
+// propose appends an entry on the leader and waits for it to be applied, configuration
+// entries are built under the lock from the current member list by change
+func (n *Node) propose(ctx context.Context, t EntryType, data []byte, change func([]string) ([]string, error)) error {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return ErrStopped
+	}
+	if n.applyErr != nil {
+		err := n.applyErr
+		n.mu.Unlock()
+		return err
+	}
+	if n.role != LEADER {
+		leader := n.leader
+		n.mu.Unlock()
+		return &NotLeaderError{Leader: leader}
+	}
+	if t == ENTRY_CONFIG {
+		if n.pendingConfig() {
+			n.mu.Unlock()
+			return ErrConfigInProgress
+		}
+		members, err := change(slices.Clone(n.members))
+		if err != nil {
+			n.mu.Unlock()
+			return err
+		}
+		if data, err = json.Marshal(members); err != nil {
+			n.mu.Unlock()
+			return err
+		}
+	}
+	e, err := n.appendLocal(t, data)
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	ch := make(chan error, 1)
+	n.waiters[e.Index] = waiter{term: e.Term, ch: ch}
+	n.mu.Unlock()
+
+	n.broadcast()
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, e.Index)
+		n.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Get reads key from the local replica after making sure the read is allowed by mode
+func (n *Node) Get(ctx context.Context, key string, mode ReadMode) (any, bool, error) {
+	if err := n.ReadBarrier(ctx, mode); err != nil {
+		return nil, false, err
+	}
+	v, ok := n.kv.Get(key)
+	return v, ok, nil
+}
+
+// ReadBarrier waits until the local replica may serve reads under mode
+func (n *Node) ReadBarrier(ctx context.Context, mode ReadMode) error {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return ErrStopped
+	}
+	switch {
+	case n.applyErr != nil:
+		err := n.applyErr
+		n.mu.Unlock()
+		return err
+	case mode == READ_LEASE && n.role == LEADER && n.hasLease(time.Now()):
+		n.mu.Unlock()
+		readIndex, err := n.termCommitIndex(ctx)
+		if err != nil {
+			return err
+		}
+		return n.waitApplied(ctx, readIndex)
+	case mode == READ_LEASE && n.role != LEADER:
+		ok := n.leader != "" && time.Since(n.leaseStart) < n.cfg.LeaseDuration
+		readIndex := n.leaderCommit
+		n.mu.Unlock()
+		if !ok {
+			return ErrNoLease
+		}
+		// what the leader had committed when it renewed the lease may not be applied here yet
+		return n.waitApplied(ctx, readIndex)
+	case n.role != LEADER:
+		leader := n.leader
+		n.mu.Unlock()
+		return &NotLeaderError{Leader: leader}
+	}
+	n.mu.Unlock()
+
+	readIndex, err := n.termCommitIndex(ctx)
+	if err != nil {
+		return err
+	}
+	if err := n.confirmQuorum(ctx); err != nil {
+		return err
+	}
+	return n.waitApplied(ctx, readIndex)
+}
+
+// termCommitIndex returns the commit index of the leader once an entry of its current term
+// committed, before that it may lag behind what earlier leaders committed, as after a restart
+func (n *Node) termCommitIndex(ctx context.Context) (uint64, error) {
+	for {
+		n.mu.Lock()
+		if n.role != LEADER {
+			n.mu.Unlock()
+			return 0, ErrLeadershipLost
+		}
+		if n.termAt(n.commitIndex) == n.term {
+			readIndex := n.commitIndex
+			n.mu.Unlock()
+			return readIndex, nil
+		}
+		n.mu.Unlock()
+		if err := n.sleep(ctx); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// confirmQuorum checks that a majority still follows this leader after the call started
+func (n *Node) confirmQuorum(ctx context.Context) error {
+	start := time.Now()
+	n.broadcast()
+	for {
+		n.mu.Lock()
+		if n.role != LEADER {
+			n.mu.Unlock()
+			return ErrLeadershipLost
+		}
+		acks := 0
+		for _, m := range n.members {
+			if m == n.cfg.ID || !n.lastAck[m].Before(start) {
+				acks++
+			}
+		}
+		ok := acks >= n.quorum()
+		n.mu.Unlock()
+		if ok {
+			return nil
+		}
+		if err := n.sleep(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+func (n *Node) waitApplied(ctx context.Context, index uint64) error {
+	for {
+		n.mu.Lock()
+		done := n.lastApplied >= index
+		n.mu.Unlock()
+		if done {
+			return nil
+		}
+		if err := n.sleep(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+func (n *Node) sleep(ctx context.Context) error {
+	t := time.NewTimer(n.cfg.HeartbeatInterval / 10)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-n.stop:
+		return ErrStopped
+	case <-t.C:
+		return nil
+	}
+}
+
+// log helpers, callers hold n.mu
+
+func (n *Node) lastIndex() uint64 {
+	return n.log[len(n.log)-1].Index
+}
+
+func (n *Node) lastTerm() uint64 {
+	return n.log[len(n.log)-1].Term
+}
+
+func (n *Node) entry(index uint64) Entry {
+	return n.log[index-n.log[0].Index]
+}
+
+func (n *Node) termAt(index uint64) uint64 {
+	return n.entry(index).Term
+}
+
+func (n *Node) quorum() int {
+	return len(n.members)/2 + 1
+}
+
+func (n *Node) isMember() bool {
+	return slices.Contains(n.members, n.cfg.ID)
+}
+
+// appendLocal stores a new entry of the current term, it only enters the log once it is durable
+func (n *Node) appendLocal(t EntryType, data []byte) (Entry, error) {
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term, Type: t, Data: data}
+	if err := n.storage.Append([]Entry{e}); err != nil {
+		return Entry{}, err
+	}
+	n.log = append(n.log, e)
+	if t == ENTRY_CONFIG {
+		n.applyConfig(e)
+	}
+	return e, nil
+}
+
+// persist writes the term and vote to storage if they changed since the last call, it must
+// succeed before any message depending on them leaves the node
+func (n *Node) persist() error {
+	st := HardState{Term: n.term, Vote: n.votedFor}
+	if st == n.saved {
+		return nil
+	}
+	if err := n.storage.SaveState(st); err != nil {
+		return err
+	}
+	n.saved = st
+	return nil
+}
+
+// applyConfig switches to the member list of e, configurations take effect as soon as they are in the log
+func (n *Node) applyConfig(e Entry) {
+	var members []string
+	if err := json.Unmarshal(e.Data, &members); err != nil {
+		return
+	}
+	n.members = members
+	if n.role == LEADER {
+		for _, m := range members {
+			if _, ok := n.nextIndex[m]; !ok {
+				n.nextIndex[m] = n.lastIndex() + 1
+				n.matchIndex[m] = 0
+			}
+		}
+	}
+}
+
+// recomputeMembers restores the member list from the log after it was truncated
+func (n *Node) recomputeMembers() {
+	for i := len(n.log) - 1; i > 0; i-- {
+		if n.log[i].Type == ENTRY_CONFIG {
+			n.applyConfig(n.log[i])
+			return
+		}
+	}
+	n.members = slices.Clone(n.snapMembers)
+}
+
+func (n *Node) pendingConfig() bool {
+	for i := len(n.log) - 1; i > 0 && n.log[i].Index > n.commitIndex; i-- {
+		if n.log[i].Type == ENTRY_CONFIG {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) resetElectionDeadline() {
+	jitter := time.Duration(rand.Int64N(int64(n.cfg.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(n.cfg.ElectionTimeout + jitter)
+}
+
+func (n *Node) hasLease(now time.Time) bool {
+	acks := 0
+	for _, m := range n.members {
+		if m == n.cfg.ID || now.Sub(n.lastAck[m]) < n.cfg.LeaseDuration {
+			acks++
+		}
+	}
+	return acks >= n.quorum()
+}
+
+func (n *Node) becomeFollower(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+	}
+	n.role = FOLLOWER
+	n.resetElectionDeadline()
+}
+
+func (n *Node) becomeLeader() {
+	n.role = LEADER
+	n.leader = n.cfg.ID
+	n.leaderSince = time.Now()
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.lastAck = make(map[string]time.Time)
+	for _, m := range n.members {
+		n.nextIndex[m] = n.lastIndex() + 1
+		n.matchIndex[m] = 0
+	}
+	if _, err := n.appendLocal(ENTRY_NOOP, nil); err != nil {
+		n.becomeFollower(n.term)
+		n.leader = ""
+		return
+	}
+	n.lastHeartbeat = time.Time{}
+}
+
+func (n *Node) ticker() {
+	defer n.wg.Done()
+	t := time.NewTicker(n.cfg.HeartbeatInterval / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case now := <-t.C:
+			n.tick(now)
+		}
+	}
+}
+
+func (n *Node) tick(now time.Time) {
+	n.mu.Lock()
+	switch n.role {
+	case LEADER:
+		// a leader cut off from the majority steps down instead of serving stale data
+		if now.Sub(n.leaderSince) > n.cfg.ElectionTimeout && !n.hasRecentQuorum(now) {
+			n.becomeFollower(n.term)
+			n.leader = ""
+			n.mu.Unlock()
+			return
+		}
+		if now.Sub(n.lastHeartbeat) >= n.cfg.HeartbeatInterval {
+			n.lastHeartbeat = now
+			n.mu.Unlock()
+			n.broadcast()
+			return
+		}
+	default:
+		if now.After(n.electionDeadline) && n.isMember() {
+			n.startElection()
+		}
+	}
+	n.mu.Unlock()
+}
+
+func (n *Node) hasRecentQuorum(now time.Time) bool {
+	acks := 0
+	for _, m := range n.members {
+		if m == n.cfg.ID || now.Sub(n.lastAck[m]) < n.cfg.ElectionTimeout {
+			acks++
+		}
+	}
+	return acks >= n.quorum()
+}
+
+// startElection is called with n.mu held
+func (n *Node) startElection() {
+	n.role = CANDIDATE
+	n.term++
+	n.votedFor = n.cfg.ID
+	n.leader = ""
+	n.resetElectionDeadline()
+	if err := n.persist(); err != nil {
+		// asking for votes without the vote for ourselves on record could elect two leaders
+		n.role = FOLLOWER
+		return
+	}
+	term := n.term
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	req := &RequestVoteRequest{
+		Term:         term,
+		Candidate:    n.cfg.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+	for _, m := range n.members {
+		if m == n.cfg.ID {
+			continue
+		}
+		go func(peer string) {
+			ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+			defer cancel()
+			res, err := n.tr.RequestVote(ctx, peer, req)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if res.Term > n.term {
+				n.becomeFollower(res.Term)
+				return
+			}
+			if n.role != CANDIDATE || n.term != term || !res.Granted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+				go n.broadcast()
+			}
+		}(m)
+	}
+}
+
+func (n *Node) broadcast() {
+	n.mu.Lock()
+	if n.role != LEADER {
+		n.mu.Unlock()
+		return
+	}
+	peers := make([]string, 0, len(n.members))
+	for _, m := range n.members {
+		if m != n.cfg.ID && !n.inflight[m] {
+			n.inflight[m] = true
+			peers = append(peers, m)
+		}
+	}
+	// a lone leader commits on its own
+	n.advanceCommit()
+	n.mu.Unlock()
+	for _, p := range peers {
+		go n.replicate(p)
+	}
+}
+
+// replicate sends the entries peer is missing, or a snapshot when they were compacted away
+func (n *Node) replicate(peer string) {
+	retry := false
+	defer func() {
+		n.mu.Lock()
+		n.inflight[peer] = false
+		n.mu.Unlock()
+		if retry {
+			n.broadcast()
+		}
+	}()
+
+	n.mu.Lock()
+	if n.role != LEADER {
+		n.mu.Unlock()
+		return
+	}
+	term := n.term
+	next := n.nextIndex[peer]
+	if next == 0 {
+		next = n.lastIndex() + 1
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+	defer cancel()
+	sent := time.Now()
+
+	if next <= n.log[0].Index {
+		req := &InstallSnapshotRequest{
+			Term:      term,
+			Leader:    n.cfg.ID,
+			LastIndex: n.log[0].Index,
+			LastTerm:  n.log[0].Term,
+			Members:   slices.Clone(n.snapMembers),
+			Data:      n.snapshot,
+		}
+		n.mu.Unlock()
+		res, err := n.tr.InstallSnapshot(ctx, peer, req)
+		if err != nil {
+			return
+		}
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if res.Term > n.term {
+			n.becomeFollower(res.Term)
+			return
+		}
+		if n.role != LEADER || n.term != term {
+			return
+		}
+		n.lastAck[peer] = sent
+		n.matchIndex[peer] = max(n.matchIndex[peer], req.LastIndex)
+		n.nextIndex[peer] = n.matchIndex[peer] + 1
+		retry = n.nextIndex[peer] <= n.lastIndex()
+		return
+	}
+
+	prev := next - 1
+	req := &AppendEntriesRequest{
+		Term:         term,
+		Leader:       n.cfg.ID,
+		PrevLogIndex: prev,
+		PrevLogTerm:  n.termAt(prev),
+		Entries:      slices.Clone(n.log[next-n.log[0].Index:]),
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+	res, err := n.tr.AppendEntries(ctx, peer, req)
+	if err != nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if res.Term > n.term {
+		n.becomeFollower(res.Term)
+		n.leader = ""
+		return
+	}
+	if n.role != LEADER || n.term != term {
+		return
+	}
+	n.lastAck[peer] = sent
+	if !res.Success {
+		n.nextIndex[peer] = max(1, min(res.ConflictIndex, n.lastIndex()+1))
+		retry = true
+		return
+	}
+	match := prev + uint64(len(req.Entries))
+	n.matchIndex[peer] = max(n.matchIndex[peer], match)
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+	n.advanceCommit()
+	retry = n.nextIndex[peer] <= n.lastIndex()
+}
+
+// advanceCommit commits the highest entry of the current term stored on a majority
+func (n *Node) advanceCommit() {
+	for idx := n.lastIndex(); idx > n.commitIndex && idx > n.log[0].Index; idx-- {
+		if n.termAt(idx) != n.term {
+			break
+		}
+		count := 0
+		for _, m := range n.members {
+			if m == n.cfg.ID || n.matchIndex[m] >= idx {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = idx
+			n.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+func (n *Node) HandleRequestVote(req *RequestVoteRequest) *RequestVoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	res := &RequestVoteResponse{Term: n.term}
+	if req.Term < n.term {
+		return res
+	}
+	// ignore candidates while a leader is known so removed or partitioned nodes cannot disrupt the cluster
+	if n.role == LEADER || n.leader != "" && time.Since(n.lastContact) < n.cfg.ElectionTimeout {
+		return res
+	}
+	if req.Term > n.term {
+		n.becomeFollower(req.Term)
+		n.leader = ""
+	}
+	res.Term = n.term
+	upToDate := req.LastLogTerm > n.lastTerm() || req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex()
+	votedFor := n.votedFor
+	if (n.votedFor == "" || n.votedFor == req.Candidate) && upToDate {
+		n.votedFor = req.Candidate
+		n.resetElectionDeadline()
+		res.Granted = true
+	}
+	if err := n.persist(); err != nil {
+		n.votedFor = votedFor
+		res.Granted = false
+	}
+	return res
+}
+
+func (n *Node) HandleAppendEntries(req *AppendEntriesRequest) *AppendEntriesResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	res := &AppendEntriesResponse{Term: n.term}
+	if req.Term < n.term {
+		return res
+	}
+	n.becomeFollower(req.Term)
+	res.Term = n.term
+	n.leader = req.Leader
+	if err := n.persist(); err != nil {
+		// have the leader retry the same entries
+		res.ConflictIndex = req.PrevLogIndex + 1
+		return res
+	}
+	n.lastContact = time.Now()
+
+	prev, prevTerm, entries := req.PrevLogIndex, req.PrevLogTerm, req.Entries
+	if prev < n.log[0].Index {
+		// the start of the request is already part of our snapshot
+		skip := n.log[0].Index - prev
+		if skip > uint64(len(entries)) {
+			res.Success = true
+			return res
+		}
+		entries = entries[skip:]
+		prev, prevTerm = n.log[0].Index, n.log[0].Term
+	}
+	if prev > n.lastIndex() {
+		res.ConflictIndex = n.lastIndex() + 1
+		return res
+	}
+	if t := n.termAt(prev); t != prevTerm {
+		idx := prev
+		for idx > n.log[0].Index+1 && n.termAt(idx-1) == t {
+			idx--
+		}
+		res.ConflictIndex = idx
+		return res
+	}
+
+	// entries already in the log are skipped, the first one that is not replaces the rest
+	first := len(entries)
+	for i, e := range entries {
+		if e.Index > n.lastIndex() || n.termAt(e.Index) != e.Term {
+			first = i
+			break
+		}
+	}
+	if first < len(entries) {
+		if err := n.storage.Append(entries[first:]); err != nil {
+			res.ConflictIndex = req.PrevLogIndex + 1
+			return res
+		}
+		truncated := false
+		if idx := entries[first].Index; idx <= n.lastIndex() {
+			n.log = n.log[:idx-n.log[0].Index]
+			truncated = true
+		}
+		for _, ne := range entries[first:] {
+			n.log = append(n.log, ne)
+			if ne.Type == ENTRY_CONFIG {
+				n.applyConfig(ne)
+			}
+		}
+		if truncated {
+			n.recomputeMembers()
+		}
+	}
+	lastNew := prev + uint64(len(entries))
+	if req.LeaderCommit > n.commitIndex {
+		n.commitIndex = min(req.LeaderCommit, lastNew)
+		n.applyCond.Broadcast()
+	}
+	// the leader's commit index only bounds staleness once it holds an entry of its own term
+	if req.LeaderCommit >= n.log[0].Index && req.LeaderCommit <= lastNew && n.termAt(req.LeaderCommit) == req.Term {
+		n.leaseStart = n.lastContact
+		n.leaderCommit = req.LeaderCommit
+	}
+	res.Success = true
+	return res
+}
+
+func (n *Node) HandleInstallSnapshot(req *InstallSnapshotRequest) *InstallSnapshotResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	res := &InstallSnapshotResponse{Term: n.term}
+	if req.Term < n.term {
+		return res
+	}
+	n.becomeFollower(req.Term)
+	res.Term = n.term
+	n.leader = req.Leader
+	if err := n.persist(); err != nil {
+		return res
+	}
+	n.lastContact = time.Now()
+	if req.LastIndex <= n.commitIndex {
+		return res
+	}
+
+	base := Entry{Index: req.LastIndex, Term: req.LastTerm}
+	var rest []Entry
+	if req.LastIndex <= n.lastIndex() && req.LastIndex >= n.log[0].Index && n.termAt(req.LastIndex) == req.LastTerm {
+		rest = n.log[req.LastIndex-n.log[0].Index+1:]
+	}
+	snap := Snapshot{Index: req.LastIndex, Term: req.LastTerm, Members: slices.Clone(req.Members), Data: req.Data}
+	if err := n.storage.SaveSnapshot(snap, rest); err != nil {
+		// the leader sends the snapshot again as the follower did not advance
+		return res
+	}
+	n.log = append([]Entry{base}, rest...)
+	n.snapshot = req.Data
+	n.snapMembers = slices.Clone(req.Members)
+	n.recomputeMembers()
+	n.commitIndex = req.LastIndex
+	n.applyCond.Broadcast()
+	return res
+}
+
+// applier feeds committed entries to the store in order, it never holds n.mu while the store runs
+func (n *Node) applier() {
+	defer n.wg.Done()
+	for {
+		n.mu.Lock()
+		for !n.stopped && n.lastApplied >= n.commitIndex {
+			n.applyCond.Wait()
+		}
+		if n.stopped {
+			n.mu.Unlock()
+			return
+		}
+		if n.lastApplied < n.log[0].Index {
+			data, idx := n.snapshot, n.log[0].Index
+			n.mu.Unlock()
+			err := n.restore(data)
+			n.mu.Lock()
+			if err != nil {
+				// entries cannot be applied on top of a store that misses the snapshot
+				n.applyErr = fmt.Errorf("restoring the snapshot at %d: %w", idx, err)
+				for i, w := range n.waiters {
+					w.ch <- n.applyErr
+					delete(n.waiters, i)
+				}
+				n.mu.Unlock()
+				return
+			}
+			n.lastApplied = max(n.lastApplied, idx)
+			n.mu.Unlock()
+			continue
+		}
+		entries := slices.Clone(n.log[n.lastApplied+1-n.log[0].Index : n.commitIndex+1-n.log[0].Index])
+		n.mu.Unlock()
+
+		for _, e := range entries {
+			err := n.apply(e)
+			n.mu.Lock()
+			if e.Index > n.lastApplied {
+				n.lastApplied = e.Index
+			}
+			if w, ok := n.waiters[e.Index]; ok {
+				delete(n.waiters, e.Index)
+				if w.term != e.Term {
+					err = ErrLeadershipLost
+				}
+				w.ch <- err
+			}
+			if e.Type == ENTRY_CONFIG && n.role == LEADER && !n.isMember() && e.Index <= n.commitIndex {
+				n.becomeFollower(n.term)
+				n.leader = ""
+			}
+			n.mu.Unlock()
+		}
+		n.maybeSnapshot()
+	}
+}
+
+func (n *Node) apply(e Entry) error {
+	if e.Type != ENTRY_COMMAND {
+		return nil
+	}
+	var ops []memkv.Op
+	if err := json.Unmarshal(e.Data, &ops); err != nil {
+		return err
+	}
+	return n.kv.Commit(memkv.NewTxn(ops...))
+}
+
+func (n *Node) restore(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	var state map[string]any
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	return n.kv.LoadFromSerializableMap(state)
+}
+
+// maybeSnapshot compacts the log once enough entries were applied since the last snapshot
+func (n *Node) maybeSnapshot() {
+	n.mu.Lock()
+	applied := n.lastApplied
+	if applied-n.log[0].Index < n.cfg.SnapshotThreshold {
+		n.mu.Unlock()
+		return
+	}
+	n.mu.Unlock()
+
+	// the applier is the only writer of the store so the state matches applied
+	data, err := json.Marshal(n.kv.GetSerializableMap())
+	if err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if applied <= n.log[0].Index {
+		return
+	}
+	members := n.snapMembers
+	for i := applied - n.log[0].Index; i > 0; i-- {
+		if n.log[i].Type == ENTRY_CONFIG {
+			_ = json.Unmarshal(n.log[i].Data, &members)
+			break
+		}
+	}
+	base := Entry{Index: applied, Term: n.termAt(applied)}
+	rest := n.log[applied-n.log[0].Index+1:]
+	snap := Snapshot{Index: base.Index, Term: base.Term, Members: slices.Clone(members), Data: data}
+	if err := n.storage.SaveSnapshot(snap, rest); err != nil {
+		// keep the whole log, compaction is tried again after the next entries
+		return
+	}
+	n.log = append([]Entry{base}, rest...)
+	n.snapshot = data
+	n.snapMembers = members
+}
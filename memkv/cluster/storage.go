@@ -0,0 +1,317 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// HardState is the part of the Raft state that must survive a restart: the current term and the
+// candidate voted for in it
+type HardState struct {
+	Term uint64
+	Vote string
+}
+
+// Snapshot is the compacted start of the log, Data holds the serializable map of the store at
+// Index and Members the member list in effect there. The zero Snapshot stands for no snapshot.
+type Snapshot struct {
+	Index   uint64
+	Term    uint64
+	Members []string
+	Data    []byte
+}
+
+// Storage keeps what a node needs to rejoin its cluster after a restart. Each method must have
+// made its change durable when it returns: the node calls them before answering the RPC or
+// counting the entry that depends on the change. Calls are serialized by the node.
+type Storage interface {
+	// Load returns everything stored, the zero values for a node that never ran. The entries
+	// follow the snapshot without gaps.
+	Load() (HardState, Snapshot, []Entry, error)
+	SaveState(st HardState) error
+	// Append stores entries, replacing every stored entry from the index of the first one on
+	Append(entries []Entry) error
+	// SaveSnapshot replaces the log with snap followed by entries
+	SaveSnapshot(snap Snapshot, entries []Entry) error
+}
+
+var (
+	_ Storage = (*MemoryStorage)(nil)
+	_ Storage = (*FileStorage)(nil)
+)
+
+// MemoryStorage keeps the state in memory, it only survives restarts of a node within the
+// same process and is the default when Config.Storage is nil
+type MemoryStorage struct {
+	mu      sync.Mutex
+	state   HardState
+	snap    Snapshot
+	entries []Entry
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+func (s *MemoryStorage) Load() (HardState, Snapshot, []Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, s.snap, slices.Clone(s.entries), nil
+}
+
+func (s *MemoryStorage) SaveState(st HardState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = st
+	return nil
+}
+
+func (s *MemoryStorage) Append(entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = appendEntries(s.entries, s.snap.Index, entries)
+	return nil
+}
+
+func (s *MemoryStorage) SaveSnapshot(snap Snapshot, entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snap = snap
+	s.entries = slices.Clone(entries)
+	return nil
+}
+
+// appendEntries applies the semantics of Storage.Append to log, which follows a snapshot at base
+func appendEntries(log []Entry, base uint64, entries []Entry) []Entry {
+	if len(entries) == 0 {
+		return log
+	}
+	keep := min(uint64(len(log)), entries[0].Index-base-1)
+	return append(log[:keep:keep], entries...)
+}
+
+// FileStorage keeps the state in a directory, writing every change through to disk with fsync.
+// The hard state and the snapshot are replaced atomically by renaming a new file over them, the
+// entries are appended to a log file that is started over at each snapshot.
+type FileStorage struct {
+	mu      sync.Mutex
+	dir     string
+	gen     uint64
+	snap    Snapshot
+	entries []Entry
+	log     *os.File
+}
+
+// fileSnapshot is the content of the snapshot file, Log is the generation of the log file
+// holding the entries that follow it
+type fileSnapshot struct {
+	Snapshot
+	Log uint64
+}
+
+// OpenFileStorage opens the state kept in dir, creating the directory if needed
+func OpenFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &FileStorage{dir: dir}
+	var fsnap fileSnapshot
+	if err := readJSON(filepath.Join(dir, "snapshot.json"), &fsnap); err != nil {
+		return nil, err
+	}
+	s.gen, s.snap = fsnap.Log, fsnap.Snapshot
+	entries, size, err := readLog(s.logPath(s.gen), s.snap.Index)
+	if err != nil {
+		return nil, err
+	}
+	s.entries = entries
+	if s.log, err = os.OpenFile(s.logPath(s.gen), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600); err != nil {
+		return nil, err
+	}
+	// drop a torn last line so the next entries start on a line of their own
+	if err := s.log.Truncate(size); err != nil {
+		s.log.Close()
+		return nil, err
+	}
+	s.removeStaleLogs()
+	return s, nil
+}
+
+// Close releases the log file, the storage must not be used afterwards
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.Close()
+}
+
+func (s *FileStorage) Load() (HardState, Snapshot, []Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var st HardState
+	if err := readJSON(filepath.Join(s.dir, "state.json"), &st); err != nil {
+		return HardState{}, Snapshot{}, nil, err
+	}
+	return st, s.snap, slices.Clone(s.entries), nil
+}
+
+func (s *FileStorage) SaveState(st HardState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeJSON(s.dir, "state.json", st)
+}
+
+// Append writes entries at the end of the log file, entries replacing others are resolved when
+// the file is read back
+func (s *FileStorage) Append(entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if _, err := s.log.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	s.entries = appendEntries(s.entries, s.snap.Index, entries)
+	return nil
+}
+
+// SaveSnapshot writes entries to a new log file, then switches to it by replacing the snapshot
+// file, so a crash in between leaves the previous snapshot and log in place
+func (s *FileStorage) SaveSnapshot(snap Snapshot, entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gen := s.gen + 1
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if err := writeFile(s.dir, filepath.Base(s.logPath(gen)), buf.Bytes()); err != nil {
+		return err
+	}
+	if err := writeJSON(s.dir, "snapshot.json", fileSnapshot{Snapshot: snap, Log: gen}); err != nil {
+		return err
+	}
+	log, err := os.OpenFile(s.logPath(gen), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	s.log.Close()
+	s.log, s.gen, s.snap, s.entries = log, gen, snap, slices.Clone(entries)
+	s.removeStaleLogs()
+	return nil
+}
+
+func (s *FileStorage) logPath(gen uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("log-%d.jsonl", gen))
+}
+
+// removeStaleLogs deletes the log files of other generations, left behind by snapshots
+func (s *FileStorage) removeStaleLogs() {
+	matches, _ := filepath.Glob(filepath.Join(s.dir, "log-*.jsonl"))
+	for _, m := range matches {
+		if m != s.logPath(s.gen) {
+			_ = os.Remove(m)
+		}
+	}
+}
+
+// readLog replays the log file at path over a snapshot at base and returns the length of its
+// complete lines. A last line cut short by a crash is left out, it was never acknowledged.
+func readLog(path string, base uint64) ([]Entry, int64, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+	var entries []Entry
+	for i, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, 0, fmt.Errorf("%s line %d: %w", path, i+1, err)
+		}
+		if e.Index <= base || e.Index > base+uint64(len(entries))+1 {
+			return nil, 0, fmt.Errorf("%s line %d: entry %d does not follow the log", path, i+1, e.Index)
+		}
+		entries = appendEntries(entries, base, []Entry{e})
+	}
+	return entries, int64(len(data)), nil
+}
+
+// readJSON decodes the file at path into v, leaving v alone when the file does not exist
+func readJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func writeJSON(dir string, name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFile(dir, name, data)
+}
+
+// writeFile durably replaces dir/name with data: the data is synced to a temporary file that is
+// renamed over the target, then the directory is synced so the rename survives a crash
+func writeFile(dir string, name string, data []byte) error {
+	tmp, err := os.CreateTemp(dir, "."+name+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,186 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+)
+
+// ErrUnreachable is returned by transports when the target node cannot be contacted
+var ErrUnreachable = errors.New("node unreachable")
+
+type EntryType int
+
+const (
+	ENTRY_NOOP    EntryType = iota
+	ENTRY_COMMAND EntryType = iota
+	ENTRY_CONFIG  EntryType = iota
+)
+
+// Entry is a single record of the replicated log, Data holds the JSON encoded
+// operations of a command or the member list of a configuration change
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Type  EntryType
+	Data  []byte
+}
+
+type RequestVoteRequest struct {
+	Term         uint64
+	Candidate    string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RequestVoteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+type AppendEntriesRequest struct {
+	Term         uint64
+	Leader       string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+type AppendEntriesResponse struct {
+	Term    uint64
+	Success bool
+	// ConflictIndex is the index the leader should retry from after a rejection
+	ConflictIndex uint64
+}
+
+type InstallSnapshotRequest struct {
+	Term      uint64
+	Leader    string
+	LastIndex uint64
+	LastTerm  uint64
+	Members   []string
+	Data      []byte
+}
+
+type InstallSnapshotResponse struct {
+	Term uint64
+}
+
+// Handler receives the RPCs addressed to a node, Node implements it
+type Handler interface {
+	HandleRequestVote(req *RequestVoteRequest) *RequestVoteResponse
+	HandleAppendEntries(req *AppendEntriesRequest) *AppendEntriesResponse
+	HandleInstallSnapshot(req *InstallSnapshotRequest) *InstallSnapshotResponse
+}
+
+// Transport carries RPCs between nodes. Bind is called once by NewNode with the node
+// that must receive the RPCs sent to it. Implementations must not retain or modify the
+// requests after the call returns.
+type Transport interface {
+	Bind(h Handler)
+	RequestVote(ctx context.Context, to string, req *RequestVoteRequest) (*RequestVoteResponse, error)
+	AppendEntries(ctx context.Context, to string, req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	InstallSnapshot(ctx context.Context, to string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+}
+
+// InMemNetwork connects nodes living in the same process, it can cut nodes off to simulate partitions
+type InMemNetwork struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+	down     map[string]bool
+}
+
+func NewInMemNetwork() *InMemNetwork {
+	return &InMemNetwork{
+		handlers: make(map[string]Handler),
+		down:     make(map[string]bool),
+	}
+}
+
+// Transport returns the endpoint of the node id on this network
+func (n *InMemNetwork) Transport(id string) Transport {
+	return &inMemTransport{net: n, id: id}
+}
+
+// Disconnect drops every message from and to id until Reconnect is called
+func (n *InMemNetwork) Disconnect(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[id] = true
+}
+
+func (n *InMemNetwork) Reconnect(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.down, id)
+}
+
+func (n *InMemNetwork) route(from string, to string) (Handler, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	h, ok := n.handlers[to]
+	if !ok || n.down[from] || n.down[to] {
+		return nil, ErrUnreachable
+	}
+	return h, nil
+}
+
+type inMemTransport struct {
+	net *InMemNetwork
+	id  string
+}
+
+func (t *inMemTransport) Bind(h Handler) {
+	t.net.mu.Lock()
+	defer t.net.mu.Unlock()
+	t.net.handlers[t.id] = h
+}
+
+// call runs f on the target handler, giving up when ctx is done
+func call[T any](ctx context.Context, t *inMemTransport, to string, f func(h Handler) T) (T, error) {
+	var zero T
+	h, err := t.net.route(t.id, to)
+	if err != nil {
+		return zero, err
+	}
+	ch := make(chan T, 1)
+	go func() {
+		ch <- f(h)
+	}()
+	select {
+	case res := <-ch:
+		// a partition may have happened while the call was in flight
+		if _, err := t.net.route(t.id, to); err != nil {
+			return zero, err
+		}
+		return res, nil
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+func (t *inMemTransport) RequestVote(ctx context.Context, to string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	r := *req
+	return call(ctx, t, to, func(h Handler) *RequestVoteResponse {
+		return h.HandleRequestVote(&r)
+	})
+}
+
+func (t *inMemTransport) AppendEntries(ctx context.Context, to string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	r := *req
+	r.Entries = slices.Clone(req.Entries)
+	return call(ctx, t, to, func(h Handler) *AppendEntriesResponse {
+		return h.HandleAppendEntries(&r)
+	})
+}
+
+func (t *inMemTransport) InstallSnapshot(ctx context.Context, to string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	r := *req
+	r.Members = slices.Clone(req.Members)
+	r.Data = slices.Clone(req.Data)
+	return call(ctx, t, to, func(h Handler) *InstallSnapshotResponse {
+		return h.HandleInstallSnapshot(&r)
+	})
+}
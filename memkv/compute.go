@@ -0,0 +1,178 @@
+package memkv
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrComputeCycle = errors.New("computed keys depend on each other")
+
+// ComputeFunc derives the value of a computed key from other keys, read through r. It runs
+// with the store locked and must not call the store by any other way.
+type ComputeFunc func(r *Reader) (any, error)
+
+// Reader reads the store for a ComputeFunc, every key read becomes a dependency of the
+// computed key, including keys that were missing
+type Reader struct {
+	m    *MemKV
+	deps map[string]struct{}
+}
+
+// Get returns a deep copy of the value at key
+func (r *Reader) Get(key string) (any, bool) {
+	key = r.m.normalize(key)
+	r.deps[key] = struct{}{}
+	v, ok := lookup(r.m.m, r.m.split(key))
+	if !ok {
+		return nil, false
+	}
+	return DeepCopy(v), true
+}
+
+type computed struct {
+	fn   ComputeFunc
+	deps map[string]struct{}
+	err  error
+}
+
+// SetComputed makes key hold the value fn computes. The value is computed right away and again
+// whenever a key fn read last time changes, reading a key space depends on everything below it.
+// Recomputing only stores and dispatches an update when the value changed, so computed keys
+// depending on computed keys cascade. Registrations making a computed key depend on itself,
+// directly or through other computed keys, are refused with ErrComputeCycle.
+//
+// Writing a computed key directly is not prevented, the value is replaced on the next recompute.
+func (m *MemKV) SetComputed(key string, fn ComputeFunc) error {
+	m.lock()
+	defer m.l.Unlock()
+	spelled := spellDraft{}
+	key = m.spell(spelled, m.m, key)
+	if key == "" {
+		return ErrEmptyKey
+	}
+	c := &computed{fn: fn}
+	val, deps, err := m.compute(c)
+	if err != nil {
+		return err
+	}
+	c.deps = deps
+	if path := m.dependsOn(key, deps, map[string]bool{}); path != "" {
+		return fmt.Errorf("%w: %s -> %s", ErrComputeCycle, key, path)
+	}
+	prev, had := m.computed[key]
+	m.computed[key] = c
+	if err := m.storeComputed(key, val); err != nil {
+		if had {
+			m.computed[key] = prev
+		} else {
+			delete(m.computed, key)
+		}
+		return err
+	}
+	m.install(spelled)
+	return nil
+}
+
+// RemoveComputed turns key back into a plain key keeping its last value
+func (m *MemKV) RemoveComputed(key string) {
+	m.lock()
+	defer m.l.Unlock()
+	delete(m.computed, m.normalize(key))
+}
+
+// ComputedErr returns why the last recompute of key failed, the key keeps its previous value
+// meanwhile. ErrNotFound is returned for keys that are not computed.
+func (m *MemKV) ComputedErr(key string) error {
+	m.rlock()
+	defer m.l.RUnlock()
+	c, ok := m.computed[m.normalize(key)]
+	if !ok {
+		return ErrNotFound
+	}
+	return c.err
+}
+
+func (m *MemKV) compute(c *computed) (any, map[string]struct{}, error) {
+	r := &Reader{m: m, deps: make(map[string]struct{})}
+	val, err := c.fn(r)
+	return val, r.deps, err
+}
+
+// dependsOn returns the chain of computed keys leading from deps back to key, empty if none does
+func (m *MemKV) dependsOn(key string, deps map[string]struct{}, seen map[string]bool) string {
+	if m.affects(key, deps) {
+		return key
+	}
+	for _, ck := range sortedKeys(m.computed) {
+		if ck == key || seen[ck] || !m.affects(ck, deps) {
+			continue
+		}
+		seen[ck] = true
+		if path := m.dependsOn(key, m.computed[ck].deps, seen); path != "" {
+			return ck + " -> " + path
+		}
+	}
+	return ""
+}
+
+// affects reports whether a change at key can change one of deps
+func (m *MemKV) affects(key string, deps map[string]struct{}) bool {
+	for d := range deps {
+		if m.underPrefix(key, d) || m.underPrefix(d, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// recomputeDependents recomputes every computed key depending on key, the write lock must be
+// held. It runs for every change dispatched, recomputes dispatch changes of their own.
+func (m *MemKV) recomputeDependents(key string) {
+	for _, ck := range sortedKeys(m.computed) {
+		if ck != key && !m.computing[ck] && m.affects(key, m.computed[ck].deps) {
+			m.refresh(ck)
+		}
+	}
+}
+
+// recomputeAll brings every computed key up to date after the tree was replaced
+func (m *MemKV) recomputeAll() {
+	for _, ck := range sortedKeys(m.computed) {
+		m.refresh(ck)
+	}
+}
+
+// refresh recomputes ck and stores the value if it changed, failures keep the old value and
+// are dispatched as failed updates
+func (m *MemKV) refresh(ck string) {
+	c := m.computed[ck]
+	m.computing[ck] = true
+	defer delete(m.computing, ck)
+	val, deps, err := m.compute(c)
+	if err == nil {
+		c.deps = deps
+		if cur, ok := lookup(m.m, m.split(ck)); !ok || !sameValue(cur, val) {
+			err = m.storeComputed(ck, val)
+		}
+	}
+	c.err = err
+	if err != nil {
+		m.dispatchWatchers(Event{Key: ck, Type: E_KEY_UPDATED, When: time.Now(), FailReason: err.Error()})
+	}
+}
+
+// storeComputed sets key to val and dispatches the change
+func (m *MemKV) storeComputed(key string, val any) error {
+	root, e, err := m.mutate(key, func(root map[string]any) (Event, error) {
+		return setIn(root, m.split(key), DeepCopy(val))
+	})
+	if err != nil {
+		return err
+	}
+	m.m = root
+	e.Key = key
+	e.NewVal = val
+	m.dispatchWatchers(e)
+	return nil
+}
@@ -0,0 +1,95 @@
+package memkv
+
+import "reflect"
+
+// DeepCopy returns a copy of v that shares no mutable state reachable through maps, slices or
+// arrays with v. Pointers, channels and functions are copied by reference, structs are copied by
+// value with their fields copied recursively.
+//
+// Structs with unexported fields are opaque: they are copied by value as a whole and their maps
+// and slices stay shared, since their invariants, such as the state of a sync.Mutex or the self
+// pointer of a strings.Builder, are theirs to keep. Store such values by pointer or treat them as
+// immutable.
+// MemKV copies every value it stores or hands out with it, so callers can never alias its state
+// beyond the opaque structs above.
+func DeepCopy(v any) any {
+	switch t := v.(type) {
+	case nil, string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64,
+		float32, float64, complex64, complex128:
+		return v
+	case map[string]any:
+		out := make(map[string]any, len(t))
+		for k, child := range t {
+			out[k] = DeepCopy(child)
+		}
+		return out
+	case []any:
+		out := make([]any, len(t))
+		for i, child := range t {
+			out[i] = DeepCopy(child)
+		}
+		return out
+	case []byte:
+		if t == nil {
+			return t
+		}
+		return append([]byte{}, t...)
+	case []string:
+		if t == nil {
+			return t
+		}
+		return append([]string{}, t...)
+	}
+	rv := reflect.ValueOf(v)
+	return copyValue(rv).Interface()
+}
+
+func copyValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(v.Type()).Elem()
+		out.Set(copyValue(v.Elem()))
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out.SetMapIndex(iter.Key(), copyValue(iter.Value()))
+		}
+		return out
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(copyValue(v.Index(i)))
+		}
+		return out
+	case reflect.Array:
+		out := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(copyValue(v.Index(i)))
+		}
+		return out
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Type().Field(i).IsExported() {
+				return v
+			}
+		}
+		out := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			out.Field(i).Set(copyValue(v.Field(i)))
+		}
+		return out
+	default:
+		return v
+	}
+}
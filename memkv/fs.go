@@ -0,0 +1,214 @@
+package memkv
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FS presents the key space at a prefix of a store as a read-only fs.FS. Key spaces are
+// directories and other values files, strings and []byte hold their raw content and every other
+// value its JSON encoding. Opening a file or directory reads the store as it is at that moment.
+//
+// Modification times come from the last event seen on a key or below a directory, content that
+// has not changed since the FS was created reports its creation time. Reading through the FS
+// dispatches no access events.
+type FS struct {
+	kv      *MemKV
+	prefix  string
+	created time.Time
+	mu      sync.Mutex
+	mtimes  map[string]time.Time
+	cancel  func()
+}
+
+var _ fs.FS = (*FS)(nil)
+
+// NewFS returns the key space at prefix as a filesystem, an empty prefix exposes the whole
+// store. Close stops tracking modification times.
+func NewFS(kv *MemKV, prefix string) *FS {
+	f := &FS{kv: kv, prefix: kv.normalize(prefix), created: time.Now(), mtimes: make(map[string]time.Time)}
+	f.cancel = kv.AddPrefixWatcherHook(prefix, func(e Event) {
+		if !e.Success {
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if e.Type == E_KEY_DELETED {
+			delete(f.mtimes, e.Key)
+		} else {
+			f.mtimes[e.Key] = e.When
+		}
+		// the directories holding the key changed as well
+		for k := e.Key; k != f.prefix && k != ""; {
+			i := strings.LastIndex(k, kv.sep)
+			if i < 0 {
+				k = ""
+			} else {
+				k = k[:i]
+			}
+			f.mtimes[k] = e.When
+		}
+	}, []EventType{E_KEY_CREATED, E_KEY_UPDATED, E_KEY_DELETED})
+	return f
+}
+
+// Close stops tracking modification times, files opened later report the last ones seen
+func (f *FS) Close() {
+	f.cancel()
+}
+
+// key returns the normalized key for a path of the filesystem
+func (f *FS) key(name string) string {
+	if name == "." {
+		return f.prefix
+	}
+	return joinKey(f.prefix, f.kv.normalize(strings.ReplaceAll(name, "/", f.kv.sep)), f.kv.sep)
+}
+
+func (f *FS) modTime(key string) time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t, ok := f.mtimes[key]; ok {
+		return t
+	}
+	return f.created
+}
+
+// Open opens the file or directory at name
+func (f *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) || (name != "." && strings.Contains(name, f.kv.sep) && f.kv.sep != "/") {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	key := f.key(name)
+	m := f.kv
+	m.rlock()
+	defer m.l.RUnlock()
+	var v any = m.m
+	if key != "" {
+		var ok bool
+		if v, ok = lookup(m.m, m.split(key)); !ok {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	base := name
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		base = name[i+1:]
+	}
+	ks, isDir := v.(map[string]any)
+	if !isDir {
+		data, err := fileContent(v)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		info := &fileInfo{name: base, size: int64(len(data)), modTime: f.modTime(key)}
+		return &memFile{info: info, r: bytes.NewReader(data)}, nil
+	}
+	dir := &memDir{info: &fileInfo{name: base, dir: true, modTime: f.modTime(key)}}
+	for _, k := range sortedKeys(ks) {
+		child := joinKey(key, k, m.sep)
+		entry := k
+		if d, ok := m.spelling[child]; ok {
+			entry = d
+		}
+		// names must be valid path elements to be opened again
+		if strings.Contains(entry, "/") || entry == "." || entry == ".." {
+			continue
+		}
+		info := &fileInfo{name: entry, modTime: f.modTime(child)}
+		if _, ok := ks[k].(map[string]any); ok {
+			info.dir = true
+		} else {
+			data, err := fileContent(ks[k])
+			if err != nil {
+				continue
+			}
+			info.size = int64(len(data))
+		}
+		dir.entries = append(dir.entries, fs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(dir.entries, func(i, j int) bool { return dir.entries[i].Name() < dir.entries[j].Name() })
+	return dir, nil
+}
+
+// fileContent returns strings and []byte as they are and everything else as JSON
+func fileContent(v any) ([]byte, error) {
+	switch t := v.(type) {
+	case string:
+		return []byte(t), nil
+	case []byte:
+		return append([]byte{}, t...), nil
+	}
+	return json.Marshal(v)
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) ModTime() time.Time { return i.modTime }
+func (i *fileInfo) IsDir() bool        { return i.dir }
+func (i *fileInfo) Sys() any           { return nil }
+
+func (i *fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+// memFile is an open leaf, it also implements io.Seeker and io.ReaderAt for http.FileServer
+type memFile struct {
+	info *fileInfo
+	r    *bytes.Reader
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Read(b []byte) (int, error) { return f.r.Read(b) }
+func (f *memFile) Close() error               { return nil }
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	return f.r.Seek(offset, whence)
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	return f.r.ReadAt(b, off)
+}
+
+// memDir is an open key space, its entries were read when it was opened
+type memDir struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *memDir) Close() error               { return nil }
+
+func (d *memDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(rest))
+	d.offset += n
+	return rest[:n], nil
+}
@@ -0,0 +1,205 @@
+package memkv
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var ErrNoIndex = errors.New("no such index")
+
+// IndexFunc returns the index values of a record, key is its full key and val its value, which
+// is shared with the store and must not be changed. Strings and numbers can be indexed, other
+// values are ignored. It runs with the store locked and must not call the store.
+type IndexFunc func(key string, val any) []any
+
+// index maps the values IndexFunc returned for the records below prefix back to the records
+type index struct {
+	prefix string
+	fn     IndexFunc
+	// byKey holds the index values of every record, keys maps each value back to its records
+	byKey map[string][]any
+	keys  map[any]map[string]struct{}
+	// values holds the distinct values in order for range lookups
+	values []any
+}
+
+// AddIndex registers an index called name over the records of the key space at prefix, every
+// direct child of it is a record. The index is built right away and kept up to date with every
+// change under the store lock, so lookups always agree with the content. Adding an index under
+// an existing name replaces it.
+func (m *MemKV) AddIndex(name string, prefix string, fn IndexFunc) {
+	m.lock()
+	defer m.l.Unlock()
+	ix := &index{prefix: m.normalize(prefix), fn: fn}
+	ix.rebuild(m)
+	m.indexes[name] = ix
+}
+
+// DropIndex removes the index called name
+func (m *MemKV) DropIndex(name string) {
+	m.lock()
+	defer m.l.Unlock()
+	delete(m.indexes, name)
+}
+
+// IndexLookup returns the records whose index values include val sorted by key. Numbers
+// match regardless of their type.
+func (m *MemKV) IndexLookup(name string, val any) ([]Match, error) {
+	m.rlock()
+	defer m.l.RUnlock()
+	ix, ok := m.indexes[name]
+	if !ok {
+		return nil, ErrNoIndex
+	}
+	out := make([]Match, 0)
+	if v, ok := indexValue(val); ok {
+		for _, k := range sortedKeys(ix.keys[v]) {
+			out = append(out, m.indexMatch(k))
+		}
+	}
+	return out, nil
+}
+
+// IndexRange returns the records with an index value from from up to but excluding to, ordered
+// by that value and then by key. A nil bound leaves that side open. Numbers sort before strings,
+// a record with several values in the range is returned once.
+func (m *MemKV) IndexRange(name string, from any, to any) ([]Match, error) {
+	m.rlock()
+	defer m.l.RUnlock()
+	ix, ok := m.indexes[name]
+	if !ok {
+		return nil, ErrNoIndex
+	}
+	lo, hi := 0, len(ix.values)
+	if from != nil {
+		v, ok := indexValue(from)
+		if !ok {
+			return nil, ErrWrongType
+		}
+		lo = ix.search(v)
+	}
+	if to != nil {
+		v, ok := indexValue(to)
+		if !ok {
+			return nil, ErrWrongType
+		}
+		hi = ix.search(v)
+	}
+	out := make([]Match, 0)
+	seen := map[string]bool{}
+	for i := lo; i < hi; i++ {
+		for _, k := range sortedKeys(ix.keys[ix.values[i]]) {
+			if !seen[k] {
+				seen[k] = true
+				out = append(out, m.indexMatch(k))
+			}
+		}
+	}
+	return out, nil
+}
+
+func (m *MemKV) indexMatch(key string) Match {
+	v, _ := lookup(m.m, m.split(key))
+	return Match{Key: key, Value: DeepCopy(v)}
+}
+
+// reindex updates the indexes after a change at key, the write lock must be held
+func (m *MemKV) reindex(key string) {
+	for _, ix := range m.indexes {
+		switch {
+		case m.underPrefix(ix.prefix, key):
+			ix.rebuild(m)
+		case m.underPrefix(key, ix.prefix):
+			rest := key
+			if ix.prefix != "" {
+				rest = key[len(ix.prefix)+len(m.sep):]
+			}
+			if i := strings.Index(rest, m.sep); i >= 0 {
+				rest = rest[:i]
+			}
+			ix.update(m, joinKey(ix.prefix, rest, m.sep))
+		}
+	}
+}
+
+// rebuildIndexes rebuilds every index after the tree was replaced
+func (m *MemKV) rebuildIndexes() {
+	for _, ix := range m.indexes {
+		ix.rebuild(m)
+	}
+}
+
+func (ix *index) rebuild(m *MemKV) {
+	ix.byKey = make(map[string][]any)
+	ix.keys = make(map[any]map[string]struct{})
+	ix.values = nil
+	var root any = m.m
+	if ix.prefix != "" {
+		root, _ = lookup(m.m, m.split(ix.prefix))
+	}
+	ks, _ := root.(map[string]any)
+	for k := range ks {
+		ix.update(m, joinKey(ix.prefix, k, m.sep))
+	}
+}
+
+// update replaces the index values of the record at key with the current ones
+func (ix *index) update(m *MemKV, key string) {
+	for _, v := range ix.byKey[key] {
+		delete(ix.keys[v], key)
+		if len(ix.keys[v]) == 0 {
+			delete(ix.keys, v)
+			i := ix.search(v)
+			ix.values = append(ix.values[:i], ix.values[i+1:]...)
+		}
+	}
+	delete(ix.byKey, key)
+	val, ok := lookup(m.m, m.split(key))
+	if !ok {
+		return
+	}
+	for _, raw := range ix.fn(key, val) {
+		v, ok := indexValue(raw)
+		if !ok {
+			continue
+		}
+		if _, exists := ix.keys[v]; !exists {
+			ix.keys[v] = make(map[string]struct{})
+			i := ix.search(v)
+			ix.values = append(ix.values, nil)
+			copy(ix.values[i+1:], ix.values[i:])
+			ix.values[i] = v
+		}
+		if _, dup := ix.keys[v][key]; !dup {
+			ix.keys[v][key] = struct{}{}
+			ix.byKey[key] = append(ix.byKey[key], v)
+		}
+	}
+}
+
+// search returns the position of the first value not below v
+func (ix *index) search(v any) int {
+	return sort.Search(len(ix.values), func(i int) bool { return compareIndex(ix.values[i], v) >= 0 })
+}
+
+// indexValue turns numbers into float64 so they match across types, only numbers and strings
+// can be indexed
+func indexValue(v any) (any, bool) {
+	if f, ok := toFloat(v); ok {
+		return f, f == f
+	}
+	s, ok := v.(string)
+	return s, ok
+}
+
+// compareIndex orders index values, numbers before strings
+func compareIndex(a any, b any) int {
+	if c, ok := compareValues(a, b); ok {
+		return c
+	}
+	if _, isNum := a.(float64); isNum {
+		return -1
+	}
+	return 1
+}
@@ -0,0 +1,363 @@
+package memkv
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// LEASE_KEYSPACE holds the state leases keep in the store, currently the fencing token counter
+const LEASE_KEYSPACE = "__lease"
+
+var (
+	ErrLeaseNotFound = errors.New("lease not found or expired")
+	ErrLocked        = errors.New("key is locked")
+	ErrLockLost      = errors.New("lock was lost")
+)
+
+// LeaseID names a lease of a Lessor, IDs are never reused
+type LeaseID uint64
+
+type lease struct {
+	ttl     time.Duration
+	expires time.Time
+	keys    map[string]struct{}
+	timer   *time.Timer
+}
+
+// Lessor grants leases on a store. Keys attached to a lease are dropped, with the usual delete
+// events, once it expires or is revoked. A key belongs to at most one lease, deleting it
+// detaches it.
+//
+// The store must not be reached through the lessor from its own watch hooks.
+type Lessor struct {
+	kv     *MemKV
+	mu     sync.Mutex
+	leases map[LeaseID]*lease
+	keys   map[string]LeaseID
+	lastID LeaseID
+	closed bool
+	cancel func()
+}
+
+// NewLessor returns a lessor for kv, Close stops its timers
+func NewLessor(kv *MemKV) *Lessor {
+	l := &Lessor{kv: kv, leases: make(map[LeaseID]*lease), keys: make(map[string]LeaseID)}
+	l.cancel = kv.AddPrefixWatcherHook("", func(e Event) {
+		if !e.Success {
+			return
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if id, ok := l.keys[e.Key]; ok {
+			delete(l.keys, e.Key)
+			if ls := l.leases[id]; ls != nil {
+				delete(ls.keys, e.Key)
+			}
+		}
+	}, []EventType{E_KEY_DELETED})
+	return l
+}
+
+// Close stops every lease timer and forgets the leases without dropping their keys
+func (l *Lessor) Close() {
+	l.cancel()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	for id, ls := range l.leases {
+		ls.timer.Stop()
+		delete(l.leases, id)
+	}
+	l.keys = make(map[string]LeaseID)
+}
+
+// Grant creates a lease expiring after ttl unless it is kept alive
+func (l *Lessor) Grant(ttl time.Duration) (LeaseID, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, ErrLeaseNotFound
+	}
+	l.lastID++
+	id := l.lastID
+	l.leases[id] = &lease{
+		ttl:     ttl,
+		expires: time.Now().Add(ttl),
+		keys:    make(map[string]struct{}),
+		timer:   time.AfterFunc(ttl, func() { l.expire(id) }),
+	}
+	return id, nil
+}
+
+// KeepAlive restarts the TTL of the lease and returns when it now expires
+func (l *Lessor) KeepAlive(id LeaseID) (time.Time, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ls, ok := l.leases[id]
+	if !ok {
+		return time.Time{}, ErrLeaseNotFound
+	}
+	ls.expires = time.Now().Add(ls.ttl)
+	ls.timer.Reset(ls.ttl)
+	return ls.expires, nil
+}
+
+// TTL returns how long the lease has left
+func (l *Lessor) TTL(id LeaseID) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ls, ok := l.leases[id]
+	if !ok {
+		return 0, ErrLeaseNotFound
+	}
+	return max(0, time.Until(ls.expires)), nil
+}
+
+// Keys returns the keys attached to the lease
+func (l *Lessor) Keys(id LeaseID) ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ls, ok := l.leases[id]
+	if !ok {
+		return nil, ErrLeaseNotFound
+	}
+	return sortedKeys(ls.keys), nil
+}
+
+// Revoke ends the lease now and drops its keys
+func (l *Lessor) Revoke(id LeaseID) error {
+	keys, ok := l.end(id, false)
+	if !ok {
+		return ErrLeaseNotFound
+	}
+	l.drop(id, keys)
+	return nil
+}
+
+// expire ends the lease when its timer fired and no keepalive came in meanwhile
+func (l *Lessor) expire(id LeaseID) {
+	if keys, ok := l.end(id, true); ok {
+		l.drop(id, keys)
+	}
+}
+
+// end removes the lease and returns its keys, with due set only if it is past its expiry. The
+// keys stay assigned to the lease until drop, so a key attached elsewhere meanwhile is spared.
+func (l *Lessor) end(id LeaseID, due bool) ([]string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ls, ok := l.leases[id]
+	if !ok || (due && time.Now().Before(ls.expires)) {
+		return nil, false
+	}
+	ls.timer.Stop()
+	delete(l.leases, id)
+	return sortedKeys(ls.keys), true
+}
+
+// drop deletes the keys of the ended lease id from the store, each only if it still belongs to
+// the lease when the store is locked for its deletion. They may be gone already.
+func (l *Lessor) drop(id LeaseID, keys []string) {
+	for _, k := range keys {
+		l.kv.dropAs("", k, true, func() error {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.keys[k] != id {
+				return ErrLeaseNotFound
+			}
+			return nil
+		})
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, k := range keys {
+		if l.keys[k] == id {
+			delete(l.keys, k)
+		}
+	}
+}
+
+// Attach ties an existing key to the lease, moving it from the lease it belonged to before
+func (l *Lessor) Attach(id LeaseID, key string) error {
+	if !l.kv.Contains(key) {
+		return ErrNotFound
+	}
+	return l.attach(id, l.kv.normalize(key))
+}
+
+func (l *Lessor) attach(id LeaseID, key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ls, ok := l.leases[id]
+	if !ok {
+		return ErrLeaseNotFound
+	}
+	if prev, ok := l.keys[key]; ok && l.leases[prev] != nil {
+		delete(l.leases[prev].keys, key)
+	}
+	l.keys[key] = id
+	ls.keys[key] = struct{}{}
+	return nil
+}
+
+// Detach releases key from its lease, it then lives on like any other key
+func (l *Lessor) Detach(key string) {
+	key = l.kv.normalize(key)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if id, ok := l.keys[key]; ok {
+		delete(l.keys, key)
+		if ls := l.leases[id]; ls != nil {
+			delete(ls.keys, key)
+		}
+	}
+}
+
+// Set stores val at key and attaches key to the lease. If the lease ends while the value is
+// being stored the key is dropped again and ErrLeaseNotFound returned.
+func (l *Lessor) Set(id LeaseID, key string, val any) error {
+	if _, err := l.TTL(id); err != nil {
+		return err
+	}
+	if err := l.kv.SetE(key, val); err != nil {
+		return err
+	}
+	if err := l.attach(id, l.kv.normalize(key)); err != nil {
+		l.kv.Drop(key, true)
+		return err
+	}
+	return nil
+}
+
+// Mutex returns a lock on key held through leases of ttl. The key holds the fencing token of
+// the current holder while the lock is held and is gone otherwise.
+func (l *Lessor) Mutex(key string, ttl time.Duration) *Mutex {
+	return &Mutex{l: l, key: key, ttl: ttl}
+}
+
+// Mutex is a lock stored in a key. Every acquisition gets a fencing token larger than any
+// handed out before by the store, so resources guarded by the lock can refuse writes carrying
+// a token older than the newest they saw, for instance from a holder whose lease expired while
+// it was paused. A Mutex is not safe for concurrent use, give every contender its own.
+type Mutex struct {
+	l     *Lessor
+	key   string
+	ttl   time.Duration
+	lease LeaseID
+	token int64
+}
+
+// TryLock acquires the lock and returns the fencing token, ErrLocked when someone holds it
+func (mu *Mutex) TryLock() (int64, error) {
+	if mu.Token() != 0 {
+		return 0, ErrLocked
+	}
+	kv := mu.l.kv
+	token, err := kv.nextFence()
+	if err != nil {
+		return 0, err
+	}
+	id, err := mu.l.Grant(mu.ttl)
+	if err != nil {
+		return 0, err
+	}
+	if err := kv.Commit(NewTxn().CheckMissing(mu.key).Set(mu.key, token)); err != nil {
+		mu.l.Revoke(id)
+		if errors.Is(err, ErrCheckFailed) {
+			return 0, ErrLocked
+		}
+		return 0, err
+	}
+	if err := mu.l.attach(id, kv.normalize(mu.key)); err != nil {
+		mu.l.kv.Drop(mu.key, true)
+		return 0, err
+	}
+	mu.lease, mu.token = id, token
+	return token, nil
+}
+
+// Lock waits until the lock is acquired or ctx is done
+func (mu *Mutex) Lock(ctx context.Context) (int64, error) {
+	for {
+		released := make(chan struct{}, 1)
+		cancel := mu.l.kv.AddWatcherHook(mu.key, func(Event) {
+			select {
+			case released <- struct{}{}:
+			default:
+			}
+		}, []EventType{E_KEY_DELETED})
+		token, err := mu.TryLock()
+		if !errors.Is(err, ErrLocked) || mu.Token() != 0 {
+			cancel()
+			return token, err
+		}
+		select {
+		case <-released:
+			cancel()
+		case <-ctx.Done():
+			cancel()
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// KeepAlive extends the lease of the held lock by its TTL, ErrLockLost once it expired
+func (mu *Mutex) KeepAlive() error {
+	if mu.token == 0 {
+		return ErrLockLost
+	}
+	if _, err := mu.l.KeepAlive(mu.lease); err != nil {
+		mu.token = 0
+		return ErrLockLost
+	}
+	return nil
+}
+
+// Token returns the fencing token of the held lock, 0 when it is not held
+func (mu *Mutex) Token() int64 {
+	if mu.token != 0 {
+		if _, err := mu.l.TTL(mu.lease); err != nil {
+			mu.token = 0
+		}
+	}
+	return mu.token
+}
+
+// Unlock releases the lock, ErrLockLost when it expired before
+func (mu *Mutex) Unlock() error {
+	if mu.token == 0 {
+		return ErrLockLost
+	}
+	token, id := mu.token, mu.lease
+	mu.token, mu.lease = 0, 0
+	held := mu.l.kv.Commit(NewTxn().Check(mu.key, token).Drop(mu.key, false))
+	if err := mu.l.Revoke(id); err != nil || held != nil {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// nextFence hands out the next fencing token. The counter is stored at LEASE_KEYSPACE.fence so
+// it survives snapshots, and tracked outside the tree too so that writes lowering the stored
+// value, or replacing it with something else, cannot make tokens go down.
+func (m *MemKV) nextFence() (int64, error) {
+	var token int64
+	err := m.update(LEASE_KEYSPACE+m.sep+"fence", func(cur any, exists bool) (any, error) {
+		token = m.fence
+		if exists {
+			if _, n, err := addInt(cur, 0); err == nil {
+				token = max(token, n)
+			}
+		}
+		if token == math.MaxInt64 {
+			return nil, ErrOverflow
+		}
+		token++
+		m.fence = token
+		return token, nil
+	})
+	return token, err
+}
@@ -3,13 +3,19 @@ package memkv
 import (
 	"errors"
 	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Opts struct {
 	CaseInsensitive bool
+	// PreserveCase makes a case insensitive store remember how keys were first written and
+	// use that spelling in listings, copies and snapshots. Keys in events, queries and ACL
+	// patterns stay lower case, DisplayKey translates them.
+	PreserveCase bool
 }
 
 type EventType int
@@ -18,6 +24,38 @@ const (
 	E_KEY_CREATED  = iota
 	E_KEY_UPDATED  = iota
 	E_KEY_ACCESSED = iota
+	E_KEY_DELETED  = iota
+)
+
+var eventNames = map[EventType]string{
+	E_KEY_CREATED:  "created",
+	E_KEY_UPDATED:  "updated",
+	E_KEY_ACCESSED: "accessed",
+	E_KEY_DELETED:  "deleted",
+}
+
+func (t EventType) String() string {
+	if n, ok := eventNames[t]; ok {
+		return n
+	}
+	return "unknown"
+}
+
+// ParseEventType returns the EventType whose String form is s
+func ParseEventType(s string) (EventType, bool) {
+	for t, n := range eventNames {
+		if n == s {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+var (
+	ErrNotFound     = errors.New("key not found")
+	ErrIsKeySpace   = errors.New("key is a key space")
+	ErrPathConflict = errors.New("path crosses a value that is not a key space")
+	ErrEmptyKey     = errors.New("empty key")
 )
 
 type Event struct {
@@ -28,12 +66,15 @@ type Event struct {
 	FailReason string
 	OldVal     any
 	NewVal     any
+	// Principal is the principal a Guard made the change for, empty for unguarded access
+	Principal string
 }
 
 type WatchHook func(e Event)
 type Trigger func(self *MemKV, e Event)
 
 type eHandler struct {
+	id           uint64
 	hook         WatchHook
 	trigger      Trigger
 	eventsFilter []EventType
@@ -43,13 +84,28 @@ type MemKV struct {
 	l         sync.RWMutex
 	sep       string
 	caseSense bool
-	m         map[string]any
-	watchers  map[string][]eHandler
+	// preserveCase keeps the first spelling of every key in spelling, see spell
+	preserveCase bool
+	spelling     map[string]string
+	m            map[string]any
+	watchers     map[string][]eHandler
+	pWatchers    map[string][]eHandler
+	schemas      map[string]*Schema
+	lastID       uint64
+	indexes      map[string]*index
+	computed     map[string]*computed
+	// computing holds the computed keys being recomputed, see recomputeDependents
+	computing map[string]bool
+	metrics   atomic.Pointer[collector]
+	// loadHooks run under the lock after a snapshot replaced the content, see addLoadHook
+	loadHooks map[uint64]func()
+	// fence is the last fencing token handed out, see nextFence
+	fence int64
 }
 
 // NewMemKV returns a new instance of MemKV with the specified separator and options.
 // If opts is nil, default options are used. If CaseInsensitive option is set to true,
-// the keys are treated as case-insensitive.
+// the keys are treated as case-insensitive, PreserveCase additionally keeps their first spelling.
 // If a key contains sep, then it's treated as a path to a nested key
 func NewMemKV(sep string, opts *Opts) *MemKV {
 	s := &MemKV{
@@ -58,6 +114,12 @@ func NewMemKV(sep string, opts *Opts) *MemKV {
 		caseSense: true,
 		m:         make(map[string]any),
 		watchers:  make(map[string][]eHandler),
+		pWatchers: make(map[string][]eHandler),
+		schemas:   make(map[string]*Schema),
+		indexes:   make(map[string]*index),
+		computed:  make(map[string]*computed),
+		computing: make(map[string]bool),
+		loadHooks: make(map[uint64]func()),
 	}
 
 	if opts == nil {
@@ -66,59 +128,125 @@ func NewMemKV(sep string, opts *Opts) *MemKV {
 
 	if opts.CaseInsensitive {
 		s.caseSense = false
+		s.preserveCase = opts.PreserveCase
+	}
+	if s.preserveCase {
+		s.spelling = make(map[string]string)
 	}
 
 	return s
 }
 
+// Separator returns the path separator used by this instance
+func (m *MemKV) Separator() string {
+	return m.sep
+}
+
+// GetSerializableMap returns a deep copy of the store along with the metadata needed to restore it
 func (m *MemKV) GetSerializableMap() map[string]any {
+	return m.snapshotAt("")
+}
+
+// snapshotAt returns a snapshot of the key space at the normalized key prefix, an empty one if
+// there is none
+func (m *MemKV) snapshotAt(prefix string) map[string]any {
+	m.rlock()
+	defer m.l.RUnlock()
+	var v any = m.m
+	if prefix != "" {
+		v, _ = lookup(m.m, m.split(prefix))
+	}
+	ks, ok := v.(map[string]any)
+	if !ok {
+		ks = map[string]any{}
+	}
+	return m.serialize(DeepCopy(ks).(map[string]any), prefix)
+}
+
+// serialize wraps ks, the key space at the normalized key prefix, into a snapshot. ks is
+// retained and must not be shared with the store.
+func (m *MemKV) serialize(ks map[string]any, prefix string) map[string]any {
+	meta := map[string]any{
+		"__serializedProtocol": SERIALIZED_PROTOCOL,
+		"caseSensitive":        m.caseSense,
+		"separator":            m.sep,
+	}
+	if m.preserveCase {
+		meta["preserveCase"] = true
+	}
 	return map[string]any{
-		"__data": m.m,
-		"__meta": map[string]any{
-			"__serializedProtocol": 1,
-			"caseSensitive":        m.caseSense,
-			"separator":            m.sep,
-		},
+		"__data": m.displayTree(ks, prefix),
+		"__meta": meta,
 	}
 }
 
+// LoadFromSerializableMap replaces the content and settings of the store with a snapshot made by
+// GetSerializableMap. Snapshots of older protocols are upgraded first, malformed snapshots and
+// snapshots of a newer protocol are refused with ErrInvalidSnapshot or ErrUnsupportedProtocol
+// and leave the store untouched. data is never retained.
 func (m *MemKV) LoadFromSerializableMap(data map[string]any) error {
-	m.l.Lock()
+	s, err := decodeSnapshot(data)
+	if err != nil {
+		return err
+	}
+	m.lock()
 	defer m.l.Unlock()
-	meta, ok := data["__meta"].(map[string]any)
-	if !ok {
-		return errors.New("meta data not found")
+	if err := m.validateTree(s.data, s.sep); err != nil {
+		return err
 	}
-	m.sep = meta["separator"].(string)
-	m.caseSense = meta["caseSensitive"].(bool)
-	m.m = data["__data"].(map[string]any)
+	m.sep = s.sep
+	m.caseSense = s.caseSense
+	m.preserveCase = s.preserveCase()
+	m.spelling = s.spelling
+	m.m = s.data
+	m.rebuildIndexes()
+	m.recomputeAll()
+	m.runLoadHooks()
 	return nil
 }
 
+// addLoadHook registers fn to run under the lock whenever a snapshot is loaded, loads dispatch
+// no events. The returned function removes the hook.
+func (m *MemKV) addLoadHook(fn func()) func() {
+	m.lock()
+	defer m.l.Unlock()
+	m.lastID++
+	id := m.lastID
+	m.loadHooks[id] = fn
+	return func() {
+		m.lock()
+		defer m.l.Unlock()
+		delete(m.loadHooks, id)
+	}
+}
+
+func (m *MemKV) runLoadHooks() {
+	for _, fn := range m.loadHooks {
+		fn()
+	}
+}
+
+// Get returns a deep copy of the value stored at key, changing it never affects the store.
+// Use GetRef to avoid the copy.
 func (m *MemKV) Get(key string) (any, bool) {
-	m.l.RLock()
+	return m.get(key, true)
+}
+
+// GetRef returns the value stored at key without copying it. The value, and for key spaces
+// every value below it, is shared with the store and must be treated as read-only: changing
+// it bypasses the lock and no event is dispatched for the change.
+func (m *MemKV) GetRef(key string) (any, bool) {
+	return m.get(key, false)
+}
+
+func (m *MemKV) get(key string, copied bool) (any, bool) {
+	m.rlock()
 	defer m.l.RUnlock()
-	if !m.caseSense {
-		key = strings.ToLower(key)
-	}
-	view := m.m
-	keys := strings.Split(key, ".")
-	if strings.Contains(key, ".") {
-		for i, k := range keys {
-			if i == len(keys)-1 {
-				break
-			}
-			viewTemp, ok := view[k].(map[string]any)
-			if !ok {
-				return nil, false
-			}
-			view = viewTemp
-		}
-	}
-	key = keys[len(keys)-1]
-	val, ok := view[key]
+	key = m.normalize(key)
+	val, ok := lookup(m.m, m.split(key))
+	m.countGet(key, ok)
 	if !ok {
-		return nil, ok
+		return nil, false
 	}
 	e := Event{
 		Key:     key,
@@ -127,61 +255,49 @@ func (m *MemKV) Get(key string) (any, bool) {
 		Success: true,
 	}
 	m.dispatchWatchers(e)
+	if copied {
+		val = m.displayTree(DeepCopy(val), key)
+	}
 	return val, true
 }
 
+// Set stores a deep copy of val at key, creating any missing key space on the way
 func (m *MemKV) Set(key string, val any) bool {
-	m.l.Lock()
+	return m.SetE(key, val) == nil
+}
+
+// SetE is Set returning why the value was rejected
+func (m *MemKV) SetE(key string, val any) error {
+	return m.setAs("", key, val, nil)
+}
+
+// setAs sets val at key on behalf of principal once check, if any, allowed it under the lock
+func (m *MemKV) setAs(principal string, key string, val any, check func() error) error {
+	m.lock()
 	defer m.l.Unlock()
-	if !m.caseSense {
-		key = strings.ToLower(key)
-	}
-	view := m.m
-	keys := strings.Split(key, ".")
-	if strings.Contains(key, ".") {
-		for i, k := range keys {
-			if i == len(keys)-1 {
-				break
-			}
-			if v, ok := view[k]; !ok {
-				view[k] = map[string]any{}
-				view = view[k].(map[string]any)
-			} else {
-				viewTemp, ok := v.(map[string]any)
-				if !ok {
-					return false
-				}
-				view = viewTemp
-			}
-		}
+	if err := m.authorize(principal, check); err != nil {
+		return err
 	}
-	key = keys[len(keys)-1]
-	if v, ok := view[key]; !ok {
-		e := Event{
-			Key:     key,
-			Type:    E_KEY_CREATED,
-			NewVal:  val,
-			When:    time.Now(),
-			Success: true,
-		}
-		m.dispatchWatchers(e)
-	} else {
-		e := Event{
-			Key:     key,
-			Type:    E_KEY_UPDATED,
-			NewVal:  val,
-			OldVal:  v,
-			When:    time.Now(),
-			Success: true,
-		}
-		m.dispatchWatchers(e)
+	spelled := spellDraft{}
+	m.spellTree(spelled, m.m, key, val)
+	key = m.spell(spelled, m.m, key)
+	root, e, err := m.mutate(key, func(root map[string]any) (Event, error) {
+		return setIn(root, m.split(key), DeepCopy(val))
+	})
+	if err != nil {
+		return err
 	}
-	view[key] = val
-	return true
+	m.m = root
+	m.install(spelled)
+	e.Key = key
+	e.NewVal = val
+	e.Principal = principal
+	m.dispatchWatchers(e)
+	return nil
 }
 
 func (m *MemKV) Contains(key string) bool {
-	_, ok := m.Get(key)
+	_, ok := m.get(key, false)
 	return ok
 }
 
@@ -190,30 +306,37 @@ func (m *MemKV) Contains(key string) bool {
 // and false otherwise. If deleteKeySpaces is true and the value of
 // the key is a KeySpace type, the entire key space is deleted.
 func (m *MemKV) Drop(key string, deleteKeySpaces bool) bool {
-	if !strings.Contains(key, m.sep) {
-		delete(m.m, key)
-		return true
+	return m.dropAs("", key, deleteKeySpaces, nil) == nil
+}
+
+// dropAs is Drop on behalf of principal, see setAs for check
+func (m *MemKV) dropAs(principal string, key string, deleteKeySpaces bool, check func() error) error {
+	m.lock()
+	defer m.l.Unlock()
+	if err := m.authorize(principal, check); err != nil {
+		return err
 	}
-	if !m.Contains(key) {
-		return false
+	key = m.normalize(key)
+	root, e, err := m.mutate(key, func(root map[string]any) (Event, error) {
+		return dropIn(root, m.split(key), deleteKeySpaces)
+	})
+	if err != nil {
+		return err
 	}
-	if m.IsKeySpace(key) {
-		if !deleteKeySpaces {
-			return false
-		}
+	m.m = root
+	spelled := spellDraft{}
+	m.forget(spelled, key)
+	m.install(spelled)
+	e.Key = key
+	e.Principal = principal
+	for _, e := range dropEvents(e, m.sep) {
+		m.dispatchWatchers(e)
 	}
-	keys := strings.Split(key, m.sep)
-	path := strings.Join(keys[:len(keys)-1], m.sep)
-	key = keys[len(keys)-1]
-	parent, _ := m.Get(path)
-	m.l.Lock()
-	defer m.l.Unlock()
-	delete(parent.(map[string]any), key)
-	return true
+	return nil
 }
 
 func (m *MemKV) IsKeySpace(key string) bool {
-	v, ok := m.Get(key)
+	v, ok := m.get(key, false)
 	if !ok {
 		return false
 	}
@@ -224,9 +347,37 @@ func (m *MemKV) IsKeySpace(key string) bool {
 	return false
 }
 
+// List returns the full path of every leaf key under prefix, sorted. An empty prefix lists the whole store.
+// If prefix names a leaf key, only that key is returned.
+func (m *MemKV) List(prefix string) []string {
+	m.rlock()
+	defer m.l.RUnlock()
+	return m.list(prefix)
+}
+
+// list is List for callers holding the lock
+func (m *MemKV) list(prefix string) []string {
+	prefix = m.normalize(prefix)
+	var root any = m.m
+	if prefix != "" {
+		v, ok := lookup(m.m, m.split(prefix))
+		if !ok {
+			return []string{}
+		}
+		root = v
+	}
+	keys := make([]string, 0)
+	walkLeaves(root, prefix, m.sep, func(k string, _ any) {
+		keys = append(keys, m.display(k))
+	})
+	sort.Strings(keys)
+	return keys
+}
+
 func (m *MemKV) dispatchWatchers(e Event) {
+	start := time.Now()
 	var wg sync.WaitGroup
-	for _, w := range m.watchers[e.Key] {
+	run := func(w eHandler) {
 		if slices.Contains(w.eventsFilter, e.Type) && w.hook != nil {
 			wg.Add(1)
 			go func() {
@@ -235,33 +386,228 @@ func (m *MemKV) dispatchWatchers(e Event) {
 			}()
 		}
 	}
+	for _, w := range m.watchers[e.Key] {
+		run(w)
+	}
+	for p, ws := range m.pWatchers {
+		if !m.underPrefix(e.Key, p) {
+			continue
+		}
+		for _, w := range ws {
+			run(w)
+		}
+	}
 	wg.Wait()
+	m.countEvent(e, time.Since(start))
+	if !e.Success || e.Type == E_KEY_ACCESSED {
+		return
+	}
+	if len(m.indexes) > 0 {
+		m.reindex(e.Key)
+	}
+	if len(m.computed) > 0 {
+		m.recomputeDependents(e.Key)
+	}
 }
 
-func (m *MemKV) AddWatcherHook(key string, hook WatchHook, eFilter []EventType) {
-	m.l.Lock()
+// AddWatcherHook registers hook to be called for every event of a type in eFilter on key.
+// The returned function removes the hook again.
+func (m *MemKV) AddWatcherHook(key string, hook WatchHook, eFilter []EventType) func() {
+	m.lock()
 	defer m.l.Unlock()
-	if !m.caseSense {
-		key = strings.ToLower(key)
-	}
+	return m.addHook(m.watchers, m.normalize(key), hook, eFilter)
+}
 
+// AddPrefixWatcherHook works like AddWatcherHook but hook is called for events on prefix itself
+// and on every key below it. An empty prefix watches the whole store.
+func (m *MemKV) AddPrefixWatcherHook(prefix string, hook WatchHook, eFilter []EventType) func() {
+	m.lock()
+	defer m.l.Unlock()
+	return m.addHook(m.pWatchers, m.normalize(prefix), hook, eFilter)
+}
+
+func (m *MemKV) addHook(set map[string][]eHandler, key string, hook WatchHook, eFilter []EventType) func() {
+	m.lastID++
 	handler := eHandler{
+		id:           m.lastID,
 		hook:         hook,
 		trigger:      nil,
 		eventsFilter: eFilter,
 	}
+	set[key] = append(set[key], handler)
+
+	return func() {
+		m.lock()
+		defer m.l.Unlock()
+		set[key] = slices.DeleteFunc(set[key], func(h eHandler) bool {
+			return h.id == handler.id
+		})
+		if len(set[key]) == 0 {
+			delete(set, key)
+		}
+	}
+}
+
+// ImportMap deep merges data into the store, incoming values win over existing ones.
+// Use MergeMap to pick another strategy.
+func (m *MemKV) ImportMap(data map[string]any) error {
+	return m.MergeMap(data, MERGE_OVERWRITE)
+}
 
-	if _, ok := m.watchers[key]; !ok {
-		m.watchers[key] = []eHandler{handler}
-	} else {
-		m.watchers[key] = append(m.watchers[key], handler)
+// mutate applies fn to the store and returns the resulting root. Without a schema covering key
+// fn works in place, otherwise it works on a copy that is only returned if it validates.
+func (m *MemKV) mutate(key string, fn func(root map[string]any) (Event, error)) (map[string]any, Event, error) {
+	if !m.hasSchemaFor(key) {
+		e, err := fn(m.m)
+		return m.m, e, err
 	}
+	root := cloneTree(m.m)
+	e, err := fn(root)
+	if err != nil {
+		return nil, e, err
+	}
+	if err := m.validateTree(root, m.sep, key); err != nil {
+		return nil, e, err
+	}
+	return root, e, nil
 }
 
-func (m *MemKV) ImportMap(data map[string]any) {
-	m.l.Lock()
-	defer m.l.Unlock()
-	for k, v := range data {
-		m.m[k] = v
+func (m *MemKV) normalize(key string) string {
+	if !m.caseSense {
+		return strings.ToLower(key)
+	}
+	return key
+}
+
+func (m *MemKV) split(key string) []string {
+	return strings.Split(key, m.sep)
+}
+
+func (m *MemKV) underPrefix(key string, prefix string) bool {
+	return prefix == "" || key == prefix || strings.HasPrefix(key, prefix+m.sep)
+}
+
+// lookup walks path starting at root and returns the value found at its end
+func lookup(root map[string]any, path []string) (any, bool) {
+	view := root
+	for _, k := range path[:len(path)-1] {
+		next, ok := view[k].(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		view = next
+	}
+	val, ok := view[path[len(path)-1]]
+	return val, ok
+}
+
+// setIn stores val at path under root creating any missing key spaces, the returned event lacks the key
+func setIn(root map[string]any, path []string, val any) (Event, error) {
+	if len(path) == 1 && path[0] == "" {
+		return Event{}, ErrEmptyKey
+	}
+	view := root
+	for _, k := range path[:len(path)-1] {
+		v, ok := view[k]
+		if !ok {
+			next := map[string]any{}
+			view[k] = next
+			view = next
+			continue
+		}
+		next, ok := v.(map[string]any)
+		if !ok {
+			return Event{}, ErrPathConflict
+		}
+		view = next
+	}
+	leaf := path[len(path)-1]
+	e := Event{
+		Type:    E_KEY_CREATED,
+		NewVal:  val,
+		When:    time.Now(),
+		Success: true,
+	}
+	if old, ok := view[leaf]; ok {
+		e.Type = E_KEY_UPDATED
+		e.OldVal = old
+	}
+	view[leaf] = val
+	return e, nil
+}
+
+// dropIn removes the value at path under root, the returned event lacks the key
+func dropIn(root map[string]any, path []string, deleteKeySpaces bool) (Event, error) {
+	parent := root
+	if len(path) > 1 {
+		v, ok := lookup(root, path[:len(path)-1])
+		if !ok {
+			return Event{}, ErrNotFound
+		}
+		if parent, ok = v.(map[string]any); !ok {
+			return Event{}, ErrNotFound
+		}
+	}
+	leaf := path[len(path)-1]
+	old, ok := parent[leaf]
+	if !ok {
+		return Event{}, ErrNotFound
+	}
+	if _, isKs := old.(map[string]any); isKs && !deleteKeySpaces {
+		return Event{}, ErrIsKeySpace
+	}
+	delete(parent, leaf)
+	return Event{
+		Type:    E_KEY_DELETED,
+		OldVal:  old,
+		When:    time.Now(),
+		Success: true,
+	}, nil
+}
+
+// dropEvents expands the deletion event of a key space into one event per removed leaf followed by e itself
+func dropEvents(e Event, sep string) []Event {
+	if _, ok := e.OldVal.(map[string]any); !ok {
+		return []Event{e}
+	}
+	events := make([]Event, 0)
+	walkLeaves(e.OldVal, e.Key, sep, func(k string, v any) {
+		events = append(events, Event{
+			Key:       k,
+			Type:      E_KEY_DELETED,
+			OldVal:    v,
+			When:      e.When,
+			Success:   true,
+			Principal: e.Principal,
+		})
+	})
+	return append(events, e)
+}
+
+// walkLeaves calls fn for every non key space value reachable from v, path is the path of v itself
+func walkLeaves(v any, path string, sep string, fn func(key string, val any)) {
+	ks, ok := v.(map[string]any)
+	if !ok {
+		fn(path, v)
+		return
+	}
+	for k, child := range ks {
+		if path != "" {
+			k = path + sep + k
+		}
+		walkLeaves(child, k, sep, fn)
+	}
+}
+
+// cloneTree copies every key space under root, leaf values are shared with the original
+func cloneTree(root map[string]any) map[string]any {
+	out := make(map[string]any, len(root))
+	for k, v := range root {
+		if ks, ok := v.(map[string]any); ok {
+			out[k] = cloneTree(ks)
+		} else {
+			out[k] = v
+		}
 	}
+	return out
 }
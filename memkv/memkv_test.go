@@ -1,8 +1,21 @@
 package memkv_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/xadaemon/libprisma/memkv"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 type expectedValues struct {
@@ -105,6 +118,81 @@ func TestMemKV_Contains(t *testing.T) {
 	}
 }
 
+func TestMemKV_PreserveCase(t *testing.T) {
+	kv := memkv.NewMemKV(".", &memkv.Opts{CaseInsensitive: true, PreserveCase: true})
+	kv.Set("Server.HTTPPort", 80)
+	kv.Set("SERVER.httpport", 8080)
+	kv.ImportMap(map[string]any{"server": map[string]any{"TLS": map[string]any{"CertFile": "c"}}})
+	kv.Set("Tags", []any{"a"})
+	kv.Push("TAGS", "b")
+
+	if v, _ := kv.Get("server.httpPORT"); v != 8080 {
+		t.Errorf("Case insensitive lookup got %v", v)
+	}
+	want := []string{"Server.HTTPPort", "Server.TLS.CertFile", "Tags"}
+	if got := kv.List(""); !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+	if got := kv.Sub("SERVER").List(""); !reflect.DeepEqual(got, []string{"HTTPPort", "TLS.CertFile"}) {
+		t.Errorf("View List() = %v", got)
+	}
+	if v, _ := kv.Get("server.tls"); !reflect.DeepEqual(v, map[string]any{"CertFile": "c"}) {
+		t.Errorf("Get() of a key space = %v", v)
+	}
+	if k := kv.DisplayKey("server.tls.certfile"); k != "Server.TLS.CertFile" {
+		t.Errorf("DisplayKey() = %q", k)
+	}
+
+	// the snapshot round trips losslessly, through JSON as well
+	data, err := json.Marshal(kv.GetSerializableMap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap map[string]any
+	if err := json.Unmarshal(data, &snap); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := snap["__data"].(map[string]any)["Server"]; !ok {
+		t.Errorf("Snapshot lost the spelling: %v", snap["__data"])
+	}
+	loaded := memkv.NewMemKV(":", nil)
+	if err := loaded.LoadFromSerializableMap(snap); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.List(""); !reflect.DeepEqual(got, want) {
+		t.Errorf("List() after loading = %v", got)
+	}
+	if v, _ := loaded.Get("SERVER.HTTPPORT"); v != float64(8080) {
+		t.Errorf("Loaded store is not case insensitive, got %v", v)
+	}
+
+	// a deleted key takes the spelling of the next write
+	kv.Drop("server.tls", true)
+	kv.Set("server.Tls.certfile", "d")
+	if got := kv.List("server.tls"); !reflect.DeepEqual(got, []string{"Server.Tls.certfile"}) {
+		t.Errorf("List() after recreating = %v", got)
+	}
+
+	// failed writes leave no spelling behind
+	kv.Commit(memkv.NewTxn().Set("LOGS.Level", 1).CheckMissing("server"))
+	kv.MergeMap(map[string]any{"LOGS": map[string]any{"Level": 1}, "tags": 1}, memkv.MERGE_ERROR)
+	kv.ApplyPatch(memkv.Patch{{Op: "add", Path: "/LOGS", Value: 1}, {Op: "test", Path: "/none", Value: 1}})
+	kv.Set("tmp.level", 2)
+	kv.ApplyPatch(memkv.Patch{{Op: "move", From: "/tmp", Path: "/logs"}})
+	if got := kv.List("logs"); !reflect.DeepEqual(got, []string{"logs.level"}) {
+		t.Errorf("List() after failed writes = %v", got)
+	}
+
+	plain := memkv.NewMemKV(".", &memkv.Opts{CaseInsensitive: true})
+	plain.Set("Server.Port", 1)
+	if got := plain.List(""); !reflect.DeepEqual(got, []string{"server.port"}) {
+		t.Errorf("Store without PreserveCase lists %v", got)
+	}
+	if err := plain.Sub("x").LoadFromSerializableMap(kv.Sub("server").GetSerializableMap()); !errors.Is(err, memkv.ErrInvalidSnapshot) {
+		t.Errorf("View accepted a snapshot with other case handling: %v", err)
+	}
+}
+
 func TestMemKV_AddWatcherHook(t *testing.T) {
 	kvs := memkv.NewMemKV(".", nil)
 	var gotWrite, gotRead int
@@ -192,3 +280,1297 @@ func TestMemKV_Drop(t *testing.T) {
 		})
 	}
 }
+
+func TestMemKV_List(t *testing.T) {
+	kvs := memkv.NewMemKV(".", nil)
+	kvs.Set("b", 1)
+	kvs.Set("a.y", 2)
+	kvs.Set("a.x.z", 3)
+
+	if got := kvs.List(""); !reflect.DeepEqual(got, []string{"a.x.z", "a.y", "b"}) {
+		t.Errorf("List() = %v", got)
+	}
+	if got := kvs.List("a.x"); !reflect.DeepEqual(got, []string{"a.x.z"}) {
+		t.Errorf("List(a.x) = %v", got)
+	}
+	if got := kvs.List("missing"); len(got) != 0 {
+		t.Errorf("List(missing) = %v", got)
+	}
+}
+
+func TestMemKV_Commit(t *testing.T) {
+	kvs := memkv.NewMemKV(".", nil)
+	kvs.Set("counter", 1)
+	var events []memkv.Event
+	kvs.AddPrefixWatcherHook("", func(e memkv.Event) {
+		events = append(events, e)
+	}, []memkv.EventType{memkv.E_KEY_CREATED, memkv.E_KEY_UPDATED, memkv.E_KEY_DELETED})
+
+	err := kvs.Commit(memkv.NewTxn().Set("a.b", 1).Check("counter", 2))
+	if !errors.Is(err, memkv.ErrCheckFailed) {
+		t.Errorf("Expected ErrCheckFailed, got %v", err)
+	}
+	if kvs.Contains("a.b") || len(events) != 0 {
+		t.Error("Failed transaction was partially applied")
+	}
+
+	err = kvs.Commit(memkv.NewTxn().Check("counter", 1).Set("counter", 2).CheckMissing("a").Set("a.b", 1).Drop("a.b", false))
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if v, _ := kvs.Get("counter"); v != 2 || kvs.Contains("a.b") {
+		t.Error("Transaction was not applied")
+	}
+	if len(events) != 3 {
+		t.Errorf("Expected 3 events, got %d", len(events))
+	}
+}
+
+func TestMemKV_DropKeySpaceEvents(t *testing.T) {
+	kvs := memkv.NewMemKV(".", nil)
+	kvs.Set("a.b.c", 1)
+	var dropped []string
+	kvs.AddWatcherHook("a.b.c", func(e memkv.Event) {
+		dropped = append(dropped, e.Key)
+	}, []memkv.EventType{memkv.E_KEY_DELETED})
+
+	if !kvs.Drop("a", true) {
+		t.Fatal("Failed to drop key space")
+	}
+	if !reflect.DeepEqual(dropped, []string{"a.b.c"}) {
+		t.Errorf("Got delete events for %v", dropped)
+	}
+}
+
+func TestMemKV_NoAliasing(t *testing.T) {
+	kvs := memkv.NewMemKV(".", nil)
+	in := map[string]any{"host": "db", "ports": []any{1, 2}}
+	kvs.Set("db", in)
+	in["host"] = "changed"
+
+	out, _ := kvs.Get("db")
+	out.(map[string]any)["ports"].([]any)[0] = 100
+	out.(map[string]any)["user"] = "root"
+
+	if v, _ := kvs.Get("db.host"); v != "db" {
+		t.Errorf("Caller map aliased the store, got %v", v)
+	}
+	if v, _ := kvs.Get("db.ports"); !reflect.DeepEqual(v, []any{1, 2}) {
+		t.Errorf("Returned slice aliased the store, got %v", v)
+	}
+	if kvs.Contains("db.user") {
+		t.Error("Returned map aliased the store")
+	}
+
+	imported := map[string]any{"app": map[string]any{"name": "ca"}}
+	kvs.ImportMap(imported)
+	imported["app"].(map[string]any)["name"] = "changed"
+	if v, _ := kvs.Get("app.name"); v != "ca" {
+		t.Errorf("Imported map aliased the store, got %v", v)
+	}
+
+	type record struct {
+		Tags  []string
+		Attrs map[string]any
+	}
+	r := record{Tags: []string{"a"}, Attrs: map[string]any{"k": []any{1}}}
+	kvs.Set("record", r)
+	r.Tags[0] = "changed"
+	r.Attrs["k"].([]any)[0] = 2
+	if v, _ := kvs.GetRef("record"); !reflect.DeepEqual(v, record{Tags: []string{"a"}, Attrs: map[string]any{"k": []any{1}}}) {
+		t.Errorf("Struct fields aliased the store, got %v", v)
+	}
+
+	// structs with unexported fields are opaque and stored by value as a whole
+	type opaque struct {
+		tags []string
+	}
+	kvs.Set("opaque", opaque{tags: []string{"a"}})
+	if v, _ := kvs.Get("opaque"); !reflect.DeepEqual(v, opaque{tags: []string{"a"}}) {
+		t.Errorf("Opaque struct was not stored, got %v", v)
+	}
+
+	ref, _ := kvs.GetRef("app")
+	ref.(map[string]any)["name"] = "direct"
+	if v, _ := kvs.Get("app.name"); v != "direct" {
+		t.Error("GetRef should return the stored value")
+	}
+}
+
+func TestMemKV_ConcurrentReadersAndWriters(t *testing.T) {
+	kvs := memkv.NewMemKV(".", nil)
+	kvs.Set("cfg.list", []any{0})
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				v, _ := kvs.Get("cfg")
+				v.(map[string]any)["list"] = append(v.(map[string]any)["list"].([]any), i)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := range 100 {
+				kvs.Set("cfg.list", []any{j})
+				_ = kvs.GetSerializableMap()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMemKV_MergeMap(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Strategy memkv.MergeStrategy
+		Incoming map[string]any
+		Expect   map[string]any
+		WantErr  bool
+	}{
+		{
+			Name:     "Overwrite keeps siblings",
+			Strategy: memkv.MERGE_OVERWRITE,
+			Incoming: map[string]any{"db": map[string]any{"port": 2}},
+			Expect:   map[string]any{"db.host": "localhost", "db.port": 2, "db.tags": []any{"a"}},
+		},
+		{
+			Name:     "Keep existing",
+			Strategy: memkv.MERGE_KEEP,
+			Incoming: map[string]any{"db": map[string]any{"port": 2, "user": "root"}},
+			Expect:   map[string]any{"db.port": 1, "db.user": "root"},
+		},
+		{
+			Name:     "Error on conflict",
+			Strategy: memkv.MERGE_ERROR,
+			Incoming: map[string]any{"db": map[string]any{"user": "root", "port": 2}},
+			Expect:   map[string]any{"db.port": 1},
+			WantErr:  true,
+		},
+		{
+			Name:     "Append lists",
+			Strategy: memkv.MERGE_APPEND,
+			Incoming: map[string]any{"db": map[string]any{"tags": []any{"b"}}},
+			Expect:   map[string]any{"db.tags": []any{"a", "b"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			kvs := memkv.NewMemKV(".", nil)
+			kvs.Set("db.host", "localhost")
+			kvs.Set("db.port", 1)
+			kvs.Set("db.tags", []any{"a"})
+			err := kvs.MergeMap(tt.Incoming, tt.Strategy)
+			var conflict *memkv.ConflictError
+			if tt.WantErr && (!errors.As(err, &conflict) || conflict.Key != "db.port") {
+				t.Errorf("Expected a conflict on db.port, got %v", err)
+			} else if !tt.WantErr && err != nil {
+				t.Errorf("Unexpected error %v", err)
+			}
+			for k, want := range tt.Expect {
+				if got, _ := kvs.Get(k); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %v, want %v", k, got, want)
+				}
+			}
+			if tt.WantErr && kvs.Contains("db.user") {
+				t.Error("Failed merge was partially applied")
+			}
+		})
+	}
+}
+
+func TestMemKV_ImportMapEvents(t *testing.T) {
+	kvs := memkv.NewMemKV(".", nil)
+	kvs.Set("db.host", "localhost")
+	var got []string
+	kvs.AddPrefixWatcherHook("db", func(e memkv.Event) {
+		got = append(got, e.Type.String()+" "+e.Key)
+	}, []memkv.EventType{memkv.E_KEY_CREATED, memkv.E_KEY_UPDATED})
+
+	kvs.ImportMap(map[string]any{"db": map[string]any{"host": "remote", "port": 5432}})
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, []string{"created db.port", "updated db.host"}) {
+		t.Errorf("Got events %v", got)
+	}
+}
+
+func TestMemKV_Schema(t *testing.T) {
+	js, err := memkv.ParseJSONSchema([]byte(`{
+		"type": "object",
+		"required": ["host", "port"],
+		"additionalProperties": false,
+		"properties": {
+			"host": {"type": "string", "pattern": "^[a-z.]+$"},
+			"port": {"type": "integer", "minimum": 1, "maximum": 65535},
+			"mode": {"enum": ["ro", "rw"]},
+			"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	goSchema := &memkv.Schema{
+		Type:     memkv.TYPE_OBJECT,
+		Required: []string{"host", "port"},
+		Closed:   true,
+		Properties: map[string]*memkv.Schema{
+			"host": {Type: memkv.TYPE_STRING, Pattern: "^[a-z.]+$"},
+			"port": {Type: memkv.TYPE_INT, Min: memkv.Limit(1.0), Max: memkv.Limit(65535.0)},
+			"mode": {Enum: []any{"ro", "rw"}},
+			"tags": {Type: memkv.TYPE_ARRAY, Items: &memkv.Schema{Type: memkv.TYPE_STRING}, MaxLength: memkv.Limit(2)},
+		},
+	}
+
+	tests := []struct {
+		Name  string
+		Apply func(kv *memkv.MemKV) error
+		Key   string
+	}{
+		{"Valid Set", func(kv *memkv.MemKV) error { return kv.SetE("db.port", 5432) }, ""},
+		{"Outside Prefix", func(kv *memkv.MemKV) error { return kv.SetE("other.port", "x") }, ""},
+		{"Wrong Type", func(kv *memkv.MemKV) error { return kv.SetE("db.port", "5432") }, "db.port"},
+		{"Out Of Range", func(kv *memkv.MemKV) error { return kv.SetE("db.port", 70000) }, "db.port"},
+		{"Pattern", func(kv *memkv.MemKV) error { return kv.SetE("db.host", "Bad Host") }, "db.host"},
+		{"Enum", func(kv *memkv.MemKV) error { return kv.SetE("db.mode", "wo") }, "db.mode"},
+		{"Typo", func(kv *memkv.MemKV) error { return kv.SetE("db.hots", "x") }, "db.hots"},
+		{"Array Item", func(kv *memkv.MemKV) error { return kv.SetE("db.tags", []any{"a", 1}) }, "db.tags[1]"},
+		{"Array Length", func(kv *memkv.MemKV) error { return kv.SetE("db.tags", []any{"a", "b", "c"}) }, "db.tags"},
+		{"Drop Required", func(kv *memkv.MemKV) error { return kv.Commit(memkv.NewTxn().Drop("db.host", false)) }, "db.host"},
+		{"Replace Key Space", func(kv *memkv.MemKV) error { return kv.SetE("db", 1) }, "db"},
+		{"Import", func(kv *memkv.MemKV) error {
+			return kv.ImportMap(map[string]any{"db": map[string]any{"port": 0}})
+		}, "db.port"},
+		{"Load", func(kv *memkv.MemKV) error {
+			other := memkv.NewMemKV(".", nil)
+			other.ImportMap(map[string]any{"db": map[string]any{"host": "h"}})
+			return kv.LoadFromSerializableMap(other.GetSerializableMap())
+		}, "db.port"},
+	}
+	for name, schema := range map[string]*memkv.Schema{"JSON": js, "Go": goSchema} {
+		for _, test := range tests {
+			t.Run(name+"/"+test.Name, func(t *testing.T) {
+				kv := memkv.NewMemKV(".", nil)
+				if err := kv.ImportMap(map[string]any{"db": map[string]any{"host": "db.local", "port": 5432}}); err != nil {
+					t.Fatal(err)
+				}
+				if err := kv.SetSchema("db", schema); err != nil {
+					t.Fatal(err)
+				}
+				before := kv.GetSerializableMap()
+				err := test.Apply(kv)
+				if test.Key == "" {
+					if err != nil {
+						t.Fatalf("Unexpected error %v", err)
+					}
+					return
+				}
+				var verr *memkv.ValidationError
+				if !errors.As(err, &verr) || !errors.Is(err, memkv.ErrSchemaViolation) {
+					t.Fatalf("Expected a validation error, got %v", err)
+				}
+				if verr.Key != test.Key {
+					t.Errorf("Error at %q, want %q: %v", verr.Key, test.Key, err)
+				}
+				if !reflect.DeepEqual(kv.GetSerializableMap(), before) {
+					t.Error("Rejected write changed the store")
+				}
+			})
+		}
+	}
+
+	kv := memkv.NewMemKV(".", nil)
+	kv.Set("db.port", "x")
+	if err := kv.SetSchema("db", goSchema); err == nil {
+		t.Error("SetSchema accepted a schema the current content violates")
+	}
+	if _, err := memkv.ParseJSONSchema([]byte(`{"$ref": "#/x"}`)); err == nil {
+		t.Error("Unsupported keyword was accepted")
+	}
+	if _, err := memkv.ParseJSONSchema([]byte(`{"minLength": 1, "maxItems": 5}`)); err == nil {
+		t.Error("String and array length limits were mixed")
+	}
+	if _, err := memkv.ParseJSONSchema([]byte(`{"minItems": 1, "maxItems": 5}`)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemKV_LoadFromSerializableMap(t *testing.T) {
+	meta := func(protocol any, sep any, caseSensitive any) map[string]any {
+		return map[string]any{"__serializedProtocol": protocol, "separator": sep, "caseSensitive": caseSensitive}
+	}
+	tests := []struct {
+		Name string
+		Data map[string]any
+		Err  error
+	}{
+		{"Nil", nil, memkv.ErrInvalidSnapshot},
+		{"No Meta", map[string]any{"__data": map[string]any{}}, memkv.ErrInvalidSnapshot},
+		{"Bad Protocol", map[string]any{"__meta": meta("2", ".", true), "__data": map[string]any{}}, memkv.ErrInvalidSnapshot},
+		{"Newer Protocol", map[string]any{"__meta": meta(memkv.SERIALIZED_PROTOCOL+1, ".", true), "__data": map[string]any{}}, memkv.ErrUnsupportedProtocol},
+		{"Bad Separator", map[string]any{"__meta": meta(2, 1, true), "__data": map[string]any{}}, memkv.ErrInvalidSnapshot},
+		{"Bad Case Flag", map[string]any{"__meta": meta(2, ".", "yes"), "__data": map[string]any{}}, memkv.ErrInvalidSnapshot},
+		{"Bad Data", map[string]any{"__meta": meta(2, ".", true), "__data": "x"}, memkv.ErrInvalidSnapshot},
+		{"Key With Separator", map[string]any{"__meta": meta(2, ".", true), "__data": map[string]any{"a.b": 1}}, memkv.ErrInvalidSnapshot},
+		{"Upper Case Key", map[string]any{"__meta": meta(2, ".", false), "__data": map[string]any{"A": 1}}, memkv.ErrInvalidSnapshot},
+		{"V1 Case Collision", map[string]any{"__meta": meta(1, ".", false), "__data": map[string]any{"A": 1, "a": 2}}, memkv.ErrInvalidSnapshot},
+		{"JSON Numbers", map[string]any{"__meta": meta(float64(2), ":", true), "__data": map[string]any{"a": 1.0}}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			kv := memkv.NewMemKV(".", nil)
+			kv.Set("keep", 1)
+			err := kv.LoadFromSerializableMap(test.Data)
+			if !errors.Is(err, test.Err) || (test.Err == nil) != (err == nil) {
+				t.Fatalf("Got error %v, want %v", err, test.Err)
+			}
+			if err != nil && !kv.Contains("keep") {
+				t.Error("Refused snapshot changed the store")
+			}
+		})
+	}
+
+	v1 := map[string]any{
+		"__meta": meta(1, ".", false),
+		"__data": map[string]any{"DB": map[string]any{"Host": "h"}, "db": map[string]any{"port": 1}},
+	}
+	kv := memkv.NewMemKV(".", nil)
+	if err := kv.LoadFromSerializableMap(v1); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := kv.Get("Db.HOST"); v != "h" {
+		t.Errorf("Migrated key is unreachable, got %v", v)
+	}
+	if v, _ := kv.Get("db.port"); v != 1 {
+		t.Errorf("Migration lost a key, got %v", v)
+	}
+	if p := kv.GetSerializableMap()["__meta"].(map[string]any)["__serializedProtocol"]; p != memkv.SERIALIZED_PROTOCOL {
+		t.Errorf("Snapshot written with protocol %v", p)
+	}
+	if _, ok := v1["__data"].(map[string]any)["DB"]; !ok {
+		t.Error("Migration modified the input")
+	}
+}
+
+func TestMemKV_Sub(t *testing.T) {
+	kv := memkv.NewMemKV(".", nil)
+	kv.ImportMap(map[string]any{
+		"services": map[string]any{
+			"ca":  map[string]any{"ttl": 10, "issuer": map[string]any{"name": "root"}},
+			"cab": map[string]any{"secret": "x"},
+		},
+		"top": 1,
+	})
+	view := kv.Sub("services.ca")
+
+	if v, ok := view.Get("ttl"); !ok || v != 10 {
+		t.Errorf("Get(ttl) = %v, %v", v, ok)
+	}
+	for _, key := range []string{"", "top", "services.cab.secret", ".secret", "b.secret"} {
+		if view.Contains(key) {
+			t.Errorf("Key %q outside the view is reachable", key)
+		}
+	}
+	if got := view.List(""); !reflect.DeepEqual(got, []string{"issuer.name", "ttl"}) {
+		t.Errorf("List() = %v", got)
+	}
+
+	var mu sync.Mutex
+	var got []string
+	cancel := view.AddPrefixWatcherHook("", func(e memkv.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, e.Type.String()+" "+e.Key)
+	}, []memkv.EventType{memkv.E_KEY_CREATED, memkv.E_KEY_UPDATED, memkv.E_KEY_DELETED})
+	defer cancel()
+
+	if err := view.Commit(memkv.NewTxn().Check("ttl", 10).Set("ttl", 20).Drop("issuer", true)); err != nil {
+		t.Fatal(err)
+	}
+	kv.Set("services.cab.secret", "y")
+	kv.Set("top", 2)
+	if err := view.ImportMap(map[string]any{"issuer": map[string]any{"name": "sub"}}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := kv.Get("services.ca.ttl"); v != 20 {
+		t.Errorf("Transaction did not reach the store, ttl = %v", v)
+	}
+	want := []string{"updated ttl", "deleted issuer.name", "deleted issuer", "created issuer.name"}
+	mu.Lock()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got events %v, want %v", got, want)
+	}
+	mu.Unlock()
+
+	nested := kv.Sub("services").Sub("ca.issuer")
+	if v, _ := nested.Get("name"); v != "sub" {
+		t.Errorf("Nested view Get(name) = %v", v)
+	}
+
+	snap := view.GetSerializableMap()
+	other := memkv.NewMemKV(".", nil)
+	if err := other.Sub("copy").LoadFromSerializableMap(snap); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := other.Get("copy.issuer.name"); v != "sub" {
+		t.Errorf("Snapshot of the view did not load, got %v", v)
+	}
+	if _, ok := snap["__data"].(map[string]any)["top"]; ok {
+		t.Error("Snapshot of the view contains keys outside it")
+	}
+}
+
+func TestMemKV_AtomicOps(t *testing.T) {
+	kv := memkv.NewMemKV(".", nil)
+	var mu sync.Mutex
+	var events []memkv.Event
+	kv.AddPrefixWatcherHook("", func(e memkv.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}, []memkv.EventType{memkv.E_KEY_CREATED, memkv.E_KEY_UPDATED})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := kv.Incr("ca.serial"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n, err := kv.Add("ca.serial", -10); err != nil || n != 40 {
+		t.Errorf("Add() = %d, %v, want 40", n, err)
+	}
+	mu.Lock()
+	if len(events) != 51 || events[0].Type != memkv.E_KEY_CREATED || events[50].OldVal != int64(50) || events[50].NewVal != int64(40) {
+		t.Errorf("Unexpected counter events %d %+v", len(events), events[len(events)-1])
+	}
+	events = nil
+	mu.Unlock()
+
+	kv.Set("json", float64(3))
+	if n, _ := kv.Decr("json"); n != 2 {
+		t.Errorf("Decr on a JSON number = %d", n)
+	}
+	kv.Set("small", int8(127))
+	if _, err := kv.Incr("small"); !errors.Is(err, memkv.ErrOverflow) {
+		t.Errorf("Expected overflow, got %v", err)
+	}
+	kv.Set("name", "x")
+	if _, err := kv.Incr("name"); !errors.Is(err, memkv.ErrWrongType) {
+		t.Errorf("Expected wrong type, got %v", err)
+	}
+
+	if n, _ := kv.Push("queue", "a", "b", "c"); n != 3 {
+		t.Errorf("Push() = %d", n)
+	}
+	if v, _ := kv.Pop("queue"); v != "c" {
+		t.Errorf("Pop() = %v", v)
+	}
+	if r, _ := kv.Range("queue", -1, 10); !reflect.DeepEqual(r, []any{"b"}) {
+		t.Errorf("Range() = %v", r)
+	}
+	if _, err := kv.Pop("missing"); !errors.Is(err, memkv.ErrNotFound) {
+		t.Errorf("Pop on a missing key = %v", err)
+	}
+
+	// hooks changing the old list of an event do not reach the stored one
+	kv.Set("jobs", []any{map[string]any{"id": 1}})
+	cancel := kv.AddWatcherHook("jobs", func(e memkv.Event) {
+		e.OldVal.([]any)[0].(map[string]any)["id"] = 2
+		e.OldVal.([]any)[0] = "changed"
+	}, []memkv.EventType{memkv.E_KEY_UPDATED})
+	kv.Push("jobs", 3)
+	kv.Pop("jobs")
+	cancel()
+	if v, _ := kv.GetRef("jobs"); !reflect.DeepEqual(v, []any{map[string]any{"id": 1}}) {
+		t.Errorf("Stored list changed by a hook: %v", v)
+	}
+
+	if n, _ := kv.SAdd("revoked", 1, 2, 2, 3); n != 3 {
+		t.Errorf("SAdd() = %d", n)
+	}
+	if n, _ := kv.SAdd("revoked", 3); n != 0 {
+		t.Errorf("SAdd of a member = %d", n)
+	}
+	if n, _ := kv.SRem("revoked", 2, 4); n != 1 {
+		t.Errorf("SRem() = %d", n)
+	}
+	if m, _ := kv.SMembers("revoked"); !reflect.DeepEqual(m, []any{1, 3}) {
+		t.Errorf("SMembers() = %v", m)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	last := events[len(events)-1]
+	if last.Key != "revoked" || !reflect.DeepEqual(last.OldVal, []any{1, 2, 3}) || !reflect.DeepEqual(last.NewVal, []any{1, 3}) {
+		t.Errorf("Unexpected set event %+v", last)
+	}
+}
+
+func TestMemKV_ACL(t *testing.T) {
+	kv := memkv.NewMemKV(".", nil)
+	kv.ImportMap(map[string]any{
+		"services": map[string]any{
+			"ca":  map[string]any{"ttl": 10, "key": "secret"},
+			"web": map[string]any{"port": 80},
+		},
+	})
+	acl := memkv.NewACL(kv)
+	defer acl.Close()
+	err := acl.SetRules([]memkv.ACLRule{
+		{Principal: "ca", Pattern: "services.ca.**", Allow: memkv.PERM_ALL},
+		{Principal: "*", Pattern: "services.**", Allow: memkv.PERM_READ | memkv.PERM_WATCH},
+		{Principal: "*", Pattern: "services.*.key", Deny: memkv.PERM_READ},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var failures []memkv.Event
+	kv.AddPrefixWatcherHook("", func(e memkv.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !e.Success {
+			failures = append(failures, e)
+		}
+	}, []memkv.EventType{memkv.E_KEY_ACCESSED, memkv.E_KEY_UPDATED, memkv.E_KEY_DELETED})
+
+	ca, web := acl.Guard("ca"), acl.Guard("web")
+	tests := []struct {
+		Name string
+		Err  error
+	}{
+		{"Own Write", ca.SetE("services.ca.ttl", 20)},
+		{"Foreign Write", web.SetE("services.ca.ttl", 30)},
+		{"Denied Read", func() error { _, err := ca.GetE("services.ca.key"); return err }()},
+		{"Reserved Read", func() error { _, err := ca.GetE("__acl.rules"); return err }()},
+		{"Foreign Delete", web.DropE("services.ca", true)},
+		{"Txn", web.Commit(memkv.NewTxn().Set("services.web.port", 81))},
+	}
+	want := []bool{true, false, false, false, false, false}
+	for i, test := range tests {
+		var perr *memkv.PermissionError
+		if denied := errors.As(test.Err, &perr); denied == want[i] {
+			t.Errorf("%s: got %v", test.Name, test.Err)
+		}
+	}
+	if v, _ := kv.Get("services.ca.ttl"); v != 20 {
+		t.Errorf("ttl = %v", v)
+	}
+	if v, _ := web.Get("services"); !reflect.DeepEqual(v, map[string]any{
+		"ca":  map[string]any{"ttl": 20},
+		"web": map[string]any{"port": 80},
+	}) {
+		t.Errorf("Key space was not filtered: %v", v)
+	}
+	if got := web.List(""); !reflect.DeepEqual(got, []string{"services.ca.ttl", "services.web.port"}) {
+		t.Errorf("List() = %v", got)
+	}
+	mu.Lock()
+	if len(failures) != 5 || failures[0].Key != "services.ca.ttl" || failures[0].Type != memkv.E_KEY_UPDATED || failures[0].FailReason == "" {
+		t.Errorf("Unexpected failure events %+v", failures)
+	}
+	mu.Unlock()
+
+	// rules stored in the reserved key space are reloaded live
+	kv.Set("__acl.rules", memkv.EncodeACLRules([]memkv.ACLRule{{Principal: "web", Pattern: "**", Allow: memkv.PERM_ALL}}))
+	if !web.Set("services.web.port", 8080) {
+		t.Error("Rules were not reloaded")
+	}
+	kv.Set("__acl.rules", "garbage")
+	if acl.Err() == nil || web.Contains("services.web.port") {
+		t.Error("Undecodable rules should deny everything")
+	}
+}
+
+func TestMemKV_ACLReplace(t *testing.T) {
+	kv := memkv.NewMemKV(".", nil)
+	kv.ImportMap(map[string]any{"svc": map[string]any{"port": 80, "secret": map[string]any{"token": "t"}}})
+	acl := memkv.NewACL(kv)
+	defer acl.Close()
+	err := acl.SetRules([]memkv.ACLRule{
+		{Principal: "op", Pattern: "svc", Allow: memkv.PERM_WRITE},
+		{Principal: "op", Pattern: "svc.*", Allow: memkv.PERM_WRITE | memkv.PERM_DELETE},
+		{Principal: "op", Pattern: "svc.secret.**", Allow: memkv.PERM_WRITE},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := acl.Guard("op")
+
+	tests := []struct {
+		Name    string
+		Err     error
+		Allowed bool
+	}{
+		{"Drop", op.DropE("svc.secret.token", false), false},
+		{"Replace Key Space", op.SetE("svc", 1), false},
+		{"Replace Sub Key Space", op.SetE("svc.secret", "x"), false},
+		{"Txn Replace", op.Commit(memkv.NewTxn().Set("svc", map[string]any{"port": 1})), false},
+		{"Import Replace", op.ImportMap(map[string]any{"svc": map[string]any{"secret": 1}}), false},
+		{"Update Leaf", op.SetE("svc.secret", map[string]any{"token": "u"}), true},
+		{"Import Merge", op.ImportMap(map[string]any{"svc": map[string]any{"port": 81, "secret": map[string]any{"token": "v"}}}), true},
+		{"Replace Deletable", op.SetE("svc", map[string]any{"secret": map[string]any{"token": "w"}}), true},
+	}
+	for _, test := range tests {
+		var perr *memkv.PermissionError
+		if denied := errors.As(test.Err, &perr); denied == test.Allowed || !denied && test.Err != nil {
+			t.Errorf("%s: got %v", test.Name, test.Err)
+		}
+	}
+	if v, _ := kv.Get("svc"); !reflect.DeepEqual(v, map[string]any{"secret": map[string]any{"token": "w"}}) {
+		t.Errorf("Store holds %v", v)
+	}
+}
+
+func TestMemKV_ACLReload(t *testing.T) {
+	kv := memkv.NewMemKV(".", nil)
+	acl := memkv.NewACL(kv)
+	defer acl.Close()
+	rules := func(pattern string) any {
+		return memkv.EncodeACLRules([]memkv.ACLRule{{Principal: "op", Pattern: pattern, Allow: memkv.PERM_READ}})
+	}
+
+	kv.Set("__acl", map[string]any{"rules": rules("a")})
+	if !acl.Allowed("op", "a", memkv.PERM_READ) {
+		t.Error("Rules set through their key space were not loaded")
+	}
+	snap := kv.GetSerializableMap()
+
+	kv.ImportMap(map[string]any{"__acl": map[string]any{"rules": rules("b")}})
+	if !acl.Allowed("op", "b", memkv.PERM_READ) || acl.Allowed("op", "a", memkv.PERM_READ) {
+		t.Error("Rules imported were not loaded")
+	}
+
+	if err := kv.LoadFromSerializableMap(snap); err != nil {
+		t.Fatal(err)
+	}
+	if !acl.Allowed("op", "a", memkv.PERM_READ) || acl.Allowed("op", "b", memkv.PERM_READ) {
+		t.Error("Rules of the loaded snapshot were not loaded")
+	}
+
+	kv.Drop("__acl", true)
+	if acl.Allowed("op", "a", memkv.PERM_READ) {
+		t.Error("Rules dropped with their key space are still in effect")
+	}
+}
+
+func TestMemKV_Query(t *testing.T) {
+	kv := memkv.NewMemKV(".", nil)
+	kv.ImportMap(map[string]any{
+		"services": map[string]any{
+			"ca":  map[string]any{"port": 8443, "host": "ca.local", "tls": true, "secret": "k"},
+			"web": map[string]any{"port": 80, "host": "web.local", "tls": false},
+			"api": map[string]any{"port": 9000, "host": "api.local", "tls": true, "limits": map[string]any{"rps": 1.5}},
+		},
+		"db": map[string]any{"secret": "pw", "port": 5432},
+	})
+	keys := func(ms []memkv.Match) []string {
+		out := make([]string, len(ms))
+		for i, m := range ms {
+			out[i] = m.Key
+		}
+		return out
+	}
+	tests := []struct {
+		Query string
+		Keys  []string
+	}{
+		{"services.*.port[@ > 8000]", []string{"services.api.port", "services.ca.port"}},
+		{"**[$key =~ \"secret$\"]", []string{"db.secret", "services.ca.secret"}},
+		{"**.port[@ >= 5432 && !(@ == 9000)]", []string{"db.port", "services.ca.port"}},
+		{"services.*[@.tls && @.port != 443]", []string{"services.api", "services.ca"}},
+		{"services.*[@.limits.rps < 2.5]", []string{"services.api"}},
+		{"services.?eb.host", []string{"services.web.host"}},
+		{"services.*[@.host == 'web.local' || @.missing == 1]", []string{"services.web"}},
+	}
+	for _, test := range tests {
+		t.Run(test.Query, func(t *testing.T) {
+			got, err := kv.Query(test.Query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(keys(got), test.Keys) {
+				t.Errorf("Got %v, want %v", keys(got), test.Keys)
+			}
+		})
+	}
+
+	got, err := kv.Query("services.*[@.tls]{port, limits.rps}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []memkv.Match{
+		{Key: "services.api", Value: map[string]any{"port": 9000, "limits": map[string]any{"rps": 1.5}}},
+		{Key: "services.ca", Value: map[string]any{"port": 8443}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Projection got %v", got)
+	}
+
+	for _, bad := range []string{"", "a..b", "a[@ >]", "a[@ =~ 1]", "a[@ == x]", "a[@ == 1", "a{b"} {
+		if _, err := kv.Query(bad); !errors.Is(err, memkv.ErrQuerySyntax) {
+			t.Errorf("Query %q: got %v", bad, err)
+		}
+	}
+
+	var mu sync.Mutex
+	var events []string
+	cancel, err := kv.AddQueryWatcherHook("services.*[@.port > 8000]", func(e memkv.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e.Key)
+	}, []memkv.EventType{memkv.E_KEY_UPDATED})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	kv.Set("services.web.host", "x")
+	kv.Set("services.ca.host", "y")
+	kv.Set("services.web.port", 8080)
+	kv.Set("db.port", 9999)
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(events, []string{"services.ca.host", "services.web.port"}) {
+		t.Errorf("Query watcher got %v", events)
+	}
+}
+
+func TestMemKV_DiffAndPatch(t *testing.T) {
+	live := memkv.NewMemKV(".", nil)
+	live.ImportMap(map[string]any{
+		"ca":  map[string]any{"ttl": 10, "issuer": "root", "old": map[string]any{"a": 1}},
+		"web": map[string]any{"ports": []any{80, 443}},
+	})
+	staged := memkv.NewMemKV(".", nil)
+	staged.LoadFromSerializableMap(live.GetSerializableMap())
+	staged.Set("ca.ttl", 20)
+	staged.Drop("ca.old", true)
+	staged.Set("ca.new.b", "x")
+
+	changes, err := memkv.DiffSnapshots(live.GetSerializableMap(), staged.GetSerializableMap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []memkv.Change{
+		{Key: "ca.new", Type: memkv.E_KEY_CREATED, NewVal: map[string]any{"b": "x"}},
+		{Key: "ca.old", Type: memkv.E_KEY_DELETED, OldVal: map[string]any{"a": 1}},
+		{Key: "ca.ttl", Type: memkv.E_KEY_UPDATED, OldVal: 10, NewVal: 20},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("Diff() = %+v", changes)
+	}
+
+	// the patch survives a JSON round trip and reproduces the staged state
+	data, err := json.Marshal(memkv.ChangesToPatch(changes, ".", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := memkv.ParsePatch(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica := memkv.NewMemKV(".", nil)
+	replica.LoadFromSerializableMap(live.GetSerializableMap())
+	var mu sync.Mutex
+	var events []string
+	replica.AddPrefixWatcherHook("", func(e memkv.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e.Type.String()+" "+e.Key)
+	}, []memkv.EventType{memkv.E_KEY_CREATED, memkv.E_KEY_UPDATED, memkv.E_KEY_DELETED})
+	if err := replica.ApplyPatch(patch); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := memkv.DiffSnapshots(replica.GetSerializableMap(), staged.GetSerializableMap()); len(after) != 0 {
+		t.Errorf("Replica differs after the patch: %+v", after)
+	}
+	mu.Lock()
+	if !reflect.DeepEqual(events, []string{"created ca.new.b", "deleted ca.old.a", "updated ca.ttl"}) {
+		t.Errorf("Patch events %v", events)
+	}
+	mu.Unlock()
+
+	// the tests of the patch no longer hold, nothing is applied
+	if err := replica.ApplyPatch(patch); !errors.Is(err, memkv.ErrCheckFailed) {
+		t.Errorf("Reapplying the patch: %v", err)
+	}
+
+	arrays, err := memkv.ParsePatch([]byte(`[
+		{"op": "add", "path": "/web/ports/-", "value": 8080},
+		{"op": "remove", "path": "/web/ports/0"},
+		{"op": "copy", "from": "/web/ports", "path": "/web/backup"},
+		{"op": "move", "from": "/ca/issuer", "path": "/ca/name"},
+		{"op": "test", "path": "/web/backup/1", "value": 8080}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.ApplyPatch(arrays); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := replica.Get("web.backup"); !reflect.DeepEqual(v, []any{443, float64(8080)}) {
+		t.Errorf("web.backup = %v", v)
+	}
+	if v, _ := replica.Get("ca.name"); v != "root" || replica.Contains("ca.issuer") {
+		t.Errorf("Move failed, ca.name = %v", v)
+	}
+
+	bad, _ := memkv.ParsePatch([]byte(`[{"op": "replace", "path": "/ca/ttl", "value": 1}, {"op": "remove", "path": "/nope"}]`))
+	var perr *memkv.PatchError
+	if err := replica.ApplyPatch(bad); !errors.As(err, &perr) || perr.Index != 1 || !errors.Is(err, memkv.ErrNotFound) {
+		t.Errorf("Expected failure at operation 1, got %v", err)
+	}
+	if v, _ := replica.Get("ca.ttl"); v != float64(20) {
+		t.Errorf("Failed patch was partially applied, ca.ttl = %v", v)
+	}
+}
+
+func TestTyped(t *testing.T) {
+	type Cert struct {
+		Subject string
+		Serial  int
+		Hosts   []string
+	}
+	certs := memkv.NewTyped[Cert](".", nil)
+	var mu sync.Mutex
+	var events []memkv.TypedEvent[Cert]
+	certs.AddPrefixWatcherHook("certs", func(e memkv.TypedEvent[Cert]) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}, []memkv.EventType{memkv.E_KEY_CREATED, memkv.E_KEY_UPDATED})
+
+	web := Cert{Subject: "web", Serial: 1, Hosts: []string{"a.example"}}
+	if !certs.Set("certs.web", web) {
+		t.Fatal("Set failed")
+	}
+	certs.Set("certs.web", Cert{Subject: "web", Serial: 2})
+	if c, ok := certs.Get("certs.web"); !ok || c.Serial != 2 {
+		t.Errorf("Get() = %+v, %v", c, ok)
+	}
+	mu.Lock()
+	if len(events) != 2 || events[1].HasOld != true || events[1].OldVal.Serial != 1 || events[1].NewVal.Serial != 2 {
+		t.Errorf("Typed events %+v", events)
+	}
+	mu.Unlock()
+
+	// an untyped store loading the snapshot from JSON holds plain maps, they convert back
+	certs.Set("certs.mail", Cert{Subject: "mail", Serial: 7})
+	data, err := json.Marshal(certs.GetSerializableMap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap map[string]any
+	json.Unmarshal(data, &snap)
+	plain := memkv.NewMemKV(".", nil)
+	if err := plain.LoadFromSerializableMap(snap); err != nil {
+		t.Fatal(err)
+	}
+	plain.Set("certs.note", "not a cert")
+	again := memkv.TypedOf[Cert](plain)
+	if c, err := again.GetE("certs.mail"); err != nil || c.Subject != "mail" || c.Serial != 7 {
+		t.Errorf("GetE() after loading = %+v, %v", c, err)
+	}
+	if _, err := again.GetE("certs.note"); !errors.Is(err, memkv.ErrWrongType) {
+		t.Errorf("GetE() of a string gave %v", err)
+	}
+	if _, err := again.GetE("certs.none"); !errors.Is(err, memkv.ErrNotFound) {
+		t.Errorf("GetE() of a missing key gave %v", err)
+	}
+	values := again.Values("certs")
+	if len(values) != 2 || values["certs.web"].Serial != 2 || values["certs.mail"].Serial != 7 {
+		t.Errorf("Values() = %+v", values)
+	}
+}
+
+func TestLessor(t *testing.T) {
+	kv := memkv.NewMemKV(".", nil)
+	l := memkv.NewLessor(kv)
+	defer l.Close()
+
+	deleted := make(chan string, 10)
+	kv.AddPrefixWatcherHook("sessions", func(e memkv.Event) {
+		deleted <- e.Key
+	}, []memkv.EventType{memkv.E_KEY_DELETED})
+
+	id, _ := l.Grant(50 * time.Millisecond)
+	if err := l.Set(id, "sessions.a", 1); err != nil {
+		t.Fatal(err)
+	}
+	kv.Set("sessions.b", 2)
+	if err := l.Attach(id, "sessions.b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Attach(id, "sessions.none"); !errors.Is(err, memkv.ErrNotFound) {
+		t.Errorf("Attached a missing key: %v", err)
+	}
+	kv.Set("sessions.c", 3)
+	l.Attach(id, "sessions.c")
+	l.Detach("sessions.c")
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(30 * time.Millisecond)
+		if _, err := l.KeepAlive(id); err != nil {
+			t.Fatalf("KeepAlive failed while the lease was alive: %v", err)
+		}
+	}
+	if !kv.Contains("sessions.a") {
+		t.Fatal("Key expired although the lease was kept alive")
+	}
+	var got []string
+	for len(got) < 2 {
+		select {
+		case k := <-deleted:
+			got = append(got, k)
+		case <-time.After(time.Second):
+			t.Fatalf("Lease did not expire, deleted %v", got)
+		}
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, []string{"sessions.a", "sessions.b"}) || !kv.Contains("sessions.c") {
+		t.Errorf("Expiry deleted %v", got)
+	}
+	if _, err := l.KeepAlive(id); !errors.Is(err, memkv.ErrLeaseNotFound) {
+		t.Errorf("KeepAlive of an expired lease: %v", err)
+	}
+
+	id, _ = l.Grant(time.Minute)
+	l.Set(id, "sessions.d", 4)
+	if err := l.Revoke(id); err != nil || kv.Contains("sessions.d") {
+		t.Errorf("Revoke left the key behind: %v", err)
+	}
+}
+
+func TestMutex(t *testing.T) {
+	kv := memkv.NewMemKV(".", nil)
+	l := memkv.NewLessor(kv)
+	defer l.Close()
+
+	a := l.Mutex("locks.crl", time.Minute)
+	b := l.Mutex("locks.crl", time.Minute)
+	first, err := a.TryLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.TryLock(); !errors.Is(err, memkv.ErrLocked) {
+		t.Fatalf("Second TryLock: %v", err)
+	}
+
+	acquired := make(chan int64)
+	go func() {
+		token, err := b.Lock(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- token
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := a.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	second := <-acquired
+	if second <= first {
+		t.Errorf("Fencing token did not grow: %d after %d", second, first)
+	}
+	if v, _ := kv.Get("locks.crl"); v != second {
+		t.Errorf("Lock key holds %v", v)
+	}
+
+	// a holder whose lease expired has lost the lock
+	c := l.Mutex("locks.ocsp", 30*time.Millisecond)
+	if _, err := c.TryLock(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := c.KeepAlive(); !errors.Is(err, memkv.ErrLockLost) || c.Token() != 0 {
+		t.Errorf("Expired lock kept alive: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := a.Lock(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Lock on a held mutex returned %v", err)
+	}
+	if err := b.Unlock(); err != nil {
+		t.Error(err)
+	}
+
+	// the counter never goes down, even when its key is overwritten
+	for _, v := range []any{0, "reset"} {
+		kv.Set("__lease.fence", v)
+		token, err := a.TryLock()
+		if err != nil || token <= second {
+			t.Errorf("Token after the counter was set to %v: %d, %v", v, token, err)
+		}
+		second = token
+		a.Unlock()
+	}
+}
+
+func TestFS(t *testing.T) {
+	kv := memkv.NewMemKV(".", nil)
+	kv.ImportMap(map[string]any{
+		"site": map[string]any{
+			"index": "<h1>hi</h1>",
+			"logo":  []byte{0x89, 'P', 'N', 'G'},
+			"conf":  map[string]any{"port": 80, "hosts": []any{"a", "b"}},
+		},
+	})
+	before := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	fsys := memkv.NewFS(kv, "site")
+	defer fsys.Close()
+	kv.Set("site.conf.port", 8080)
+
+	if err := fstest.TestFS(fsys, "index", "logo", "conf/port", "conf/hosts"); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"index": "<h1>hi</h1>", "logo": "\x89PNG", "conf/port": "8080", "conf/hosts": `["a","b"]`}
+	for name, want := range files {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil || string(data) != want {
+			t.Errorf("ReadFile(%q) = %q, %v", name, data, err)
+		}
+	}
+
+	changed, _ := fs.Stat(fsys, "conf/port")
+	unchanged, _ := fs.Stat(fsys, "index")
+	dir, _ := fs.Stat(fsys, "conf")
+	if !changed.ModTime().After(unchanged.ModTime()) || !dir.ModTime().Equal(changed.ModTime()) {
+		t.Errorf("Modification times %v, %v, %v", changed.ModTime(), unchanged.ModTime(), dir.ModTime())
+	}
+	if unchanged.ModTime().Before(before) {
+		t.Errorf("Unchanged file dated before the FS was created")
+	}
+
+	var walked []string
+	fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		walked = append(walked, path)
+		return err
+	})
+	if !reflect.DeepEqual(walked, []string{".", "conf", "conf/hosts", "conf/port", "index", "logo"}) {
+		t.Errorf("WalkDir visited %v", walked)
+	}
+	if _, err := fsys.Open("conf.port"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("Name with the separator opened: %v", err)
+	}
+	if _, err := fsys.Open("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Missing file: %v", err)
+	}
+}
+
+func TestMemKV_SetComputed(t *testing.T) {
+	kv := memkv.NewMemKV(".", nil)
+	kv.ImportMap(map[string]any{"db": map[string]any{"host": "h1", "port": 5432, "user": "ca"}})
+	dsn := func(r *memkv.Reader) (any, error) {
+		host, _ := r.Get("db.host")
+		port, _ := r.Get("db.port")
+		user, ok := r.Get("db.user")
+		if !ok {
+			return nil, errors.New("db.user is not set")
+		}
+		return fmt.Sprintf("postgres://%v@%v:%v", user, host, port), nil
+	}
+	if err := kv.SetComputed("db.dsn", dsn); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.SetComputed("app.banner", func(r *memkv.Reader) (any, error) {
+		v, _ := r.Get("db.dsn")
+		return fmt.Sprintf("connected to %v", v), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var events []string
+	kv.AddPrefixWatcherHook("", func(e memkv.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, fmt.Sprintf("%s %s %v", e.Type, e.Key, e.NewVal))
+	}, []memkv.EventType{memkv.E_KEY_UPDATED})
+
+	kv.Set("db.host", "h2")
+	kv.Set("db.port", 5432)
+	if v, _ := kv.Get("app.banner"); v != "connected to postgres://ca@h2:5432" {
+		t.Errorf("app.banner = %v", v)
+	}
+	mu.Lock()
+	want := []string{
+		"updated db.host h2",
+		"updated db.dsn postgres://ca@h2:5432",
+		"updated app.banner connected to postgres://ca@h2:5432",
+		"updated db.port 5432",
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("Events %q", events)
+	}
+	mu.Unlock()
+
+	// a failing recompute keeps the last value
+	kv.Drop("db.user", false)
+	if err := kv.ComputedErr("db.dsn"); err == nil {
+		t.Error("Missing dependency was not reported")
+	}
+	if v, _ := kv.Get("db.dsn"); v != "postgres://ca@h2:5432" {
+		t.Errorf("db.dsn = %v after a failed recompute", v)
+	}
+	kv.Set("db.user", "issuer")
+	if err := kv.ComputedErr("db.dsn"); err != nil {
+		t.Errorf("Error kept after recovering: %v", err)
+	}
+
+	// db.dsn would read app.banner which reads db.dsn
+	err := kv.SetComputed("db.host", func(r *memkv.Reader) (any, error) {
+		v, _ := r.Get("app")
+		return v, nil
+	})
+	if !errors.Is(err, memkv.ErrComputeCycle) {
+		t.Errorf("Cycle accepted: %v", err)
+	}
+	if err := kv.SetComputed("loop", func(r *memkv.Reader) (any, error) {
+		v, _ := r.Get("loop")
+		return v, nil
+	}); !errors.Is(err, memkv.ErrComputeCycle) {
+		t.Errorf("Self dependency accepted: %v", err)
+	}
+	if v, _ := kv.Get("db.host"); v != "h2" {
+		t.Errorf("Refused registration changed the key to %v", v)
+	}
+}
+
+func TestMemKV_Index(t *testing.T) {
+	kv := memkv.NewMemKV(".", nil)
+	kv.ImportMap(map[string]any{"certs": map[string]any{
+		"web":  map[string]any{"serial": 10, "hosts": []any{"a.example", "b.example"}},
+		"mail": map[string]any{"serial": 20, "hosts": []any{"m.example"}},
+	}})
+	kv.AddIndex("serial", "certs", func(_ string, v any) []any {
+		if ks, ok := v.(map[string]any); ok {
+			return []any{ks["serial"]}
+		}
+		return nil
+	})
+	kv.AddIndex("host", "certs", func(_ string, v any) []any {
+		if ks, ok := v.(map[string]any); ok {
+			hosts, _ := ks["hosts"].([]any)
+			return hosts
+		}
+		return nil
+	})
+	keys := func(ms []memkv.Match, err error) []string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make([]string, 0, len(ms))
+		for _, m := range ms {
+			out = append(out, m.Key)
+		}
+		return out
+	}
+
+	if got := keys(kv.IndexLookup("serial", float64(10))); !reflect.DeepEqual(got, []string{"certs.web"}) {
+		t.Errorf("IndexLookup(10) = %v", got)
+	}
+	kv.Set("certs.web.serial", 30)
+	kv.Set("certs.ocsp", map[string]any{"serial": 15, "hosts": []any{"a.example"}})
+	kv.Drop("certs.mail", true)
+	if got := keys(kv.IndexLookup("serial", 10)); len(got) != 0 {
+		t.Errorf("Stale entry after Set: %v", got)
+	}
+	if got := keys(kv.IndexLookup("host", "a.example")); !reflect.DeepEqual(got, []string{"certs.ocsp", "certs.web"}) {
+		t.Errorf("IndexLookup(a.example) = %v", got)
+	}
+	if got := keys(kv.IndexRange("serial", 0, 30)); !reflect.DeepEqual(got, []string{"certs.ocsp"}) {
+		t.Errorf("IndexRange(0, 30) = %v", got)
+	}
+	if got := keys(kv.IndexRange("serial", 15, nil)); !reflect.DeepEqual(got, []string{"certs.ocsp", "certs.web"}) {
+		t.Errorf("IndexRange(15, nil) = %v", got)
+	}
+	if got := keys(kv.IndexRange("host", "b", nil)); !reflect.DeepEqual(got, []string{"certs.web"}) {
+		t.Errorf("IndexRange(b, nil) = %v", got)
+	}
+
+	// loading a snapshot rebuilds the indexes
+	other := memkv.NewMemKV(".", nil)
+	other.Set("certs.root", map[string]any{"serial": 1})
+	kv.LoadFromSerializableMap(other.GetSerializableMap())
+	if got := keys(kv.IndexLookup("serial", 1)); !reflect.DeepEqual(got, []string{"certs.root"}) {
+		t.Errorf("IndexLookup(1) after loading = %v", got)
+	}
+	if _, err := kv.IndexLookup("missing", 1); !errors.Is(err, memkv.ErrNoIndex) {
+		t.Errorf("Unknown index: %v", err)
+	}
+}
+
+func TestMemKV_Metrics(t *testing.T) {
+	kv := memkv.NewMemKV(".", nil)
+	if _, ok := kv.Metrics(); ok {
+		t.Error("Metrics are on by default")
+	}
+	kv.EnableMetrics(2)
+	kv.ImportMap(map[string]any{"certs": map[string]any{"a": "x", "b": "y"}, "sessions": map[string]any{"s1": 1}})
+	kv.Set("certs.a", "z")
+	kv.Set("misc", true)
+	kv.Get("certs.a")
+	kv.Get("certs.none")
+	kv.Get("sessions.s1")
+	kv.Drop("certs", true)
+
+	s, ok := kv.Metrics()
+	if !ok {
+		t.Fatal("Metrics are off after EnableMetrics")
+	}
+	if s.GetHits != 2 || s.GetMisses != 1 || s.Sets != 5 || s.Deletes != 2 || s.Keys != 2 {
+		t.Errorf("Metrics %+v", s)
+	}
+	if s.DispatchLatency.Count == 0 || s.LockWait.Count == 0 || s.ApproxBytes <= 0 {
+		t.Errorf("Histograms or size empty: %+v", s)
+	}
+	if len(s.Prefixes) != 2 || s.Prefixes[0].Prefix != "certs" || s.Prefixes[0].Deletes != 2 || s.Prefixes[1].Prefix != "sessions" {
+		t.Errorf("Top prefixes %+v", s.Prefixes)
+	}
+
+	rec := httptest.NewRecorder()
+	memkv.MetricsHandler(kv).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE memkv_gets_total counter",
+		`memkv_gets_total{result="miss"} 1`,
+		"memkv_sets_total 5",
+		`memkv_lock_wait_seconds_bucket{le="+Inf"}`,
+		"memkv_dispatch_duration_seconds_count",
+		`memkv_prefix_operations_total{prefix="certs",op="delete"} 2`,
+		`memkv_prefix_keys{prefix="sessions"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Exposition lacks %q:\n%s", want, body)
+		}
+	}
+	kv.DisableMetrics()
+	rec = httptest.NewRecorder()
+	memkv.MetricsHandler(kv).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Disabled metrics served with %d", rec.Code)
+	}
+}
+
+func TestMemKV_MetricsBounded(t *testing.T) {
+	kv := memkv.NewMemKV(".", nil)
+	kv.EnableMetrics(1)
+	for i := range 1100 {
+		kv.Set(fmt.Sprintf("k%d", i), i)
+	}
+	for i := range 100 {
+		kv.Get(fmt.Sprintf("missing%d", i))
+	}
+	s, _ := kv.Metrics()
+	want := memkv.PrefixStats{Prefix: memkv.METRICS_OTHER_PREFIX, Gets: 100, Sets: 1100 - 1024}
+	if len(s.Prefixes) != 1 || s.Prefixes[0] != want {
+		t.Errorf("Top prefixes %+v, want %+v", s.Prefixes, want)
+	}
+}
@@ -0,0 +1,158 @@
+package memkv
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// MergeStrategy decides what happens when a merged value meets an existing one at the same path.
+// Key spaces on both sides are always merged recursively, strategies only apply to the remaining cases.
+type MergeStrategy int
+
+const (
+	// MERGE_OVERWRITE replaces the existing value with the incoming one
+	MERGE_OVERWRITE MergeStrategy = iota
+	// MERGE_KEEP keeps the existing value and ignores the incoming one
+	MERGE_KEEP MergeStrategy = iota
+	// MERGE_ERROR aborts the whole merge when the two values differ
+	MERGE_ERROR MergeStrategy = iota
+	// MERGE_APPEND concatenates []any values and otherwise behaves like MERGE_OVERWRITE
+	MERGE_APPEND MergeStrategy = iota
+)
+
+// ConflictError is returned by MERGE_ERROR merges, Key is the full path of the first conflict found
+type ConflictError struct {
+	Key      string
+	Existing any
+	Incoming any
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("merge conflict at %q: %v != %v", e.Key, e.Existing, e.Incoming)
+}
+
+// ChangeFunc is told about every leaf a merge created (E_KEY_CREATED), replaced (E_KEY_UPDATED) or
+// removed (E_KEY_DELETED) because a key space took its place or the other way around
+type ChangeFunc func(path []string, t EventType, oldVal any, newVal any)
+
+// MergeMaps deep merges src into dst following strategy, src is never modified and no value of it is
+// retained by dst. onChange may be nil. Conflicts are reported with sep joining the path.
+// dst is left partially merged when an error is returned.
+func MergeMaps(dst map[string]any, src map[string]any, strategy MergeStrategy, sep string, onChange ChangeFunc) error {
+	return mergeInto(dst, src, nil, strategy, sep, func(s string) string { return s }, onChange)
+}
+
+func mergeInto(dst map[string]any, src map[string]any, path []string, strategy MergeStrategy, sep string, norm func(string) string, onChange ChangeFunc) error {
+	for rawKey, in := range src {
+		k := norm(rawKey)
+		p := append(path[:len(path):len(path)], k)
+		cur, exists := dst[k]
+		inKs, inIsKs := in.(map[string]any)
+		curKs, curIsKs := cur.(map[string]any)
+		switch {
+		case !exists:
+			if inIsKs {
+				ks := map[string]any{}
+				dst[k] = ks
+				if err := mergeInto(ks, inKs, p, strategy, sep, norm, onChange); err != nil {
+					return err
+				}
+				continue
+			}
+			dst[k] = DeepCopy(in)
+			notify(onChange, p, E_KEY_CREATED, nil, dst[k])
+		case inIsKs && curIsKs:
+			if err := mergeInto(curKs, inKs, p, strategy, sep, norm, onChange); err != nil {
+				return err
+			}
+		case reflect.DeepEqual(cur, in):
+		case strategy == MERGE_KEEP:
+		case strategy == MERGE_ERROR:
+			return &ConflictError{Key: strings.Join(p, sep), Existing: cur, Incoming: in}
+		default:
+			if strategy == MERGE_APPEND {
+				curList, okA := cur.([]any)
+				inList, okB := in.([]any)
+				if okA && okB {
+					merged := append(append([]any{}, curList...), DeepCopy(inList).([]any)...)
+					dst[k] = merged
+					notify(onChange, p, E_KEY_UPDATED, cur, merged)
+					continue
+				}
+			}
+			if curIsKs {
+				walkLeaves(curKs, "", "\x00", func(leaf string, v any) {
+					notify(onChange, append(p[:len(p):len(p)], strings.Split(leaf, "\x00")...), E_KEY_DELETED, v, nil)
+				})
+			}
+			if inIsKs {
+				ks := map[string]any{}
+				dst[k] = ks
+				if err := mergeInto(ks, inKs, p, strategy, sep, norm, onChange); err != nil {
+					return err
+				}
+				continue
+			}
+			dst[k] = DeepCopy(in)
+			if curIsKs {
+				notify(onChange, p, E_KEY_CREATED, nil, dst[k])
+			} else {
+				notify(onChange, p, E_KEY_UPDATED, cur, dst[k])
+			}
+		}
+	}
+	return nil
+}
+
+func notify(onChange ChangeFunc, path []string, t EventType, oldVal any, newVal any) {
+	if onChange != nil {
+		onChange(path, t, oldVal, newVal)
+	}
+}
+
+// MergeMap deep merges data into the store following strategy. Nested maps in data extend the
+// matching key spaces instead of replacing them, so merging {"db": {"port": 1}} keeps db.host.
+// The merge is atomic, on error the store is left untouched. An event is dispatched for every
+// leaf that was created, updated or removed.
+func (m *MemKV) MergeMap(data map[string]any, strategy MergeStrategy) error {
+	return m.mergeAs("", data, strategy, nil)
+}
+
+// mergeAs is MergeMap on behalf of principal, see setAs for check
+func (m *MemKV) mergeAs(principal string, data map[string]any, strategy MergeStrategy, check func() error) error {
+	m.lock()
+	defer m.l.Unlock()
+	if err := m.authorize(principal, check); err != nil {
+		return err
+	}
+	spelled := spellDraft{}
+	m.spellTree(spelled, m.m, "", data)
+	root := cloneTree(m.m)
+	now := time.Now()
+	var events []Event
+	err := mergeInto(root, data, nil, strategy, m.sep, m.normalize, func(path []string, t EventType, oldVal any, newVal any) {
+		events = append(events, Event{
+			Key:       strings.Join(path, m.sep),
+			Type:      t,
+			When:      now,
+			Success:   true,
+			OldVal:    oldVal,
+			NewVal:    DeepCopy(newVal),
+			Principal: principal,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if err := m.validateTree(root, m.sep); err != nil {
+		return err
+	}
+	m.m = root
+	m.install(spelled)
+	for _, e := range events {
+		m.dispatchWatchers(e)
+	}
+	return nil
+}
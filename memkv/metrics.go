@@ -0,0 +1,380 @@
+package memkv
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// METRICS_OTHER_PREFIX stands in the prefix metrics for the top level key spaces that are not
+// tracked individually, see EnableMetrics
+const METRICS_OTHER_PREFIX = "__other"
+
+// maxPrefixes is the least number of top level key spaces tracked individually
+const maxPrefixes = 1024
+
+// latencyBuckets are the upper bounds in seconds of the latency histograms
+var latencyBuckets = []float64{1e-6, 5e-6, 1e-5, 5e-5, 1e-4, 5e-4, 1e-3, 5e-3, 1e-2, 5e-2, 0.1, 0.5, 1}
+
+// Histogram is a snapshot of a latency histogram in seconds. Counts[i] counts the observations
+// up to Buckets[i] that did not fit a smaller bucket, the last entry counts the rest.
+type Histogram struct {
+	Buckets []float64
+	Counts  []uint64
+	Count   uint64
+	Sum     float64
+}
+
+// PrefixStats breaks the operations down by top level key space
+type PrefixStats struct {
+	Prefix      string
+	Gets        uint64
+	Sets        uint64
+	Deletes     uint64
+	Keys        int
+	ApproxBytes int64
+}
+
+// Metrics is a snapshot of the metrics of a store
+type Metrics struct {
+	GetHits   uint64
+	GetMisses uint64
+	// Sets counts every value created or updated, whatever operation did it
+	Sets uint64
+	// Deletes counts every value deleted, a dropped key space counts each of its values
+	Deletes uint64
+	// DispatchLatency is the time watch hooks took for each event
+	DispatchLatency Histogram
+	// LockWait is the time operations waited for the store lock
+	LockWait Histogram
+	// Keys counts the values, key spaces not included
+	Keys int
+	// ApproxBytes estimates the memory held by keys and values
+	ApproxBytes int64
+	// Prefixes holds the top level key spaces with the most operations, at most as many as
+	// EnableMetrics was asked for. METRICS_OTHER_PREFIX sums up those not tracked individually.
+	Prefixes []PrefixStats
+}
+
+type histogram struct {
+	counts []atomic.Uint64
+	count  atomic.Uint64
+	// sum holds the total in nanoseconds
+	sum atomic.Int64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]atomic.Uint64, len(latencyBuckets)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(latencyBuckets, d.Seconds())
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+func (h *histogram) snapshot() Histogram {
+	out := Histogram{
+		Buckets: append([]float64{}, latencyBuckets...),
+		Counts:  make([]uint64, len(h.counts)),
+		Count:   h.count.Load(),
+		Sum:     time.Duration(h.sum.Load()).Seconds(),
+	}
+	for i := range h.counts {
+		out.Counts[i] = h.counts[i].Load()
+	}
+	return out
+}
+
+type prefixCounters struct {
+	gets, sets, deletes atomic.Uint64
+}
+
+// collector gathers the metrics of a store, its counters are updated without the store lock
+type collector struct {
+	topN               int
+	getHits, getMisses atomic.Uint64
+	sets, deletes      atomic.Uint64
+	dispatch, lockWait *histogram
+	prefixes           sync.Map
+	// tracked counts the entries of prefixes, other takes the operations past the limit
+	tracked atomic.Int64
+	other   prefixCounters
+}
+
+// EnableMetrics starts collecting metrics, breaking them down for the topN busiest top level key
+// spaces. Metrics are off by default and cost a few atomic operations per operation when on.
+// Enabling them again resets them.
+//
+// Top level key spaces are tracked individually once a value is written to them, up to the
+// larger of topN and 1024. Operations on the others, and lookups missing a key space that is
+// not tracked, are counted under METRICS_OTHER_PREFIX so the metrics stay bounded.
+func (m *MemKV) EnableMetrics(topN int) {
+	m.metrics.Store(&collector{topN: topN, dispatch: newHistogram(), lockWait: newHistogram()})
+}
+
+// DisableMetrics stops collecting metrics
+func (m *MemKV) DisableMetrics() {
+	m.metrics.Store(nil)
+}
+
+// lock takes the write lock, timing the wait when metrics are on
+func (m *MemKV) lock() {
+	c := m.metrics.Load()
+	if c == nil {
+		m.l.Lock()
+		return
+	}
+	start := time.Now()
+	m.l.Lock()
+	c.lockWait.observe(time.Since(start))
+}
+
+// rlock takes the read lock, timing the wait when metrics are on
+func (m *MemKV) rlock() {
+	c := m.metrics.Load()
+	if c == nil {
+		m.l.RLock()
+		return
+	}
+	start := time.Now()
+	m.l.RLock()
+	c.lockWait.observe(time.Since(start))
+}
+
+// prefix returns the counters of the top level key space of key, track is false for lookups
+// that missed so keys that never existed do not take a slot
+func (c *collector) prefix(key string, sep string, track bool) *prefixCounters {
+	if i := strings.Index(key, sep); i >= 0 {
+		key = key[:i]
+	}
+	if p, ok := c.prefixes.Load(key); ok {
+		return p.(*prefixCounters)
+	}
+	if !track || c.tracked.Load() >= int64(max(c.topN, maxPrefixes)) {
+		return &c.other
+	}
+	p, loaded := c.prefixes.LoadOrStore(key, &prefixCounters{})
+	if !loaded {
+		c.tracked.Add(1)
+	}
+	return p.(*prefixCounters)
+}
+
+// countGet records a lookup of the normalized key
+func (m *MemKV) countGet(key string, hit bool) {
+	c := m.metrics.Load()
+	if c == nil {
+		return
+	}
+	if hit {
+		c.getHits.Add(1)
+	} else {
+		c.getMisses.Add(1)
+	}
+	c.prefix(key, m.sep, hit).gets.Add(1)
+}
+
+// countEvent records a dispatched event and how long its hooks took
+func (m *MemKV) countEvent(e Event, took time.Duration) {
+	c := m.metrics.Load()
+	if c == nil {
+		return
+	}
+	c.dispatch.observe(took)
+	if !e.Success {
+		return
+	}
+	switch e.Type {
+	case E_KEY_CREATED, E_KEY_UPDATED:
+		c.sets.Add(1)
+		c.prefix(e.Key, m.sep, true).sets.Add(1)
+	case E_KEY_DELETED:
+		if _, isKs := e.OldVal.(map[string]any); !isKs {
+			c.deletes.Add(1)
+			c.prefix(e.Key, m.sep, true).deletes.Add(1)
+		}
+	}
+}
+
+// Metrics returns a snapshot of the metrics, false when they are off. Counting the keys and
+// their size walks the whole store under the read lock.
+func (m *MemKV) Metrics() (Metrics, bool) {
+	c := m.metrics.Load()
+	if c == nil {
+		return Metrics{}, false
+	}
+	out := Metrics{
+		GetHits:         c.getHits.Load(),
+		GetMisses:       c.getMisses.Load(),
+		Sets:            c.sets.Load(),
+		Deletes:         c.deletes.Load(),
+		DispatchLatency: c.dispatch.snapshot(),
+		LockWait:        c.lockWait.snapshot(),
+	}
+	sizes := map[string]*PrefixStats{}
+	m.rlock()
+	for k, v := range m.m {
+		s := &PrefixStats{Prefix: k}
+		walkLeaves(v, k, m.sep, func(string, any) { s.Keys++ })
+		s.ApproxBytes = int64(len(k)) + approxSize(v)
+		out.Keys += s.Keys
+		out.ApproxBytes += s.ApproxBytes
+		sizes[k] = s
+	}
+	m.l.RUnlock()
+
+	c.prefixes.Range(func(k, v any) bool {
+		p := v.(*prefixCounters)
+		s, ok := sizes[k.(string)]
+		if !ok {
+			s = &PrefixStats{Prefix: k.(string)}
+			sizes[s.Prefix] = s
+		}
+		s.Gets, s.Sets, s.Deletes = p.gets.Load(), p.sets.Load(), p.deletes.Load()
+		return true
+	})
+	if other := (PrefixStats{
+		Prefix:  METRICS_OTHER_PREFIX,
+		Gets:    c.other.gets.Load(),
+		Sets:    c.other.sets.Load(),
+		Deletes: c.other.deletes.Load(),
+	}); other.Gets+other.Sets+other.Deletes > 0 {
+		// a key space named like the stand-in is folded into it
+		if s, ok := sizes[other.Prefix]; ok {
+			other.Gets, other.Sets, other.Deletes = other.Gets+s.Gets, other.Sets+s.Sets, other.Deletes+s.Deletes
+			other.Keys, other.ApproxBytes = s.Keys, s.ApproxBytes
+		}
+		sizes[other.Prefix] = &other
+	}
+	for _, s := range sizes {
+		out.Prefixes = append(out.Prefixes, *s)
+	}
+	sort.Slice(out.Prefixes, func(i, j int) bool {
+		a, b := out.Prefixes[i], out.Prefixes[j]
+		if oa, ob := a.Gets+a.Sets+a.Deletes, b.Gets+b.Sets+b.Deletes; oa != ob {
+			return oa > ob
+		}
+		if a.ApproxBytes != b.ApproxBytes {
+			return a.ApproxBytes > b.ApproxBytes
+		}
+		return a.Prefix < b.Prefix
+	})
+	if len(out.Prefixes) > c.topN {
+		out.Prefixes = out.Prefixes[:c.topN]
+	}
+	return out, true
+}
+
+// approxSize estimates the memory v holds, counting headers, keys and contents but not
+// allocator overhead
+func approxSize(v any) int64 {
+	switch t := v.(type) {
+	case nil:
+		return 0
+	case map[string]any:
+		n := int64(48)
+		for k, child := range t {
+			n += 16 + int64(len(k)) + 16 + approxSize(child)
+		}
+		return n
+	case []any:
+		n := int64(24)
+		for _, child := range t {
+			n += 16 + approxSize(child)
+		}
+		return n
+	case string:
+		return 16 + int64(len(t))
+	case []byte:
+		return 24 + int64(len(t))
+	}
+	return int64(reflect.TypeOf(v).Size())
+}
+
+// WritePrometheus writes s in the Prometheus text exposition format
+func WritePrometheus(w io.Writer, s Metrics) error {
+	var b strings.Builder
+	metric := func(name string, kind string, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	metric("memkv_gets_total", "counter", "Lookups by result.")
+	fmt.Fprintf(&b, "memkv_gets_total{result=\"hit\"} %d\n", s.GetHits)
+	fmt.Fprintf(&b, "memkv_gets_total{result=\"miss\"} %d\n", s.GetMisses)
+	metric("memkv_sets_total", "counter", "Values created or updated.")
+	fmt.Fprintf(&b, "memkv_sets_total %d\n", s.Sets)
+	metric("memkv_deletes_total", "counter", "Values deleted.")
+	fmt.Fprintf(&b, "memkv_deletes_total %d\n", s.Deletes)
+	metric("memkv_dispatch_duration_seconds", "histogram", "Time watch hooks took per event.")
+	writeHistogram(&b, "memkv_dispatch_duration_seconds", s.DispatchLatency)
+	metric("memkv_lock_wait_seconds", "histogram", "Time operations waited for the store lock.")
+	writeHistogram(&b, "memkv_lock_wait_seconds", s.LockWait)
+	metric("memkv_keys", "gauge", "Values in the store.")
+	fmt.Fprintf(&b, "memkv_keys %d\n", s.Keys)
+	metric("memkv_approx_bytes", "gauge", "Estimated memory held by keys and values.")
+	fmt.Fprintf(&b, "memkv_approx_bytes %d\n", s.ApproxBytes)
+	if len(s.Prefixes) > 0 {
+		metric("memkv_prefix_operations_total", "counter", "Operations by top level key space.")
+		for _, p := range s.Prefixes {
+			l := promLabel(p.Prefix)
+			fmt.Fprintf(&b, "memkv_prefix_operations_total{prefix=\"%s\",op=\"get\"} %d\n", l, p.Gets)
+			fmt.Fprintf(&b, "memkv_prefix_operations_total{prefix=\"%s\",op=\"set\"} %d\n", l, p.Sets)
+			fmt.Fprintf(&b, "memkv_prefix_operations_total{prefix=\"%s\",op=\"delete\"} %d\n", l, p.Deletes)
+		}
+		metric("memkv_prefix_keys", "gauge", "Values by top level key space.")
+		for _, p := range s.Prefixes {
+			fmt.Fprintf(&b, "memkv_prefix_keys{prefix=\"%s\"} %d\n", promLabel(p.Prefix), p.Keys)
+		}
+		metric("memkv_prefix_approx_bytes", "gauge", "Estimated memory by top level key space.")
+		for _, p := range s.Prefixes {
+			fmt.Fprintf(&b, "memkv_prefix_approx_bytes{prefix=\"%s\"} %d\n", promLabel(p.Prefix), p.ApproxBytes)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeHistogram(b *strings.Builder, name string, h Histogram) {
+	var cumulative uint64
+	for i, n := range h.Counts {
+		cumulative += n
+		le := "+Inf"
+		if i < len(h.Buckets) {
+			le = promFloat(h.Buckets[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{le=\"%s\"} %d\n", name, le, cumulative)
+	}
+	fmt.Fprintf(b, "%s_sum %s\n%s_count %d\n", name, promFloat(h.Sum), name, h.Count)
+}
+
+func promFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", f)
+}
+
+func promLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// MetricsHandler serves the metrics of m in the Prometheus text format, 404 while they are off
+func MetricsHandler(m *MemKV) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, ok := m.Metrics()
+		if !ok {
+			http.Error(w, "metrics are disabled", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = WritePrometheus(w, s)
+	})
+}
@@ -0,0 +1,480 @@
+package memkv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Change is one difference between two trees. Type is E_KEY_CREATED, E_KEY_UPDATED or
+// E_KEY_DELETED. Key spaces that only exist on one side are reported as a single change holding
+// the whole key space, key spaces on both sides are compared key by key.
+type Change struct {
+	Key    string
+	Type   EventType
+	OldVal any
+	NewVal any
+}
+
+// Diff returns the changes turning from into to sorted by key, keys are joined with sep.
+// Numbers are equal when their values are, so trees that went through JSON compare cleanly.
+func Diff(from map[string]any, to map[string]any, sep string) []Change {
+	out := make([]Change, 0)
+	diffInto(&out, from, to, "", sep)
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// DiffSnapshots compares two snapshots made by GetSerializableMap, for example of a staged and a
+// live store. Both must use the same separator.
+func DiffSnapshots(from map[string]any, to map[string]any) ([]Change, error) {
+	a, err := decodeSnapshot(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := decodeSnapshot(to)
+	if err != nil {
+		return nil, err
+	}
+	if a.sep != b.sep {
+		return nil, fmt.Errorf("snapshots use different separators %q and %q", a.sep, b.sep)
+	}
+	return Diff(a.data, b.data, a.sep), nil
+}
+
+func diffInto(out *[]Change, from map[string]any, to map[string]any, path string, sep string) {
+	for k, a := range from {
+		key := joinKey(path, k, sep)
+		b, ok := to[k]
+		if !ok {
+			*out = append(*out, Change{Key: key, Type: E_KEY_DELETED, OldVal: a})
+			continue
+		}
+		ksA, isKsA := a.(map[string]any)
+		ksB, isKsB := b.(map[string]any)
+		if isKsA && isKsB {
+			diffInto(out, ksA, ksB, key, sep)
+		} else if !sameValue(a, b) {
+			*out = append(*out, Change{Key: key, Type: E_KEY_UPDATED, OldVal: a, NewVal: b})
+		}
+	}
+	for k, b := range to {
+		if _, ok := from[k]; !ok {
+			*out = append(*out, Change{Key: joinKey(path, k, sep), Type: E_KEY_CREATED, NewVal: b})
+		}
+	}
+}
+
+// sameValue is reflect.DeepEqual comparing numbers by value
+func sameValue(a any, b any) bool {
+	switch ta := a.(type) {
+	case map[string]any:
+		tb, ok := b.(map[string]any)
+		if !ok || len(ta) != len(tb) {
+			return false
+		}
+		for k, v := range ta {
+			w, ok := tb[k]
+			if !ok || !sameValue(v, w) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		tb, ok := b.([]any)
+		if !ok || len(ta) != len(tb) {
+			return false
+		}
+		for i := range ta {
+			if !sameValue(ta[i], tb[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return equalValues(a, b)
+}
+
+// PatchOp is one operation of an RFC 6902 JSON Patch
+type PatchOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	From  string `json:"from,omitempty"`
+	Value any    `json:"value"`
+}
+
+// MarshalJSON leaves out the value of operations that take none
+func (o PatchOp) MarshalJSON() ([]byte, error) {
+	type plain PatchOp
+	switch o.Op {
+	case "remove", "move", "copy":
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+			From string `json:"from,omitempty"`
+		}{o.Op, o.Path, o.From})
+	}
+	return json.Marshal(plain(o))
+}
+
+// Patch is an RFC 6902 JSON Patch, it marshals to the standard JSON form
+type Patch []PatchOp
+
+var ErrPatchSyntax = errors.New("invalid JSON patch")
+
+// ParsePatch decodes a JSON Patch document and checks its operations are well formed
+func ParsePatch(data []byte) (Patch, error) {
+	var raw []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPatchSyntax, err)
+	}
+	p := make(Patch, len(raw))
+	for i, r := range raw {
+		op := &p[i]
+		for field, dst := range map[string]*string{"op": &op.Op, "path": &op.Path, "from": &op.From} {
+			if v, ok := r[field]; ok {
+				if err := json.Unmarshal(v, dst); err != nil {
+					return nil, fmt.Errorf("%w: operation %d: %s must be a string", ErrPatchSyntax, i, field)
+				}
+			}
+		}
+		_, hasPath := r["path"]
+		_, hasFrom := r["from"]
+		_, hasValue := r["value"]
+		switch op.Op {
+		case "add", "replace", "test":
+			if !hasValue {
+				return nil, fmt.Errorf("%w: operation %d: %s needs a value", ErrPatchSyntax, i, op.Op)
+			}
+			if err := json.Unmarshal(r["value"], &op.Value); err != nil {
+				return nil, fmt.Errorf("%w: operation %d: %w", ErrPatchSyntax, i, err)
+			}
+		case "move", "copy":
+			if !hasFrom {
+				return nil, fmt.Errorf("%w: operation %d: %s needs from", ErrPatchSyntax, i, op.Op)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("%w: operation %d: unknown op %q", ErrPatchSyntax, i, op.Op)
+		}
+		if !hasPath {
+			return nil, fmt.Errorf("%w: operation %d: path is missing", ErrPatchSyntax, i)
+		}
+	}
+	return p, nil
+}
+
+// ChangesToPatch turns changes into a patch. With tests every replace and remove is preceded by
+// a test of the old value, so applying the patch to a store that drifted from the one it was
+// computed on fails instead of overwriting unseen changes.
+func ChangesToPatch(changes []Change, sep string, tests bool) Patch {
+	p := make(Patch, 0, len(changes))
+	for _, c := range changes {
+		ptr := keyToPointer(c.Key, sep)
+		if tests && c.Type != E_KEY_CREATED {
+			p = append(p, PatchOp{Op: "test", Path: ptr, Value: c.OldVal})
+		}
+		switch c.Type {
+		case E_KEY_CREATED:
+			p = append(p, PatchOp{Op: "add", Path: ptr, Value: c.NewVal})
+		case E_KEY_UPDATED:
+			p = append(p, PatchOp{Op: "replace", Path: ptr, Value: c.NewVal})
+		case E_KEY_DELETED:
+			p = append(p, PatchOp{Op: "remove", Path: ptr})
+		}
+	}
+	return p
+}
+
+func keyToPointer(key string, sep string) string {
+	var b strings.Builder
+	for _, k := range strings.Split(key, sep) {
+		b.WriteByte('/')
+		b.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(k))
+	}
+	return b.String()
+}
+
+func parsePointer(ptr string) ([]string, error) {
+	if ptr == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, fmt.Errorf("%w: pointer %q must start with /", ErrPatchSyntax, ptr)
+	}
+	tokens := strings.Split(ptr[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return tokens, nil
+}
+
+// PatchError reports the operation that made a patch fail, Index counts from 0
+type PatchError struct {
+	Index int
+	Op    PatchOp
+	Err   error
+}
+
+func (e *PatchError) Error() string {
+	return fmt.Sprintf("patch operation %d (%s %s): %v", e.Index, e.Op.Op, e.Op.Path, e.Err)
+}
+
+func (e *PatchError) Unwrap() error {
+	return e.Err
+}
+
+// ApplyPatch applies every operation of p or none of them. A failing test operation aborts the
+// patch with ErrCheckFailed. Array elements can be addressed by index and "-" appends to an
+// array. Events are dispatched for every leaf that changed once the whole patch succeeded.
+func (m *MemKV) ApplyPatch(p Patch) error {
+	m.lock()
+	defer m.l.Unlock()
+	var root any = DeepCopy(m.m)
+	spelled := spellDraft{}
+	for i, op := range p {
+		var err error
+		if root, err = m.applyOp(spelled, root, op); err != nil {
+			return &PatchError{Index: i, Op: op, Err: err}
+		}
+	}
+	next, ok := root.(map[string]any)
+	if !ok {
+		return &PatchError{Index: len(p) - 1, Op: p[len(p)-1], Err: ErrPathConflict}
+	}
+	if err := checkKeys(next, "", m.sep, m.caseSense); err != nil {
+		return err
+	}
+	if err := m.validateTree(next, m.sep); err != nil {
+		return err
+	}
+	changes := Diff(m.m, next, m.sep)
+	m.m = next
+	m.install(spelled)
+	now := time.Now()
+	for _, c := range changes {
+		for _, e := range changeEvents(c, m.sep) {
+			e.When = now
+			m.dispatchWatchers(e)
+		}
+	}
+	return nil
+}
+
+// changeEvents expands a change into one event per leaf it created, updated or deleted
+func changeEvents(c Change, sep string) []Event {
+	events := make([]Event, 0, 1)
+	_, oldKs := c.OldVal.(map[string]any)
+	_, newKs := c.NewVal.(map[string]any)
+	if c.Type == E_KEY_UPDATED && !oldKs && !newKs {
+		return append(events, Event{Key: c.Key, Type: E_KEY_UPDATED, Success: true, OldVal: c.OldVal, NewVal: c.NewVal})
+	}
+	if c.Type != E_KEY_CREATED {
+		walkLeaves(c.OldVal, c.Key, sep, func(k string, v any) {
+			events = append(events, Event{Key: k, Type: E_KEY_DELETED, Success: true, OldVal: v})
+		})
+	}
+	if c.Type != E_KEY_DELETED {
+		walkLeaves(c.NewVal, c.Key, sep, func(k string, v any) {
+			events = append(events, Event{Key: k, Type: E_KEY_CREATED, Success: true, NewVal: v})
+		})
+	}
+	return events
+}
+
+func (m *MemKV) applyOp(spelled spellDraft, root any, op PatchOp) (any, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	if ks, ok := root.(map[string]any); ok && len(path) > 0 && op.Op != "test" && op.Op != "remove" {
+		raw := strings.Join(path, m.sep)
+		m.spellTree(spelled, ks, raw, op.Value)
+		m.spell(spelled, ks, raw)
+	}
+	path = m.normalizeTokens(path)
+	switch op.Op {
+	case "add":
+		return setPointer(root, path, m.normalizeValue(DeepCopy(op.Value)), true)
+	case "replace":
+		return setPointer(root, path, m.normalizeValue(DeepCopy(op.Value)), false)
+	case "remove":
+		root, _, err = removePointer(root, path)
+		return root, err
+	case "test":
+		v, err := getPointer(root, path)
+		if errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("%w: %w", ErrCheckFailed, err)
+		} else if err != nil {
+			return nil, err
+		}
+		if !sameValue(v, op.Value) {
+			return nil, ErrCheckFailed
+		}
+		return root, nil
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		from = m.normalizeTokens(from)
+		var v any
+		if op.Op == "copy" {
+			if v, err = getPointer(root, from); err != nil {
+				return nil, err
+			}
+			v = DeepCopy(v)
+		} else {
+			if len(path) > len(from) && reflect.DeepEqual(path[:len(from)], from) {
+				return nil, fmt.Errorf("%w: cannot move %q into itself", ErrPatchSyntax, op.From)
+			}
+			if root, v, err = removePointer(root, from); err != nil {
+				return nil, err
+			}
+		}
+		return setPointer(root, path, v, true)
+	}
+	return nil, fmt.Errorf("%w: unknown op %q", ErrPatchSyntax, op.Op)
+}
+
+func (m *MemKV) normalizeTokens(path []string) []string {
+	for i, t := range path {
+		path[i] = m.normalize(t)
+	}
+	return path
+}
+
+// normalizeValue applies the case rules of the store to the keys of the key spaces in v
+func (m *MemKV) normalizeValue(v any) any {
+	ks, ok := v.(map[string]any)
+	if !ok || m.caseSense {
+		return v
+	}
+	out := make(map[string]any, len(ks))
+	for k, child := range ks {
+		out[m.normalize(k)] = m.normalizeValue(child)
+	}
+	return out
+}
+
+func arrayIndex(tok string, n int, allowEnd bool) (int, error) {
+	if tok == "-" && allowEnd {
+		return n, nil
+	}
+	i, err := strconv.Atoi(tok)
+	if err != nil || i < 0 || (tok != "0" && strings.HasPrefix(tok, "0")) {
+		return 0, fmt.Errorf("%w: bad array index %q", ErrPatchSyntax, tok)
+	}
+	if i > n || (i == n && !allowEnd) {
+		return 0, ErrNotFound
+	}
+	return i, nil
+}
+
+func getPointer(node any, path []string) (any, error) {
+	for _, tok := range path {
+		switch t := node.(type) {
+		case map[string]any:
+			v, ok := t[tok]
+			if !ok {
+				return nil, ErrNotFound
+			}
+			node = v
+		case []any:
+			i, err := arrayIndex(tok, len(t), false)
+			if err != nil {
+				return nil, err
+			}
+			node = t[i]
+		default:
+			return nil, ErrPathConflict
+		}
+	}
+	return node, nil
+}
+
+// setPointer stores val at path and returns the new node, add inserts into arrays and creates
+// missing keys while replace requires the target to exist
+func setPointer(node any, path []string, val any, add bool) (any, error) {
+	if len(path) == 0 {
+		return val, nil
+	}
+	tok, last := path[0], len(path) == 1
+	switch t := node.(type) {
+	case map[string]any:
+		child, ok := t[tok]
+		if !ok && (!last || !add) {
+			return nil, ErrNotFound
+		}
+		v, err := setPointer(child, path[1:], val, add)
+		if err != nil {
+			return nil, err
+		}
+		t[tok] = v
+		return t, nil
+	case []any:
+		i, err := arrayIndex(tok, len(t), last && add)
+		if err != nil {
+			return nil, err
+		}
+		if last && add {
+			t = append(t, nil)
+			copy(t[i+1:], t[i:])
+			t[i] = val
+			return t, nil
+		}
+		v, err := setPointer(t[i], path[1:], val, add)
+		if err != nil {
+			return nil, err
+		}
+		t[i] = v
+		return t, nil
+	}
+	return nil, ErrPathConflict
+}
+
+// removePointer deletes the value at path and returns the new node and the removed value
+func removePointer(node any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("%w: the root cannot be removed", ErrPatchSyntax)
+	}
+	tok, last := path[0], len(path) == 1
+	switch t := node.(type) {
+	case map[string]any:
+		child, ok := t[tok]
+		if !ok {
+			return nil, nil, ErrNotFound
+		}
+		if last {
+			delete(t, tok)
+			return t, child, nil
+		}
+		v, removed, err := removePointer(child, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		t[tok] = v
+		return t, removed, nil
+	case []any:
+		i, err := arrayIndex(tok, len(t), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if last {
+			removed := t[i]
+			return append(t[:i], t[i+1:]...), removed, nil
+		}
+		v, removed, err := removePointer(t[i], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		t[i] = v
+		return t, removed, nil
+	}
+	return nil, nil, ErrPathConflict
+}
@@ -0,0 +1,587 @@
+package memkv
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Query selects keys of a store with a path, an optional filter and an optional projection:
+//
+//	services.*.port[@ > 8000]
+//	**[$key =~ "secret$"]
+//	services.*[@.tls && @.port != 443]{host, port}
+//
+// The path is split at the separator of the store. "*" matches one segment, "**" any number of
+// segments and other segments may use the * and ? globs of path.Match. Paths select key spaces
+// as well as leaves.
+//
+// The filter between brackets is evaluated for every selected key. @ is its value, @ followed by
+// the separator and a path is a value below it and $key is the full key. Operands compare with
+// ==, !=, <, <=, >, >= and strings match regular expressions with =~. Conditions combine with
+// &&, || and ! and group with parentheses. A lone operand is true when it exists and is neither
+// false nor null. Comparisons involving a missing value are false. Literals are numbers, quoted
+// strings, true, false and null.
+//
+// The projection between braces replaces every selected key space with a key space holding only
+// the listed paths, selected values that are not key spaces are dropped.
+type Query struct {
+	src     string
+	sep     string
+	path    []string
+	filter  expr
+	project [][]string
+}
+
+var ErrQuerySyntax = errors.New("query syntax error")
+
+// Match is a key selected by a query and a copy of its value
+type Match struct {
+	Key   string
+	Value any
+}
+
+// CompileQuery parses q for a store using sep
+func CompileQuery(q string, sep string) (*Query, error) {
+	out := &Query{src: q, sep: sep}
+	end := strings.IndexAny(q, "[{")
+	if end < 0 {
+		end = len(q)
+	}
+	p := strings.TrimSpace(q[:end])
+	if p == "" {
+		return nil, fmt.Errorf("%w: empty path in %q", ErrQuerySyntax, q)
+	}
+	out.path = strings.Split(p, sep)
+	for _, seg := range out.path {
+		if seg == "" {
+			return nil, fmt.Errorf("%w: empty path segment in %q", ErrQuerySyntax, q)
+		}
+		if _, err := path.Match(seg, ""); err != nil {
+			return nil, fmt.Errorf("%w: bad pattern %q", ErrQuerySyntax, seg)
+		}
+	}
+	rest := strings.TrimSpace(q[end:])
+	if strings.HasPrefix(rest, "[") {
+		l := &lexer{src: rest[1:], sep: sep}
+		e, err := l.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if l.next().kind != tokRBracket {
+			return nil, fmt.Errorf("%w: expected ] in %q", ErrQuerySyntax, q)
+		}
+		out.filter = e
+		rest = strings.TrimSpace(l.src[l.pos:])
+	}
+	if strings.HasPrefix(rest, "{") {
+		if !strings.HasSuffix(rest, "}") {
+			return nil, fmt.Errorf("%w: expected } in %q", ErrQuerySyntax, q)
+		}
+		for _, f := range strings.Split(rest[1:len(rest)-1], ",") {
+			f = strings.TrimSpace(f)
+			if f == "" {
+				return nil, fmt.Errorf("%w: empty projection in %q", ErrQuerySyntax, q)
+			}
+			out.project = append(out.project, strings.Split(f, sep))
+		}
+		rest = ""
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("%w: unexpected %q", ErrQuerySyntax, rest)
+	}
+	return out, nil
+}
+
+func (q *Query) String() string {
+	return q.src
+}
+
+// Query compiles q and runs it, see Select
+func (m *MemKV) Query(q string) ([]Match, error) {
+	compiled, err := CompileQuery(q, m.sep)
+	if err != nil {
+		return nil, err
+	}
+	return m.Select(compiled), nil
+}
+
+// Select returns the keys matched by q sorted by key. The whole query is evaluated against one
+// consistent state of the store, no access events are dispatched.
+func (m *MemKV) Select(q *Query) []Match {
+	m.rlock()
+	defer m.l.RUnlock()
+	segs := make([]string, len(q.path))
+	for i, s := range q.path {
+		segs[i] = m.normalize(s)
+	}
+	seen := map[string]bool{}
+	out := make([]Match, 0)
+	var walk func(node any, segs []string, key []string)
+	walk = func(node any, segs []string, key []string) {
+		if len(segs) == 0 {
+			k := strings.Join(key, m.sep)
+			if len(key) == 0 || seen[k] {
+				return
+			}
+			seen[k] = true
+			if q.filter != nil && !truthy(q.filter.eval(k, node)) {
+				return
+			}
+			if q.project != nil {
+				ks, ok := node.(map[string]any)
+				if !ok {
+					return
+				}
+				node = q.projection(ks, m.normalize)
+			}
+			out = append(out, Match{Key: k, Value: DeepCopy(node)})
+			return
+		}
+		if segs[0] == "**" {
+			walk(node, segs[1:], key)
+		}
+		ks, ok := node.(map[string]any)
+		if !ok {
+			return
+		}
+		for name, child := range ks {
+			next := segs[1:]
+			if segs[0] == "**" {
+				next = segs
+			} else if ok, _ := path.Match(segs[0], name); !ok {
+				continue
+			}
+			walk(child, next, append(key[:len(key):len(key)], name))
+		}
+	}
+	walk(m.m, segs, nil)
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+func (q *Query) projection(ks map[string]any, norm func(string) string) map[string]any {
+	out := map[string]any{}
+	for _, p := range q.project {
+		np := make([]string, len(p))
+		for i, s := range p {
+			np[i] = norm(s)
+		}
+		if v, ok := lookup(ks, np); ok {
+			_, _ = setIn(out, np, v)
+		}
+	}
+	return out
+}
+
+// AddQueryWatcherHook calls hook for events on keys selected by the path of q and on keys below
+// them. With a filter the event is only delivered when the selected key passes it before or after
+// the change. Key spaces are checked in the state after the whole write the event belongs to.
+func (m *MemKV) AddQueryWatcherHook(q string, hook WatchHook, eFilter []EventType) (func(), error) {
+	compiled, err := CompileQuery(q, m.sep)
+	if err != nil {
+		return nil, err
+	}
+	segs := make([]string, len(compiled.path))
+	static := make([]string, 0, len(segs))
+	for i, s := range compiled.path {
+		segs[i] = m.normalize(s)
+		if len(static) == i && !strings.ContainsAny(s, "*?") {
+			static = append(static, segs[i])
+		}
+	}
+	return m.AddPrefixWatcherHook(strings.Join(static, m.sep), func(e Event) {
+		key := m.split(e.Key)
+		for n := 1; n <= len(key); n++ {
+			if !matchPattern(segs, key[:n]) {
+				continue
+			}
+			if compiled.filter == nil {
+				hook(e)
+				return
+			}
+			// the writer holding the lock waits for the hooks, so the tree is stable
+			node := strings.Join(key[:n], m.sep)
+			if cur, ok := lookup(m.m, key[:n]); ok && truthy(compiled.filter.eval(node, cur)) {
+				hook(e)
+				return
+			}
+			if n == len(key) && e.OldVal != nil && truthy(compiled.filter.eval(node, e.OldVal)) {
+				hook(e)
+				return
+			}
+		}
+	}, eFilter), nil
+}
+
+// expr is a compiled filter, eval returns the value of the expression for the key and value
+// being filtered and missing when it refers to something that does not exist
+type expr interface {
+	eval(key string, val any) any
+}
+
+// missing is the value of paths that do not exist
+type missingValue struct{}
+
+var missing = missingValue{}
+
+type litExpr struct{ v any }
+
+func (e litExpr) eval(string, any) any { return e.v }
+
+type keyExpr struct{}
+
+func (keyExpr) eval(key string, _ any) any { return key }
+
+type valExpr struct{ path []string }
+
+func (e valExpr) eval(_ string, val any) any {
+	if len(e.path) == 0 {
+		return val
+	}
+	ks, ok := val.(map[string]any)
+	if !ok {
+		return missing
+	}
+	v, ok := lookup(ks, e.path)
+	if !ok {
+		return missing
+	}
+	return v
+}
+
+type notExpr struct{ e expr }
+
+func (e notExpr) eval(key string, val any) any { return !truthy(e.e.eval(key, val)) }
+
+type logicExpr struct {
+	and  bool
+	l, r expr
+}
+
+func (e logicExpr) eval(key string, val any) any {
+	l := truthy(e.l.eval(key, val))
+	if e.and {
+		return l && truthy(e.r.eval(key, val))
+	}
+	return l || truthy(e.r.eval(key, val))
+}
+
+type cmpExpr struct {
+	op   string
+	l, r expr
+	re   *regexp.Regexp
+}
+
+func (e cmpExpr) eval(key string, val any) any {
+	l, r := e.l.eval(key, val), e.r.eval(key, val)
+	if l == missing || r == missing {
+		return false
+	}
+	switch e.op {
+	case "==":
+		return equalValues(l, r)
+	case "!=":
+		return !equalValues(l, r)
+	case "=~":
+		s, ok := l.(string)
+		return ok && e.re.MatchString(s)
+	}
+	c, ok := compareValues(l, r)
+	if !ok {
+		return false
+	}
+	switch e.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+func compareValues(a any, b any) (int, bool) {
+	fa, okA := toFloat(a)
+	fb, okB := toFloat(b)
+	if okA && okB {
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+	sa, okA := a.(string)
+	sb, okB := b.(string)
+	if okA && okB {
+		return strings.Compare(sa, sb), true
+	}
+	return 0, false
+}
+
+func truthy(v any) bool {
+	return v != missing && v != nil && v != false
+}
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokRBracket
+	tokLParen
+	tokRParen
+	tokOp
+	tokNot
+	tokAnd
+	tokOr
+	tokOperand
+)
+
+type token struct {
+	kind tokKind
+	text string
+	e    expr
+}
+
+type lexer struct {
+	src    string
+	sep    string
+	pos    int
+	peeked *token
+	err    error
+}
+
+func (l *lexer) fail(format string, args ...any) token {
+	if l.err == nil {
+		l.err = fmt.Errorf("%w: %s at offset %d", ErrQuerySyntax, fmt.Sprintf(format, args...), l.pos)
+	}
+	return token{kind: tokEOF}
+}
+
+func (l *lexer) peek() token {
+	if l.peeked == nil {
+		t := l.scan()
+		l.peeked = &t
+	}
+	return *l.peeked
+}
+
+func (l *lexer) next() token {
+	t := l.peek()
+	l.peeked = nil
+	return t
+}
+
+func (l *lexer) scan() token {
+	for l.pos < len(l.src) && unicode.IsSpace(rune(l.src[l.pos])) {
+		l.pos++
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF}
+	}
+	rest := l.src[l.pos:]
+	for _, op := range []string{"==", "!=", "<=", ">=", "=~", "&&", "||"} {
+		if strings.HasPrefix(rest, op) {
+			l.pos += 2
+			switch op {
+			case "&&":
+				return token{kind: tokAnd}
+			case "||":
+				return token{kind: tokOr}
+			}
+			return token{kind: tokOp, text: op}
+		}
+	}
+	c := rest[0]
+	switch {
+	case c == ']':
+		l.pos++
+		return token{kind: tokRBracket}
+	case c == '(':
+		l.pos++
+		return token{kind: tokLParen}
+	case c == ')':
+		l.pos++
+		return token{kind: tokRParen}
+	case c == '<' || c == '>':
+		l.pos++
+		return token{kind: tokOp, text: string(c)}
+	case c == '!':
+		l.pos++
+		return token{kind: tokNot}
+	case c == '"' || c == '\'':
+		return l.scanString(c)
+	case c == '@':
+		l.pos++
+		var p []string
+		for strings.HasPrefix(l.src[l.pos:], l.sep) {
+			l.pos += len(l.sep)
+			name := l.scanKey()
+			if name == "" {
+				return l.fail("expected a key after %q", l.sep)
+			}
+			p = append(p, name)
+		}
+		return token{kind: tokOperand, e: valExpr{path: p}}
+	case c == '$':
+		l.pos++
+		if l.scanWord() != "key" {
+			return l.fail("unknown variable, only $key exists")
+		}
+		return token{kind: tokOperand, e: keyExpr{}}
+	}
+	word := l.scanWord()
+	switch word {
+	case "":
+		return l.fail("unexpected %q", c)
+	case "true":
+		return token{kind: tokOperand, e: litExpr{true}}
+	case "false":
+		return token{kind: tokOperand, e: litExpr{false}}
+	case "null":
+		return token{kind: tokOperand, e: litExpr{nil}}
+	}
+	if n, err := strconv.ParseInt(word, 10, 64); err == nil {
+		return token{kind: tokOperand, e: litExpr{n}}
+	}
+	if f, err := strconv.ParseFloat(word, 64); err == nil {
+		return token{kind: tokOperand, e: litExpr{f}}
+	}
+	return l.fail("unknown word %q, quote strings", word)
+}
+
+// scanWord reads a literal or variable name
+func (l *lexer) scanWord() string {
+	start := l.pos
+	for l.pos < len(l.src) {
+		r := rune(l.src[l.pos])
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("_-+.", r) {
+			break
+		}
+		l.pos++
+	}
+	return l.src[start:l.pos]
+}
+
+// scanKey reads a key of a path below @, it ends at the separator, spaces and operators
+func (l *lexer) scanKey() string {
+	start := l.pos
+	for l.pos < len(l.src) && !strings.HasPrefix(l.src[l.pos:], l.sep) {
+		r := rune(l.src[l.pos])
+		if unicode.IsSpace(r) || strings.ContainsRune("=!<>()&|]", r) {
+			break
+		}
+		l.pos++
+	}
+	return l.src[start:l.pos]
+}
+
+func (l *lexer) scanString(quote byte) token {
+	var b strings.Builder
+	for i := l.pos + 1; i < len(l.src); i++ {
+		switch c := l.src[i]; {
+		case c == '\\' && i+1 < len(l.src):
+			i++
+			b.WriteByte(l.src[i])
+		case c == quote:
+			l.pos = i + 1
+			return token{kind: tokOperand, text: b.String(), e: litExpr{b.String()}}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return l.fail("unterminated string")
+}
+
+func (l *lexer) parseOr() (expr, error) {
+	left, err := l.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for l.peek().kind == tokOr {
+		l.next()
+		right, err := l.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicExpr{l: left, r: right}
+	}
+	return left, l.err
+}
+
+func (l *lexer) parseAnd() (expr, error) {
+	left, err := l.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for l.peek().kind == tokAnd {
+		l.next()
+		right, err := l.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = logicExpr{and: true, l: left, r: right}
+	}
+	return left, l.err
+}
+
+func (l *lexer) parseUnary() (expr, error) {
+	t := l.next()
+	switch t.kind {
+	case tokNot:
+		e, err := l.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{e}, nil
+	case tokLParen:
+		e, err := l.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if l.next().kind != tokRParen {
+			l.fail("expected )")
+			return nil, l.err
+		}
+		return e, nil
+	case tokOperand:
+		if l.peek().kind != tokOp {
+			return t.e, l.err
+		}
+		op := l.next().text
+		r := l.next()
+		if r.kind != tokOperand {
+			l.fail("expected an operand after %s", op)
+			return nil, l.err
+		}
+		c := cmpExpr{op: op, l: t.e, r: r.e}
+		if op == "=~" {
+			lit, _ := r.e.(litExpr)
+			s, ok := lit.v.(string)
+			if !ok {
+				l.fail("=~ needs a quoted regular expression")
+				return nil, l.err
+			}
+			re, err := regexp.Compile(s)
+			if err != nil {
+				l.fail("%v", err)
+				return nil, l.err
+			}
+			c.re = re
+		}
+		return c, l.err
+	}
+	if l.err == nil {
+		l.fail("expected a condition")
+	}
+	return nil, l.err
+}
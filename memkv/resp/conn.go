@@ -0,0 +1,728 @@
+package resp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xadaemon/libprisma/memkv"
+)
+
+// message is a pub/sub delivery, pattern is empty for plain subscriptions
+type message struct {
+	pattern string
+	channel string
+	payload string
+}
+
+// eventPayload is the JSON body of pub/sub messages
+type eventPayload struct {
+	Key    string `json:"key"`
+	Type   string `json:"type"`
+	OldVal any    `json:"oldVal,omitempty"`
+	NewVal any    `json:"newVal,omitempty"`
+}
+
+type conn struct {
+	id int64
+	s  *Server
+	nc net.Conn
+	r  *bufio.Reader
+
+	wmu  sync.Mutex
+	w    *writer
+	subs map[string]func()
+	msgs chan message
+	done chan struct{}
+	once sync.Once
+}
+
+var pubSubEvents = []memkv.EventType{memkv.E_KEY_CREATED, memkv.E_KEY_UPDATED, memkv.E_KEY_DELETED}
+
+func (c *conn) serve() {
+	defer c.s.forget(c)
+	defer c.close()
+	go c.deliver()
+	for {
+		args, err := readCommand(c.r)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				c.reply(func(w *writer) { w.err("ERR Protocol error") })
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if quit := c.dispatch(args); quit {
+			return
+		}
+	}
+}
+
+func (c *conn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.wmu.Lock()
+		for _, cancel := range c.subs {
+			cancel()
+		}
+		c.subs = map[string]func(){}
+		c.wmu.Unlock()
+		c.nc.Close()
+	})
+}
+
+// reply writes a complete reply while holding the write lock so pushes never interleave with it
+func (c *conn) reply(f func(w *writer)) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	f(c.w)
+	_ = c.w.flush()
+}
+
+// deliver writes queued pub/sub messages until the connection closes
+func (c *conn) deliver() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case m := <-c.msgs:
+			c.reply(func(w *writer) {
+				if m.pattern != "" {
+					w.push(4)
+					w.bulk("pmessage")
+					w.bulk(m.pattern)
+				} else {
+					w.push(3)
+					w.bulk("message")
+				}
+				w.bulk(m.channel)
+				w.bulk(m.payload)
+			})
+		}
+	}
+}
+
+// enqueue is called from store watchers, it must never block the store
+func (c *conn) enqueue(m message) {
+	select {
+	case c.msgs <- m:
+	case <-c.done:
+	default:
+		go c.close()
+	}
+}
+
+func (c *conn) subscribed() int {
+	return len(c.subs)
+}
+
+func (c *conn) dispatch(args []string) bool {
+	cmd := strings.ToUpper(args[0])
+	args = args[1:]
+	c.wmu.Lock()
+	inPubSub := c.subscribed() > 0
+	c.wmu.Unlock()
+	if inPubSub && c.w.proto < 3 {
+		switch cmd {
+		case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "PING", "QUIT", "RESET":
+		default:
+			c.reply(func(w *writer) {
+				w.err(fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", strings.ToLower(cmd)))
+			})
+			return false
+		}
+	}
+	if f, ok := commands[cmd]; ok {
+		if f.arity >= 0 && len(args) != f.arity || f.arity < 0 && len(args) < -f.arity-1 {
+			c.reply(func(w *writer) {
+				w.err(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+			})
+			return false
+		}
+		f.fn(c, args)
+		return false
+	}
+	switch cmd {
+	case "QUIT":
+		c.reply(func(w *writer) { w.simple("OK") })
+		return true
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		c.subscribe(args, cmd == "PSUBSCRIBE")
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		c.unsubscribe(args, cmd == "PUNSUBSCRIBE")
+	default:
+		c.reply(func(w *writer) {
+			w.err(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(cmd)))
+		})
+	}
+	return false
+}
+
+type command struct {
+	// arity is the exact argument count, or -(n+1) for at least n arguments
+	arity int
+	fn    func(c *conn, args []string)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"PING":    {-1, cmdPing},
+		"ECHO":    {1, cmdEcho},
+		"HELLO":   {-1, cmdHello},
+		"SELECT":  {1, cmdSelect},
+		"CLIENT":  {-2, cmdClient},
+		"COMMAND": {-1, cmdCommand},
+		"GET":     {1, cmdGet},
+		"SET":     {-3, cmdSet},
+		"DEL":     {-2, cmdDel},
+		"EXISTS":  {-2, cmdExists},
+		"KEYS":    {1, cmdKeys},
+		"SCAN":    {-2, cmdScan},
+		"DBSIZE":  {0, cmdDBSize},
+		"EXPIRE":  {2, func(c *conn, a []string) { cmdExpire(c, a, time.Second) }},
+		"PEXPIRE": {2, func(c *conn, a []string) { cmdExpire(c, a, time.Millisecond) }},
+		"TTL":     {1, func(c *conn, a []string) { cmdTTL(c, a, time.Second) }},
+		"PTTL":    {1, func(c *conn, a []string) { cmdTTL(c, a, time.Millisecond) }},
+		"PERSIST": {1, cmdPersist},
+		"INCR":    {1, func(c *conn, a []string) { cmdIncr(c, a[0], "1", false) }},
+		"DECR":    {1, func(c *conn, a []string) { cmdIncr(c, a[0], "1", true) }},
+		"INCRBY":  {2, func(c *conn, a []string) { cmdIncr(c, a[0], a[1], false) }},
+		"DECRBY":  {2, func(c *conn, a []string) { cmdIncr(c, a[0], a[1], true) }},
+	}
+}
+
+func (c *conn) errReply(msg string) {
+	c.reply(func(w *writer) { w.err(msg) })
+}
+
+func (c *conn) okReply() {
+	c.reply(func(w *writer) { w.simple("OK") })
+}
+
+func (c *conn) intReply(n int64) {
+	c.reply(func(w *writer) { w.int(n) })
+}
+
+// lookup reads key honouring expiry
+func (c *conn) lookup(key string) (any, bool) {
+	if c.s.ttl.expired(key, time.Now()) {
+		return nil, false
+	}
+	return c.s.store.Get(key)
+}
+
+func cmdPing(c *conn, args []string) {
+	c.wmu.Lock()
+	inPubSub := c.subscribed() > 0
+	c.wmu.Unlock()
+	if inPubSub && c.w.proto < 3 {
+		msg := ""
+		if len(args) > 0 {
+			msg = args[0]
+		}
+		c.reply(func(w *writer) { w.bulks([]string{"pong", msg}) })
+		return
+	}
+	if len(args) > 0 {
+		c.reply(func(w *writer) { w.bulk(args[0]) })
+		return
+	}
+	c.reply(func(w *writer) { w.simple("PONG") })
+}
+
+func cmdEcho(c *conn, args []string) {
+	c.reply(func(w *writer) { w.bulk(args[0]) })
+}
+
+func cmdHello(c *conn, args []string) {
+	proto := c.w.proto
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil || v < 2 || v > 3 {
+			c.errReply("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = v
+	}
+	c.reply(func(w *writer) {
+		w.proto = proto
+		w.mapHeader(7)
+		w.bulk("server")
+		w.bulk("memkv")
+		w.bulk("version")
+		w.bulk("1.0.0")
+		w.bulk("proto")
+		w.int(int64(proto))
+		w.bulk("id")
+		w.int(c.id)
+		w.bulk("mode")
+		w.bulk("standalone")
+		w.bulk("role")
+		w.bulk("master")
+		w.bulk("modules")
+		w.array(0)
+	})
+}
+
+func cmdSelect(c *conn, args []string) {
+	if args[0] != "0" {
+		c.errReply("ERR DB index is out of range")
+		return
+	}
+	c.okReply()
+}
+
+func cmdClient(c *conn, args []string) {
+	switch strings.ToUpper(args[0]) {
+	case "ID":
+		c.intReply(c.id)
+	default:
+		c.okReply()
+	}
+}
+
+func cmdCommand(c *conn, _ []string) {
+	c.reply(func(w *writer) { w.array(0) })
+}
+
+// formatValue renders a stored value the way GET returns it
+func formatValue(v any) (string, bool) {
+	switch t := v.(type) {
+	case map[string]any:
+		return "", false
+	case string:
+		return t, true
+	case []byte:
+		return string(t), true
+	case int:
+		return strconv.Itoa(t), true
+	case int64:
+		return strconv.FormatInt(t, 10), true
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(t), true
+	case fmt.Stringer:
+		return t.String(), true
+	default:
+		data, err := json.Marshal(t)
+		if err != nil {
+			return fmt.Sprint(t), true
+		}
+		return string(data), true
+	}
+}
+
+const wrongType = "WRONGTYPE Operation against a key holding the wrong kind of value"
+
+func cmdGet(c *conn, args []string) {
+	v, ok := c.lookup(c.s.storeKey(args[0]))
+	if !ok {
+		c.reply(func(w *writer) { w.null() })
+		return
+	}
+	s, ok := formatValue(v)
+	if !ok {
+		c.errReply(wrongType)
+		return
+	}
+	c.reply(func(w *writer) { w.bulk(s) })
+}
+
+func cmdSet(c *conn, args []string) {
+	key := c.s.storeKey(args[0])
+	val := args[1]
+	var nx, xx, keepTTL bool
+	var ttl time.Duration
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				c.errReply("ERR syntax error")
+				return
+			}
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil || n <= 0 {
+				c.errReply("ERR invalid expire time in 'set' command")
+				return
+			}
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			ttl = time.Duration(n) * unit
+		default:
+			c.errReply("ERR syntax error")
+			return
+		}
+	}
+	if nx && xx || keepTTL && ttl > 0 {
+		c.errReply("ERR syntax error")
+		return
+	}
+
+	c.s.ttl.expired(key, time.Now())
+	txn := memkv.NewTxn()
+	if nx {
+		txn.CheckMissing(key)
+	}
+	if xx {
+		cur, ok := c.s.store.Get(key)
+		if !ok {
+			c.reply(func(w *writer) { w.null() })
+			return
+		}
+		txn.Check(key, cur)
+	}
+	txn.Set(key, val)
+	commit := func() error { return c.s.store.Commit(txn) }
+	if keepTTL {
+		commit = func() error { return c.s.ttl.keep(key, func() error { return c.s.store.Commit(txn) }) }
+	}
+	if err := commit(); err != nil {
+		if errors.Is(err, memkv.ErrCheckFailed) {
+			c.reply(func(w *writer) { w.null() })
+			return
+		}
+		c.errReply("ERR " + err.Error())
+		return
+	}
+	if ttl > 0 {
+		c.s.ttl.set(key, time.Now().Add(ttl))
+	}
+	c.okReply()
+}
+
+func cmdDel(c *conn, args []string) {
+	var n int64
+	for _, a := range args {
+		key := c.s.storeKey(a)
+		if c.s.ttl.expired(key, time.Now()) {
+			continue
+		}
+		if c.s.store.Drop(key, true) {
+			n++
+		}
+	}
+	c.intReply(n)
+}
+
+func cmdExists(c *conn, args []string) {
+	var n int64
+	for _, a := range args {
+		if _, ok := c.lookup(c.s.storeKey(a)); ok {
+			n++
+		}
+	}
+	c.intReply(n)
+}
+
+// matchingKeys lists the live keys matching the glob pattern
+func (c *conn) matchingKeys(pattern string) ([]string, error) {
+	now := time.Now()
+	pattern = c.s.storeKey(pattern)
+	keys := make([]string, 0)
+	for _, k := range c.s.store.List("") {
+		if c.s.ttl.expired(k, now) {
+			continue
+		}
+		if pattern != "" && pattern != "*" {
+			ok, err := path.Match(pattern, k)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func cmdKeys(c *conn, args []string) {
+	keys, err := c.matchingKeys(args[0])
+	if err != nil {
+		c.errReply("ERR invalid pattern")
+		return
+	}
+	c.reply(func(w *writer) { w.bulks(keys) })
+}
+
+// cmdScan implements SCAN with the cursor being an offset into the sorted key list
+func cmdScan(c *conn, args []string) {
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil || cursor < 0 {
+		c.errReply("ERR invalid cursor")
+		return
+	}
+	pattern, count := "*", 10
+	for i := 1; i < len(args); i++ {
+		if i+1 >= len(args) {
+			c.errReply("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				c.errReply("ERR syntax error")
+				return
+			}
+		case "TYPE":
+		default:
+			c.errReply("ERR syntax error")
+			return
+		}
+		i++
+	}
+	keys, err := c.matchingKeys(pattern)
+	if err != nil {
+		c.errReply("ERR invalid pattern")
+		return
+	}
+	if cursor > len(keys) {
+		cursor = len(keys)
+	}
+	end := cursor + count
+	next := end
+	if end >= len(keys) {
+		end, next = len(keys), 0
+	}
+	page := keys[cursor:end]
+	c.reply(func(w *writer) {
+		w.array(2)
+		w.bulk(strconv.Itoa(next))
+		w.bulks(page)
+	})
+}
+
+func cmdDBSize(c *conn, _ []string) {
+	keys, _ := c.matchingKeys("*")
+	c.intReply(int64(len(keys)))
+}
+
+func cmdExpire(c *conn, args []string, unit time.Duration) {
+	n, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		c.errReply("ERR value is not an integer or out of range")
+		return
+	}
+	key := c.s.storeKey(args[0])
+	if _, ok := c.lookup(key); !ok {
+		c.intReply(0)
+		return
+	}
+	if n <= 0 {
+		c.s.ttl.clear(key)
+		c.s.store.Drop(key, true)
+		c.intReply(1)
+		return
+	}
+	c.s.ttl.set(key, time.Now().Add(time.Duration(n)*unit))
+	c.intReply(1)
+}
+
+func cmdTTL(c *conn, args []string, unit time.Duration) {
+	key := c.s.storeKey(args[0])
+	if _, ok := c.lookup(key); !ok {
+		c.intReply(-2)
+		return
+	}
+	at, ok := c.s.ttl.deadline(key)
+	if !ok {
+		c.intReply(-1)
+		return
+	}
+	left := time.Until(at)
+	c.intReply(int64(math.Ceil(float64(left) / float64(unit))))
+}
+
+func cmdPersist(c *conn, args []string) {
+	key := c.s.storeKey(args[0])
+	if _, ok := c.lookup(key); !ok {
+		c.intReply(0)
+		return
+	}
+	if c.s.ttl.clear(key) {
+		c.intReply(1)
+		return
+	}
+	c.intReply(0)
+}
+
+// toInt converts a stored value to an integer the way Redis would for INCR
+func toInt(v any) (int64, bool) {
+	switch t := v.(type) {
+	case string:
+		n, err := strconv.ParseInt(t, 10, 64)
+		return n, err == nil
+	case int:
+		return int64(t), true
+	case int64:
+		return t, true
+	case float64:
+		if t != math.Trunc(t) {
+			return 0, false
+		}
+		return int64(t), true
+	}
+	return 0, false
+}
+
+func cmdIncr(c *conn, name string, by string, negate bool) {
+	delta, err := strconv.ParseInt(by, 10, 64)
+	if err != nil {
+		c.errReply("ERR value is not an integer or out of range")
+		return
+	}
+	if negate {
+		delta = -delta
+	}
+	key := c.s.storeKey(name)
+	for {
+		txn := memkv.NewTxn()
+		var n int64
+		cur, ok := c.lookup(key)
+		if ok {
+			if n, ok = toInt(cur); !ok {
+				c.errReply("ERR value is not an integer or out of range")
+				return
+			}
+			txn.Check(key, cur)
+		} else {
+			txn.CheckMissing(key)
+		}
+		if delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta {
+			c.errReply("ERR increment or decrement would overflow")
+			return
+		}
+		n += delta
+		txn.Set(key, strconv.FormatInt(n, 10))
+		err := c.s.ttl.keep(key, func() error { return c.s.store.Commit(txn) })
+		if errors.Is(err, memkv.ErrCheckFailed) {
+			continue
+		}
+		if err != nil {
+			c.errReply("ERR " + err.Error())
+			return
+		}
+		c.intReply(n)
+		return
+	}
+}
+
+func (c *conn) subscribe(channels []string, pattern bool) {
+	if len(channels) == 0 {
+		c.errReply("ERR wrong number of arguments for 'subscribe' command")
+		return
+	}
+	kind := "subscribe"
+	if pattern {
+		kind = "psubscribe"
+	}
+	for _, ch := range channels {
+		id := kind + ":" + ch
+		c.wmu.Lock()
+		if _, ok := c.subs[id]; !ok {
+			c.subs[id] = c.watch(ch, pattern)
+		}
+		n := c.subscribed()
+		c.wmu.Unlock()
+		c.reply(func(w *writer) {
+			w.push(3)
+			w.bulk(kind)
+			w.bulk(ch)
+			w.int(int64(n))
+		})
+	}
+}
+
+// watch registers the store watcher behind a channel or pattern subscription
+func (c *conn) watch(ch string, pattern bool) func() {
+	send := func(pat string, e memkv.Event) {
+		data, err := json.Marshal(eventPayload{Key: e.Key, Type: e.Type.String(), OldVal: e.OldVal, NewVal: e.NewVal})
+		if err != nil {
+			return
+		}
+		channel := ch
+		if pattern {
+			channel = e.Key
+		}
+		c.enqueue(message{pattern: pat, channel: channel, payload: string(data)})
+	}
+	if pattern {
+		glob := c.s.storeKey(ch)
+		return c.s.store.AddPrefixWatcherHook("", func(e memkv.Event) {
+			if ok, _ := path.Match(glob, e.Key); ok {
+				send(ch, e)
+			}
+		}, pubSubEvents)
+	}
+	return c.s.store.AddPrefixWatcherHook(c.s.storeKey(ch), func(e memkv.Event) {
+		send("", e)
+	}, pubSubEvents)
+}
+
+func (c *conn) unsubscribe(channels []string, pattern bool) {
+	kind := "unsubscribe"
+	prefix := "subscribe:"
+	if pattern {
+		kind = "punsubscribe"
+		prefix = "psubscribe:"
+	}
+	c.wmu.Lock()
+	if len(channels) == 0 {
+		for id := range c.subs {
+			if strings.HasPrefix(id, prefix) {
+				channels = append(channels, strings.TrimPrefix(id, prefix))
+			}
+		}
+	}
+	c.wmu.Unlock()
+	if len(channels) == 0 {
+		c.reply(func(w *writer) {
+			w.push(3)
+			w.bulk(kind)
+			w.null()
+			w.int(0)
+		})
+		return
+	}
+	for _, ch := range channels {
+		c.wmu.Lock()
+		if cancel, ok := c.subs[prefix+ch]; ok {
+			cancel()
+			delete(c.subs, prefix+ch)
+		}
+		n := c.subscribed()
+		c.wmu.Unlock()
+		c.reply(func(w *writer) {
+			w.push(3)
+			w.bulk(kind)
+			w.bulk(ch)
+			w.int(int64(n))
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var errProtocol = errors.New("protocol error")
+
+// readCommand reads one command either as an array of bulk strings or as an inline command
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > 1024*1024 {
+		return nil, errProtocol
+	}
+	args := make([]string, n)
+	for i := range args {
+		hdr, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(hdr) == 0 || hdr[0] != '$' {
+			return nil, errProtocol
+		}
+		size, err := strconv.Atoi(hdr[1:])
+		if err != nil || size < 0 || size > 512*1024*1024 {
+			return nil, errProtocol
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, errProtocol
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// writer encodes replies for the protocol version negotiated by the connection
+type writer struct {
+	w     *bufio.Writer
+	proto int
+}
+
+func (w *writer) simple(s string) {
+	fmt.Fprintf(w.w, "+%s\r\n", s)
+}
+
+func (w *writer) err(s string) {
+	fmt.Fprintf(w.w, "-%s\r\n", s)
+}
+
+func (w *writer) int(n int64) {
+	fmt.Fprintf(w.w, ":%d\r\n", n)
+}
+
+func (w *writer) bulk(s string) {
+	fmt.Fprintf(w.w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func (w *writer) null() {
+	if w.proto >= 3 {
+		w.w.WriteString("_\r\n")
+		return
+	}
+	w.w.WriteString("$-1\r\n")
+}
+
+func (w *writer) array(n int) {
+	fmt.Fprintf(w.w, "*%d\r\n", n)
+}
+
+// push starts an out of band message, RESP2 has no push type so an array is used
+func (w *writer) push(n int) {
+	if w.proto >= 3 {
+		fmt.Fprintf(w.w, ">%d\r\n", n)
+		return
+	}
+	w.array(n)
+}
+
+// mapHeader starts a map of n pairs, RESP2 clients get a flat array
+func (w *writer) mapHeader(n int) {
+	if w.proto >= 3 {
+		fmt.Fprintf(w.w, "%%%d\r\n", n)
+		return
+	}
+	w.array(n * 2)
+}
+
+func (w *writer) bulks(ss []string) {
+	w.array(len(ss))
+	for _, s := range ss {
+		w.bulk(s)
+	}
+}
+
+func (w *writer) flush() error {
+	return w.w.Flush()
+}
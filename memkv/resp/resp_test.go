@@ -0,0 +1,216 @@
+package resp_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xadaemon/libprisma/memkv"
+	"github.com/xadaemon/libprisma/memkv/resp"
+)
+
+// testClient is a minimal RESP client that decodes replies into Go values
+type testClient struct {
+	t  *testing.T
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+func dial(t *testing.T) (*memkv.MemKV, *testClient) {
+	kvs := memkv.NewMemKV(".", nil)
+	return kvs, dialStore(t, kvs)
+}
+
+func dialStore(t *testing.T, kvs memkv.Store) *testClient {
+	s := resp.NewServer(kvs)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, nc: nc, r: bufio.NewReader(nc)}
+}
+
+func (c *testClient) do(args ...string) any {
+	fmt.Fprintf(c.nc, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(c.nc, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return c.read()
+}
+
+func (c *testClient) read() any {
+	_ = c.nc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("read failed: %v", err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return fmt.Errorf("%s", line[1:])
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '_':
+		return nil
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatal(err)
+		}
+		return string(buf[:n])
+	case '*', '>', '%':
+		n, _ := strconv.Atoi(line[1:])
+		if line[0] == '%' {
+			n *= 2
+		}
+		out := make([]any, n)
+		for i := range out {
+			out[i] = c.read()
+		}
+		return out
+	}
+	c.t.Fatalf("unexpected reply %q", line)
+	return nil
+}
+
+func TestServer_Strings(t *testing.T) {
+	kvs, c := dial(t)
+
+	if got := c.do("SET", "services:ca:port", "8443"); got != "OK" {
+		t.Fatalf("SET = %v", got)
+	}
+	if v, ok := kvs.Get("services.ca.port"); !ok || v != "8443" {
+		t.Errorf("Store has %v, want 8443", v)
+	}
+	if got := c.do("GET", "services.ca.port"); got != "8443" {
+		t.Errorf("GET = %v", got)
+	}
+	if got := c.do("GET", "services:ca"); got == nil {
+		t.Error("GET on a key space should fail")
+	}
+	if got := c.do("SET", "services:ca:port", "1", "NX"); got != nil {
+		t.Errorf("SET NX on existing key = %v", got)
+	}
+	if got := c.do("SET", "missing", "1", "XX"); got != nil {
+		t.Errorf("SET XX on missing key = %v", got)
+	}
+	if got := c.do("INCR", "services:ca:port"); got != int64(8444) {
+		t.Errorf("INCR = %v", got)
+	}
+	if got := c.do("DECRBY", "counter", "5"); got != int64(-5) {
+		t.Errorf("DECRBY = %v", got)
+	}
+	if got := c.do("EXISTS", "counter", "services:ca:port", "nope"); got != int64(2) {
+		t.Errorf("EXISTS = %v", got)
+	}
+	if got := c.do("KEYS", "services:*"); !reflect.DeepEqual(got, []any{"services.ca.port"}) {
+		t.Errorf("KEYS = %v", got)
+	}
+	if got := c.do("DEL", "counter", "nope"); got != int64(1) {
+		t.Errorf("DEL = %v", got)
+	}
+}
+
+func TestServer_Scan(t *testing.T) {
+	_, c := dial(t)
+	for i := range 5 {
+		c.do("SET", fmt.Sprintf("k%d", i), "v")
+	}
+	var keys []any
+	cursor := "0"
+	for {
+		reply := c.do("SCAN", cursor, "COUNT", "2").([]any)
+		keys = append(keys, reply[1].([]any)...)
+		cursor = reply[0].(string)
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(keys) != 5 {
+		t.Errorf("SCAN returned %v", keys)
+	}
+}
+
+func TestServer_Expire(t *testing.T) {
+	kvs, c := dial(t)
+	c.do("SET", "session", "abc", "PX", "50")
+	if got := c.do("TTL", "session"); got != int64(1) {
+		t.Errorf("TTL = %v", got)
+	}
+	c.do("SET", "other", "x")
+	if got := c.do("PEXPIRE", "other", "50"); got != int64(1) {
+		t.Errorf("PEXPIRE = %v", got)
+	}
+	time.Sleep(80 * time.Millisecond)
+	if got := c.do("GET", "session"); got != nil {
+		t.Errorf("GET after expiry = %v", got)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if kvs.Contains("other") {
+		t.Error("Expired key was not swept")
+	}
+}
+
+func TestServer_ExpireChanges(t *testing.T) {
+	kvs := memkv.NewMemKV(".", &memkv.Opts{CaseInsensitive: true})
+	c := dialStore(t, kvs)
+
+	c.do("SET", "Counter", "1", "EX", "100")
+	c.do("INCR", "counter")
+	c.do("SET", "COUNTER", "5", "KEEPTTL")
+	if got := c.do("TTL", "counter"); got != int64(100) {
+		t.Errorf("TTL after INCR and SET KEEPTTL = %v", got)
+	}
+	tests := []struct {
+		Name  string
+		Write func()
+	}{
+		{"Update", func() { kvs.Set("counter", "2") }},
+		{"Recreate", func() { kvs.Drop("COUNTER", false); kvs.Set("Counter", "3") }},
+	}
+	for _, test := range tests {
+		c.do("SET", "counter", "1", "EX", "100")
+		test.Write()
+		if got := c.do("TTL", "COUNTER"); got != int64(-1) {
+			t.Errorf("%s: TTL = %v", test.Name, got)
+		}
+	}
+}
+
+func TestServer_SubscribeRESP3(t *testing.T) {
+	kvs, c := dial(t)
+	hello := c.do("HELLO", "3").([]any)
+	if hello[5] != int64(3) {
+		t.Fatalf("HELLO = %v", hello)
+	}
+	if got := c.do("SUBSCRIBE", "svc"); !reflect.DeepEqual(got, []any{"subscribe", "svc", int64(1)}) {
+		t.Fatalf("SUBSCRIBE = %v", got)
+	}
+	kvs.Set("svc.port", 80)
+	msg := c.read().([]any)
+	if msg[0] != "message" || msg[1] != "svc" || !strings.Contains(msg[2].(string), `"key":"svc.port"`) {
+		t.Errorf("Unexpected message %v", msg)
+	}
+	if got := c.do("GET", "svc.port"); got != "80" {
+		t.Errorf("GET in RESP3 subscribe mode = %v", got)
+	}
+}
@@ -0,0 +1,256 @@
+// Package resp serves a memkv.Store over the Redis serialization protocol so redis-cli and Redis client
+// libraries can use it as a local cache. Both RESP2 and RESP3 (negotiated with HELLO) are supported.
+//
+// Redis key names are mapped onto MemKV paths by treating every character in Server.Separators as the
+// store separator, so with the default ":." both "services:ca:port" and "services.ca.port" address the
+// same nested key. Keys returned by KEYS and SCAN use the store separator.
+//
+// Supported commands are GET, SET (EX, PX, NX, XX, KEEPTTL), DEL, EXISTS, KEYS, SCAN, EXPIRE, PEXPIRE,
+// TTL, PTTL, PERSIST, INCR, INCRBY, DECR, DECRBY, DBSIZE, SUBSCRIBE, PSUBSCRIBE, UNSUBSCRIBE,
+// PUNSUBSCRIBE, PING, ECHO, HELLO, SELECT, CLIENT, COMMAND and QUIT. Subscribing to a channel watches
+// the key of the same name and everything below it, each message carries a JSON encoded event.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xadaemon/libprisma/memkv"
+)
+
+// Server accepts RESP connections for a single store
+type Server struct {
+	store memkv.Store
+	ttl   *expirer
+	// Separators lists the characters that separate key spaces in Redis key names
+	Separators string
+	// PubSubBuffer is the number of messages buffered per subscribed connection, a connection
+	// that falls further behind is closed
+	PubSubBuffer int
+
+	mu     sync.Mutex
+	ls     []net.Listener
+	conns  map[*conn]struct{}
+	closed bool
+	stop   chan struct{}
+	nextID int64
+}
+
+func NewServer(store memkv.Store) *Server {
+	s := &Server{
+		store:        store,
+		Separators:   ":.",
+		PubSubBuffer: 1024,
+		conns:        make(map[*conn]struct{}),
+		stop:         make(chan struct{}),
+	}
+	s.ttl = newExpirer(store, s.stop)
+	return s
+}
+
+// ListenAndServe listens on the TCP address addr and serves connections until Close is called
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until Close is called, it always returns a non nil error
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.ls = append(s.ls, l)
+	s.mu.Unlock()
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		c := s.newConn(nc)
+		if c == nil {
+			nc.Close()
+			return net.ErrClosed
+		}
+		go c.serve()
+	}
+}
+
+// Close stops every listener and closes all open connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	var errs []error
+	for _, l := range s.ls {
+		errs = append(errs, l.Close())
+	}
+	for c := range s.conns {
+		c.nc.Close()
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) newConn(nc net.Conn) *conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.nextID++
+	c := &conn{
+		id:   s.nextID,
+		s:    s,
+		nc:   nc,
+		r:    bufio.NewReader(nc),
+		w:    &writer{w: bufio.NewWriter(nc), proto: 2},
+		subs: make(map[string]func()),
+		msgs: make(chan message, s.PubSubBuffer),
+		done: make(chan struct{}),
+	}
+	s.conns[c] = struct{}{}
+	return c
+}
+
+func (s *Server) forget(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+}
+
+// storeKey converts a Redis key name to a store path
+func (s *Server) storeKey(name string) string {
+	return mapSeparators(name, s.Separators, s.store.Separator())
+}
+
+func mapSeparators(name string, from string, to string) string {
+	var sb strings.Builder
+	for _, r := range name {
+		if strings.ContainsRune(from, r) {
+			sb.WriteString(to)
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// expirer drops keys once their time to live elapsed
+type expirer struct {
+	store memkv.Store
+	// norm normalizes keys like the store does for the keys of its events
+	norm func(string) string
+	mu   sync.Mutex
+	at   map[string]time.Time
+}
+
+// normalizer is implemented by stores folding the case of keys, see memkv.MemKV.NormalizeKey
+type normalizer interface {
+	NormalizeKey(key string) string
+}
+
+func newExpirer(store memkv.Store, stop chan struct{}) *expirer {
+	e := &expirer{store: store, at: make(map[string]time.Time), norm: func(key string) string { return key }}
+	if n, ok := store.(normalizer); ok {
+		e.norm = n.NormalizeKey
+	}
+	// a key written, replaced or deleted by someone else must not inherit a stale deadline.
+	// Event keys are normalized already and the store is locked, so e.norm must not be called.
+	cancel := store.AddPrefixWatcherHook("", func(ev memkv.Event) {
+		if ev.Success {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			delete(e.at, ev.Key)
+		}
+	}, []memkv.EventType{memkv.E_KEY_CREATED, memkv.E_KEY_UPDATED, memkv.E_KEY_DELETED})
+	go func() {
+		t := time.NewTicker(100 * time.Millisecond)
+		defer t.Stop()
+		defer cancel()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-t.C:
+				e.sweep(now)
+			}
+		}
+	}()
+	return e
+}
+
+func (e *expirer) set(key string, at time.Time) {
+	key = e.norm(key)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.at[key] = at
+}
+
+func (e *expirer) clear(key string) bool {
+	key = e.norm(key)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.at[key]
+	delete(e.at, key)
+	return ok
+}
+
+func (e *expirer) deadline(key string) (time.Time, bool) {
+	key = e.norm(key)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	at, ok := e.at[key]
+	return at, ok
+}
+
+// keep runs write, a change of key that keeps its deadline as INCR or SET KEEPTTL do in Redis.
+// The deadline cleared by the change is put back once it succeeded.
+func (e *expirer) keep(key string, write func() error) error {
+	at, ok := e.deadline(key)
+	err := write()
+	if err == nil && ok {
+		e.set(key, at)
+	}
+	return err
+}
+
+// expired drops key if its deadline passed and reports whether it did
+func (e *expirer) expired(key string, now time.Time) bool {
+	key = e.norm(key)
+	e.mu.Lock()
+	at, ok := e.at[key]
+	if !ok || now.Before(at) {
+		e.mu.Unlock()
+		return false
+	}
+	delete(e.at, key)
+	e.mu.Unlock()
+	e.store.Drop(key, false)
+	return true
+}
+
+func (e *expirer) sweep(now time.Time) {
+	e.mu.Lock()
+	var due []string
+	for k, at := range e.at {
+		if !now.Before(at) {
+			due = append(due, k)
+		}
+	}
+	e.mu.Unlock()
+	for _, k := range due {
+		e.expired(k, now)
+	}
+}
@@ -0,0 +1,563 @@
+package memkv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SchemaType restricts the kind of value a Schema accepts
+type SchemaType int
+
+const (
+	// TYPE_ANY accepts every value
+	TYPE_ANY    SchemaType = iota
+	TYPE_STRING SchemaType = iota
+	// TYPE_INT accepts every integer type and floats without a fractional part
+	TYPE_INT SchemaType = iota
+	// TYPE_NUMBER accepts every integer and float type
+	TYPE_NUMBER SchemaType = iota
+	TYPE_BOOL   SchemaType = iota
+	// TYPE_OBJECT accepts key spaces
+	TYPE_OBJECT SchemaType = iota
+	// TYPE_ARRAY accepts slices and arrays
+	TYPE_ARRAY SchemaType = iota
+	TYPE_NULL  SchemaType = iota
+)
+
+var schemaTypeNames = map[SchemaType]string{
+	TYPE_ANY:    "any",
+	TYPE_STRING: "string",
+	TYPE_INT:    "integer",
+	TYPE_NUMBER: "number",
+	TYPE_BOOL:   "boolean",
+	TYPE_OBJECT: "object",
+	TYPE_ARRAY:  "array",
+	TYPE_NULL:   "null",
+}
+
+func (t SchemaType) String() string {
+	if n, ok := schemaTypeNames[t]; ok {
+		return n
+	}
+	return "unknown"
+}
+
+var ErrSchemaViolation = errors.New("schema violation")
+
+// ValidationError reports the first value that violates a schema, Key is its full path.
+// Elements of arrays are addressed as key[i].
+type ValidationError struct {
+	Key    string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s at %q: %s", ErrSchemaViolation, e.Key, e.Reason)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrSchemaViolation
+}
+
+// Schema describes the values allowed under a key. The zero value accepts everything, every
+// field set adds a constraint. Limits are pointers so they can be told apart from zero, use
+// Limit to declare them inline.
+type Schema struct {
+	Type SchemaType
+	// Enum lists the only allowed values, compared with reflect.DeepEqual after numeric normalization
+	Enum []any
+	// Min and Max bound numbers inclusively
+	Min *float64
+	Max *float64
+	// MinLength and MaxLength bound the length of strings and arrays
+	MinLength *int
+	MaxLength *int
+	// Pattern is a regular expression strings must contain a match of, anchor it to match whole strings
+	Pattern string
+	// Properties are the schemas of known keys of a key space
+	Properties map[string]*Schema
+	// Required lists the keys that must be present in a key space
+	Required []string
+	// Additional validates keys of a key space that are not in Properties
+	Additional *Schema
+	// Closed rejects keys of a key space that are not in Properties, which catches typos
+	Closed bool
+	// Items validates every element of an array
+	Items *Schema
+}
+
+// Limit returns a pointer to v, for Schema fields
+func Limit[T int | float64](v T) *T {
+	return &v
+}
+
+// patterns caches compiled Pattern fields, schemas are shared between goroutines and never modified
+var patterns sync.Map
+
+func compilePattern(p string) (*regexp.Regexp, error) {
+	if re, ok := patterns.Load(p); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(p)
+	if err != nil {
+		return nil, err
+	}
+	patterns.Store(p, re)
+	return re, nil
+}
+
+// Compile checks that the schema is consistent and its patterns are valid, SetSchema calls it
+func (s *Schema) Compile() error {
+	return s.compile("")
+}
+
+func (s *Schema) compile(path string) error {
+	if s == nil {
+		return nil
+	}
+	if s.Pattern != "" {
+		if _, err := compilePattern(s.Pattern); err != nil {
+			return fmt.Errorf("schema at %q: %w", path, err)
+		}
+	}
+	if s.Min != nil && s.Max != nil && *s.Min > *s.Max {
+		return fmt.Errorf("schema at %q: minimum is greater than maximum", path)
+	}
+	for _, k := range sortedKeys(s.Properties) {
+		if err := s.Properties[k].compile(joinPath(path, k)); err != nil {
+			return err
+		}
+	}
+	if err := s.Additional.compile(joinPath(path, "*")); err != nil {
+		return err
+	}
+	return s.Items.compile(path + "[]")
+}
+
+// Validate checks val against the schema, key is the path used in errors
+func (s *Schema) Validate(key string, val any) error {
+	if err := s.Compile(); err != nil {
+		return err
+	}
+	return s.validate(key, val, ".", func(k string) string { return k })
+}
+
+func (s *Schema) validate(key string, val any, sep string, norm func(string) string) error {
+	if s == nil {
+		return nil
+	}
+	fail := func(format string, args ...any) error {
+		return &ValidationError{Key: key, Reason: fmt.Sprintf(format, args...)}
+	}
+	num, isNum := toFloat(val)
+	switch s.Type {
+	case TYPE_ANY:
+	case TYPE_STRING:
+		if _, ok := val.(string); !ok {
+			return fail("expected string, got %s", typeName(val))
+		}
+	case TYPE_INT:
+		if !isNum || num != math.Trunc(num) {
+			return fail("expected integer, got %s", typeName(val))
+		}
+	case TYPE_NUMBER:
+		if !isNum {
+			return fail("expected number, got %s", typeName(val))
+		}
+	case TYPE_BOOL:
+		if _, ok := val.(bool); !ok {
+			return fail("expected boolean, got %s", typeName(val))
+		}
+	case TYPE_OBJECT:
+		if _, ok := val.(map[string]any); !ok {
+			return fail("expected key space, got %s", typeName(val))
+		}
+	case TYPE_ARRAY:
+		if k := reflect.ValueOf(val).Kind(); k != reflect.Slice && k != reflect.Array {
+			return fail("expected array, got %s", typeName(val))
+		}
+	case TYPE_NULL:
+		if val != nil {
+			return fail("expected null, got %s", typeName(val))
+		}
+	default:
+		return fail("unknown schema type %d", s.Type)
+	}
+
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(e any) bool { return equalValues(e, val) }) {
+		return fail("%v is not one of %v", val, s.Enum)
+	}
+	if isNum {
+		if s.Min != nil && num < *s.Min {
+			return fail("%v is less than the minimum %v", val, *s.Min)
+		}
+		if s.Max != nil && num > *s.Max {
+			return fail("%v is greater than the maximum %v", val, *s.Max)
+		}
+	}
+	if str, ok := val.(string); ok {
+		if err := checkLength(len([]rune(str)), s, fail); err != nil {
+			return err
+		}
+		if s.Pattern != "" {
+			re, err := compilePattern(s.Pattern)
+			if err != nil {
+				return fail("invalid pattern: %v", err)
+			}
+			if !re.MatchString(str) {
+				return fail("%q does not match %q", str, s.Pattern)
+			}
+		}
+	}
+
+	if ks, ok := val.(map[string]any); ok {
+		return s.validateKeySpace(key, ks, sep, norm)
+	}
+	rv := reflect.ValueOf(val)
+	if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+		if err := checkLength(rv.Len(), s, fail); err != nil {
+			return err
+		}
+		if s.Items != nil {
+			for i := 0; i < rv.Len(); i++ {
+				if err := s.Items.validate(fmt.Sprintf("%s[%d]", key, i), rv.Index(i).Interface(), sep, norm); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateKeySpace(key string, ks map[string]any, sep string, norm func(string) string) error {
+	props := make(map[string]*Schema, len(s.Properties))
+	for k, p := range s.Properties {
+		props[norm(k)] = p
+	}
+	for _, r := range s.Required {
+		if _, ok := ks[norm(r)]; !ok {
+			return &ValidationError{Key: joinKey(key, norm(r), sep), Reason: "required key is missing"}
+		}
+	}
+	for _, k := range sortedKeys(ks) {
+		child := joinKey(key, k, sep)
+		p, known := props[k]
+		switch {
+		case known:
+		case s.Closed:
+			return &ValidationError{Key: child, Reason: "key is not allowed by the schema"}
+		default:
+			p = s.Additional
+		}
+		if err := p.validate(child, ks[k], sep, norm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkLength(n int, s *Schema, fail func(string, ...any) error) error {
+	if s.MinLength != nil && n < *s.MinLength {
+		return fail("length %d is less than %d", n, *s.MinLength)
+	}
+	if s.MaxLength != nil && n > *s.MaxLength {
+		return fail("length %d is greater than %d", n, *s.MaxLength)
+	}
+	return nil
+}
+
+// ParseJSONSchema builds a Schema from a JSON Schema document. The type, enum, const, minimum,
+// maximum, minLength, maxLength, minItems, maxItems, pattern, properties, required,
+// additionalProperties and items keywords are supported, annotations such as title and
+// description are ignored and any other keyword is rejected rather than silently skipped.
+// Schema bounds strings and arrays with the same limits, so a schema may use minLength and
+// maxLength or minItems and maxItems but not both.
+func ParseJSONSchema(data []byte) (*Schema, error) {
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	s, err := parseJSONSchema(doc, "")
+	if err != nil {
+		return nil, err
+	}
+	return s, s.Compile()
+}
+
+var jsonSchemaTypes = map[string]SchemaType{
+	"string":  TYPE_STRING,
+	"integer": TYPE_INT,
+	"number":  TYPE_NUMBER,
+	"boolean": TYPE_BOOL,
+	"object":  TYPE_OBJECT,
+	"array":   TYPE_ARRAY,
+	"null":    TYPE_NULL,
+}
+
+var jsonSchemaAnnotations = []string{"$schema", "$id", "$comment", "title", "description", "default", "examples", "deprecated", "readOnly", "writeOnly"}
+
+func parseJSONSchema(doc any, path string) (*Schema, error) {
+	if b, ok := doc.(bool); ok {
+		if b {
+			return &Schema{}, nil
+		}
+		return nil, fmt.Errorf("schema at %q: false is only supported as additionalProperties", path)
+	}
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("schema at %q: expected an object", path)
+	}
+	fail := func(kw string, want string) error {
+		return fmt.Errorf("schema at %q: %s must be %s", path, kw, want)
+	}
+	s := &Schema{}
+	// limits holds the keyword that set MinLength or MaxLength, see ParseJSONSchema
+	var limits string
+	for _, kw := range sortedKeys(obj) {
+		v := obj[kw]
+		switch kw {
+		case "type":
+			name, _ := v.(string)
+			t, ok := jsonSchemaTypes[name]
+			if !ok {
+				return nil, fail(kw, "one of string, integer, number, boolean, object, array or null")
+			}
+			s.Type = t
+		case "enum":
+			list, ok := v.([]any)
+			if !ok {
+				return nil, fail(kw, "an array")
+			}
+			s.Enum = list
+		case "const":
+			s.Enum = []any{v}
+		case "minimum", "maximum":
+			f, ok := v.(float64)
+			if !ok {
+				return nil, fail(kw, "a number")
+			}
+			if kw == "minimum" {
+				s.Min = &f
+			} else {
+				s.Max = &f
+			}
+		case "minLength", "maxLength", "minItems", "maxItems":
+			f, ok := v.(float64)
+			if !ok || f < 0 || f != math.Trunc(f) {
+				return nil, fail(kw, "a non negative integer")
+			}
+			if limits != "" && strings.HasSuffix(limits, "Length") != strings.HasSuffix(kw, "Length") {
+				return nil, fmt.Errorf("schema at %q: %s and %s cannot be combined", path, limits, kw)
+			}
+			limits = kw
+			n := int(f)
+			if strings.HasPrefix(kw, "min") {
+				s.MinLength = &n
+			} else {
+				s.MaxLength = &n
+			}
+		case "pattern":
+			p, ok := v.(string)
+			if !ok {
+				return nil, fail(kw, "a string")
+			}
+			s.Pattern = p
+		case "properties":
+			props, ok := v.(map[string]any)
+			if !ok {
+				return nil, fail(kw, "an object")
+			}
+			s.Properties = make(map[string]*Schema, len(props))
+			for _, k := range sortedKeys(props) {
+				p, err := parseJSONSchema(props[k], joinPath(path, k))
+				if err != nil {
+					return nil, err
+				}
+				s.Properties[k] = p
+			}
+		case "required":
+			list, ok := v.([]any)
+			if !ok {
+				return nil, fail(kw, "an array of strings")
+			}
+			for _, r := range list {
+				name, ok := r.(string)
+				if !ok {
+					return nil, fail(kw, "an array of strings")
+				}
+				s.Required = append(s.Required, name)
+			}
+		case "additionalProperties":
+			if b, ok := v.(bool); ok {
+				s.Closed = !b
+				continue
+			}
+			p, err := parseJSONSchema(v, joinPath(path, "*"))
+			if err != nil {
+				return nil, err
+			}
+			s.Additional = p
+		case "items":
+			p, err := parseJSONSchema(v, path+"[]")
+			if err != nil {
+				return nil, err
+			}
+			s.Items = p
+		default:
+			if !slices.ContainsFunc(jsonSchemaAnnotations, func(a string) bool { return a == kw }) {
+				return nil, fmt.Errorf("schema at %q: unsupported keyword %q", path, kw)
+			}
+		}
+	}
+	return s, nil
+}
+
+// SetSchema attaches s to prefix, an empty prefix covers the whole store. The key space at
+// prefix must satisfy s from now on, writes that would break it are rejected and leave the
+// store untouched. A missing prefix is always valid, so required keys only apply once the key
+// space exists. The current content must already satisfy s. A nil s removes the schema.
+func (m *MemKV) SetSchema(prefix string, s *Schema) error {
+	m.lock()
+	defer m.l.Unlock()
+	prefix = m.normalize(prefix)
+	if s == nil {
+		delete(m.schemas, prefix)
+		return nil
+	}
+	if err := s.Compile(); err != nil {
+		return err
+	}
+	if err := m.validateSchema(m.m, prefix, s, m.sep); err != nil {
+		return err
+	}
+	m.schemas[prefix] = s
+	return nil
+}
+
+// Schema returns the schema attached to prefix
+func (m *MemKV) Schema(prefix string) (*Schema, bool) {
+	m.rlock()
+	defer m.l.RUnlock()
+	s, ok := m.schemas[m.normalize(prefix)]
+	return s, ok
+}
+
+// hasSchemaFor reports whether a write to key can affect the key space of a schema
+func (m *MemKV) hasSchemaFor(key string) bool {
+	for p := range m.schemas {
+		if m.underPrefix(key, p) || m.underPrefix(p, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateTree checks root against every schema whose key space overlaps one of keys, no keys
+// means every schema
+func (m *MemKV) validateTree(root map[string]any, sep string, keys ...string) error {
+	for _, p := range sortedKeys(m.schemas) {
+		if len(keys) > 0 && !slices.ContainsFunc(keys, func(k string) bool {
+			return m.underPrefix(k, p) || m.underPrefix(p, k)
+		}) {
+			continue
+		}
+		if err := m.validateSchema(root, p, m.schemas[p], sep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemKV) validateSchema(root map[string]any, prefix string, s *Schema, sep string) error {
+	var val any = root
+	if prefix != "" {
+		v, ok := lookup(root, strings.Split(prefix, sep))
+		if !ok {
+			return nil
+		}
+		val = v
+	}
+	return s.validate(prefix, val, sep, m.normalize)
+}
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// equalValues compares like reflect.DeepEqual but treats numbers of different types as equal
+// when their values are, so an enum parsed from JSON matches the ints of a Go caller
+func equalValues(a any, b any) bool {
+	fa, okA := toFloat(a)
+	fb, okB := toFloat(b)
+	if okA && okB {
+		return fa == fb
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func typeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]any:
+		return "key space"
+	}
+	return reflect.TypeOf(v).String()
+}
+
+func joinKey(key string, child string, sep string) string {
+	if key == "" {
+		return child
+	}
+	return key + sep + child
+}
+
+func joinPath(path string, child string) string {
+	return joinKey(path, child, ".")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,337 @@
+// Package server exposes a memkv.Store over HTTP with JSON bodies, watch events are streamed as Server-Sent Events.
+//
+// Routes:
+//
+//	GET    /v1/keys/{key}             read a key, 404 if it does not exist
+//	PUT    /v1/keys/{key}             set a key from a ValueBody
+//	DELETE /v1/keys/{key}?keyspaces=1 drop a key, key spaces are only dropped when keyspaces is set
+//	GET    /v1/list?prefix=p          list leaf keys under p
+//	POST   /v1/txn                    commit a TxnBody atomically
+//	POST   /v1/import                 import a JSON object with ImportMap
+//	GET    /v1/snapshot               dump GetSerializableMap
+//	PUT    /v1/snapshot               load a dump with LoadFromSerializableMap
+//	GET    /v1/watch?key=k            stream events for k
+//	GET    /v1/watch?prefix=p         stream events for p and everything below it
+//
+// Watch requests may restrict the streamed event types with a comma separated events parameter
+// holding the names returned by memkv.EventType.String. Without the parameter every type is
+// streamed, an empty one streams none, like an empty filter given to memkv.Store.AddWatcherHook.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xadaemon/libprisma/memkv"
+)
+
+// ValueBody is the body of key reads and writes
+type ValueBody struct {
+	Key   string `json:"key,omitempty"`
+	Value any    `json:"value"`
+}
+
+// ListBody is the body returned by the list route
+type ListBody struct {
+	Keys []string `json:"keys"`
+}
+
+// OpBody is the wire form of a memkv.Op
+type OpBody struct {
+	Op              string `json:"op"`
+	Key             string `json:"key"`
+	Value           any    `json:"value,omitempty"`
+	DeleteKeySpaces bool   `json:"deleteKeySpaces,omitempty"`
+}
+
+// TxnBody is the body of the transaction route
+type TxnBody struct {
+	Ops []OpBody `json:"ops"`
+}
+
+// InfoBody is returned by the info route so clients can learn how keys are split
+type InfoBody struct {
+	Separator string `json:"separator"`
+}
+
+// ErrorBody is returned with every non 2xx status
+type ErrorBody struct {
+	Error string `json:"error"`
+}
+
+var opNames = map[memkv.OpType]string{
+	memkv.OP_SET:           "set",
+	memkv.OP_DROP:          "drop",
+	memkv.OP_CHECK:         "check",
+	memkv.OP_CHECK_MISSING: "checkMissing",
+}
+
+// EncodeTxn converts txn to its wire form
+func EncodeTxn(txn *memkv.Txn) TxnBody {
+	body := TxnBody{Ops: make([]OpBody, len(txn.Ops()))}
+	for i, op := range txn.Ops() {
+		body.Ops[i] = OpBody{
+			Op:              opNames[op.Type],
+			Key:             op.Key,
+			Value:           op.Val,
+			DeleteKeySpaces: op.DeleteKeySpaces,
+		}
+	}
+	return body
+}
+
+// DecodeTxn converts the wire form of a transaction back to a memkv.Txn
+func DecodeTxn(body TxnBody) (*memkv.Txn, error) {
+	ops := make([]memkv.Op, len(body.Ops))
+	for i, o := range body.Ops {
+		found := false
+		for t, n := range opNames {
+			if n == o.Op {
+				ops[i] = memkv.Op{Type: t, Key: o.Key, Val: o.Value, DeleteKeySpaces: o.DeleteKeySpaces}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown op %q", o.Op)
+		}
+	}
+	return memkv.NewTxn(ops...), nil
+}
+
+// Server is an http.Handler serving a single store
+type Server struct {
+	store memkv.Store
+	mux   *http.ServeMux
+	// WatchBuffer is the number of events buffered per watch stream, a stream that
+	// falls further behind is closed so slow consumers cannot stall the store
+	WatchBuffer int
+}
+
+func New(store memkv.Store) *Server {
+	s := &Server{
+		store:       store,
+		mux:         http.NewServeMux(),
+		WatchBuffer: 256,
+	}
+	s.mux.HandleFunc("GET /v1/info", s.info)
+	s.mux.HandleFunc("GET /v1/keys/{key...}", s.get)
+	s.mux.HandleFunc("PUT /v1/keys/{key...}", s.set)
+	s.mux.HandleFunc("DELETE /v1/keys/{key...}", s.drop)
+	s.mux.HandleFunc("GET /v1/list", s.list)
+	s.mux.HandleFunc("POST /v1/txn", s.txn)
+	s.mux.HandleFunc("POST /v1/import", s.importMap)
+	s.mux.HandleFunc("GET /v1/snapshot", s.snapshot)
+	s.mux.HandleFunc("PUT /v1/snapshot", s.loadSnapshot)
+	s.mux.HandleFunc("GET /v1/watch", s.watch)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeErr(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, ErrorBody{Error: err.Error()})
+}
+
+// errSetter is implemented by stores that can explain why a Set failed, such as MemKV
+type errSetter interface {
+	SetE(key string, val any) error
+}
+
+// errStatus maps a failed write to a status, schema violations are 422 and anything else 409
+func errStatus(err error) int {
+	if errors.Is(err, memkv.ErrSchemaViolation) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusConflict
+}
+
+func (s *Server) info(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, InfoBody{Separator: s.store.Separator()})
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	v, ok := s.store.Get(key)
+	if !ok {
+		writeErr(w, http.StatusNotFound, memkv.ErrNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, ValueBody{Key: key, Value: v})
+}
+
+func (s *Server) set(w http.ResponseWriter, r *http.Request) {
+	var body ValueBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, http.StatusBadRequest, err)
+		return
+	}
+	if setter, ok := s.store.(errSetter); ok {
+		if err := setter.SetE(r.PathValue("key"), body.Value); err != nil {
+			writeErr(w, errStatus(err), err)
+			return
+		}
+	} else if !s.store.Set(r.PathValue("key"), body.Value) {
+		writeErr(w, http.StatusConflict, errors.New("key could not be set"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) drop(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	keySpaces, _ := strconv.ParseBool(r.URL.Query().Get("keyspaces"))
+	if !s.store.Drop(key, keySpaces) {
+		if s.store.IsKeySpace(key) {
+			writeErr(w, http.StatusConflict, memkv.ErrIsKeySpace)
+		} else {
+			writeErr(w, http.StatusNotFound, memkv.ErrNotFound)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, ListBody{Keys: s.store.List(r.URL.Query().Get("prefix"))})
+}
+
+func (s *Server) txn(w http.ResponseWriter, r *http.Request) {
+	var body TxnBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, http.StatusBadRequest, err)
+		return
+	}
+	txn, err := DecodeTxn(body)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.store.Commit(txn); err != nil {
+		writeErr(w, errStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) importMap(w http.ResponseWriter, r *http.Request) {
+	var body map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.store.ImportMap(body); err != nil {
+		writeErr(w, errStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) snapshot(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.store.GetSerializableMap())
+}
+
+func (s *Server) loadSnapshot(w http.ResponseWriter, r *http.Request) {
+	var body map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.store.LoadFromSerializableMap(body); err != nil {
+		writeErr(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseEvents reads the comma separated event filter of q, a missing filter selects every event
+// type and an empty one none
+func parseEvents(q url.Values) ([]memkv.EventType, error) {
+	if !q.Has("events") {
+		return []memkv.EventType{memkv.E_KEY_CREATED, memkv.E_KEY_UPDATED, memkv.E_KEY_ACCESSED, memkv.E_KEY_DELETED}, nil
+	}
+	out := []memkv.EventType{}
+	s := q.Get("events")
+	if s == "" {
+		return out, nil
+	}
+	for _, name := range strings.Split(s, ",") {
+		t, ok := memkv.ParseEventType(strings.TrimSpace(name))
+		if !ok {
+			return nil, fmt.Errorf("unknown event type %q", name)
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+func (s *Server) watch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter, err := parseEvents(q)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeErr(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	events := make(chan memkv.Event, s.WatchBuffer)
+	overflow := make(chan struct{})
+	var once sync.Once
+	hook := func(e memkv.Event) {
+		select {
+		case events <- e:
+		default:
+			once.Do(func() { close(overflow) })
+		}
+	}
+	var cancel func()
+	if q.Has("key") {
+		cancel = s.store.AddWatcherHook(q.Get("key"), hook, filter)
+	} else {
+		cancel = s.store.AddPrefixWatcherHook(q.Get("prefix"), hook, filter)
+	}
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-overflow:
+			_, _ = fmt.Fprint(w, "event: overflow\ndata: {}\n\n")
+			flusher.Flush()
+			return
+		case e := <-events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xadaemon/libprisma/memkv"
+	"github.com/xadaemon/libprisma/memkv/server"
+)
+
+func newServer(t *testing.T) (*memkv.MemKV, *httptest.Server) {
+	kvs := memkv.NewMemKV(".", nil)
+	ts := httptest.NewServer(server.New(kvs))
+	t.Cleanup(ts.Close)
+	return kvs, ts
+}
+
+func TestServer_Errors(t *testing.T) {
+	kvs, ts := newServer(t)
+	kvs.Set("svc.port", 80)
+	if err := kvs.SetSchema("limits", &memkv.Schema{Type: memkv.TYPE_INT}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Name   string
+		Method string
+		Path   string
+		Body   string
+		Status int
+	}{
+		{"Get Missing", http.MethodGet, "/v1/keys/none", "", http.StatusNotFound},
+		{"Set Malformed", http.MethodPut, "/v1/keys/a", "{", http.StatusBadRequest},
+		{"Set Schema Violation", http.MethodPut, "/v1/keys/limits", `{"value": "x"}`, http.StatusUnprocessableEntity},
+		{"Set Under Leaf", http.MethodPut, "/v1/keys/svc.port.x", `{"value": 1}`, http.StatusConflict},
+		{"Drop Missing", http.MethodDelete, "/v1/keys/none", "", http.StatusNotFound},
+		{"Drop Key Space", http.MethodDelete, "/v1/keys/svc", "", http.StatusConflict},
+		{"Txn Unknown Op", http.MethodPost, "/v1/txn", `{"ops": [{"op": "swap", "key": "a"}]}`, http.StatusBadRequest},
+		{"Txn Check Failed", http.MethodPost, "/v1/txn", `{"ops": [{"op": "checkMissing", "key": "svc.port"}]}`, http.StatusConflict},
+		{"Import Malformed", http.MethodPost, "/v1/import", `[]`, http.StatusBadRequest},
+		{"Load Invalid Snapshot", http.MethodPut, "/v1/snapshot", `{"__data": 1}`, http.StatusBadRequest},
+		{"Watch Unknown Event", http.MethodGet, "/v1/watch?key=a&events=created,renamed", "", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.Method, ts.URL+test.Path, strings.NewReader(test.Body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body server.ErrorBody
+		err = json.NewDecoder(res.Body).Decode(&body)
+		res.Body.Close()
+		if res.StatusCode != test.Status || err != nil || body.Error == "" {
+			t.Errorf("%s: got %d with %+v (%v), want %d", test.Name, res.StatusCode, body, err, test.Status)
+		}
+	}
+	if v, _ := kvs.Get("svc.port"); v != 80 {
+		t.Errorf("Failed requests changed the store, svc.port = %v", v)
+	}
+}
+
+// frame is a Server-Sent Event
+type frame struct {
+	Name string
+	Data string
+}
+
+// openWatch starts a watch stream and returns its frames, the stream ends with the test
+func openWatch(t *testing.T, ts *httptest.Server, query string) <-chan frame {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/v1/watch?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		res.Body.Close()
+		t.Fatalf("Watch answered %d with %q", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	frames := make(chan frame, 16)
+	go func() {
+		defer close(frames)
+		defer res.Body.Close()
+		r := bufio.NewReader(res.Body)
+		var f frame
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch line = strings.TrimSuffix(line, "\n"); {
+			case line == "":
+				frames <- f
+				f = frame{}
+			case strings.HasPrefix(line, "event: "):
+				f.Name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				f.Data = strings.TrimPrefix(line, "data: ")
+			default:
+				t.Errorf("Unexpected line %q", line)
+			}
+		}
+	}()
+	return frames
+}
+
+func next(t *testing.T, frames <-chan frame) frame {
+	t.Helper()
+	select {
+	case f, ok := <-frames:
+		if !ok {
+			t.Fatal("Stream ended")
+		}
+		return f
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+	}
+	return frame{}
+}
+
+func TestServer_Watch(t *testing.T) {
+	kvs, ts := newServer(t)
+	all := openWatch(t, ts, "prefix=svc")
+	deletes := openWatch(t, ts, "key=svc.port&events=deleted")
+	none := openWatch(t, ts, "prefix=svc&events=")
+
+	kvs.Set("svc.port", 80)
+	kvs.Get("svc.port")
+	kvs.Drop("svc.port", false)
+
+	for _, want := range []memkv.EventType{memkv.E_KEY_CREATED, memkv.E_KEY_ACCESSED, memkv.E_KEY_DELETED} {
+		f := next(t, all)
+		var e memkv.Event
+		if err := json.Unmarshal([]byte(f.Data), &e); err != nil {
+			t.Fatalf("Data of %q is not an event: %v", f.Name, err)
+		}
+		if f.Name != want.String() || e.Type != want || e.Key != "svc.port" {
+			t.Errorf("Got %q with %+v, want %v on svc.port", f.Name, e, want)
+		}
+	}
+	if f := next(t, deletes); f.Name != "deleted" {
+		t.Errorf("Filtered stream got %q", f.Name)
+	}
+	select {
+	case f := <-none:
+		t.Errorf("Stream with an empty filter got %+v", f)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// gatedWriter records a response, its writes wait until open is closed and its first flush,
+// sending the headers, closes flushed
+type gatedWriter struct {
+	*httptest.ResponseRecorder
+	open    chan struct{}
+	flushed chan struct{}
+	once    sync.Once
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	<-w.open
+	return w.ResponseRecorder.Write(p)
+}
+
+func (w *gatedWriter) Flush() {
+	w.once.Do(func() { close(w.flushed) })
+}
+
+func TestServer_WatchOverflow(t *testing.T) {
+	kvs := memkv.NewMemKV(".", nil)
+	s := server.New(kvs)
+	s.WatchBuffer = 1
+	w := &gatedWriter{ResponseRecorder: httptest.NewRecorder(), open: make(chan struct{}), flushed: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/watch?key=k", nil))
+	}()
+	<-w.flushed
+	// at most one event is taken by the blocked stream and one fills the buffer, so the third
+	// overflows it at the latest
+	for i := range 3 {
+		kvs.Set("k", i)
+	}
+	close(w.open)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stream was not closed on overflow")
+	}
+	if body := w.Body.String(); !strings.HasSuffix(body, "event: overflow\ndata: {}\n\n") {
+		t.Errorf("Stream did not end with an overflow frame: %q", body)
+	}
+}
@@ -0,0 +1,173 @@
+package memkv
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// SERIALIZED_PROTOCOL is the snapshot version written by GetSerializableMap.
+//
+// Version 1 was written before keys were normalized on import, so case insensitive snapshots
+// may hold key spaces with upper case keys that can never be looked up.
+// Version 2 guarantees every key of a case insensitive snapshot is lower case.
+// Version 3 adds __meta.preserveCase, snapshots of case preserving stores keep keys as they
+// were first written and are only lower cased when loaded.
+const SERIALIZED_PROTOCOL = 3
+
+var (
+	ErrInvalidSnapshot     = errors.New("invalid snapshot")
+	ErrUnsupportedProtocol = errors.New("unsupported snapshot protocol")
+	ErrInvalidKey          = errors.New("invalid key")
+)
+
+// migration upgrades a snapshot by exactly one protocol version. It receives a deep copy it
+// may change in place and does not need to update __serializedProtocol.
+type migration func(snapshot map[string]any) (map[string]any, error)
+
+// migrations holds the upgrade from every old protocol version to the next one
+var migrations = map[int]migration{
+	1: migrateV1,
+	2: migrateV2,
+}
+
+// migrateV1 lower cases the keys of case insensitive snapshots, merging key spaces that only
+// differed in case. Values that collide that way are refused rather than picked at random.
+func migrateV1(snapshot map[string]any) (map[string]any, error) {
+	meta := snapshot["__meta"].(map[string]any)
+	if cs, _ := meta["caseSensitive"].(bool); cs {
+		return snapshot, nil
+	}
+	data, ok := snapshot["__data"].(map[string]any)
+	if !ok {
+		return snapshot, nil
+	}
+	sep, _ := meta["separator"].(string)
+	lowered := map[string]any{}
+	if err := mergeInto(lowered, data, nil, MERGE_ERROR, sep, strings.ToLower, nil); err != nil {
+		return nil, fmt.Errorf("keys differing only in case: %w", err)
+	}
+	snapshot["__data"] = lowered
+	return snapshot, nil
+}
+
+// migrateV2 has nothing to do, version 2 snapshots never preserve case
+func migrateV2(snapshot map[string]any) (map[string]any, error) {
+	return snapshot, nil
+}
+
+// snapshot is a validated snapshot of the current protocol
+type snapshot struct {
+	sep       string
+	caseSense bool
+	// spelling is set for snapshots of case preserving stores, see spell
+	spelling map[string]string
+	data     map[string]any
+}
+
+func (s *snapshot) preserveCase() bool {
+	return s.spelling != nil
+}
+
+// MigrateSnapshot upgrades data to SERIALIZED_PROTOCOL without loading it, data is not modified.
+// LoadFromSerializableMap does the same before loading.
+func MigrateSnapshot(data map[string]any) (map[string]any, error) {
+	s, err := decodeSnapshot(data)
+	if err != nil {
+		return nil, err
+	}
+	m := &MemKV{sep: s.sep, caseSense: s.caseSense, preserveCase: s.preserveCase(), spelling: s.spelling}
+	return m.serialize(s.data, ""), nil
+}
+
+// decodeSnapshot checks the shape of data, upgrades it to the current protocol and returns a
+// copy that shares nothing with data
+func decodeSnapshot(data map[string]any) (*snapshot, error) {
+	if data == nil {
+		return nil, fmt.Errorf("%w: snapshot is nil", ErrInvalidSnapshot)
+	}
+	meta, ok := data["__meta"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: __meta is missing or not a map", ErrInvalidSnapshot)
+	}
+	version, ok := toInt(meta["__serializedProtocol"])
+	if !ok || version < 1 {
+		return nil, fmt.Errorf("%w: __meta.__serializedProtocol must be a positive integer, got %v", ErrInvalidSnapshot, meta["__serializedProtocol"])
+	}
+	if version > SERIALIZED_PROTOCOL {
+		return nil, fmt.Errorf("%w: snapshot protocol %d is newer than the supported %d", ErrUnsupportedProtocol, version, SERIALIZED_PROTOCOL)
+	}
+
+	copied := DeepCopy(data).(map[string]any)
+	for ; version < SERIALIZED_PROTOCOL; version++ {
+		up, ok := migrations[version]
+		if !ok {
+			return nil, fmt.Errorf("%w: no migration from protocol %d", ErrUnsupportedProtocol, version)
+		}
+		var err error
+		if copied, err = up(copied); err != nil {
+			return nil, fmt.Errorf("%w: migrating from protocol %d: %w", ErrInvalidSnapshot, version, err)
+		}
+	}
+
+	meta = copied["__meta"].(map[string]any)
+	s := &snapshot{}
+	if s.sep, ok = meta["separator"].(string); !ok || s.sep == "" {
+		return nil, fmt.Errorf("%w: __meta.separator must be a non empty string, got %v", ErrInvalidSnapshot, meta["separator"])
+	}
+	if s.caseSense, ok = meta["caseSensitive"].(bool); !ok {
+		return nil, fmt.Errorf("%w: __meta.caseSensitive must be a boolean, got %v", ErrInvalidSnapshot, meta["caseSensitive"])
+	}
+	if s.data, ok = copied["__data"].(map[string]any); !ok {
+		return nil, fmt.Errorf("%w: __data is missing or not a map", ErrInvalidSnapshot)
+	}
+	preserve, ok := meta["preserveCase"].(bool)
+	if _, present := meta["preserveCase"]; present && !ok {
+		return nil, fmt.Errorf("%w: __meta.preserveCase must be a boolean, got %v", ErrInvalidSnapshot, meta["preserveCase"])
+	}
+	if preserve && s.caseSense {
+		return nil, fmt.Errorf("%w: only case insensitive snapshots can preserve case", ErrInvalidSnapshot)
+	}
+	if err := checkKeys(s.data, "", s.sep, s.caseSense || preserve); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+	if preserve {
+		var err error
+		if s.data, s.spelling, err = collectSpelling(s.data, s.sep); err != nil {
+			return nil, fmt.Errorf("%w: keys differing only in case: %w", ErrInvalidSnapshot, err)
+		}
+	}
+	return s, nil
+}
+
+// checkKeys makes sure every key of the tree can be addressed with sep and, for case
+// insensitive stores, is lower case
+func checkKeys(ks map[string]any, path string, sep string, caseSense bool) error {
+	for k, v := range ks {
+		full := joinKey(path, k, sep)
+		switch {
+		case k == "":
+			return fmt.Errorf("%w: empty key under %q", ErrInvalidKey, path)
+		case strings.Contains(k, sep):
+			return fmt.Errorf("%w: key %q contains the separator %q", ErrInvalidKey, full, sep)
+		case !caseSense && strings.ToLower(k) != k:
+			return fmt.Errorf("%w: key %q is not lower case in a case insensitive store", ErrInvalidKey, full)
+		}
+		if child, ok := v.(map[string]any); ok {
+			if err := checkKeys(child, full, sep, caseSense); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// toInt accepts the integer types and integral floats, snapshots that went through JSON hold float64
+func toInt(v any) (int, bool) {
+	f, ok := toFloat(v)
+	if !ok || f != math.Trunc(f) || f > math.MaxInt32 || f < math.MinInt32 {
+		return 0, false
+	}
+	return int(f), true
+}
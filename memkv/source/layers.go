@@ -0,0 +1,104 @@
+package source
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/xadaemon/libprisma/memkv"
+)
+
+// Provenance maps the full path of every leaf key to the name of the source that provided it
+type Provenance map[string]string
+
+// Origin returns the source key came from
+func (p Provenance) Origin(key string) (string, bool) {
+	s, ok := p[key]
+	return s, ok
+}
+
+type layer struct {
+	src      Source
+	priority int
+	order    int
+}
+
+// Layers merges several sources, a source with a higher priority overrides the keys of the ones
+// below it and sources with equal priority override in the order they were added
+type Layers struct {
+	mu     sync.Mutex
+	layers []layer
+	sep    string
+	last   Provenance
+}
+
+// NewLayers returns an empty stack, sep joins key paths in provenance records
+func NewLayers(sep string) *Layers {
+	return &Layers{sep: sep, last: Provenance{}}
+}
+
+func (l *Layers) Add(src Source, priority int) *Layers {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.layers = append(l.layers, layer{src: src, priority: priority, order: len(l.layers)})
+	sort.SliceStable(l.layers, func(i, j int) bool {
+		if l.layers[i].priority != l.layers[j].priority {
+			return l.layers[i].priority < l.layers[j].priority
+		}
+		return l.layers[i].order < l.layers[j].order
+	})
+	return l
+}
+
+// Load loads every source and deep merges them by priority
+func (l *Layers) Load() (map[string]any, Provenance, error) {
+	l.mu.Lock()
+	layers := append([]layer{}, l.layers...)
+	l.mu.Unlock()
+
+	out := map[string]any{}
+	prov := Provenance{}
+	for _, ly := range layers {
+		data, err := ly.src.Load()
+		if err != nil {
+			return nil, nil, fmt.Errorf("loading %s: %w", ly.src.Name(), err)
+		}
+		name := ly.src.Name()
+		err = memkv.MergeMaps(out, data, memkv.MERGE_OVERWRITE, l.sep, func(path []string, t memkv.EventType, _ any, _ any) {
+			key := strings.Join(path, l.sep)
+			if t == memkv.E_KEY_DELETED {
+				delete(prov, key)
+				return
+			}
+			prov[key] = name
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return out, prov, nil
+}
+
+// Apply loads the layers and merges the result into kv with strategy, the provenance of the
+// loaded keys is returned and kept for Origin
+func (l *Layers) Apply(kv *memkv.MemKV, strategy memkv.MergeStrategy) (Provenance, error) {
+	data, prov, err := l.Load()
+	if err != nil {
+		return nil, err
+	}
+	if err := kv.MergeMap(data, strategy); err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	l.last = prov
+	l.mu.Unlock()
+	return prov, nil
+}
+
+// Origin returns the source that provided key during the last Apply
+func (l *Layers) Origin(key string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.last.Origin(key)
+}
@@ -0,0 +1,211 @@
+// Package source loads configuration into a MemKV from files and the environment. Sources can be
+// stacked in Layers so higher priority ones override lower ones, while remembering which source
+// every key came from.
+package source
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Source produces a tree of key spaces, Name identifies it in provenance records and errors
+type Source interface {
+	Name() string
+	Load() (map[string]any, error)
+}
+
+// Format parses the content of a configuration file
+type Format func(data []byte) (map[string]any, error)
+
+func ParseJSON(data []byte) (map[string]any, error) {
+	out := map[string]any{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&out); err != nil {
+		return nil, err
+	}
+	return normalize(out).(map[string]any), nil
+}
+
+func ParseYAML(data []byte) (map[string]any, error) {
+	out := map[string]any{}
+	if err := yaml.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	return normalize(out).(map[string]any), nil
+}
+
+func ParseTOML(data []byte) (map[string]any, error) {
+	out := map[string]any{}
+	if err := toml.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	return normalize(out).(map[string]any), nil
+}
+
+// FormatFor picks the format matching the extension of path
+func FormatFor(path string) (Format, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return ParseJSON, nil
+	case ".yaml", ".yml":
+		return ParseYAML, nil
+	case ".toml":
+		return ParseTOML, nil
+	default:
+		return nil, fmt.Errorf("no format known for %q", path)
+	}
+}
+
+// normalize converts decoder specific containers to the map[string]any and []any trees MemKV uses
+// and turns JSON numbers into int64 when they are integral and float64 otherwise
+func normalize(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, child := range t {
+			t[k] = normalize(child)
+		}
+		return t
+	case map[any]any:
+		out := make(map[string]any, len(t))
+		for k, child := range t {
+			out[fmt.Sprint(k)] = normalize(child)
+		}
+		return out
+	case []map[string]any:
+		out := make([]any, len(t))
+		for i, child := range t {
+			out[i] = normalize(child)
+		}
+		return out
+	case []any:
+		for i, child := range t {
+			t[i] = normalize(child)
+		}
+		return t
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n
+		}
+		f, _ := t.Float64()
+		return f
+	default:
+		return v
+	}
+}
+
+type fileSource struct {
+	path   string
+	format Format
+}
+
+// File reads path with the format picked from its extension
+func File(path string) (Source, error) {
+	f, err := FormatFor(path)
+	if err != nil {
+		return nil, err
+	}
+	return FileWithFormat(path, f), nil
+}
+
+// FileWithFormat reads path with an explicit format
+func FileWithFormat(path string, format Format) Source {
+	return &fileSource{path: path, format: format}
+}
+
+func (f *fileSource) Name() string {
+	return "file:" + f.path
+}
+
+func (f *fileSource) Load() (map[string]any, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	out, err := f.format(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.path, err)
+	}
+	return out, nil
+}
+
+type envSource struct {
+	prefix  string
+	environ func() []string
+}
+
+// Env loads the environment variables starting with prefix followed by an underscore. The prefix
+// becomes the top key space and double underscores separate nested key spaces, so with prefix
+// APP the variable APP_DB__HOST is loaded as app.db.host. Names are lowercased and values are
+// kept as strings.
+func Env(prefix string) Source {
+	return &envSource{prefix: prefix, environ: os.Environ}
+}
+
+// EnvFrom is Env reading the KEY=value pairs in environ instead of the process environment
+func EnvFrom(prefix string, environ []string) Source {
+	return &envSource{prefix: prefix, environ: func() []string { return environ }}
+}
+
+func (e *envSource) Name() string {
+	return "env:" + e.prefix
+}
+
+func (e *envSource) Load() (map[string]any, error) {
+	root := map[string]any{}
+	top := map[string]any{}
+	vars := e.environ()
+	sort.Strings(vars)
+	for _, kv := range vars {
+		name, val, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(name, e.prefix+"_") {
+			continue
+		}
+		parts := strings.Split(strings.ToLower(strings.TrimPrefix(name, e.prefix+"_")), "__")
+		view := top
+		for i, p := range parts {
+			if i == len(parts)-1 {
+				if _, isKs := view[p].(map[string]any); !isKs {
+					view[p] = val
+				}
+				break
+			}
+			next, ok := view[p].(map[string]any)
+			if !ok {
+				next = map[string]any{}
+				view[p] = next
+			}
+			view = next
+		}
+	}
+	if len(top) > 0 {
+		root[strings.ToLower(e.prefix)] = top
+	}
+	return root, nil
+}
+
+type mapSource struct {
+	name string
+	data map[string]any
+}
+
+// Map wraps an in memory tree, typically used for defaults
+func Map(name string, data map[string]any) Source {
+	return &mapSource{name: name, data: data}
+}
+
+func (m *mapSource) Name() string {
+	return m.name
+}
+
+func (m *mapSource) Load() (map[string]any, error) {
+	return m.data, nil
+}
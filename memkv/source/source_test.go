@@ -0,0 +1,214 @@
+package source_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xadaemon/libprisma/memkv"
+	"github.com/xadaemon/libprisma/memkv/source"
+)
+
+func write(t *testing.T, name string, content string) string {
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestFormats(t *testing.T) {
+	want := map[string]any{"app": map[string]any{"db": map[string]any{"host": "h", "port": int64(5432)}}}
+	files := map[string]string{
+		"c.json": `{"app": {"db": {"host": "h", "port": 5432}}}`,
+		"c.yaml": "app:\n  db:\n    host: h\n    port: 5432\n",
+		"c.toml": "[app.db]\nhost = \"h\"\nport = 5432\n",
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			src, err := source.File(write(t, name, content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := src.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// yaml decodes integers to int
+			if v, ok := got["app"].(map[string]any)["db"].(map[string]any)["port"].(int); ok {
+				got["app"].(map[string]any)["db"].(map[string]any)["port"] = int64(v)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Loaded %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestEnv(t *testing.T) {
+	src := source.EnvFrom("APP", []string{"APP_DB__HOST=db", "APP_NAME=ca", "OTHER_X=1", "APPX=2"})
+	got, err := src.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"app": map[string]any{"name": "ca", "db": map[string]any{"host": "db"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Loaded %v, want %v", got, want)
+	}
+}
+
+func TestLayers(t *testing.T) {
+	file := write(t, "c.json", `{"app": {"db": {"host": "file-host", "port": 1}, "name": "file"}}`)
+	fileSrc, _ := source.File(file)
+	layers := source.NewLayers(".").
+		Add(source.EnvFrom("APP", []string{"APP_DB__HOST=env-host"}), 10).
+		Add(fileSrc, 5).
+		Add(source.Map("defaults", map[string]any{"app": map[string]any{"db": map[string]any{"user": "ca"}}}), 0)
+
+	kvs := memkv.NewMemKV(".", nil)
+	kvs.Set("app.db.host", "old")
+	prov, err := layers.Apply(kvs, memkv.MERGE_OVERWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]struct {
+		val    any
+		origin string
+	}{
+		"app.db.host": {"env-host", "env:APP"},
+		"app.db.port": {int64(1), "file:" + file},
+		"app.db.user": {"ca", "defaults"},
+		"app.name":    {"file", "file:" + file},
+	}
+	for k, e := range expect {
+		if v, _ := kvs.Get(k); v != e.val {
+			t.Errorf("%s = %v, want %v", k, v, e.val)
+		}
+		if o, _ := prov.Origin(k); o != e.origin {
+			t.Errorf("%s came from %q, want %q", k, o, e.origin)
+		}
+		if o, _ := layers.Origin(k); o != e.origin {
+			t.Errorf("Layers.Origin(%s) = %q, want %q", k, o, e.origin)
+		}
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	for _, polling := range []bool{false, true} {
+		name := "notify"
+		if polling {
+			name = "polling"
+		}
+		t.Run(name, func(t *testing.T) {
+			path := write(t, "c.json", `{"db": {"host": "a", "port": 1, "user": "ca"}}`)
+			kvs := memkv.NewMemKV(".", nil)
+			errs := make(chan error, 10)
+			reloads := make(chan int, 10)
+			w, err := source.WatchFile(kvs, path, &source.WatchOpts{
+				ForcePolling: polling,
+				PollInterval: 20 * time.Millisecond,
+				Debounce:     10 * time.Millisecond,
+				OnError:      func(err error) { errs <- err },
+				OnReload:     func(n int) { reloads <- n },
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			<-reloads
+			if !polling && !w.UsesNotifications() {
+				t.Log("notifications unavailable, polling instead")
+			}
+
+			var mu sync.Mutex
+			var events []string
+			kvs.AddPrefixWatcherHook("", func(e memkv.Event) {
+				mu.Lock()
+				defer mu.Unlock()
+				events = append(events, e.Type.String()+" "+e.Key)
+			}, []memkv.EventType{memkv.E_KEY_CREATED, memkv.E_KEY_UPDATED, memkv.E_KEY_DELETED})
+
+			// make sure the modification time moves for the polling watcher
+			time.Sleep(20 * time.Millisecond)
+			if err := os.WriteFile(path, []byte(`{"db": {"host": "b", "port": 1, "name": "x"}}`), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case n := <-reloads:
+				if n != 3 {
+					t.Errorf("Reload changed %d keys, want 3", n)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("File change was not picked up")
+			}
+			mu.Lock()
+			sort.Strings(events)
+			if !reflect.DeepEqual(events, []string{"created db.name", "deleted db.user", "updated db.host"}) {
+				t.Errorf("Got events %v", events)
+			}
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+			if err := os.WriteFile(path, []byte(`{"db": `), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-errs:
+			case <-time.After(2 * time.Second):
+				t.Fatal("Parse error was not reported")
+			}
+			if w.Err() == nil {
+				t.Error("Err() should report the parse error")
+			}
+			if v, _ := kvs.Get("db.host"); v != "b" {
+				t.Errorf("Last good state was not kept, db.host = %v", v)
+			}
+		})
+	}
+}
+
+func TestWatchFile_StoreChanges(t *testing.T) {
+	path := write(t, "c.json", `{"a": 1, "b": 2}`)
+	kvs := memkv.NewMemKV(".", nil)
+	reloads := make(chan int, 10)
+	w, err := source.WatchFile(kvs, path, &source.WatchOpts{
+		ForcePolling: true,
+		PollInterval: time.Hour,
+		OnReload:     func(n int) { reloads <- n },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	<-reloads
+
+	// values changed in the store are put back
+	kvs.Set("a", 5)
+	kvs.Drop("b", false)
+	if err := w.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-reloads; n != 2 {
+		t.Errorf("Reload changed %d keys, want 2", n)
+	}
+	if v, _ := kvs.Get("a"); v != int64(1) || !kvs.Contains("b") {
+		t.Errorf("Store was not brought back to the file, a = %v", v)
+	}
+
+	// keys gone from the store already need no change
+	kvs.Drop("b", false)
+	if err := os.WriteFile(path, []byte(`{"a": 1}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-reloads; n != 0 {
+		t.Errorf("Reload changed %d keys, want 0", n)
+	}
+}
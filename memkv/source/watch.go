@@ -0,0 +1,260 @@
+package source
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/xadaemon/libprisma/memkv"
+)
+
+var errNotifyUnsupported = errors.New("file notifications are not supported on this platform")
+
+type WatchOpts struct {
+	// Format parses the file, by default it is picked from the file extension
+	Format Format
+	// PollInterval is how often the file is checked when notifications are unavailable or disabled
+	PollInterval time.Duration
+	// ForcePolling disables inotify and always polls
+	ForcePolling bool
+	// Debounce delays reloads so bursts of writes cause a single reload
+	Debounce time.Duration
+	// OnError is called when reloading fails, the store keeps the last good state
+	OnError func(err error)
+	// OnReload is called after a successful reload with the number of changed keys
+	OnReload func(changed int)
+}
+
+// FileWatcher keeps the keys of a configuration file in sync with a store. Each reload only
+// touches the keys whose value changed, so watchers of the store see E_KEY_CREATED,
+// E_KEY_UPDATED and E_KEY_DELETED events for exactly those keys.
+type FileWatcher struct {
+	kv     *memkv.MemKV
+	path   string
+	opts   WatchOpts
+	reload sync.Mutex
+	last   map[string]any
+	mu     sync.Mutex
+	err    error
+	stat   os.FileInfo
+	kick   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+	notify bool
+}
+
+// WatchFile loads path into kv and keeps reloading it when it changes until Close is called.
+// An error is only returned when the initial load fails.
+func WatchFile(kv *memkv.MemKV, path string, opts *WatchOpts) (*FileWatcher, error) {
+	w := &FileWatcher{
+		kv:   kv,
+		path: filepath.Clean(path),
+		last: map[string]any{},
+		kick: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if opts != nil {
+		w.opts = *opts
+	}
+	if w.opts.Format == nil {
+		f, err := FormatFor(path)
+		if err != nil {
+			return nil, err
+		}
+		w.opts.Format = f
+	}
+	if w.opts.PollInterval == 0 {
+		w.opts.PollInterval = time.Second
+	}
+	if w.opts.Debounce == 0 {
+		w.opts.Debounce = 50 * time.Millisecond
+	}
+	if err := w.Reload(); err != nil {
+		return nil, err
+	}
+	if !w.opts.ForcePolling {
+		w.notify = w.startNotify() == nil
+	}
+	go w.loop()
+	return w, nil
+}
+
+// UsesNotifications reports whether changes are detected with OS notifications instead of polling
+func (w *FileWatcher) UsesNotifications() bool {
+	return w.notify
+}
+
+// Err returns the error of the last reload, it is nil once a reload succeeded again
+func (w *FileWatcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close stops watching, the loaded keys stay in the store
+func (w *FileWatcher) Close() error {
+	select {
+	case <-w.stop:
+	default:
+		close(w.stop)
+	}
+	<-w.done
+	return nil
+}
+
+// trigger requests a reload, it never blocks
+func (w *FileWatcher) trigger() {
+	select {
+	case w.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (w *FileWatcher) loop() {
+	defer close(w.done)
+	var poll <-chan time.Time
+	if !w.notify {
+		t := time.NewTicker(w.opts.PollInterval)
+		defer t.Stop()
+		poll = t.C
+	}
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-poll:
+			if w.changedOnDisk() {
+				w.trigger()
+			}
+		case <-w.kick:
+			select {
+			case <-w.stop:
+				return
+			case <-time.After(w.opts.Debounce):
+			}
+			// drop the kicks that arrived while debouncing
+			select {
+			case <-w.kick:
+			default:
+			}
+			if err := w.Reload(); err != nil && w.opts.OnError != nil {
+				w.opts.OnError(err)
+			}
+		}
+	}
+}
+
+func (w *FileWatcher) changedOnDisk() bool {
+	st, err := os.Stat(w.path)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		return w.stat != nil
+	}
+	return w.stat == nil || !st.ModTime().Equal(w.stat.ModTime()) || st.Size() != w.stat.Size()
+}
+
+// Reload parses the file now and applies the keys that changed since the last successful load
+func (w *FileWatcher) Reload() error {
+	w.reload.Lock()
+	defer w.reload.Unlock()
+	st, _ := os.Stat(w.path)
+	changed, err := w.load()
+	w.mu.Lock()
+	w.stat = st
+	w.err = err
+	w.mu.Unlock()
+	if err == nil && w.opts.OnReload != nil {
+		w.opts.OnReload(changed)
+	}
+	return err
+}
+
+func (w *FileWatcher) load() (int, error) {
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return 0, err
+	}
+	parsed, err := w.opts.Format(data)
+	if err != nil {
+		return 0, err
+	}
+	return w.apply(parsed)
+}
+
+// apply turns the difference between the store and the new content into one transaction. Keys
+// of the last load that left the file are dropped and keys whose value in the store differs from
+// the file are set, so values changed in the store meanwhile are put back.
+func (w *FileWatcher) apply(next map[string]any) (int, error) {
+	sep := w.kv.Separator()
+	// Query dispatches no access events and reads the whole store at once, unlike Get
+	top, err := w.kv.Query("*")
+	if err != nil {
+		return 0, err
+	}
+	tree := make(map[string]any, len(top))
+	for _, m := range top {
+		tree[m.Key] = m.Value
+	}
+	current := flatten(tree, sep)
+	file := flatten(next, sep)
+	inFile := make(map[string]bool, len(file))
+	for k := range file {
+		inFile[w.kv.NormalizeKey(k)] = true
+	}
+
+	txn := memkv.NewTxn()
+	changed := 0
+	for k := range flatten(w.last, sep) {
+		norm := w.kv.NormalizeKey(k)
+		if inFile[norm] {
+			continue
+		}
+		if _, ok := current[norm]; ok {
+			txn.Drop(k, false)
+			changed++
+		}
+	}
+	for k, v := range file {
+		if cur, ok := current[w.kv.NormalizeKey(k)]; !ok || !reflect.DeepEqual(cur, v) {
+			txn.Set(k, v)
+			changed++
+		}
+	}
+	if changed == 0 {
+		w.last = next
+		return 0, nil
+	}
+	if err := w.kv.Commit(txn); err != nil {
+		return 0, err
+	}
+	w.last = next
+	return changed, nil
+}
+
+// flatten maps the full path of every leaf in tree to its value
+func flatten(tree map[string]any, sep string) map[string]any {
+	out := map[string]any{}
+	var walk func(prefix string, v any)
+	walk = func(prefix string, v any) {
+		ks, ok := v.(map[string]any)
+		if !ok {
+			out[prefix] = v
+			return
+		}
+		for k, child := range ks {
+			if prefix != "" {
+				k = prefix + sep + k
+			}
+			walk(k, child)
+		}
+	}
+	for k, v := range tree {
+		walk(k, v)
+	}
+	return out
+}
@@ -0,0 +1,54 @@
+//go:build linux
+
+package source
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// startNotify watches the directory of the file with inotify, editors often replace files
+// by renaming a new one over them which a watch on the file itself would miss
+func (w *FileWatcher) startNotify() error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_DELETE)
+	if _, err := syscall.InotifyAddWatch(fd, filepath.Dir(w.path), mask); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	// a non blocking descriptor is handled by the runtime poller so closing it unblocks Read
+	f := os.NewFile(uintptr(fd), "inotify")
+	name := []byte(filepath.Base(w.path))
+	go func() {
+		<-w.stop
+		f.Close()
+	}()
+	go func() {
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				nameStart := off + syscall.SizeofInotifyEvent
+				nameEnd := nameStart + int(ev.Len)
+				if nameEnd > n {
+					break
+				}
+				if bytes.Equal(bytes.TrimRight(buf[nameStart:nameEnd], "\x00"), name) {
+					w.trigger()
+				}
+				off = nameEnd
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package source
+
+func (w *FileWatcher) startNotify() error {
+	return errNotifyUnsupported
+}
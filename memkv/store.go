@@ -0,0 +1,20 @@
+package memkv
+
+// Store is the API shared by MemKV and everything that fronts one, such as remote clients.
+type Store interface {
+	Separator() string
+	Get(key string) (any, bool)
+	Set(key string, val any) bool
+	Contains(key string) bool
+	Drop(key string, deleteKeySpaces bool) bool
+	IsKeySpace(key string) bool
+	List(prefix string) []string
+	Commit(txn *Txn) error
+	AddWatcherHook(key string, hook WatchHook, eFilter []EventType) func()
+	AddPrefixWatcherHook(prefix string, hook WatchHook, eFilter []EventType) func()
+	ImportMap(data map[string]any) error
+	GetSerializableMap() map[string]any
+	LoadFromSerializableMap(data map[string]any) error
+}
+
+var _ Store = (*MemKV)(nil)
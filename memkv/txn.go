@@ -0,0 +1,137 @@
+package memkv
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+type OpType int
+
+const (
+	OP_SET           OpType = iota
+	OP_DROP          OpType = iota
+	OP_CHECK         OpType = iota
+	OP_CHECK_MISSING OpType = iota
+)
+
+var ErrCheckFailed = errors.New("transaction precondition failed")
+
+// Op is a single operation of a transaction, DeleteKeySpaces is only meaningful for OP_DROP
+type Op struct {
+	Type            OpType
+	Key             string
+	Val             any
+	DeleteKeySpaces bool
+}
+
+// Txn is an ordered batch of operations that is applied atomically by Commit.
+// Checks are evaluated against the state left by the operations before them.
+type Txn struct {
+	ops []Op
+}
+
+func NewTxn(ops ...Op) *Txn {
+	return &Txn{ops: ops}
+}
+
+// Set queues a set of key to val
+func (t *Txn) Set(key string, val any) *Txn {
+	t.ops = append(t.ops, Op{Type: OP_SET, Key: key, Val: val})
+	return t
+}
+
+// Drop queues the deletion of key, the transaction fails if the key does not exist
+func (t *Txn) Drop(key string, deleteKeySpaces bool) *Txn {
+	t.ops = append(t.ops, Op{Type: OP_DROP, Key: key, DeleteKeySpaces: deleteKeySpaces})
+	return t
+}
+
+// Check makes the transaction fail unless key holds a value deeply equal to val
+func (t *Txn) Check(key string, val any) *Txn {
+	t.ops = append(t.ops, Op{Type: OP_CHECK, Key: key, Val: val})
+	return t
+}
+
+// CheckMissing makes the transaction fail if key exists
+func (t *Txn) CheckMissing(key string) *Txn {
+	t.ops = append(t.ops, Op{Type: OP_CHECK_MISSING, Key: key})
+	return t
+}
+
+// Ops returns the queued operations in order
+func (t *Txn) Ops() []Op {
+	return t.ops
+}
+
+// Commit applies every operation in txn or none of them. Events for the applied
+// operations are dispatched after the whole transaction succeeded.
+func (m *MemKV) Commit(txn *Txn) error {
+	return m.commitAs("", txn, nil)
+}
+
+// commitAs is Commit on behalf of principal, see setAs for check
+func (m *MemKV) commitAs(principal string, txn *Txn, check func() error) error {
+	m.lock()
+	defer m.l.Unlock()
+	if err := m.authorize(principal, check); err != nil {
+		return err
+	}
+	root := cloneTree(m.m)
+	events := make([]Event, 0, len(txn.ops))
+	touched := make([]string, 0, len(txn.ops))
+	spelled := spellDraft{}
+	for i, op := range txn.ops {
+		key := m.normalize(op.Key)
+		if op.Type == OP_SET {
+			m.spellTree(spelled, root, op.Key, op.Val)
+			m.spell(spelled, root, op.Key)
+		}
+		path := m.split(key)
+		var e Event
+		var err error
+		switch op.Type {
+		case OP_SET:
+			e, err = setIn(root, path, DeepCopy(op.Val))
+		case OP_DROP:
+			e, err = dropIn(root, path, op.DeleteKeySpaces)
+		case OP_CHECK:
+			if v, ok := lookup(root, path); !ok || !reflect.DeepEqual(v, op.Val) {
+				err = ErrCheckFailed
+			}
+		case OP_CHECK_MISSING:
+			if _, ok := lookup(root, path); ok {
+				err = ErrCheckFailed
+			}
+		default:
+			err = fmt.Errorf("unknown operation type %d", op.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("op %d on %q: %w", i, op.Key, err)
+		}
+		switch op.Type {
+		case OP_SET:
+			touched = append(touched, key)
+			e.Key = key
+			e.NewVal = op.Val
+			events = append(events, e)
+		case OP_DROP:
+			touched = append(touched, key)
+			m.forget(spelled, key)
+			e.Key = key
+			events = append(events, dropEvents(e, m.sep)...)
+		}
+	}
+	if len(touched) > 0 {
+		if err := m.validateTree(root, m.sep, touched...); err != nil {
+			return err
+		}
+	}
+	m.m = root
+	m.install(spelled)
+	for _, e := range events {
+		e.Principal = principal
+		m.dispatchWatchers(e)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package memkv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Typed is a Store holding values of type T. Values are stored as they are, so the underlying
+// store, its snapshots and its watchers keep working untyped. Values that are not a T, such as
+// the maps a JSON snapshot decodes to, are converted on the way out by a JSON round trip.
+type Typed[T any] struct {
+	s Store
+}
+
+// TypedEvent is an Event with its values converted to T. OldVal and NewVal are the zero value
+// when the event carries none, HasOld and HasNew tell them apart from a stored zero value.
+type TypedEvent[T any] struct {
+	Key        string
+	Type       EventType
+	When       time.Time
+	Success    bool
+	FailReason string
+	OldVal     T
+	NewVal     T
+	HasOld     bool
+	HasNew     bool
+	Principal  string
+}
+
+type TypedWatchHook[T any] func(e TypedEvent[T])
+
+// NewTyped returns a new MemKV holding values of type T
+func NewTyped[T any](sep string, opts *Opts) *Typed[T] {
+	return &Typed[T]{s: NewMemKV(sep, opts)}
+}
+
+// TypedOf returns a typed front for s, which may hold values of other types as well
+func TypedOf[T any](s Store) *Typed[T] {
+	return &Typed[T]{s: s}
+}
+
+// Untyped returns the underlying store
+func (t *Typed[T]) Untyped() Store {
+	return t.s
+}
+
+func (t *Typed[T]) Separator() string {
+	return t.s.Separator()
+}
+
+// Get returns the value at key, false when key is missing or holds something that does not
+// convert to T
+func (t *Typed[T]) Get(key string) (T, bool) {
+	v, err := t.GetE(key)
+	return v, err == nil
+}
+
+// GetE is Get returning ErrNotFound or ErrWrongType
+func (t *Typed[T]) GetE(key string) (T, error) {
+	v, ok := t.s.Get(key)
+	if !ok {
+		var zero T
+		return zero, ErrNotFound
+	}
+	return convertTo[T](v)
+}
+
+func (t *Typed[T]) Set(key string, val T) bool {
+	return t.SetE(key, val) == nil
+}
+
+// SetE is Set returning why the value was rejected when the underlying store tells
+func (t *Typed[T]) SetE(key string, val T) error {
+	if s, ok := t.s.(interface{ SetE(string, any) error }); ok {
+		return s.SetE(key, val)
+	}
+	if !t.s.Set(key, val) {
+		return fmt.Errorf("setting %q failed", key)
+	}
+	return nil
+}
+
+func (t *Typed[T]) Contains(key string) bool {
+	return t.s.Contains(key)
+}
+
+func (t *Typed[T]) Drop(key string, deleteKeySpaces bool) bool {
+	return t.s.Drop(key, deleteKeySpaces)
+}
+
+func (t *Typed[T]) List(prefix string) []string {
+	return t.s.List(prefix)
+}
+
+// Values returns every key under prefix holding a value that converts to T. Key spaces that
+// convert, as structs do once they went through JSON, are returned whole.
+func (t *Typed[T]) Values(prefix string) map[string]T {
+	out := make(map[string]T)
+	var root any
+	if prefix != "" {
+		v, ok := t.s.Get(prefix)
+		if !ok {
+			return out
+		}
+		root = v
+	} else {
+		root = t.s.GetSerializableMap()["__data"]
+	}
+	t.collect(out, root, prefix)
+	return out
+}
+
+func (t *Typed[T]) collect(out map[string]T, v any, key string) {
+	if key != "" {
+		if val, err := convertTo[T](v); err == nil {
+			out[key] = val
+			return
+		}
+	}
+	if ks, ok := v.(map[string]any); ok {
+		for k, child := range ks {
+			t.collect(out, child, joinKey(key, k, t.s.Separator()))
+		}
+	}
+}
+
+func (t *Typed[T]) Commit(txn *Txn) error {
+	return t.s.Commit(txn)
+}
+
+// AddWatcherHook works like MemKV.AddWatcherHook, events whose values do not convert to T
+// are not passed to hook
+func (t *Typed[T]) AddWatcherHook(key string, hook TypedWatchHook[T], eFilter []EventType) func() {
+	return t.s.AddWatcherHook(key, typedHook(hook), eFilter)
+}
+
+// AddPrefixWatcherHook works like MemKV.AddPrefixWatcherHook, events whose values do not
+// convert to T are not passed to hook
+func (t *Typed[T]) AddPrefixWatcherHook(prefix string, hook TypedWatchHook[T], eFilter []EventType) func() {
+	return t.s.AddPrefixWatcherHook(prefix, typedHook(hook), eFilter)
+}
+
+func typedHook[T any](hook TypedWatchHook[T]) WatchHook {
+	return func(e Event) {
+		te := TypedEvent[T]{
+			Key:        e.Key,
+			Type:       e.Type,
+			When:       e.When,
+			Success:    e.Success,
+			FailReason: e.FailReason,
+			HasOld:     e.OldVal != nil,
+			HasNew:     e.NewVal != nil,
+			Principal:  e.Principal,
+		}
+		var err error
+		if te.HasOld {
+			if te.OldVal, err = convertTo[T](e.OldVal); err != nil {
+				return
+			}
+		}
+		if te.HasNew {
+			if te.NewVal, err = convertTo[T](e.NewVal); err != nil {
+				return
+			}
+		}
+		hook(te)
+	}
+}
+
+// ImportMap merges data into the store, incoming values win over existing ones
+func (t *Typed[T]) ImportMap(data map[string]T) error {
+	untyped := make(map[string]any, len(data))
+	for k, v := range data {
+		untyped[k] = v
+	}
+	return t.s.ImportMap(untyped)
+}
+
+// GetSerializableMap returns a snapshot of the underlying store, it loads into untyped stores
+func (t *Typed[T]) GetSerializableMap() map[string]any {
+	return t.s.GetSerializableMap()
+}
+
+// LoadFromSerializableMap loads a snapshot of any store, values are converted when read
+func (t *Typed[T]) LoadFromSerializableMap(data map[string]any) error {
+	return t.s.LoadFromSerializableMap(data)
+}
+
+// convertTo returns v as a T, converting it through JSON when it is not one already
+func convertTo[T any](v any) (T, error) {
+	if val, ok := v.(T); ok {
+		return val, nil
+	}
+	var out T
+	data, err := json.Marshal(v)
+	if err == nil {
+		// unknown fields would let any key space pass for a struct
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&out)
+	}
+	if err != nil {
+		var zero T
+		return zero, fmt.Errorf("%w: %T is not a %T: %w", ErrWrongType, v, zero, err)
+	}
+	return out, nil
+}
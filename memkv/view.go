@@ -0,0 +1,288 @@
+package memkv
+
+import (
+	"fmt"
+	"strings"
+)
+
+// View is a MemKV rooted at a key space of another one. Keys passed to a view are relative to
+// its prefix and keys in events, listings and snapshots are reported relative to it as well, so
+// nothing outside the prefix can be read, written or watched through it. Views are cheap and
+// hold no state besides the prefix, the key space does not need to exist yet.
+type View struct {
+	kv     *MemKV
+	prefix string
+}
+
+var _ Store = (*View)(nil)
+
+// Sub returns a view of the key space at prefix
+func (m *MemKV) Sub(prefix string) *View {
+	return &View{kv: m, prefix: m.normalize(prefix)}
+}
+
+// Sub returns a view of the key space at prefix relative to this view
+func (v *View) Sub(prefix string) *View {
+	return &View{kv: v.kv, prefix: v.kv.normalize(v.full(prefix))}
+}
+
+// Prefix returns the full path of the root of the view in the underlying store
+func (v *View) Prefix() string {
+	return v.prefix
+}
+
+// full maps a key of the view to the key in the store. The empty key names the root of the
+// view, which only listing and prefix watchers accept.
+func (v *View) full(key string) string {
+	if v.prefix == "" {
+		return key
+	}
+	if key == "" {
+		return v.prefix
+	}
+	return v.prefix + v.kv.sep + key
+}
+
+// rel maps a normalized key of the store to the key in the view
+func (v *View) rel(key string) (string, bool) {
+	if v.prefix == "" {
+		return key, true
+	}
+	if !strings.HasPrefix(key, v.prefix+v.kv.sep) {
+		return "", false
+	}
+	return key[len(v.prefix)+len(v.kv.sep):], true
+}
+
+func (v *View) Separator() string {
+	return v.kv.Separator()
+}
+
+func (v *View) NormalizeKey(key string) string {
+	return v.kv.NormalizeKey(key)
+}
+
+func (v *View) Get(key string) (any, bool) {
+	if key == "" {
+		return nil, false
+	}
+	return v.kv.Get(v.full(key))
+}
+
+func (v *View) GetRef(key string) (any, bool) {
+	if key == "" {
+		return nil, false
+	}
+	return v.kv.GetRef(v.full(key))
+}
+
+func (v *View) Set(key string, val any) bool {
+	return v.SetE(key, val) == nil
+}
+
+func (v *View) SetE(key string, val any) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+	return v.kv.SetE(v.full(key), val)
+}
+
+func (v *View) Contains(key string) bool {
+	return key != "" && v.kv.Contains(v.full(key))
+}
+
+func (v *View) Drop(key string, deleteKeySpaces bool) bool {
+	return key != "" && v.kv.Drop(v.full(key), deleteKeySpaces)
+}
+
+func (v *View) IsKeySpace(key string) bool {
+	return key != "" && v.kv.IsKeySpace(v.full(key))
+}
+
+// List works like MemKV.List with keys relative to the view, an empty prefix lists the whole view
+func (v *View) List(prefix string) []string {
+	keys := v.kv.List(v.full(prefix))
+	if v.prefix == "" {
+		return keys
+	}
+	// listed keys may be spelled differently from the prefix, strip it segment wise
+	depth := len(v.kv.split(v.prefix))
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if segs := v.kv.split(k); len(segs) > depth {
+			out = append(out, strings.Join(segs[depth:], v.kv.sep))
+		}
+	}
+	return out
+}
+
+// Commit applies txn with every key resolved inside the view
+func (v *View) Commit(txn *Txn) error {
+	ops := make([]Op, len(txn.ops))
+	for i, op := range txn.ops {
+		if op.Key == "" {
+			return fmt.Errorf("op %d on %q: %w", i, op.Key, ErrEmptyKey)
+		}
+		op.Key = v.full(op.Key)
+		ops[i] = op
+	}
+	return v.kv.Commit(NewTxn(ops...))
+}
+
+// AddWatcherHook works like MemKV.AddWatcherHook, hook sees keys relative to the view
+func (v *View) AddWatcherHook(key string, hook WatchHook, eFilter []EventType) func() {
+	if key == "" {
+		return func() {}
+	}
+	return v.kv.AddWatcherHook(v.full(key), v.wrap(hook), eFilter)
+}
+
+// AddPrefixWatcherHook works like MemKV.AddPrefixWatcherHook, an empty prefix watches the whole view.
+// Events on the root of the view itself are not delivered, only those of the keys below it.
+func (v *View) AddPrefixWatcherHook(prefix string, hook WatchHook, eFilter []EventType) func() {
+	return v.kv.AddPrefixWatcherHook(v.full(prefix), v.wrap(hook), eFilter)
+}
+
+func (v *View) wrap(hook WatchHook) WatchHook {
+	return func(e Event) {
+		key, ok := v.rel(e.Key)
+		if !ok {
+			return
+		}
+		e.Key = key
+		hook(e)
+	}
+}
+
+func (v *View) ImportMap(data map[string]any) error {
+	return v.MergeMap(data, MERGE_OVERWRITE)
+}
+
+// MergeMap deep merges data into the view, see MemKV.MergeMap
+func (v *View) MergeMap(data map[string]any, strategy MergeStrategy) error {
+	return v.kv.MergeMap(v.nest(data), strategy)
+}
+
+// nest wraps data in the key spaces leading to the root of the view
+func (v *View) nest(data map[string]any) map[string]any {
+	if v.prefix == "" {
+		return data
+	}
+	path := v.kv.split(v.prefix)
+	for i := len(path) - 1; i >= 0; i-- {
+		data = map[string]any{path[i]: data}
+	}
+	return data
+}
+
+// GetSerializableMap returns a snapshot of the view that loads into any store or view
+func (v *View) GetSerializableMap() map[string]any {
+	return v.kv.snapshotAt(v.prefix)
+}
+
+// LoadFromSerializableMap replaces the content of the view with a snapshot. The separator and
+// case handling of the snapshot must match the store, a view cannot change them.
+func (v *View) LoadFromSerializableMap(data map[string]any) error {
+	if v.prefix == "" {
+		return v.kv.LoadFromSerializableMap(data)
+	}
+	s, err := decodeSnapshot(data)
+	if err != nil {
+		return err
+	}
+	m := v.kv
+	m.lock()
+	defer m.l.Unlock()
+	if s.sep != m.sep || s.caseSense != m.caseSense || s.preserveCase() != m.preserveCase {
+		return fmt.Errorf("%w: separator and case handling must match the store", ErrInvalidSnapshot)
+	}
+	root := cloneTree(m.m)
+	if _, err := setIn(root, m.split(v.prefix), s.data); err != nil {
+		return err
+	}
+	if err := m.validateTree(root, m.sep, v.prefix); err != nil {
+		return err
+	}
+	m.m = root
+	if m.preserveCase {
+		for k := range m.spelling {
+			if strings.HasPrefix(k, v.prefix+m.sep) {
+				delete(m.spelling, k)
+			}
+		}
+		for k, spelled := range s.spelling {
+			m.spelling[v.prefix+m.sep+k] = spelled
+		}
+	}
+	m.rebuildIndexes()
+	m.recomputeAll()
+	m.runLoadHooks()
+	return nil
+}
+
+func (v *View) Add(key string, delta int64) (int64, error) {
+	if key == "" {
+		return 0, ErrEmptyKey
+	}
+	return v.kv.Add(v.full(key), delta)
+}
+
+func (v *View) Incr(key string) (int64, error) {
+	return v.Add(key, 1)
+}
+
+func (v *View) Decr(key string) (int64, error) {
+	return v.Add(key, -1)
+}
+
+func (v *View) Push(key string, vals ...any) (int, error) {
+	if key == "" {
+		return 0, ErrEmptyKey
+	}
+	return v.kv.Push(v.full(key), vals...)
+}
+
+func (v *View) Pop(key string) (any, error) {
+	if key == "" {
+		return nil, ErrEmptyKey
+	}
+	return v.kv.Pop(v.full(key))
+}
+
+func (v *View) Range(key string, start int, end int) ([]any, error) {
+	if key == "" {
+		return nil, ErrEmptyKey
+	}
+	return v.kv.Range(v.full(key), start, end)
+}
+
+func (v *View) SAdd(key string, members ...any) (int, error) {
+	if key == "" {
+		return 0, ErrEmptyKey
+	}
+	return v.kv.SAdd(v.full(key), members...)
+}
+
+func (v *View) SRem(key string, members ...any) (int, error) {
+	if key == "" {
+		return 0, ErrEmptyKey
+	}
+	return v.kv.SRem(v.full(key), members...)
+}
+
+func (v *View) SMembers(key string) ([]any, error) {
+	if key == "" {
+		return nil, ErrEmptyKey
+	}
+	return v.kv.SMembers(v.full(key))
+}
+
+// SetSchema attaches s to prefix inside the view, see MemKV.SetSchema
+func (v *View) SetSchema(prefix string, s *Schema) error {
+	return v.kv.SetSchema(v.full(prefix), s)
+}
+
+// Schema returns the schema attached to prefix inside the view
+func (v *View) Schema(prefix string) (*Schema, bool) {
+	return v.kv.Schema(v.full(prefix))
+}